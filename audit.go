@@ -0,0 +1,145 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	createAuditLogTable = `CREATE TABLE IF NOT EXISTS AuditLog (
+        AuditID     INTEGER PRIMARY KEY NOT NULL,
+        Time        INTEGER             NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        Username    TEXT                NOT NULL,
+        Event       TEXT                NOT NULL,
+        RemoteAddr  TEXT                NOT NULL,
+        Detail      TEXT                NOT NULL
+    );`
+	createAuditLogTimeIndex = `CREATE INDEX IF NOT EXISTS AuditLogTime ON AuditLog (Time);`
+
+	addAuditRecord  = `INSERT INTO AuditLog (Time, UserID, Username, Event, RemoteAddr, Detail) VALUES (?, ?, ?, ?, ?, ?);`
+	getAuditRecords = `SELECT AuditID, Time, UserID, Username, Event, RemoteAddr, Detail FROM AuditLog
+		WHERE (? = '' OR Username = ?) AND Time >= ? AND Time <= ? ORDER BY Time, AuditID;`
+)
+
+// The events recorded in the audit log.
+const (
+	// AuditLogin is recorded when a user logs in.
+	AuditLogin = "login"
+
+	// AuditLoginFailure is recorded when a login fails.
+	AuditLoginFailure = "login.failure"
+
+	// AuditLoginLockout is recorded when a username is locked out after too
+	// many failed logins.
+	AuditLoginLockout = "login.lockout"
+
+	// AuditFileRegister is recorded when a file is registered for a user.
+	AuditFileRegister = "file.register"
+
+	// AuditFileVersion is recorded when a new version of a file is tagged.
+	AuditFileVersion = "file.version"
+
+	// AuditFileCommit is recorded when a version of a file is committed.
+	AuditFileCommit = "file.commit"
+
+	// AuditFileDelete is recorded when a file is removed.
+	AuditFileDelete = "file.delete"
+
+	// AuditFileVersionsDelete is recorded when versions of a file are removed.
+	AuditFileVersionsDelete = "file.versions.delete"
+
+	// AuditUploadCancel is recorded when a user cancels an upload session.
+	AuditUploadCancel = "upload.cancel"
+
+	// AuditCryptoHash is recorded when a user's crypto hash and wrapped key change.
+	AuditCryptoHash = "user.cryptohash"
+
+	// AuditUserAdd is recorded when an admin adds a user.
+	AuditUserAdd = "user.add"
+
+	// AuditUserRemove is recorded when an admin removes a user.
+	AuditUserRemove = "user.remove"
+
+	// AuditUserPassword is recorded when an admin resets a user's password.
+	AuditUserPassword = "user.password"
+
+	// AuditUserQuota is recorded when an admin changes a user's quota.
+	AuditUserQuota = "user.quota"
+)
+
+// AuditRecord is an entry in the audit log of security relevant events.
+type AuditRecord struct {
+	ID int
+
+	// Time is when the event happened in Unix seconds
+	Time int64
+
+	// UserID and Username identify the user the event was for; UserID is 0 if
+	// the username didn't match a user. The name is kept so the records still
+	// make sense after the user is removed.
+	UserID   int
+	Username string
+
+	// Event is the kind of event that happened, like AuditLoginLockout
+	Event string
+
+	// RemoteAddr is the address of the client that caused the event, if known
+	RemoteAddr string
+
+	// Detail is a human readable description of the event
+	Detail string
+}
+
+// AddAuditRecord writes a record to the audit log. If the record's Time is 0
+// the current time is used.
+func (s *Storage) AddAuditRecord(r *AuditRecord) error {
+	if r.Time == 0 {
+		r.Time = time.Now().Unix()
+	}
+	res, err := s.db.Exec(addAuditRecord, r.Time, r.UserID, r.Username, r.Event, r.RemoteAddr, r.Detail)
+	if err != nil {
+		return fmt.Errorf("failed to add the %s audit record: %v", r.Event, err)
+	}
+
+	auditID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get the id of the new audit record: %v", err)
+	}
+	r.ID = int(auditID)
+	return nil
+}
+
+// GetAuditRecords returns the audit records between the since and until times
+// (inclusive, in Unix seconds) in the order they were recorded. If username is
+// not empty, only the records for that username are returned. An until value
+// of 0 means there is no upper limit.
+func (s *Storage) GetAuditRecords(username string, since int64, until int64) ([]AuditRecord, error) {
+	if until == 0 {
+		until = 1<<63 - 1
+	}
+	rows, err := s.db.Query(getAuditRecords, username, username, since, until)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the audit records from the database: %v", err)
+	}
+	defer rows.Close()
+
+	var records []AuditRecord
+	for rows.Next() {
+		var r AuditRecord
+		err = rows.Scan(&r.ID, &r.Time, &r.UserID, &r.Username, &r.Event, &r.RemoteAddr, &r.Detail)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing the audit records: %v", err)
+		}
+		records = append(records, r)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the audit records from the database: %v", err)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	createFileChangesTable = `CREATE TABLE IF NOT EXISTS FileChanges (
+        ChangeID    INTEGER PRIMARY KEY NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        Revision    INTEGER             NOT NULL,
+        FileID      INTEGER             NOT NULL,
+        VersionID   INTEGER             NOT NULL,
+        Change      TEXT                NOT NULL,
+        Time        INTEGER             NOT NULL
+    );`
+	createFileChangesRevisionIndex = `CREATE INDEX IF NOT EXISTS FileChangesRevision ON FileChanges (UserID, Revision);`
+
+	getUserRevision = `SELECT Revision FROM UserStats WHERE UserID = ?;`
+	addFileChange   = `INSERT INTO FileChanges (UserID, Revision, FileID, VersionID, Change, Time) VALUES (?, ?, ?, ?, ?, ?);`
+	getFileChanges  = `SELECT ChangeID, Revision, FileID, VersionID, Change, Time FROM FileChanges
+		WHERE UserID = ? AND Revision > ? ORDER BY Revision, ChangeID;`
+	countFileChangeRevisions = `SELECT COUNT(DISTINCT Revision) FROM FileChanges WHERE UserID = ? AND Revision > ? AND Revision <= ?;`
+
+	// the ChangeIDs only go up, so the oldest changes are found in the primary key
+	// without scanning the whole journal for the old ones
+	removeOldFileChanges = `DELETE FROM FileChanges WHERE ChangeID IN
+		(SELECT ChangeID FROM FileChanges ORDER BY ChangeID LIMIT ?) AND Time < ?;`
+)
+
+const (
+	// DefaultChangeRetention is how long the changes are kept in the journal
+	// unless the ChangeRetention of the Storage is changed.
+	DefaultChangeRetention = 90 * 24 * time.Hour
+
+	// fileChangePruneBatch is the most old changes removed from the journal each
+	// time a change is recorded; it's more than one so the pruning keeps up.
+	fileChangePruneBatch = 100
+)
+
+// The kinds of changes recorded in the change journal.
+const (
+	// ChangeFileAdd is recorded when a file is registered.
+	ChangeFileAdd = "file.add"
+
+	// ChangeFileRemove is recorded when a file and all of its versions are removed.
+	ChangeFileRemove = "file.remove"
+
+	// ChangeVersionAdd is recorded when a new version of a file is tagged.
+	ChangeVersionAdd = "version.add"
+
+	// ChangeVersionCurrent is recorded when an uploaded version is committed
+	// and it becomes the current version of the file.
+	ChangeVersionCurrent = "version.current"
+
+	// ChangeVersionRemove is recorded when versions of a file are removed.
+	ChangeVersionRemove = "version.remove"
+
+	// ChangeChunkAdd is recorded when chunks are added to a file version.
+	ChangeChunkAdd = "chunk.add"
+
+	// ChangeChunkRemove is recorded when a chunk is removed from a file version.
+	ChangeChunkRemove = "chunk.remove"
+)
+
+// FileChange is an entry in the change journal of a user's files. Every change
+// bumps the user's revision, so the changes since a revision a client has seen
+// tell it which files it needs to look at again.
+type FileChange struct {
+	ID int
+
+	// Revision is the user's revision after the change was made
+	Revision int
+
+	// FileID is the file that changed
+	FileID int
+
+	// VersionID is the file version that was added or had chunks added or
+	// removed; it's 0 for the changes that aren't to one version
+	VersionID int
+
+	// Change is the kind of change that was made, like ChangeFileAdd
+	Change string
+
+	// Time is when the change was made in Unix seconds
+	Time int64
+}
+
+// userFileChange is a change recorded for a user by the transaction in progress.
+type userFileChange struct {
+	userID int
+	change FileChange
+}
+
+// recordFileChange updates the user's allocation by allocDelta, bumps the user's
+// revision and writes the change to the journal as part of the transaction. The
+// change is passed to the ChangeObserver once the transaction is committed. The
+// oldest changes in the journal are pruned at the same time once they are older
+// than the ChangeRetention.
+func (s *Storage) recordFileChange(tx *sql.Tx, userID int, fileID int, versionID int, change string, allocDelta int) error {
+	res, err := tx.Exec(updateUserStats, allocDelta, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update the user stats in the database for the %s change: %v", change, err)
+	}
+
+	// make sure one row was affected with the UPDATE statement
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to update the user stats in the database for the %s change; no rows were affected", change)
+	} else if err != nil {
+		return fmt.Errorf("failed to update the user stats in the database for the %s change: %v", change, err)
+	}
+
+	c := FileChange{FileID: fileID, VersionID: versionID, Change: change, Time: time.Now().Unix()}
+	err = tx.QueryRow(getUserRevision, userID).Scan(&c.Revision)
+	if err != nil {
+		return fmt.Errorf("failed to get the revision for the %s change: %v", change, err)
+	}
+	res, err = tx.Exec(addFileChange, userID, c.Revision, c.FileID, c.VersionID, c.Change, c.Time)
+	if err != nil {
+		return fmt.Errorf("failed to add the %s change to the journal: %v", change, err)
+	}
+	changeID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get the id of the %s change added to the journal: %v", change, err)
+	}
+	c.ID = int(changeID)
+
+	if s.ChangeRetention > 0 {
+		cutoff := time.Now().Add(-s.ChangeRetention).Unix()
+		_, err = tx.Exec(removeOldFileChanges, fileChangePruneBatch, cutoff)
+		if err != nil {
+			return fmt.Errorf("failed to remove the old changes from the journal: %v", err)
+		}
+	}
+
+	s.pendingChanges = append(s.pendingChanges, userFileChange{userID, c})
+	return nil
+}
+
+// notifyChanges passes the changes recorded by the transaction that just finished
+// to the ChangeObserver if it was committed and then forgets them.
+func (s *Storage) notifyChanges(committed bool) {
+	if committed && s.ChangeObserver != nil {
+		for _, uc := range s.pendingChanges {
+			s.ChangeObserver(uc.userID, uc.change)
+		}
+	}
+	s.pendingChanges = nil
+}
+
+// GetFileChanges returns the changes made to the user's files after the since
+// revision, in the order they were made, along with the user's current revision.
+// If the journal doesn't have every change since that revision, such as when
+// the revision is from before the journal was added or the revision is newer
+// than the user's current one, it's older than the ChangeRetention or the revision
+// was bumped by UpdateUserStats since then, complete is false and the client
+// should look at all of the user's files again.
+func (s *Storage) GetFileChanges(userID int, since int) (changes []FileChange, revision int, complete bool, e error) {
+	err := s.transact("GetFileChanges", func(tx *sql.Tx) error {
+		var quota, allocated int
+		err := tx.QueryRow(getUserStats, userID).Scan(&quota, &allocated, &revision)
+		if err != nil {
+			return fmt.Errorf("failed to get the revision for the user: %v", err)
+		}
+		if since == revision {
+			complete = true
+			return nil
+		}
+		if since < 0 || since > revision {
+			return nil
+		}
+
+		// every revision after the since revision has to be in the journal; the
+		// revision can be bumped without a change being journaled by UpdateUserStats
+		// and the oldest changes get pruned
+		var count int
+		err = tx.QueryRow(countFileChangeRevisions, userID, since, revision).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("failed to check the change journal for the user: %v", err)
+		}
+		if count != revision-since {
+			return nil
+		}
+
+		rows, err := tx.Query(getFileChanges, userID, since)
+		if err != nil {
+			return fmt.Errorf("failed to get the changes from the database: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var c FileChange
+			err = rows.Scan(&c.ID, &c.Revision, &c.FileID, &c.VersionID, &c.Change, &c.Time)
+			if err != nil {
+				return fmt.Errorf("failed to scan the next row while processing the changes: %v", err)
+			}
+			changes = append(changes, c)
+		}
+		err = rows.Err()
+		if err != nil {
+			return fmt.Errorf("failed to get the changes from the database: %v", err)
+		}
+
+		complete = true
+		return nil
+	})
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	return changes, revision, complete, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// ChunkingFixed splits a file into chunks of the maximum chunk size so that every
+	// chunk but the last one is full. File versions stored before the chunking mode
+	// was recorded were all split this way.
+	ChunkingFixed = "fixed"
+
+	// ChunkingFastCDC splits a file at the boundaries picked by the FastCDC rolling
+	// hash, which depend only on the bytes around them. Inserting or removing bytes
+	// then only changes the chunks near the edit instead of every chunk after it.
+	ChunkingFastCDC = "fastcdc"
+
+	// gearTableInfo is mixed with the hash key to derive the gear table used by FastCDC
+	gearTableInfo = "filefreezer fastcdc gear table"
+)
+
+// ChunkingModes are the chunking modes that files can be split into chunks with.
+var ChunkingModes = []string{ChunkingFixed, ChunkingFastCDC}
+
+// Chunker splits the data read from a reader into chunks with a chunking mode. No
+// chunk is ever larger than the maximum chunk size the Chunker was created with.
+type Chunker struct {
+	r      io.Reader
+	buffer []byte
+	start  int
+	end    int
+	eof    bool
+
+	// cut returns the length of the next chunk at the start of data, which
+	// holds the whole buffer unless the end of the reader has been reached
+	cut func(data []byte) int
+}
+
+// NewChunker returns a Chunker that splits the data read from r into chunks of at most
+// maxChunkSize bytes with the chunking mode given. The boundaries FastCDC picks depend
+// on hashKey (see DeriveHashKey) so that the chunk lengths the server sees can't be
+// matched against the lengths of known files. An error is returned if the chunking
+// mode isn't supported.
+func NewChunker(chunking string, maxChunkSize int64, r io.Reader, hashKey []byte) (*Chunker, error) {
+	if maxChunkSize < 1 {
+		return nil, fmt.Errorf("the chunk size must be at least one byte")
+	}
+
+	c := new(Chunker)
+	c.r = r
+	c.buffer = make([]byte, maxChunkSize)
+	switch chunking {
+	case ChunkingFixed:
+		c.cut = func(data []byte) int { return len(data) }
+	case ChunkingFastCDC:
+		c.cut = newFastCDC(int(maxChunkSize), hashKey).cut
+	default:
+		return nil, fmt.Errorf("unsupported chunking mode: %s", chunking)
+	}
+	return c, nil
+}
+
+// Next returns the next chunk of the data, which is only valid until Next gets called
+// again. io.EOF is returned once all of the data has been split into chunks.
+func (c *Chunker) Next() ([]byte, error) {
+	// move what's left of the buffer to the front and fill up the rest of it so
+	// that the boundary can be picked from as many bytes as a chunk can hold
+	if !c.eof && c.end-c.start < len(c.buffer) {
+		c.end = copy(c.buffer, c.buffer[c.start:c.end])
+		c.start = 0
+		readCount, err := io.ReadFull(c.r, c.buffer[c.end:])
+		c.end += readCount
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	length := c.cut(c.buffer[c.start:c.end])
+	chunk := c.buffer[c.start : c.start+length]
+	c.start += length
+	return chunk, nil
+}
+
+// fastCDC picks the chunk boundaries with the FastCDC algorithm: a gear hash is rolled
+// over the bytes after the minimum chunk size and a boundary is placed where the masked
+// bits of the hash are all zero. A harder mask is used before the average chunk size
+// and an easier one after it so that the chunk sizes stay close to the average.
+type fastCDC struct {
+	minSize int
+	avgSize int
+	maxSize int
+	maskS   uint64
+	maskL   uint64
+	gear    [256]uint64
+}
+
+// newFastCDC returns the FastCDC parameters for chunks of up to maxSize bytes, which
+// average a quarter of that size, with a gear table keyed with hashKey.
+func newFastCDC(maxSize int, hashKey []byte) *fastCDC {
+	f := new(fastCDC)
+	f.maxSize = maxSize
+	f.avgSize = maxSize / 4
+	f.minSize = maxSize / 16
+
+	var bits uint
+	for 1<<(bits+1) <= f.avgSize {
+		bits++
+	}
+	f.maskS = gearMask(bits + 1)
+	f.maskL = gearMask(bits - 1)
+
+	// each HMAC-SHA256 sum fills four entries of the gear table
+	mac := hmac.New(sha256.New, hashKey)
+	var sum []byte
+	for i := range f.gear {
+		if i%4 == 0 {
+			mac.Reset()
+			mac.Write([]byte(gearTableInfo))
+			mac.Write([]byte{byte(i / 4)})
+			sum = mac.Sum(sum[:0])
+		}
+		f.gear[i] = binary.BigEndian.Uint64(sum[(i%4)*8:])
+	}
+
+	return f
+}
+
+// gearMask returns a mask of the top bits of the gear hash, which depend on the
+// most bytes rolled into the hash.
+func gearMask(bits uint) uint64 {
+	if bits == 0 || bits > 64 {
+		return 0
+	}
+	return ^uint64(0) << (64 - bits)
+}
+
+// cut returns the length of the chunk at the start of data.
+func (f *fastCDC) cut(data []byte) int {
+	n := len(data)
+	if n <= f.minSize {
+		return n
+	}
+	if n > f.maxSize {
+		n = f.maxSize
+	}
+	normal := f.avgSize
+	if normal > n {
+		normal = n
+	}
+
+	var h uint64
+	i := f.minSize
+	for ; i < normal; i++ {
+		h = (h << 1) + f.gear[data[i]]
+		if h&f.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + f.gear[data[i]]
+		if h&f.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,237 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	createChunkBlobsTable = `CREATE TABLE IF NOT EXISTS ChunkBlobs (
+        BlobRef     TEXT PRIMARY KEY    NOT NULL,
+        Chunk       BLOB                NOT NULL
+    );`
+
+	addChunkBlob    = `INSERT OR REPLACE INTO ChunkBlobs (BlobRef, Chunk) VALUES (?, ?);`
+	getChunkBlob    = `SELECT Chunk FROM ChunkBlobs WHERE BlobRef = ?;`
+	removeChunkBlob = `DELETE FROM ChunkBlobs WHERE BlobRef = ?;`
+)
+
+// ChunkStore is the interface used by Storage to persist the bytes of the file
+// chunks. The FileChunks table only keeps the chunk metadata and a blob reference
+// which is the key used to identify the chunk bytes in the ChunkStore.
+type ChunkStore interface {
+	// PutChunk writes the chunk bytes under the blob reference, replacing
+	// any chunk that was already stored with the same reference.
+	PutChunk(blobRef string, chunk []byte) error
+
+	// GetChunk returns the chunk bytes stored under the blob reference.
+	GetChunk(blobRef string) ([]byte, error)
+
+	// RemoveChunk deletes the chunk bytes stored under the blob reference.
+	// Removing a blob reference that doesn't exist is not an error.
+	RemoveChunk(blobRef string) error
+
+	// Check returns a non-nil error if chunks can't currently be written
+	// to the store.
+	Check() error
+}
+
+// newBlobRef generates a new random blob reference to store a chunk under.
+func newBlobRef() (string, error) {
+	refBytes := make([]byte, 16)
+	_, err := rand.Read(refBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate a random blob reference: %v", err)
+	}
+	return hex.EncodeToString(refBytes), nil
+}
+
+// FileSystemChunkStore is a ChunkStore that writes each chunk to its own file
+// in a sharded directory tree under RootPath. The first two pairs of characters
+// of the blob reference are used as the subdirectories so that no one directory
+// ends up with too many files.
+type FileSystemChunkStore struct {
+	// RootPath is the directory that contains the sharded chunk files
+	RootPath string
+}
+
+// NewFileSystemChunkStore creates a new FileSystemChunkStore rooted at the
+// path given, creating the directory if it doesn't exist.
+func NewFileSystemChunkStore(rootPath string) (*FileSystemChunkStore, error) {
+	err := os.MkdirAll(rootPath, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the chunk store directory (%s): %v", rootPath, err)
+	}
+
+	fs := new(FileSystemChunkStore)
+	fs.RootPath = rootPath
+	return fs, nil
+}
+
+// chunkPath returns the file path for the chunk identified by the blob reference.
+func (fs *FileSystemChunkStore) chunkPath(blobRef string) (string, error) {
+	// blob references are generated by Storage as hex strings; validate the
+	// reference here so that nothing can escape the root path.
+	if len(blobRef) < 5 {
+		return "", fmt.Errorf("invalid blob reference: %s", blobRef)
+	}
+	for _, c := range blobRef {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return "", fmt.Errorf("invalid blob reference: %s", blobRef)
+		}
+	}
+
+	return filepath.Join(fs.RootPath, blobRef[0:2], blobRef[2:4], blobRef), nil
+}
+
+// PutChunk writes the chunk bytes to a file for the blob reference. The chunk
+// is written to a temporary file first and then renamed so that a partially
+// written chunk file is never visible.
+func (fs *FileSystemChunkStore) PutChunk(blobRef string, chunk []byte) error {
+	chunkPath, err := fs.chunkPath(blobRef)
+	if err != nil {
+		return err
+	}
+
+	chunkDir := filepath.Dir(chunkPath)
+	err = os.MkdirAll(chunkDir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create the chunk directory (%s): %v", chunkDir, err)
+	}
+
+	tmpFile, err := ioutil.TempFile(chunkDir, blobRef+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary chunk file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+
+	_, err = tmpFile.Write(chunk)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write the chunk file (%s): %v", tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, chunkPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to move the chunk file into place (%s): %v", chunkPath, err)
+	}
+
+	return nil
+}
+
+// GetChunk reads the chunk bytes from the file for the blob reference.
+func (fs *FileSystemChunkStore) GetChunk(blobRef string) ([]byte, error) {
+	chunkPath, err := fs.chunkPath(blobRef)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk, err := ioutil.ReadFile(chunkPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the chunk file (%s): %v", chunkPath, err)
+	}
+
+	return chunk, nil
+}
+
+// RemoveChunk deletes the file for the blob reference.
+func (fs *FileSystemChunkStore) RemoveChunk(blobRef string) error {
+	chunkPath, err := fs.chunkPath(blobRef)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(chunkPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the chunk file (%s): %v", chunkPath, err)
+	}
+
+	return nil
+}
+
+// Check makes sure that a file can be written to the root path.
+func (fs *FileSystemChunkStore) Check() error {
+	tmpFile, err := ioutil.TempFile(fs.RootPath, "check.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create a file in the chunk store directory (%s): %v", fs.RootPath, err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	_, err = tmpFile.Write([]byte{0})
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write a file in the chunk store directory (%s): %v", fs.RootPath, err)
+	}
+
+	return nil
+}
+
+// databaseChunkStore is a ChunkStore that keeps the chunk bytes in the ChunkBlobs
+// table of the same database that Storage uses for the metadata.
+type databaseChunkStore struct {
+	db *sql.DB
+}
+
+// PutChunk inserts the chunk bytes into the ChunkBlobs table.
+func (dbs *databaseChunkStore) PutChunk(blobRef string, chunk []byte) error {
+	_, err := dbs.db.Exec(addChunkBlob, blobRef, chunk)
+	if err != nil {
+		return fmt.Errorf("failed to add the chunk blob to the database: %v", err)
+	}
+	return nil
+}
+
+// GetChunk selects the chunk bytes from the ChunkBlobs table.
+func (dbs *databaseChunkStore) GetChunk(blobRef string) ([]byte, error) {
+	var chunk []byte
+	err := dbs.db.QueryRow(getChunkBlob, blobRef).Scan(&chunk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the chunk blob from the database: %v", err)
+	}
+	return chunk, nil
+}
+
+// Check inserts a chunk into the ChunkBlobs table in a transaction that is
+// then rolled back to make sure the table can be written to.
+func (dbs *databaseChunkStore) Check() error {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin a transaction to check the chunk blobs: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(addChunkBlob, "check", []byte{0})
+	if err != nil {
+		return fmt.Errorf("failed to write a chunk blob to the database: %v", err)
+	}
+	return nil
+}
+
+// RemoveChunk deletes the chunk bytes from the ChunkBlobs table.
+func (dbs *databaseChunkStore) RemoveChunk(blobRef string) error {
+	_, err := dbs.db.Exec(removeChunkBlob, blobRef)
+	if err != nil {
+		return fmt.Errorf("failed to remove the chunk blob from the database: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package certgen generates X.509 certificates and keys for testing HTTPS and
+// client certificate authentication with the freezer server. Certificates can
+// be self-signed or signed by a CA certificate made with this package.
+package certgen
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Options controls the certificate that Generate creates.
+type Options struct {
+	// Hosts are the hostnames and IPs the certificate is valid for
+	Hosts []string
+
+	// CommonName is the subject common name of the certificate; for client
+	// certificates it's what the server maps to a user
+	CommonName string
+
+	// ValidFrom is when the certificate starts being valid; the current time
+	// is used if it's zero
+	ValidFrom time.Time
+
+	// ValidFor is how long the certificate is valid for; a year is used if
+	// it's zero
+	ValidFor time.Duration
+
+	// IsCA makes the certificate a certificate authority that can sign others
+	IsCA bool
+
+	// IsClient makes the certificate usable for client authentication
+	// instead of for a server
+	IsClient bool
+
+	// RSABits is the size of the RSA key to generate if ECDSACurve is empty;
+	// 2048 is used if it's zero
+	RSABits int
+
+	// ECDSACurve is the curve to use to generate an ECDSA key. Valid values
+	// are P224, P256, P384 and P521.
+	ECDSACurve string
+
+	// Parent and ParentKey are the CA certificate and key that sign the new
+	// certificate. The certificate is self-signed if Parent is nil.
+	Parent    *x509.Certificate
+	ParentKey interface{}
+}
+
+// Generate creates a new key and a certificate for it as described by opts and
+// returns them both PEM encoded.
+func Generate(opts Options) (certPEM []byte, keyPEM []byte, err error) {
+	var priv interface{}
+	switch opts.ECDSACurve {
+	case "":
+		bits := opts.RSABits
+		if bits == 0 {
+			bits = 2048
+		}
+		priv, err = rsa.GenerateKey(rand.Reader, bits)
+	case "P224":
+		priv, err = ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	case "P256":
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "P384":
+		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "P521":
+		priv, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	default:
+		return nil, nil, fmt.Errorf("unrecognized elliptic curve: %q", opts.ECDSACurve)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate private key: %v", err)
+	}
+
+	notBefore := opts.ValidFrom
+	if notBefore.IsZero() {
+		notBefore = time.Now()
+	}
+	validFor := opts.ValidFor
+	if validFor == 0 {
+		validFor = 365 * 24 * time.Hour
+	}
+	notAfter := notBefore.Add(validFor)
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"Acme Co"},
+			CommonName:   opts.CommonName,
+		},
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if opts.IsClient {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	for _, h := range opts.Hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	if opts.IsCA {
+		// the extended key usages of a CA limit those of the certificates it
+		// signs, so it has to allow both
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+
+	parent := &template
+	parentKey := priv
+	if opts.Parent != nil {
+		parent = opts.Parent
+		parentKey = opts.ParentKey
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent, publicKey(priv), parentKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+
+	keyBlock, err := pemBlockForKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	keyPEM = pem.EncodeToMemory(keyBlock)
+	return certPEM, keyPEM, nil
+}
+
+// ParseCA parses a PEM encoded CA certificate and its key, such as the ones
+// returned by Generate, so that they can be used as the Parent and ParentKey
+// to sign other certificates.
+func ParseCA(certPEM []byte, keyPEM []byte) (*x509.Certificate, interface{}, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("failed to find a PEM encoded certificate")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse the certificate: %v", err)
+	}
+	if !cert.IsCA {
+		return nil, nil, fmt.Errorf("the certificate is not a certificate authority")
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("failed to find a PEM encoded private key")
+	}
+	var key interface{}
+	switch keyBlock.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(keyBlock.Bytes)
+	default:
+		return nil, nil, fmt.Errorf("unsupported private key type: %s", keyBlock.Type)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse the private key: %v", err)
+	}
+
+	return cert, key, nil
+}
+
+func publicKey(priv interface{}) interface{} {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		return &k.PublicKey
+	case *ecdsa.PrivateKey:
+		return &k.PublicKey
+	default:
+		return nil
+	}
+}
+
+func pemBlockForKey(priv interface{}) (*pem.Block, error) {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal ECDSA private key: %v", err)
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type")
+	}
+}
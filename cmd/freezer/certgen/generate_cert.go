@@ -4,158 +4,95 @@
 
 // +build ignore
 
-// Generate a self-signed X.509 certificate for a TLS server. Outputs to
-// 'cert.pem' and 'key.pem' and will overwrite existing files.
+// Generate an X.509 certificate for a TLS server or client. The certificate is
+// self-signed unless --ca-cert and --ca-key are given, in which case it is signed
+// by that CA. Outputs to '<out>cert.pem' and '<out>key.pem' and will overwrite
+// existing files.
 
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
 	"flag"
-	"fmt"
+	"io/ioutil"
 	"log"
-	"math/big"
-	"net"
-	"os"
 	"strings"
 	"time"
+
+	"github.com/tbogdala/filefreezer/cmd/freezer/certgen"
 )
 
 var (
 	host       = flag.String("host", "", "Comma-separated hostnames and IPs to generate a certificate for")
+	commonName = flag.String("cn", "", "The subject common name; for client certificates this is mapped to a user by the server")
 	validFrom  = flag.String("start-date", "", "Creation date formatted as Jan 1 15:04:05 2011")
 	validFor   = flag.Duration("duration", 365*24*time.Hour, "Duration that certificate is valid for")
 	isCA       = flag.Bool("ca", false, "whether this cert should be its own Certificate Authority")
+	isClient   = flag.Bool("client", false, "whether this cert is for client authentication instead of a server")
+	caCert     = flag.String("ca-cert", "", "The CA certificate file to sign the new certificate with")
+	caKey      = flag.String("ca-key", "", "The CA private key file to sign the new certificate with")
+	out        = flag.String("out", "", "The prefix for the output file names")
 	rsaBits    = flag.Int("rsa-bits", 2048, "Size of RSA key to generate. Ignored if --ecdsa-curve is set")
 	ecdsaCurve = flag.String("ecdsa-curve", "", "ECDSA curve to use to generate a key. Valid values are P224, P256, P384, P521")
 )
 
-func publicKey(priv interface{}) interface{} {
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		return &k.PublicKey
-	case *ecdsa.PrivateKey:
-		return &k.PublicKey
-	default:
-		return nil
-	}
-}
-
-func pemBlockForKey(priv interface{}) *pem.Block {
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
-	case *ecdsa.PrivateKey:
-		b, err := x509.MarshalECPrivateKey(k)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to marshal ECDSA private key: %v", err)
-			os.Exit(2)
-		}
-		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
-	default:
-		return nil
-	}
-}
-
 func main() {
 	flag.Parse()
 
-	if len(*host) == 0 {
+	if len(*host) == 0 && !*isClient && !*isCA {
 		log.Fatalf("Missing required --host parameter")
 	}
 
-	var priv interface{}
-	var err error
-	switch *ecdsaCurve {
-	case "":
-		priv, err = rsa.GenerateKey(rand.Reader, *rsaBits)
-	case "P224":
-		priv, err = ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
-	case "P256":
-		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	case "P384":
-		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
-	case "P521":
-		priv, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
-	default:
-		fmt.Fprintf(os.Stderr, "Unrecognized elliptic curve: %q", *ecdsaCurve)
-		os.Exit(1)
+	opts := certgen.Options{
+		CommonName: *commonName,
+		ValidFor:   *validFor,
+		IsCA:       *isCA,
+		IsClient:   *isClient,
+		RSABits:    *rsaBits,
+		ECDSACurve: *ecdsaCurve,
 	}
-	if err != nil {
-		log.Fatalf("failed to generate private key: %s", err)
+	if len(*host) > 0 {
+		opts.Hosts = strings.Split(*host, ",")
 	}
 
-	var notBefore time.Time
-	if len(*validFrom) == 0 {
-		notBefore = time.Now()
-	} else {
-		notBefore, err = time.Parse("Jan 2 15:04:05 2006", *validFrom)
+	if len(*validFrom) > 0 {
+		var err error
+		opts.ValidFrom, err = time.Parse("Jan 2 15:04:05 2006", *validFrom)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to parse creation date: %s\n", err)
-			os.Exit(1)
+			log.Fatalf("Failed to parse creation date: %s", err)
 		}
 	}
 
-	notAfter := notBefore.Add(*validFor)
-
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	if err != nil {
-		log.Fatalf("failed to generate serial number: %s", err)
-	}
-
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{"Acme Co"},
-		},
-		NotBefore: notBefore,
-		NotAfter:  notAfter,
-
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-	}
-
-	hosts := strings.Split(*host, ",")
-	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
-		} else {
-			template.DNSNames = append(template.DNSNames, h)
+	if len(*caCert) > 0 || len(*caKey) > 0 {
+		caCertPEM, err := ioutil.ReadFile(*caCert)
+		if err != nil {
+			log.Fatalf("Failed to read the CA certificate: %s", err)
+		}
+		caKeyPEM, err := ioutil.ReadFile(*caKey)
+		if err != nil {
+			log.Fatalf("Failed to read the CA private key: %s", err)
+		}
+		opts.Parent, opts.ParentKey, err = certgen.ParseCA(caCertPEM, caKeyPEM)
+		if err != nil {
+			log.Fatalf("Failed to load the CA: %s", err)
 		}
 	}
 
-	if *isCA {
-		template.IsCA = true
-		template.KeyUsage |= x509.KeyUsageCertSign
-	}
-
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
+	certPEM, keyPEM, err := certgen.Generate(opts)
 	if err != nil {
 		log.Fatalf("Failed to create certificate: %s", err)
 	}
 
-	certOut, err := os.Create("cert.pem")
+	certFile := *out + "cert.pem"
+	err = ioutil.WriteFile(certFile, certPEM, 0644)
 	if err != nil {
-		log.Fatalf("failed to open cert.pem for writing: %s", err)
+		log.Fatalf("failed to write %s: %s", certFile, err)
 	}
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	certOut.Close()
-	log.Print("written cert.pem\n")
+	log.Printf("written %s\n", certFile)
 
-	keyOut, err := os.OpenFile("key.pem", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	keyFile := *out + "key.pem"
+	err = ioutil.WriteFile(keyFile, keyPEM, 0600)
 	if err != nil {
-		log.Print("failed to open key.pem for writing:", err)
-		return
+		log.Fatalf("failed to write %s: %s", keyFile, err)
 	}
-	pem.Encode(keyOut, pemBlockForKey(priv))
-	keyOut.Close()
-	log.Print("written key.pem\n")
+	log.Printf("written %s\n", keyFile)
 }
@@ -0,0 +1,111 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// clientIPContextName is the name the client IP address is stored under in the echo context
+	clientIPContextName = "ClientIP"
+)
+
+// parseTrustedProxies parses the IP addresses and CIDR ranges of the reverse proxies
+// whose forwarding headers are trusted.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("The trusted proxy %s is not an IP address or CIDR range", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("The trusted proxy %s is not an IP address or CIDR range", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy returns true if the address is one of the trusted proxies.
+func (state *serverState) isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range state.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the host part of the address of the connection a request came in on.
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// clientIPMiddleware works out the IP address of the client for the rate limits and
+// the logs. It's the address the request came from unless that is a trusted proxy,
+// in which case the last address in X-Forwarded-For that isn't a trusted proxy or
+// else X-Real-IP is used. The forwarding headers are ignored for anybody else since
+// clients can put anything in them.
+func (state *serverState) clientIPMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ip := remoteHost(req.RemoteAddr)
+		if state.isTrustedProxy(ip) {
+			forwarded := ""
+			if xff := req.Header.Get(echo.HeaderXForwardedFor); xff != "" {
+				hops := strings.Split(xff, ",")
+				for i := len(hops) - 1; i >= 0; i-- {
+					hop := strings.TrimSpace(hops[i])
+					if hop != "" && !state.isTrustedProxy(hop) {
+						forwarded = hop
+						break
+					}
+				}
+			}
+			if forwarded == "" {
+				forwarded = strings.TrimSpace(req.Header.Get(echo.HeaderXRealIP))
+			}
+			if forwarded != "" {
+				ip = forwarded
+			}
+		}
+
+		c.Set(clientIPContextName, ip)
+		return next(c)
+	}
+}
+
+// clientIP returns the IP address of the client found by clientIPMiddleware, or the
+// address the request came from if the middleware didn't run.
+func clientIP(c echo.Context) string {
+	if ip, ok := c.Get(clientIPContextName).(string); ok {
+		return ip
+	}
+	return remoteHost(c.Request().RemoteAddr)
+}
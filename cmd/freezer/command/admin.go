@@ -0,0 +1,170 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+// AdminGetUsers returns all of the users on the server along with their stats.
+// The authenticated user in the command State must be an admin. A non-nil error
+// value is returned on failure.
+func (s *State) AdminGetUsers() ([]models.AdminUserInfo, error) {
+	target := fmt.Sprintf("%s/api/admin/users", s.HostURI)
+	body, err := s.RunAuthRequest(target, "GET", s.authToken(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the list of users: %v", err)
+	}
+
+	var r models.AdminUsersGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %v", target, err)
+	}
+
+	for _, u := range r.Users {
+		admin := ""
+		if u.IsAdmin {
+			admin = " (admin)"
+		}
+		s.Printf("%d | %s%s | %d / %d bytes | revision %d\n", u.ID, u.Name, admin,
+			u.Stats.Allocated, u.Stats.Quota, u.Stats.Revision)
+	}
+
+	return r.Users, nil
+}
+
+// AdminAddUser creates a new user on the server with the username, password and quota
+// provided. The authenticated user in the command State must be an admin.
+// A non-nil error value is returned on failure.
+func (s *State) AdminAddUser(username string, password string, quota int, isAdmin bool) (*models.AdminUserInfo, error) {
+	var req models.AdminUserAddRequest
+	req.Name = username
+	req.Password = password
+	req.Quota = quota
+	req.IsAdmin = isAdmin
+
+	target := fmt.Sprintf("%s/api/admin/users", s.HostURI)
+	body, err := s.RunAuthRequest(target, "POST", s.authToken(), req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the user %s: %v", username, err)
+	}
+
+	var r models.AdminUserAddResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %v", target, err)
+	}
+
+	s.Println("User created successfully")
+	return &r.User, nil
+}
+
+// AdminRmUser removes a user from the server and purges their data. The authenticated
+// user in the command State must be an admin. A non-nil error value is returned on failure.
+func (s *State) AdminRmUser(username string) error {
+	target := fmt.Sprintf("%s/api/admin/users/%s", s.HostURI, url.PathEscape(username))
+	err := s.runAdminUpdate(target, "DELETE", nil)
+	if err != nil {
+		return fmt.Errorf("Failed to remove the user %s: %v", username, err)
+	}
+
+	s.Println("User removed successfully")
+	return nil
+}
+
+// AdminSetUserPassword resets the login password for a user on the server. The
+// authenticated user in the command State must be an admin. A non-nil error value
+// is returned on failure.
+func (s *State) AdminSetUserPassword(username string, newPassword string) error {
+	var req models.AdminUserPasswordRequest
+	req.Password = newPassword
+
+	target := fmt.Sprintf("%s/api/admin/users/%s/password", s.HostURI, url.PathEscape(username))
+	err := s.runAdminUpdate(target, "PUT", req)
+	if err != nil {
+		return fmt.Errorf("Failed to reset the password for the user %s: %v", username, err)
+	}
+
+	s.Println("User password reset successfully")
+	return nil
+}
+
+// AdminSetUserQuota sets the quota in bytes for a user on the server. The authenticated
+// user in the command State must be an admin. A non-nil error value is returned on failure.
+func (s *State) AdminSetUserQuota(username string, quota int) error {
+	var req models.AdminUserQuotaRequest
+	req.Quota = quota
+
+	target := fmt.Sprintf("%s/api/admin/users/%s/quota", s.HostURI, url.PathEscape(username))
+	err := s.runAdminUpdate(target, "PUT", req)
+	if err != nil {
+		return fmt.Errorf("Failed to set the quota for the user %s: %v", username, err)
+	}
+
+	s.Println("User quota set successfully")
+	return nil
+}
+
+// AdminGetAuditLog returns the records in the server's audit log between the since
+// and until times in Unix seconds. If username is not empty, only the records for
+// that username are returned. An until value of 0 means there is no upper limit.
+// The authenticated user in the command State must be an admin. A non-nil error
+// value is returned on failure.
+func (s *State) AdminGetAuditLog(username string, since int64, until int64) ([]filefreezer.AuditRecord, error) {
+	query := url.Values{}
+	if username != "" {
+		query.Set("user", username)
+	}
+	if since != 0 {
+		query.Set("since", strconv.FormatInt(since, 10))
+	}
+	if until != 0 {
+		query.Set("until", strconv.FormatInt(until, 10))
+	}
+	target := fmt.Sprintf("%s/api/admin/audit?%s", s.HostURI, query.Encode())
+	body, err := s.RunAuthRequest(target, "GET", s.authToken(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the audit log: %v", err)
+	}
+
+	var r models.AdminAuditGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %v", target, err)
+	}
+
+	for _, rec := range r.Records {
+		s.Printf("%s | %s | %s | %s | %s\n", time.Unix(rec.Time, 0).Format(time.RFC3339),
+			rec.Event, rec.Username, rec.RemoteAddr, rec.Detail)
+	}
+
+	return r.Records, nil
+}
+
+// runAdminUpdate runs the request for an admin route that responds with an AdminUserUpdateResponse.
+func (s *State) runAdminUpdate(target string, method string, reqBody interface{}) error {
+	body, err := s.RunAuthRequest(target, method, s.authToken(), reqBody)
+	if err != nil {
+		return err
+	}
+
+	var r models.AdminUserUpdateResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return fmt.Errorf("Poorly formatted response to %s: %v", target, err)
+	}
+	if !r.Success {
+		return fmt.Errorf("the server did not update the user")
+	}
+
+	return nil
+}
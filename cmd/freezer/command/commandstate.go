@@ -5,7 +5,9 @@ package command
 
 import (
 	"fmt"
+	"sync"
 
+	"github.com/tbogdala/filefreezer"
 	"github.com/tbogdala/filefreezer/cmd/freezer/models"
 )
 
@@ -17,12 +19,24 @@ type State struct {
 	// the authentication token returned after logging in
 	AuthToken string
 
+	// the refresh token returned after logging in that is used to get a
+	// new AuthToken when it expires
+	RefreshToken string
+
+	// authLock guards AuthToken and RefreshToken when they get refreshed
+	// while chunks are being transferred
+	authLock sync.Mutex
+
 	// the stored crypto hash for the client that is used
 	// to verify the client-entered plaintext password.
 	CryptoHash []byte
 
-	// the key used to encrypt/decrypt file chunks and names
-	// and is derived from a plaintext password.
+	// the stored master key wrapped by the key derived from the plaintext password.
+	// this is empty for accounts that set their password before master keys were used.
+	WrappedKey []byte
+
+	// the key used to encrypt/decrypt file chunks and names which is the master key
+	// unwrapped with the key derived from a plaintext password.
 	CryptoKey []byte
 
 	// the capabilities returned by the authenticated server
@@ -36,23 +50,111 @@ type State struct {
 	// the fmt package version from the stdlib.
 	Printf func(format string, v ...interface{})
 
-	// the HTTPS TLS public crt file
-	TLSCrt string
+	// the file with the CA certificates trusted for the HTTPS server; HTTPS
+	// uses the system's CA certificates if it's empty
+	CACert string
 
-	// the HTTPS TLS private key file
-	TLSKey string
+	// the certificate and private key files presented to the server to log in
+	// without a password; no certificate is presented if either is empty
+	ClientCert string
+	ClientKey  string
 
 	// extra strict file checking during sync operations
 	ExtraStrict bool
+
+	// the number of file chunks to upload or download at the same time
+	Jobs int
+
+	// the optional index of local files used to skip hashing unchanged files during sync operations
+	Index *SyncIndex
+
+	// forces the local files to be hashed during sync operations even if the index has them unchanged
+	Rehash bool
+
+	// the chunking mode to split files into chunks with when uploading them; files are
+	// split into fixed size chunks if it's empty or the server doesn't support it
+	Chunking string
+
+	// the compression to apply to the chunks before encrypting them when uploading
+	// files; chunks aren't compressed if it's empty or CompressionNone
+	Compression string
+
+	// the policy used during sync operations when a local file and the remote file both
+	// changed since the local file was last synced; the newer file wins if it's empty
+	Conflict string
+
+	// called to ask which policy to use for a conflict when Conflict is ConflictAsk; it
+	// returns one of the other policies
+	ConflictPrompt func(localFilename string, remoteFilepath string) string
 }
 
+const (
+	// DefaultJobs is the default number of file chunks to upload or download at the same time.
+	DefaultJobs = 4
+
+	// CompressionNone uploads the chunks without compressing them.
+	CompressionNone = "none"
+
+	// CompressionGzip compresses the chunks with gzip before encrypting them.
+	CompressionGzip = "gzip"
+)
+
+// CompressionModes are the kinds of compression that chunks can be uploaded with.
+var CompressionModes = []string{CompressionNone, CompressionGzip}
+
+const (
+	// ConflictNewer keeps whichever of the local and remote files was modified last.
+	ConflictNewer = "newer"
+
+	// ConflictLocal uploads the local file as a new version of the remote file.
+	ConflictLocal = "local"
+
+	// ConflictRemote replaces the local file with the remote file.
+	ConflictRemote = "remote"
+
+	// ConflictKeepBoth renames the local file to a conflict copy and then downloads
+	// the remote file in its place.
+	ConflictKeepBoth = "keep-both"
+
+	// ConflictAsk asks the ConflictPrompt which of the other policies to use.
+	ConflictAsk = "ask"
+)
+
+// ConflictPolicies are the policies that conflicts can be resolved with.
+var ConflictPolicies = []string{ConflictNewer, ConflictLocal, ConflictRemote, ConflictKeepBoth, ConflictAsk}
+
 // NewState creates a new State object.
 func NewState() *State {
 	s := new(State)
+	s.Jobs = DefaultJobs
 	s.SetQuiet(false)
 	return s
 }
 
+// jobCount returns the number of file chunks to upload or download at the same time.
+func (s *State) jobCount() int {
+	if s.Jobs < 1 {
+		return 1
+	}
+	return s.Jobs
+}
+
+// chunking returns the chunking mode to split local files into chunks with, which is
+// the Chunking mode set if the server supports it and filefreezer.ChunkingFixed otherwise.
+func (s *State) chunking() string {
+	for _, mode := range s.ServerCapabilities.ChunkingModes {
+		if mode == s.Chunking {
+			return mode
+		}
+	}
+	return filefreezer.ChunkingFixed
+}
+
+// compressing returns true if the chunks are compressed before they're encrypted.
+func (s *State) compressing() bool {
+	return s.Compression != "" && s.Compression != CompressionNone
+}
+
 func defaultPrintln(v ...interface{}) {
 	fmt.Println(v...)
 }
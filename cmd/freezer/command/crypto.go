@@ -4,18 +4,71 @@
 package command
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
+
+	"github.com/tbogdala/filefreezer"
 )
 
 const (
 	cryptoNonceSize = 12
+
+	// chunkFormatV1 is the format byte at the start of the chunks encrypted by encryptChunk
+	chunkFormatV1 = 1
+
+	// chunkFormatV2 is the format byte at the start of the chunks encrypted by encryptChunk
+	// when compression is on; the decrypted bytes start with the codec byte so that the
+	// server can't tell which chunks were compressed
+	chunkFormatV2 = 2
+
+	// chunkCodecNone and chunkCodecGzip are the codec bytes of a chunkFormatV2 chunk
+	// that was stored as is or compressed with gzip
+	chunkCodecNone = 0
+	chunkCodecGzip = 1
+
+	// chunkCodecSize is the size of the codec byte of a chunkFormatV2 chunk
+	chunkCodecSize = 1
+
+	// chunkHeaderSize is the size of the chunk header: the format byte followed by the
+	// file id, version number and chunk number the chunk was encrypted for
+	chunkHeaderSize = 1 + 8*3
+
+	// gcmTagSize is the size of the authentication tag AES-GCM adds to the encrypted bytes
+	gcmTagSize = 16
+
+	// chunkCryptoOverhead is how many more bytes a chunk takes up once encrypted
+	chunkCryptoOverhead = chunkHeaderSize + cryptoNonceSize + gcmTagSize
 )
 
+// chunkOrigin identifies the chunk of a file version that a chunk was encrypted for.
+type chunkOrigin struct {
+	FileID        int
+	VersionNumber int
+	ChunkNumber   int
+}
+
+// header returns the chunk header for the origin with the format byte given.
+func (o chunkOrigin) header(format byte) []byte {
+	header := make([]byte, chunkHeaderSize)
+	header[0] = format
+	binary.BigEndian.PutUint64(header[1:], uint64(o.FileID))
+	binary.BigEndian.PutUint64(header[9:], uint64(o.VersionNumber))
+	binary.BigEndian.PutUint64(header[17:], uint64(o.ChunkNumber))
+	return header
+}
+
+func (o chunkOrigin) String() string {
+	return fmt.Sprintf("chunk #%d of version %d of file id %d", o.ChunkNumber, o.VersionNumber, o.FileID)
+}
+
 // encryptString will encrypt the source string bytes and then return
 // a base64 encoded string version of the crypto bytes
 func (s *State) EncryptString(source string) (string, error) {
@@ -43,16 +96,153 @@ func (s *State) DecryptString(encoded string) (string, error) {
 	return string(decrypted), nil
 }
 
-func (s *State) encryptBytes(b []byte) ([]byte, error) {
-	// encrypt the original bytes
-	aesCipher, err := aes.NewCipher(s.CryptoKey)
+// hashKey returns the key used for the chunk hashes.
+func (s *State) hashKey() []byte {
+	return filefreezer.DeriveHashKey(s.CryptoKey)
+}
+
+// hashKeyFor returns the key to pass to the filefreezer hashing functions for the hash algorithm.
+func (s *State) hashKeyFor(hashAlgo string) []byte {
+	if hashAlgo == filefreezer.HashAlgoSHA1 {
+		return nil
+	}
+	return s.hashKey()
+}
+
+// hashChunk returns the keyed hash used to identify the chunk bytes on the server.
+func (s *State) hashChunk(b []byte) string {
+	return filefreezer.CalcChunkHash(s.hashKey(), b)
+}
+
+// chunkOverhead returns how many more bytes a chunk can take up once encrypted.
+func (s *State) chunkOverhead() int {
+	if s.compressing() {
+		return chunkCryptoOverhead + chunkCodecSize
+	}
+	return chunkCryptoOverhead
+}
+
+// encryptChunk encrypts the chunk bytes for the chunk of a file version given by origin.
+// The chunk header is written in the clear before the nonce and is authenticated as the
+// AES-GCM additional data, so the chunk can't be passed off as any other chunk.
+// If compression is on, the chunk is compressed first unless that doesn't make it any
+// smaller, and the codec is encrypted along with the chunk.
+func (s *State) encryptChunk(b []byte, origin chunkOrigin) ([]byte, error) {
+	if !s.compressing() {
+		return s.seal(origin.header(chunkFormatV1), b)
+	}
+
+	payload, err := compressChunk(b)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't initialize the AES cipher. " + err.Error())
+		return nil, err
 	}
+	return s.seal(origin.header(chunkFormatV2), payload)
+}
 
-	gcm, err := cipher.NewGCM(aesCipher)
+// decryptChunk decrypts a chunk encrypted by encryptChunk and returns the origin the chunk
+// was encrypted for. Chunks stored before the chunk header was added are decrypted without
+// any additional data and have a nil origin. Compressed chunks are decompressed.
+func (s *State) decryptChunk(b []byte) ([]byte, *chunkOrigin, error) {
+	if len(b) > chunkHeaderSize && (b[0] == chunkFormatV1 || b[0] == chunkFormatV2) {
+		header := b[:chunkHeaderSize]
+		clearBytes, err := s.open(header, b[chunkHeaderSize:])
+		if err == nil {
+			origin := &chunkOrigin{
+				FileID:        int(binary.BigEndian.Uint64(header[1:])),
+				VersionNumber: int(binary.BigEndian.Uint64(header[9:])),
+				ChunkNumber:   int(binary.BigEndian.Uint64(header[17:])),
+			}
+			if header[0] == chunkFormatV2 {
+				clearBytes, err = decompressChunk(clearBytes, s.ServerCapabilities.ChunkSize)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			return clearBytes, origin, nil
+		}
+
+		// the nonce of a chunk without a header can start with the format byte too
+		clearBytes, legacyErr := s.decryptBytes(b)
+		if legacyErr != nil {
+			return nil, nil, err
+		}
+		return clearBytes, nil, nil
+	}
+
+	clearBytes, err := s.decryptBytes(b)
+	return clearBytes, nil, err
+}
+
+// compressChunk returns the codec byte followed by the chunk bytes compressed with gzip,
+// or followed by the chunk bytes as they are if compressing them doesn't save anything.
+func compressChunk(b []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte(chunkCodecGzip)
+	w := gzip.NewWriter(&buffer)
+	_, err := w.Write(b)
+	if err == nil {
+		err = w.Close()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't initialize the AES-GCM cipher. " + err.Error())
+		return nil, fmt.Errorf("Failed to compress the chunk: %v", err)
+	}
+	if buffer.Len() < chunkCodecSize+len(b) {
+		return buffer.Bytes(), nil
+	}
+
+	payload := make([]byte, chunkCodecSize+len(b))
+	payload[0] = chunkCodecNone
+	copy(payload[chunkCodecSize:], b)
+	return payload, nil
+}
+
+// decompressChunk returns the chunk bytes from the codec byte and bytes returned by
+// compressChunk. A chunk that decompresses to more than maxSize bytes is an error
+// unless maxSize is 0.
+func decompressChunk(payload []byte, maxSize int64) ([]byte, error) {
+	if len(payload) < chunkCodecSize {
+		return nil, fmt.Errorf("The decrypted chunk is missing its codec.")
+	}
+
+	switch payload[0] {
+	case chunkCodecNone:
+		return payload[chunkCodecSize:], nil
+	case chunkCodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(payload[chunkCodecSize:]))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decompress the chunk: %v", err)
+		}
+		var limited io.Reader = r
+		if maxSize > 0 {
+			limited = io.LimitReader(r, maxSize+1)
+		}
+		b, err := ioutil.ReadAll(limited)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decompress the chunk: %v", err)
+		}
+		if maxSize > 0 && int64(len(b)) > maxSize {
+			return nil, fmt.Errorf("The decompressed chunk is larger than the chunk size of %d bytes.", maxSize)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("The chunk was compressed with an unsupported codec: %d", payload[0])
+	}
+}
+
+func (s *State) encryptBytes(b []byte) ([]byte, error) {
+	return s.seal(nil, b)
+}
+
+func (s *State) decryptBytes(b []byte) ([]byte, error) {
+	return s.open(nil, b)
+}
+
+// seal encrypts the bytes with AES-GCM and returns the header, the nonce and the
+// encrypted bytes. The header is used as the additional data.
+func (s *State) seal(header []byte, b []byte) ([]byte, error) {
+	gcm, err := s.newGCM()
+	if err != nil {
+		return nil, err
 	}
 
 	nonce := make([]byte, cryptoNonceSize)
@@ -61,13 +251,30 @@ func (s *State) encryptBytes(b []byte) ([]byte, error) {
 		return nil, fmt.Errorf("Failed to initialize random data for AES-GCM. " + err.Error())
 	}
 
-	cipherBytes := gcm.Seal(nil, nonce, b, nil)
-	cipherBytes = append(nonce, cipherBytes...)
-	return cipherBytes, nil
+	cipherBytes := make([]byte, 0, len(header)+cryptoNonceSize+len(b)+gcm.Overhead())
+	cipherBytes = append(cipherBytes, header...)
+	cipherBytes = append(cipherBytes, nonce...)
+	return gcm.Seal(cipherBytes, nonce, b, header), nil
 }
 
-func (s *State) decryptBytes(b []byte) ([]byte, error) {
-	// encrypt the original bytes
+// open decrypts the nonce and encrypted bytes returned by seal after the header
+// has been removed. The header is checked as the additional data.
+func (s *State) open(header []byte, b []byte) ([]byte, error) {
+	gcm, err := s.newGCM()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < cryptoNonceSize+gcm.Overhead() {
+		return nil, fmt.Errorf("The encrypted data is too short to decrypt.")
+	}
+
+	nonce := make([]byte, cryptoNonceSize)
+	copy(nonce, b[:cryptoNonceSize])
+	clearBytes, err := gcm.Open(nil, nonce, b[cryptoNonceSize:], header)
+	return clearBytes, err
+}
+
+func (s *State) newGCM() (cipher.AEAD, error) {
 	aesCipher, err := aes.NewCipher(s.CryptoKey)
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't initialize the AES cipher. " + err.Error())
@@ -77,9 +284,5 @@ func (s *State) decryptBytes(b []byte) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't initialize the AES-GCM cipher. " + err.Error())
 	}
-
-	nonce := make([]byte, cryptoNonceSize)
-	copy(nonce, b[:cryptoNonceSize])
-	clearBytes, err := gcm.Open(nil, nonce, b[cryptoNonceSize:], nil)
-	return clearBytes, err
+	return gcm, nil
 }
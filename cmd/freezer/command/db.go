@@ -0,0 +1,42 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+// MigrateDB applies the pending schema migrations to the database so that it is
+// updated to filefreezer.CurrentDBVersion. If dryRun is true, the pending migration
+// steps are only listed and the database is left unchanged.
+func (s *State) MigrateDB(store *filefreezer.Storage, dryRun bool) ([]filefreezer.MigrationStep, error) {
+	pending, err := store.PendingMigrations()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the pending database migrations: %v", err)
+	}
+	if len(pending) == 0 {
+		s.Printf("The database is already at version %d.\n", filefreezer.CurrentDBVersion)
+		return pending, nil
+	}
+
+	if dryRun {
+		for _, step := range pending {
+			s.Printf("Pending migration to version %d: %s\n", step.Version, step.Description)
+		}
+		return pending, nil
+	}
+
+	applied, err := store.Migrate()
+	for _, step := range applied {
+		s.Printf("Migrated to version %d: %s\n", step.Version, step.Description)
+	}
+	if err != nil {
+		return applied, fmt.Errorf("Failed to migrate the database: %v", err)
+	}
+
+	s.Println("Database migrated successfully")
+	return applied, nil
+}
@@ -0,0 +1,251 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+const (
+	// WatchRetryDelay is how long Watch waits before connecting to the event
+	// stream again after it was closed or couldn't be opened.
+	WatchRetryDelay = 5 * time.Second
+)
+
+// StreamEvents opens the event stream for the authenticated user in the command
+// State and calls handler with each event until the stream is closed by the server,
+// handler returns an error or stop is closed. An expired authentication token is
+// refreshed once. A non-nil error value is returned if the stream couldn't be opened
+// or on failure; nil is returned when the stream ends.
+func (s *State) StreamEvents(stop <-chan struct{}, handler func(models.Event) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	target := fmt.Sprintf("%s/api/events", s.HostURI)
+	token := s.authToken()
+	resp, err := s.openEventStream(ctx, target, token)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		refreshed, err := s.refreshAuthToken(token)
+		if err != nil {
+			return fmt.Errorf("Failed to refresh the authentication token for the event stream: %v", err)
+		}
+		if refreshed {
+			resp, err = s.openEventStream(ctx, target, s.authToken())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Failed to open the event stream %s (status: %s): %v", target, resp.Status, string(body))
+	}
+
+	// the events are separated by blank lines and only the data lines are needed
+	// since the event name is in the data too; lines starting with a colon are
+	// comments sent to keep the connection alive.
+	var data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			continue
+		}
+		if line != "" || data == "" {
+			continue
+		}
+
+		var event models.Event
+		err = json.Unmarshal([]byte(data), &event)
+		data = ""
+		if err != nil {
+			return fmt.Errorf("Poorly formatted event from %s: %v", target, err)
+		}
+		err = handler(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	// closing the stop channel cancels the request, which isn't an error
+	select {
+	case <-stop:
+		return nil
+	default:
+	}
+	return scanner.Err()
+}
+
+// openEventStream makes the request for the event stream with the token.
+func (s *State) openEventStream(ctx context.Context, target string, token string) (*http.Response, error) {
+	client, req, err := s.buildAuthRequest(target, "GET", token, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open the event stream %s: %v", target, err)
+	}
+	return resp, nil
+}
+
+// Watch synchronizes the localDir with the remoteDir on the server and then keeps
+// listening to the event stream for the authenticated user, pulling the files that
+// change under remoteDir as soon as they're complete on the server. Watch only
+// returns once stop is closed or if the current revision can't be read from the
+// server; the event stream is opened again after WatchRetryDelay if it's closed or
+// can't be opened.
+func (s *State) Watch(localDir string, remoteDir string, stop <-chan struct{}) error {
+	// get the revision before syncing so that no change is missed before the
+	// event stream is open
+	changes, err := s.GetChanges(-1)
+	if err != nil {
+		return fmt.Errorf("Failed to get the current revision: %v", err)
+	}
+	revision := changes.Revision
+
+	// files that are still being uploaded by another client can fail to sync,
+	// but they get pulled once the rest of their chunks show up
+	_, err = s.SyncDirectory(localDir, remoteDir)
+	if err != nil {
+		s.Printf("Failed to synchronize the directory %s: %v\n", localDir, err)
+	}
+
+	// the events only signal that there's something to pull; the pulls happen one
+	// at a time and the events that come in during a pull are handled by the next one
+	pullCh := make(chan struct{}, 1)
+	pullDone := make(chan struct{})
+	go func() {
+		defer close(pullDone)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-pullCh:
+			}
+			var pullErr error
+			revision, pullErr = s.pullChanges(localDir, remoteDir, revision)
+			if pullErr != nil {
+				s.Printf("Failed to pull the changes: %v\n", pullErr)
+			}
+		}
+	}()
+
+	handler := func(event models.Event) error {
+		switch event.Event {
+		case models.EventQuota:
+			s.Printf("Quota changed to %d bytes\n", event.Quota)
+		case filefreezer.ChangeChunkRemove:
+			// a file version losing a chunk doesn't make it any more complete
+		default:
+			select {
+			case pullCh <- struct{}{}:
+			default:
+			}
+		}
+		return nil
+	}
+
+	for {
+		err = s.StreamEvents(stop, handler)
+		if err != nil {
+			s.Printf("The event stream failed: %v\n", err)
+		}
+
+		select {
+		case <-stop:
+			<-pullDone
+			return nil
+		case <-time.After(WatchRetryDelay):
+		}
+	}
+}
+
+// pullChanges syncs the files under remoteDir that changed since the revision given
+// with the files in localDir and returns the revision they were synced up to. Files
+// that haven't been committed or are still missing chunks are skipped until they are
+// complete and files that were removed on the server are left alone locally.
+func (s *State) pullChanges(localDir string, remoteDir string, revision int) (int, error) {
+	changes, err := s.GetChanges(revision)
+	if err != nil {
+		return revision, err
+	}
+	changed := changes.Files
+	if !changes.Complete {
+		changed, err = s.GetAllFileHashes()
+		if err != nil {
+			return revision, err
+		}
+	}
+
+	// files that are still being uploaded hold the revision back so that
+	// they are pulled again once they're complete
+	nextRevision := changes.Revision
+	for _, fi := range changed {
+		remoteName, err := s.decryptFileName(fi)
+		if err != nil {
+			return revision, fmt.Errorf("Failed to decrypt remote file name for file id %d: %v", fi.FileID, err)
+		}
+		if !strings.HasPrefix(remoteName, remoteDir) {
+			continue
+		}
+
+		if !fi.CurrentVersion.Committed {
+			nextRevision = revision
+			continue
+		}
+		missing, err := s.GetMissingChunksForFile(fi.FileID)
+		if err != nil {
+			return revision, err
+		}
+		if len(missing) > 0 {
+			nextRevision = revision
+			continue
+		}
+
+		localName := localDir + remoteName[len(remoteDir):]
+		dirIndex := strings.LastIndex(localName, "/")
+		if dirIndex > 0 {
+			err = os.MkdirAll(localName[:dirIndex], 0777)
+			if err != nil {
+				return revision, fmt.Errorf("Failed to create the local directory for %s: %v", localName, err)
+			}
+		}
+
+		remoteFiles := map[string]filefreezer.FileInfo{remoteName: fi}
+		_, _, err = s.syncFile(localName, remoteName, SyncCurrentVersion, remoteFiles)
+		if err != nil {
+			return revision, fmt.Errorf("Failed to sync remote file (%s) with the local file (%s): %v", remoteName, localName, err)
+		}
+	}
+
+	return nextRevision, nil
+}
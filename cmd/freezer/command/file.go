@@ -29,7 +29,7 @@ func (s *State) GetFileInfoByFilename(filename string) (foundFile filefreezer.Fi
 
 	// iterate through all of the files
 	for _, fi := range allFileInfos {
-		decryptedFilename, err := s.DecryptString(fi.FileName)
+		decryptedFilename, err := s.decryptFileName(fi)
 		if err != nil {
 			return foundFile, err
 		}
@@ -42,6 +42,25 @@ func (s *State) GetFileInfoByFilename(filename string) (foundFile filefreezer.Fi
 	return foundFile, fmt.Errorf("could not find the file: %s", filename)
 }
 
+// decryptFileName returns the plaintext name of the remote file. If the State has a
+// SyncIndex set, the names are cached there so that they're only decrypted once.
+func (s *State) decryptFileName(fi filefreezer.FileInfo) (string, error) {
+	if s.Index == nil {
+		return s.DecryptString(fi.FileName)
+	}
+
+	name, cached, err := s.Index.GetRemoteName(fi.FileID, fi.FileName)
+	if err != nil || cached {
+		return name, err
+	}
+
+	name, err = s.DecryptString(fi.FileName)
+	if err != nil {
+		return "", err
+	}
+	return name, s.Index.PutRemoteName(fi.FileID, fi.FileName, name)
+}
+
 // RmFile takes the filename and attempts to find it in the list of filenames
 // registered on the storage server for the user. If it does find it, an
 // API method is called to delete the object. If dryRun is set to true
@@ -54,7 +73,7 @@ func (s *State) RmFile(filename string, dryRun bool) error {
 
 	if !dryRun {
 		target := fmt.Sprintf("%s/api/file/%d", s.HostURI, fi.FileID)
-		_, err = s.RunAuthRequest(target, "DELETE", s.AuthToken, nil)
+		_, err = s.RunAuthRequest(target, "DELETE", s.authToken(), nil)
 		if err != nil {
 			return fmt.Errorf("Failed to remove the file %s: %v", filename, err)
 		}
@@ -90,7 +109,7 @@ func (s *State) RmRxFiles(pattern string, dryRun bool) error {
 			// only attempt to actually delete when not on a dryRun
 			if !dryRun {
 				target := fmt.Sprintf("%s/api/file/%d", s.HostURI, fi.FileID)
-				_, err = s.RunAuthRequest(target, "DELETE", s.AuthToken, nil)
+				_, err = s.RunAuthRequest(target, "DELETE", s.authToken(), nil)
 				if err != nil {
 					return fmt.Errorf("Failed to remove the file %s: %v", plaintextFilename, err)
 				}
@@ -107,7 +126,7 @@ func (s *State) RmRxFiles(pattern string, dryRun bool) error {
 // delete the object. A non-nil error is returned on failure.
 func (s *State) RmFileByID(fileID int) error {
 	target := fmt.Sprintf("%s/api/file/%d", s.HostURI, fileID)
-	_, err := s.RunAuthRequest(target, "DELETE", s.AuthToken, nil)
+	_, err := s.RunAuthRequest(target, "DELETE", s.authToken(), nil)
 	if err != nil {
 		return fmt.Errorf("Failed to remove the file by file ID (%d): %v", fileID, err)
 	}
@@ -127,7 +146,7 @@ func (s *State) GetFileVersions(filename string) (versions []filefreezer.FileVer
 
 	// get the file id for the filename provided
 	target := fmt.Sprintf("%s/api/file/%d/versions", s.HostURI, fi.FileID)
-	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	body, err := s.RunAuthRequest(target, "GET", s.authToken(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get the file versions for %s: %v", target, err)
 	}
@@ -160,7 +179,7 @@ func (s *State) RmFileVersions(filename string, minVersion int, maxVersion int,
 	// get the file id for the filename provided
 	if !dryRun {
 		target := fmt.Sprintf("%s/api/file/%d/versions", s.HostURI, fi.FileID)
-		body, err := s.RunAuthRequest(target, "DELETE", s.AuthToken, putReq)
+		body, err := s.RunAuthRequest(target, "DELETE", s.authToken(), putReq)
 		if err != nil {
 			return fmt.Errorf("Failed to delete the file versions for %s: %v", target, err)
 		}
@@ -223,7 +242,7 @@ func (s *State) RmRxFileVersions(pattern string, minVersion int, maxVersionStr s
 				putReq.MaxVersion = maxVersion
 
 				target := fmt.Sprintf("%s/api/file/%d/versions", s.HostURI, fi.FileID)
-				body, err := s.RunAuthRequest(target, "DELETE", s.AuthToken, putReq)
+				body, err := s.RunAuthRequest(target, "DELETE", s.authToken(), putReq)
 				if err != nil {
 					return fmt.Errorf("Failed to delete the file versions for %s: %v", plaintextFilename, err)
 				}
@@ -252,7 +271,7 @@ func (s *State) RmRxFileVersions(pattern string, minVersion int, maxVersionStr s
 func (s *State) GetMissingChunksForFile(fileID int) ([]int, error) {
 	// get the file id for the filename provided
 	target := fmt.Sprintf("%s/api/file/%d", s.HostURI, fileID)
-	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	body, err := s.RunAuthRequest(target, "GET", s.authToken(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get the file's missing chunk list: %v", err)
 	}
@@ -265,3 +284,62 @@ func (s *State) GetMissingChunksForFile(fileID int) ([]int, error) {
 
 	return r.MissingChunks, nil
 }
+
+// StartUpload starts an upload session on the server for a file with the local file
+// stats given, or resumes the session already uploading the same contents. If fileID
+// is 0 a new file is registered with the remote name given, which should already be
+// encrypted; otherwise a new version of the file is uploaded. size is the number of
+// bytes of the local file, which is used to reserve space in the user's quota for the
+// encrypted chunks. The session returned lists the chunks that still need to be uploaded.
+func (s *State) StartUpload(fileID int, cryptoRemoteName string, localStats *filefreezer.FileStats, size int64) (*filefreezer.UploadSession, error) {
+	var req models.UploadStartRequest
+	req.FileID = fileID
+	req.FileName = cryptoRemoteName
+	req.IsDir = localStats.IsDir
+	req.Permissions = localStats.Permissions
+	req.LastMod = localStats.LastMod
+	req.ChunkCount = localStats.ChunkCount
+	req.FileHash = localStats.HashString
+	req.HashAlgo = localStats.HashAlgo
+	req.Chunking = localStats.Chunking
+	req.Size = int(size) + localStats.ChunkCount*s.chunkOverhead()
+
+	target := fmt.Sprintf("%s/api/uploads", s.HostURI)
+	body, err := s.RunAuthRequest(target, "POST", s.authToken(), req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start the upload: %v", err)
+	}
+
+	var r models.UploadSessionResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the response for starting the upload: %v", err)
+	}
+
+	return &r.UploadSession, nil
+}
+
+// CommitVersion commits a version of a file once all of its chunks have been uploaded
+// so that it becomes the current version of the file. The chunk count and file hash
+// of the local file stats are checked by the server against the ones the version was
+// tagged with.
+func (s *State) CommitVersion(fileID int, versionID int, localStats *filefreezer.FileStats) error {
+	var req models.FileCommitRequest
+	req.VersionID = versionID
+	req.ChunkCount = localStats.ChunkCount
+	req.FileHash = localStats.HashString
+
+	target := fmt.Sprintf("%s/api/file/%d/commit", s.HostURI, fileID)
+	body, err := s.RunAuthRequest(target, "POST", s.authToken(), req)
+	if err != nil {
+		return fmt.Errorf("Failed to commit the version of the file %d: %v", fileID, err)
+	}
+
+	var r models.FileCommitResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil || r.Status == false {
+		return fmt.Errorf("Failed to read the response for committing the version of the file %d: %v", fileID, err)
+	}
+
+	return nil
+}
@@ -61,46 +61,100 @@ func (s *State) Authenticate(hostURI, username, password string) error {
 	// authentication was successful so update the command state
 	s.HostURI = hostURI
 	s.AuthToken = userLogin.Token
+	s.RefreshToken = userLogin.RefreshToken
 	s.CryptoHash = userLogin.CryptoHash
+	s.WrappedKey = userLogin.WrappedKey
 	s.ServerCapabilities = userLogin.Capabilities
 
 	return nil
 }
 
-// getHttpClient returns a new http Client object set to work with TLS if keys are provided
-// on the command line or plain http otherwise.
-func (s *State) getHTTPClient() (*http.Client, error) {
-	var client *http.Client
-	if s.TLSCrt != "" && s.TLSKey != "" {
-		cert, err := tls.LoadX509KeyPair(s.TLSCrt, s.TLSKey)
-		if err != nil {
-			return nil, fmt.Errorf("unable to load cert: %v", err)
-		}
+// authToken returns the current authentication token, which may be changed by another
+// goroutine refreshing it.
+func (s *State) authToken() string {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	return s.AuthToken
+}
 
-		xpool := x509.NewCertPool()
-		tlsConfig := &tls.Config{
-			RootCAs:      xpool,
-			Certificates: []tls.Certificate{cert},
-		}
-		//tlsConfig.BuildNameToCertificate()
-		transport := &http.Transport{TLSClientConfig: tlsConfig}
-		client = &http.Client{Transport: transport}
+// refreshAuthToken exchanges the refresh token for a new authentication token after
+// expiredToken was rejected by the server. If another goroutine already replaced
+// expiredToken, only true is returned since each refresh token can only be used once.
+// False is returned if there is no refresh token to use.
+func (s *State) refreshAuthToken(expiredToken string) (bool, error) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	if s.AuthToken != expiredToken {
+		return true, nil
+	}
+	if s.RefreshToken == "" {
+		return false, nil
+	}
 
+	client, err := s.getHTTPClient()
+	if err != nil {
+		return false, err
+	}
+
+	target := fmt.Sprintf("%s/api/users/refresh", s.HostURI)
+	resp, err := client.PostForm(target, url.Values{
+		"token": {s.RefreshToken},
+	})
+	if err != nil {
+		return false, fmt.Errorf("Failed to make the HTTP POST request to %s: %v", target, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read the response body from %s: %v", target, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Failed to make the HTTP POST request to %s (status: %s): %v", target, resp.Status, string(body))
+	}
+
+	var refresh models.UserRefreshResponse
+	err = json.Unmarshal(body, &refresh)
+	if err != nil {
+		return false, fmt.Errorf("Poorly formatted response to %s: %v", target, err)
+	}
+
+	s.AuthToken = refresh.Token
+	s.RefreshToken = refresh.RefreshToken
+	return true, nil
+}
+
+// getHttpClient returns a new http Client object that trusts the CA certificates and
+// presents the client certificate provided on the command line. If neither are provided
+// the default client is used.
+func (s *State) getHTTPClient() (*http.Client, error) {
+	if s.CACert == "" && (s.ClientCert == "" || s.ClientKey == "") {
+		return &http.Client{}, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if s.CACert != "" {
 		// Load our trusted certificate path
-		certPath := s.TLSCrt
-		pemData, err := ioutil.ReadFile(certPath)
+		pemData, err := ioutil.ReadFile(s.CACert)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to load the certificate file %s: %v", certPath, err)
+			return nil, fmt.Errorf("Failed to load the certificate file %s: %v", s.CACert, err)
 		}
+		tlsConfig.RootCAs = x509.NewCertPool()
 		ok := tlsConfig.RootCAs.AppendCertsFromPEM(pemData)
 		if !ok {
 			return nil, fmt.Errorf("couldn't load PEM data for HTTPS client")
 		}
-	} else {
-		client = &http.Client{}
 	}
 
-	return client, nil
+	if s.ClientCert != "" && s.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(s.ClientCert, s.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the client cert: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	return &http.Client{Transport: transport}, nil
 }
 
 // buildAuthRequest builds a http client and request with the authorization header and token attached.
@@ -124,6 +178,9 @@ func (s *State) buildAuthRequest(target string, method string, token string, bod
 // RunAuthRequest will build the http client and request then get the response and read
 // the body into a byte array. If reqBody is a []byte array, no transformation is done,
 // but if it's another type than it gets marshalled to a text JSON object.
+//
+// If the server rejects the token as unauthorized and the State has a refresh token,
+// the authentication token is refreshed and the request is made again.
 func (s *State) RunAuthRequest(target string, method string, token string, reqBody interface{}) ([]byte, error) {
 	// serialize the reqBody object if one was passed in
 	var err error
@@ -139,25 +196,23 @@ func (s *State) RunAuthRequest(target string, method string, token string, reqBo
 		}
 	}
 
-	client, req, err := s.buildAuthRequest(target, method, token, reqBytes)
+	resp, body, err := s.doAuthRequest(target, method, token, reqBytes, !reqBodyIsByteSlice)
 	if err != nil {
 		return nil, err
 	}
 
-	// set the header if a JSON object is being sent
-	if reqBytes != nil && !reqBodyIsByteSlice {
-		req.Header.Set("Content-Type", "application/json")
-	}
-
-	// perform the request and read the response body
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to make the HTTP %s request to %s (status: %s): %v", method, target, resp.Status, err)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to read the response body from %s: %v", target, err)
+	// an expired token gets refreshed and the request is tried once more
+	if resp.StatusCode == http.StatusUnauthorized {
+		refreshed, err := s.refreshAuthToken(token)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to refresh the authentication token for the HTTP %s request to %s: %v", method, target, err)
+		}
+		if refreshed {
+			resp, body, err = s.doAuthRequest(target, method, s.authToken(), reqBytes, !reqBodyIsByteSlice)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	// check the status code to ensure the success of the call
@@ -168,41 +223,43 @@ func (s *State) RunAuthRequest(target string, method string, token string, reqBo
 	return body, nil
 }
 
-type eachChunkFunc func(chunkNumber int, chunk []byte) (bool, error)
+// doAuthRequest makes the request with the token and returns the response, which has
+// already been closed, and the bytes of the response body.
+func (s *State) doAuthRequest(target string, method string, token string, reqBytes []byte, isJSON bool) (*http.Response, []byte, error) {
+	client, req, err := s.buildAuthRequest(target, method, token, reqBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// set the header if a JSON object is being sent
+	if reqBytes != nil && isJSON {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
-func forEachChunk(chunkSize int, filename string, localChunkCount int, eachFunc eachChunkFunc) error {
-	// open the local file and create a chunk sized buffer
-	buffer := make([]byte, chunkSize)
-	f, err := os.Open(filename)
+	// perform the request and read the response body
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to make the HTTP %s request to %s: %v", method, target, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("Failed to open the file %s: %v", filename, err)
+		return nil, nil, fmt.Errorf("Failed to read the response body from %s: %v", target, err)
 	}
-	defer f.Close()
 
-	// with the chunk list, lets make sure that each chunk locally has the same hash
-	for i := 0; i < localChunkCount; i++ {
-		readCount, err := io.ReadAtLeast(f, buffer, chunkSize)
-		if err != nil {
-			if err == io.ErrUnexpectedEOF {
-				// if we don't fill the buffer and we're not on the last chunk, the files are different
-				if i+1 != localChunkCount {
-					return fmt.Errorf("nexpeced EOF while reading the file %s", filename)
-				}
-			} else {
-				return fmt.Errorf("an error occured while reading %d bytes from the file %s: %v", readCount, filename, err)
-			}
-		}
-		clampedBuffer := buffer[:readCount]
+	return resp, body, nil
+}
 
-		// call the supplied callback and break the loop if false is returned
-		contLoop, err := eachFunc(i, clampedBuffer)
-		if err != nil {
-			return err
-		}
-		if !contLoop {
-			break
+// readChunkAt reads the chunk with the chunkNumber, which is length bytes long and starts at
+// offset, from the open file into the buffer and returns the part of the buffer that was filled.
+func readChunkAt(f *os.File, chunkNumber int, offset int64, length int, buffer []byte) ([]byte, error) {
+	readCount, err := f.ReadAt(buffer[:length], offset)
+	if readCount < length {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
+		return nil, fmt.Errorf("an error occured while reading chunk #%d from the file %s: %v", chunkNumber, f.Name(), err)
 	}
 
-	return nil
+	return buffer[:length], nil
 }
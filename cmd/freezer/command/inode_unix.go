@@ -0,0 +1,20 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build !windows
+// +build !windows
+
+package command
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of the file or 0 if it's not available.
+func fileInode(fileInfo os.FileInfo) uint64 {
+	if st, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,17 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build windows
+// +build windows
+
+package command
+
+import (
+	"os"
+)
+
+// fileInode returns 0 on Windows since os.FileInfo doesn't carry the file index;
+// the size and modification time are used to detect changed files instead.
+func fileInode(fileInfo os.FileInfo) uint64 {
+	return 0
+}
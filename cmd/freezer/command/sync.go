@@ -4,13 +4,14 @@
 package command
 
 import (
-	"crypto/sha1"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/tbogdala/filefreezer"
 	"github.com/tbogdala/filefreezer/cmd/freezer/models"
@@ -30,6 +31,10 @@ const (
 	// SyncCurrentVersion is the value to pass to SyncFile to sync the current version
 	// of the file and not a particular version number.
 	SyncCurrentVersion = 0
+
+	// downloadSuffix is added to the name of a local file for the temporary file
+	// a download is written to
+	downloadSuffix = ".freezer-download"
 )
 
 // SyncDirectory will take a localDir and recursively walk the filesystem calling SyncFile
@@ -44,11 +49,23 @@ func (s *State) SyncDirectory(localDir string, remoteDir string) (changeCount in
 	// been sync'd.
 	alreadyProccessed := make(map[string]bool)
 
-	// get all of the remote files
-	remoteFileHashes, err := s.GetAllFileHashes()
+	// get all of the remote files and map them by name so that each file
+	// sync doesn't have to get the list again
+	remoteFileHashes, err := s.getRemoteFiles()
 	if err != nil {
 		return 0, fmt.Errorf("Failed to a list of remote file hashes: %v", err)
 	}
+	remoteFileNames := make([]string, len(remoteFileHashes))
+	remoteFiles := make(map[string]filefreezer.FileInfo)
+	for i, remoteFileHash := range remoteFileHashes {
+		remoteFileNames[i], err = s.decryptFileName(remoteFileHash)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to decrypt remote file name for file id %d: %v", remoteFileHash.FileID, err)
+		}
+		if _, dupe := remoteFiles[remoteFileNames[i]]; !dupe {
+			remoteFiles[remoteFileNames[i]] = remoteFileHash
+		}
+	}
 	var processDir func(localDir string, remoteDir string) (changeCount int, e error)
 	processDir = func(localDir string, remoteDir string) (changeCount int, e error) {
 		// silently return if the directory does not exist
@@ -65,6 +82,11 @@ func (s *State) SyncDirectory(localDir string, remoteDir string) (changeCount in
 		// sync all of the local files
 		var localFileInfo os.FileInfo
 		for _, localFileInfo = range localFileInfos {
+			// skip the files left behind by downloads that were interrupted
+			if strings.HasSuffix(localFileInfo.Name(), downloadSuffix) {
+				continue
+			}
+
 			localFileName := localDir + "/" + localFileInfo.Name()
 			remoteFileName := remoteDir + "/" + localFileInfo.Name()
 
@@ -79,7 +101,7 @@ func (s *State) SyncDirectory(localDir string, remoteDir string) (changeCount in
 			}
 
 			// attempt the local file sync operation
-			_, changes, err := s.SyncFile(localFileName, remoteFileName, SyncCurrentVersion)
+			_, changes, err := s.syncFile(localFileName, remoteFileName, SyncCurrentVersion, remoteFiles)
 			if err != nil {
 				return changeCount, fmt.Errorf("Failed to sync local file (%s) with the remote file (%s): %v", localFileName, remoteFileName, err)
 			}
@@ -99,12 +121,7 @@ func (s *State) SyncDirectory(localDir string, remoteDir string) (changeCount in
 	}
 
 	// sync all of the remote files
-	for _, remoteFileHash := range remoteFileHashes {
-		remoteFileName, err := s.DecryptString(remoteFileHash.FileName)
-		if err != nil {
-			return 0, fmt.Errorf("Failed to decrypt remote file name for file id %d: %v", remoteFileHash.FileID, err)
-		}
-
+	for _, remoteFileName := range remoteFileNames {
 		// skip the remote file if we don't start with the right prefix
 		if !strings.HasPrefix(remoteFileName, remoteDir) {
 			continue
@@ -131,7 +148,7 @@ func (s *State) SyncDirectory(localDir string, remoteDir string) (changeCount in
 		}
 
 		// attempt the remote file sync
-		_, changes, err := s.SyncFile(localFileName, remoteFileName, SyncCurrentVersion)
+		_, changes, err := s.syncFile(localFileName, remoteFileName, SyncCurrentVersion, remoteFiles)
 		if err != nil {
 			return changeCount, fmt.Errorf("Failed to sync remote file (%s) with the local file (%s): %v", remoteFileName, localFileName, err)
 		}
@@ -143,12 +160,63 @@ func (s *State) SyncDirectory(localDir string, remoteDir string) (changeCount in
 	return changeCount, nil
 }
 
+// getRemoteFiles returns all of the remote files for the user. If the State has a
+// SyncIndex set, the remote files are cached there and only the changes since the
+// cached revision are pulled from the server.
+func (s *State) getRemoteFiles() ([]filefreezer.FileInfo, error) {
+	if s.Index == nil {
+		return s.GetAllFileHashes()
+	}
+
+	revision, cached, err := s.Index.GetRemoteFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := s.GetChanges(revision)
+	if err != nil {
+		return nil, err
+	}
+	if changes.Complete {
+		if len(changes.Files) == 0 && len(changes.Removed) == 0 {
+			return cached, nil
+		}
+		err = s.Index.PutRemoteFiles(changes.Revision, changes.Files, changes.Removed, false)
+		if err != nil {
+			return nil, err
+		}
+		_, files, err := s.Index.GetRemoteFiles()
+		return files, err
+	}
+
+	// the changes aren't known, so get all of the files; they're at least as
+	// new as the revision returned with the changes
+	files, err := s.GetAllFileHashes()
+	if err != nil {
+		return nil, err
+	}
+	err = s.Index.PutRemoteFiles(changes.Revision, files, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
 // SyncFile will synchronize the localFilename which is identified as remoteFilepath on the server.
 // A versionNum can also be specified (or left at <=0 for current version) to pick a particular version to sync.
 // A sync status enumeration value is returned indicating if chunks were missing or whether or not
 // the local or remote version were considered newer. The number of chunks changes is also returned and
 // a non-nil error value is returned on error.
+//
+// If the State has a SyncIndex set, local files that haven't changed since they were last hashed
+// are not read again and the remote file versions they were synced with are recorded.
 func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum int) (status int, changeCount int, e error) {
+	return s.syncFile(localFilename, remoteFilepath, versionNum, nil)
+}
+
+// syncFile implements SyncFile. If remoteFiles is not nil, the remote file information
+// is looked up by name in the map instead of getting the list of files from the server.
+func (s *State) syncFile(localFilename string, remoteFilepath string, versionNum int, remoteFiles map[string]filefreezer.FileInfo) (status int, changeCount int, e error) {
 	// make sure that we're not attempting to sync a symlink, device, named pipe or socket
 	localFileStat, localFileStatErr := os.Stat(localFilename)
 	if localFileStatErr == nil {
@@ -165,21 +233,31 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 
 	// get the file information for the filename, which provides
 	// all of the information necessary to determine what to sync.
-	remote, err := s.GetFileInfoByFilename(remoteFilepath)
+	var remote filefreezer.FileInfo
+	var err error
+	if remoteFiles != nil {
+		var found bool
+		remote, found = remoteFiles[remoteFilepath]
+		if !found {
+			err = fmt.Errorf("could not find the file: %s", remoteFilepath)
+		}
+	} else {
+		remote, err = s.GetFileInfoByFilename(remoteFilepath)
+	}
 
 	// if the file is not registered with the storage server, then upload it ...
 	// futher checking will be unnecessary.
 	if err != nil {
-		localStats, err := filefreezer.CalcFileHashInfo(s.ServerCapabilities.ChunkSize, localFilename)
+		localStats, localEntry, err := s.calcLocalFileStats(localFilename)
 		if err != nil {
 			return SyncStatusMissing, 0, fmt.Errorf("Failed to calculate the file hash data for file %s to upload as %s: %v", localFilename, remoteFilepath, err)
 		}
-		ulCount, err := s.syncUploadNew(localFilename, remoteFilepath, localStats.IsDir,
-			localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString)
+		remoteFileID, remoteVersionID, ulCount, err := s.syncUploadNew(localFilename, remoteFilepath, &localStats)
 		if err != nil {
 			return SyncStatusMissing, ulCount, fmt.Errorf("Failed to upload the file to the server %s: %v", s.HostURI, err)
 		}
-		return SyncStatusLocalNewer, ulCount, nil
+		err = s.recordSync(localEntry, remoteFileID, remoteVersionID)
+		return SyncStatusLocalNewer, ulCount, err
 	}
 
 	// we got a valid response so the file is registered on the server;
@@ -210,8 +288,7 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 		// if it is a local file that doesn't exist then download the file from the
 		// server if it is registered there.
 		if !remote.IsDir {
-			dlCount, err := s.syncDownload(remote.FileID, syncVersion.VersionID, localFilename,
-				remoteFilepath, syncVersion.ChunkCount)
+			dlCount, err := s.syncDownload(remote.FileID, syncVersion, localFilename, remoteFilepath)
 			return SyncStatusRemoteNewer, dlCount, err
 		}
 
@@ -229,7 +306,7 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 	// so it is time to calculate hash information and do comparisons ...
 
 	// calculate some of the local file information
-	localStats, err := filefreezer.CalcFileHashInfo(s.ServerCapabilities.ChunkSize, localFilename)
+	localStats, localEntry, err := s.calcLocalFileStats(localFilename)
 	if err != nil {
 		return 0, 0, fmt.Errorf("Failed to calculate the local file hash data for %s: %v", localFilename, err)
 	}
@@ -247,9 +324,12 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 	// is not the current version. in this case we will compare file hashes and
 	// download the remote version of the file if the hashes are not equal
 	if syncVersion.VersionID != remote.CurrentVersion.VersionID {
-		if localStats.HashString != syncVersion.FileHash {
-			dlCount, err := s.syncDownload(remote.FileID, syncVersion.VersionID, localFilename,
-				remoteFilepath, syncVersion.ChunkCount)
+		syncVersionHash, err := s.localHashFor(localFilename, &localStats, syncVersion)
+		if err != nil {
+			return 0, 0, err
+		}
+		if syncVersionHash != syncVersion.FileHash {
+			dlCount, err := s.syncDownload(remote.FileID, syncVersion, localFilename, remoteFilepath)
 			return SyncStatusRemoteNewer, dlCount, err
 		}
 	}
@@ -260,45 +340,89 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 		return SyncStatusSame, 0, err
 	}
 
+	// the local file hash to compare against the current version
+	localHash, err := s.localHashFor(localFilename, &localStats, &remote.CurrentVersion)
+	if err != nil {
+		return 0, 0, err
+	}
+	legacyHashes := remote.CurrentVersion.HashAlgo != localStats.HashAlgo
+
+	// the chunks of the local file only line up with the remote chunks if the file
+	// was split into chunks the same way
+	sameChunking := remote.CurrentVersion.Chunking == localStats.Chunking
+
+	// a file that doesn't have a committed version yet is still being uploaded; if the
+	// local file is the one being uploaded, the upload gets finished and committed
+	if !remote.CurrentVersion.Committed && !legacyHashes && sameChunking && localHash == remote.CurrentVersion.FileHash &&
+		localStats.ChunkCount == remote.CurrentVersion.ChunkCount {
+		ulCount, e := s.syncUploadMissing(remote.FileID, &remote.CurrentVersion, localFilename, remoteFilepath,
+			&localStats, remoteMissingChunks)
+		if e != nil {
+			return SyncStatusMissing, ulCount, e
+		}
+		e = s.CommitVersion(remote.FileID, remote.CurrentVersion.VersionID, &localStats)
+		if e != nil {
+			return SyncStatusMissing, ulCount, e
+		}
+		s.Printf("%s ==> uploaded\n", remoteFilepath)
+		return SyncStatusMissing, ulCount, s.recordSync(localEntry, remote.FileID, remote.CurrentVersion.VersionID)
+	}
+
 	// lets prove that we don't need to do anything for some cases
 	// NOTE: a lastMod difference here doesn't trigger a difference if other metrics check out the same
 	// NOTE: a difference in permissions also doesn't trigger a difference
-	if localStats.HashString == remote.CurrentVersion.FileHash &&
-		len(remoteMissingChunks) == 0 &&
-		localStats.ChunkCount == remote.CurrentVersion.ChunkCount {
+	// NOTE: a file split into chunks another way is still the same file
+	if localHash == remote.CurrentVersion.FileHash &&
+		len(remoteMissingChunks) == 0 && remote.CurrentVersion.Committed &&
+		(localStats.ChunkCount == remote.CurrentVersion.ChunkCount || !sameChunking) {
+		// the files are the same but the current version was stored with the legacy unkeyed
+		// hashes, so it's replaced with a new version using keyed hashes that the server
+		// can't use to fingerprint the file.
+		if legacyHashes {
+			remoteVersionID, ulCount, e := s.syncUploadNewer(remote.FileID, localFilename, remoteFilepath, &localStats)
+			if e != nil {
+				return SyncStatusLocalNewer, ulCount, e
+			}
+			s.Printf("%s ### rehashed\n", remoteFilepath)
+			return SyncStatusLocalNewer, ulCount, s.recordSync(localEntry, remote.FileID, remoteVersionID)
+		}
+
+		// the chunk hashes don't need to be checked again if the local file hasn't
+		// changed since it was last synced with the current version
+		alreadyChecked := localEntry != nil && localEntry.RemoteFileID == remote.FileID &&
+			localEntry.RemoteVersionID == remote.CurrentVersion.VersionID && localEntry.SyncedHash == localEntry.FileHash
+
 		different := false
-		if s.ExtraStrict {
+		if s.ExtraStrict && !alreadyChecked {
 			// now we get a chunk list for the file
-			var remoteChunks models.FileChunksGetResponse
-			target := fmt.Sprintf("%s/api/chunk/%d/%d", s.HostURI, remote.FileID, remote.CurrentVersion.VersionID)
-			body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
-			err = json.Unmarshal(body, &remoteChunks)
+			remoteChunks, err := s.getRemoteChunks(remote.FileID, remote.CurrentVersion.VersionID)
 			if err != nil {
 				return 0, 0, fmt.Errorf("Failed to get the file chunk list for the file name given (%s): %v", remoteFilepath, err)
 			}
 
+			// the chunk hashes are only missing if the file hash came from the sync index; the
+			// local file also gets hashed again if the remote version was chunked another way
+			localChunkHashes := localStats.ChunkHashes
+			if localChunkHashes == nil || !sameChunking {
+				rehashed, err := filefreezer.CalcChunkedFileHashInfo(remote.CurrentVersion.Chunking, s.ServerCapabilities.ChunkSize,
+					localFilename, s.hashKey())
+				if err != nil {
+					return 0, 0, fmt.Errorf("Failed to check the local file (%s) against the remote hashes: %v", localFilename, err)
+				}
+				localChunkHashes = rehashed.ChunkHashes
+			}
+
 			// sanity check
-			remoteChunkCount := len(remoteChunks.Chunks)
-			if localStats.ChunkCount == remoteChunkCount {
+			remoteChunkCount := len(remoteChunks)
+			if len(localChunkHashes) == remoteChunkCount {
 				// check the local chunks against remote hashes
-				err = forEachChunk(int(s.ServerCapabilities.ChunkSize), localFilename, localStats.ChunkCount, func(i int, b []byte) (bool, error) {
-					// hash the chunk
-					hasher := sha1.New()
-					hasher.Write(b)
-					hash := hasher.Sum(nil)
-					chunkHash := base64.URLEncoding.EncodeToString(hash)
-
-					// do the hashes match?
-					if strings.Compare(chunkHash, remoteChunks.Chunks[i].ChunkHash) != 0 {
+				for i, chunkHash := range localChunkHashes {
+					if strings.Compare(chunkHash, remoteChunks[i].ChunkHash) != 0 {
 						// FIXME: At this point we have a chunk difference and it should be left to
 						// the client as to which source to trust for the correct file, local or remote.
 						different = true
-						return false, nil
+						break
 					}
-					return true, nil
-				})
-				if err != nil {
-					return 0, 0, fmt.Errorf("Failed to check the local file (%s) against the remote hashes: %v", localFilename, err)
 				}
 			}
 		}
@@ -306,38 +430,86 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 		// after whole-file hashs and all chunk hashs match, we can feel safe in saying they're not different
 		if !different {
 			s.Printf("%s --- unchanged\n", remoteFilepath)
-			return SyncStatusSame, 0, nil
+			err = s.recordSync(localEntry, remote.FileID, remote.CurrentVersion.VersionID)
+			return SyncStatusSame, 0, err
+		}
+	}
+
+	// at this point we have a file difference. if the index remembers the version the local file
+	// was last synced with, the side that changed since then wins and if both sides changed the
+	// conflict is resolved with the Conflict policy.
+	if localHash != remote.CurrentVersion.FileHash && remote.CurrentVersion.Committed &&
+		syncVersion.VersionID == remote.CurrentVersion.VersionID &&
+		localEntry != nil && localEntry.RemoteFileID == remote.FileID && localEntry.SyncedHash != "" {
+		localChanged := localStats.HashString != localEntry.SyncedHash
+		remoteChanged := remote.CurrentVersion.VersionID != localEntry.RemoteVersionID &&
+			remote.CurrentVersion.FileHash != localEntry.SyncedHash
+
+		policy := ConflictNewer
+		switch {
+		case localChanged && remoteChanged:
+			policy, err = s.conflictPolicy(localFilename, remoteFilepath)
+			if err != nil {
+				return 0, 0, err
+			}
+			s.Printf("%s !!! changed locally and remotely since the last sync; resolving with %s\n", remoteFilepath, policy)
+		case localChanged:
+			policy = ConflictLocal
+		case remoteChanged:
+			policy = ConflictRemote
+		}
+
+		switch policy {
+		case ConflictLocal:
+			remoteVersionID, ulCount, e := s.syncUploadNewer(remote.FileID, localFilename, remoteFilepath, &localStats)
+			if e != nil {
+				return SyncStatusLocalNewer, ulCount, e
+			}
+			return SyncStatusLocalNewer, ulCount, s.recordSync(localEntry, remote.FileID, remoteVersionID)
+		case ConflictRemote:
+			dlCount, e := s.syncDownload(remote.FileID, &remote.CurrentVersion, localFilename, remoteFilepath)
+			return SyncStatusRemoteNewer, dlCount, e
+		case ConflictKeepBoth:
+			dlCount, e := s.syncKeepBoth(remote.FileID, &remote.CurrentVersion, localFilename, remoteFilepath)
+			return SyncStatusRemoteNewer, dlCount, e
 		}
 	}
 
-	// at this point we have a file difference. we'll use the local file as the source of truth
-	// if it's lastMod is newer than the remote file.
+	// we'll use the local file as the source of truth if it's lastMod is newer than the remote file.
 	if localStats.LastMod > remote.CurrentVersion.LastMod {
-		ulCount, e := s.syncUploadNewer(remote.FileID, localFilename, remoteFilepath, localStats.IsDir,
-			localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString)
-		return SyncStatusLocalNewer, ulCount, e
+		remoteVersionID, ulCount, e := s.syncUploadNewer(remote.FileID, localFilename, remoteFilepath, &localStats)
+		if e != nil {
+			return SyncStatusLocalNewer, ulCount, e
+		}
+		return SyncStatusLocalNewer, ulCount, s.recordSync(localEntry, remote.FileID, remoteVersionID)
 	}
 
 	if localStats.LastMod < remote.CurrentVersion.LastMod {
-		dlCount, e := s.syncDownload(remote.FileID, remote.CurrentVersion.VersionID, localFilename,
-			remoteFilepath, remote.CurrentVersion.ChunkCount)
+		dlCount, e := s.syncDownload(remote.FileID, &remote.CurrentVersion, localFilename, remoteFilepath)
 		return SyncStatusRemoteNewer, dlCount, e
 	}
 
 	// there's been a difference detected in the files, but the mod times were the same, so
 	// we attempt to upload any missing chunks.
-	if len(remoteMissingChunks) > 0 {
-		ulCount, e := s.syncUploadMissing(remote.FileID, remote.CurrentVersion.VersionID, localFilename, remoteFilepath, localStats.ChunkCount)
-		return SyncStatusMissing, ulCount, e
+	if len(remoteMissingChunks) > 0 && !legacyHashes && sameChunking && remote.CurrentVersion.Committed {
+		ulCount, e := s.syncUploadMissing(remote.FileID, &remote.CurrentVersion, localFilename, remoteFilepath,
+			&localStats, remoteMissingChunks)
+		if e != nil {
+			return SyncStatusMissing, ulCount, e
+		}
+		return SyncStatusMissing, ulCount, s.recordSync(localEntry, remote.FileID, remote.CurrentVersion.VersionID)
 	}
 
 	// if we've got this far, we have a local and remote file with the same lastmod
-	// but differing hashes. for this case we'll upload the local file as a newer version.
-	if localStats.HashString != remote.CurrentVersion.FileHash &&
+	// but differing hashes, or a remote version with legacy hashes or chunked another
+	// way that is missing chunks. for this case we'll upload the local file as a newer version.
+	if (localHash != remote.CurrentVersion.FileHash || legacyHashes || !sameChunking) &&
 		localStats.LastMod == remote.CurrentVersion.LastMod {
-		ulCount, e := s.syncUploadNewer(remote.FileID, localFilename, remoteFilepath, localStats.IsDir,
-			localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString)
-		return SyncStatusLocalNewer, ulCount, e
+		remoteVersionID, ulCount, e := s.syncUploadNewer(remote.FileID, localFilename, remoteFilepath, &localStats)
+		if e != nil {
+			return SyncStatusLocalNewer, ulCount, e
+		}
+		return SyncStatusLocalNewer, ulCount, s.recordSync(localEntry, remote.FileID, remoteVersionID)
 	}
 
 	// we checked to make sure it was the same above, but we found it different -- however, no steps to
@@ -346,40 +518,79 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 		"but this was not reconcilled; lastmod equality (%v); hash equality (%v)",
 		localFilename, remoteFilepath,
 		localStats.LastMod == remote.CurrentVersion.LastMod,
-		localStats.HashString == remote.CurrentVersion.FileHash)
+		localHash == remote.CurrentVersion.FileHash)
 }
 
-func (s *State) syncUploadMissing(remoteID int, remoteVersionID int, filename string, remoteFilepath string, localChunkCount int) (uploadCount int, e error) {
-	// upload each chunk
-	err := forEachChunk(int(s.ServerCapabilities.ChunkSize), filename, localChunkCount, func(i int, b []byte) (bool, error) {
-		// hash the chunk with unencrypted data
-		hasher := sha1.New()
-		hasher.Write(b)
-		hash := hasher.Sum(nil)
-		chunkHash := base64.URLEncoding.EncodeToString(hash)
-
-		cryptoBytes, err := s.encryptBytes(b)
+// localHashFor returns the hash of the local file to compare against the hash of the remote
+// file version. Versions stored before the hashes were keyed have plain SHA1 hashes, so the
+// local file gets hashed again with the legacy algorithm for those.
+func (s *State) localHashFor(localFilename string, localStats *filefreezer.FileStats, version *filefreezer.FileVersionInfo) (string, error) {
+	switch version.HashAlgo {
+	case localStats.HashAlgo:
+		return localStats.HashString, nil
+	case filefreezer.HashAlgoSHA1:
+		legacyStats, err := filefreezer.CalcFileHashInfo(s.ServerCapabilities.ChunkSize, localFilename, nil)
 		if err != nil {
-			return false, fmt.Errorf("Failed to encrypt chunk before sending to the server: %v", err)
+			return "", fmt.Errorf("Failed to calculate the legacy file hash for %s: %v", localFilename, err)
 		}
+		return legacyStats.HashString, nil
+	default:
+		return "", fmt.Errorf("The remote version of %s uses an unsupported hash algorithm: %s", localFilename, version.HashAlgo)
+	}
+}
 
-		target := fmt.Sprintf("%s/api/chunk/%d/%d/%d/%s", s.HostURI, remoteID, remoteVersionID, i, chunkHash)
-		body, err := s.RunAuthRequest(target, "PUT", s.AuthToken, cryptoBytes)
-		if err != nil {
-			return false, err
+// conflictPolicy returns the policy to resolve a conflict between the local file and
+// the remote file with, asking the ConflictPrompt if the Conflict policy is ConflictAsk.
+// The local file is kept as a conflict copy if there's no ConflictPrompt to ask.
+func (s *State) conflictPolicy(localFilename string, remoteFilepath string) (string, error) {
+	policy := s.Conflict
+	if policy == "" {
+		return ConflictNewer, nil
+	}
+	if policy == ConflictAsk {
+		if s.ConflictPrompt == nil {
+			return ConflictKeepBoth, nil
 		}
+		policy = s.ConflictPrompt(localFilename, remoteFilepath)
+	}
 
-		var resp models.FileChunkPutResponse
-		err = json.Unmarshal(body, &resp)
-		if err != nil || resp.Status == false {
-			return false, fmt.Errorf("Failed to upload the chunk to the server: %v", err)
+	for _, p := range ConflictPolicies {
+		if p == policy && p != ConflictAsk {
+			return policy, nil
 		}
+	}
+	return "", fmt.Errorf("Unsupported conflict policy for %s: %s", localFilename, policy)
+}
 
-		s.Printf("%s +++ %d / %d\n", remoteFilepath, i+1, localChunkCount)
-		uploadCount++
+// syncKeepBoth moves the local file out of the way to a conflict copy named after the
+// host and the current time, which gets uploaded as a file of its own on the next sync,
+// and then downloads the remote file version in its place.
+func (s *State) syncKeepBoth(remoteID int, version *filefreezer.FileVersionInfo, filename string, remoteFilepath string) (downloadCount int, e error) {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	conflictName := fmt.Sprintf("%s.conflict-%s-%s", filename, host, time.Now().Format("20060102-150405"))
+	err = os.Rename(filename, conflictName)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to keep the local file %s as a conflict copy: %v", filename, err)
+	}
+	s.Printf("%s !!! kept the local file as %s\n", remoteFilepath, conflictName)
 
-		return true, nil
-	})
+	// the local file is put back if the remote version can't be downloaded
+	downloadCount, err = s.syncDownload(remoteID, version, filename, remoteFilepath)
+	if err != nil {
+		if _, statErr := os.Stat(filename); os.IsNotExist(statErr) {
+			os.Rename(conflictName, filename)
+		}
+		return downloadCount, err
+	}
+	return downloadCount, nil
+}
+
+func (s *State) syncUploadMissing(remoteID int, version *filefreezer.FileVersionInfo, filename string, remoteFilepath string, localStats *filefreezer.FileStats, missingChunks []int) (uploadCount int, e error) {
+	// upload each missing chunk
+	uploadCount, err := s.syncUploadChunks(remoteID, version, filename, remoteFilepath, localStats, missingChunks, "+++")
 	if err != nil {
 		return uploadCount, fmt.Errorf("Failed to upload the local file chunk for %s: %v", filename, err)
 	}
@@ -387,186 +598,489 @@ func (s *State) syncUploadMissing(remoteID int, remoteVersionID int, filename st
 	return uploadCount, nil
 }
 
-func (s *State) syncUploadNewer(remoteFileID int, filename string, remoteFilepath string, isDir bool, localPermissions uint32, localLastMod int64, localChunkCount int, localHash string) (uploadCount int, e error) {
-	// tag a new version for the file
-	var postReq models.NewFileVersionRequest
-	postReq.LastMod = localLastMod
-	postReq.Permissions = localPermissions
-	postReq.ChunkCount = localChunkCount
-	postReq.FileHash = localHash
-	target := fmt.Sprintf("%s/api/file/%d/version", s.HostURI, remoteFileID)
-	body, err := s.RunAuthRequest(target, "POST", s.AuthToken, postReq)
+func (s *State) syncUploadNewer(remoteFileID int, filename string, remoteFilepath string, localStats *filefreezer.FileStats) (remoteVersionID int, uploadCount int, e error) {
+	// start the upload of a new version for the file, which resumes the upload
+	// of the same version if it was interrupted
+	size, err := localFileSize(filename, localStats)
 	if err != nil {
-		return 0, fmt.Errorf("Failed to tag a new version for the file %d: %v", remoteFileID, err)
+		return 0, 0, err
 	}
-
-	var postResp models.NewFileVersionResponse
-	err = json.Unmarshal(body, &postResp)
+	sess, err := s.StartUpload(remoteFileID, "", localStats, size)
 	if err != nil {
-		return 0, fmt.Errorf("Failed to read the response for tagging a new version for the file %d: %v", remoteFileID, err)
+		return 0, 0, fmt.Errorf("Failed to tag a new version for the file %d: %v", remoteFileID, err)
 	}
+	remoteVersionID = sess.Version.VersionID
 
 	// if we're uploading a newer version for a directory we can just
 	// stop here because there are no chunks to send.
-	if isDir {
+	if localStats.IsDir {
 		return
 	}
+	if sess.Resumed {
+		s.Printf("%s ... resuming the upload with %d of %d chunks missing\n", remoteFilepath, len(sess.MissingChunks), sess.Version.ChunkCount)
+	}
 
-	fi := &postResp.FileInfo
-
-	// upload each chunk
-	err = forEachChunk(int(s.ServerCapabilities.ChunkSize), filename, localChunkCount, func(i int, b []byte) (bool, error) {
-		// hash the chunk
-		hasher := sha1.New()
-		hasher.Write(b)
-		hash := hasher.Sum(nil)
-		chunkHash := base64.URLEncoding.EncodeToString(hash)
-
-		cryptoBytes, err := s.encryptBytes(b)
-		if err != nil {
-			return false, fmt.Errorf("Failed to encrypt chunk before sending to the server: %v", err)
-		}
+	// upload each chunk the server doesn't have yet
+	uploadCount, err = s.syncUploadChunks(sess.FileID, &sess.Version, filename, remoteFilepath, localStats, sess.MissingChunks, ">>>")
+	if err != nil {
+		return remoteVersionID, uploadCount, fmt.Errorf("Failed to upload the local file chunk for %s: %v", filename, err)
+	}
 
-		target = fmt.Sprintf("%s/api/chunk/%d/%d/%d/%s", s.HostURI, fi.FileID, fi.CurrentVersion.VersionID, i, chunkHash)
-		body, err = s.RunAuthRequest(target, "PUT", s.AuthToken, cryptoBytes)
+	// the new version only becomes current once it's committed
+	if !sess.Version.Committed {
+		err = s.CommitVersion(sess.FileID, remoteVersionID, localStats)
 		if err != nil {
-			return false, err
+			return remoteVersionID, uploadCount, err
 		}
-
-		var resp models.FileChunkPutResponse
-		err = json.Unmarshal(body, &resp)
-		if err != nil || resp.Status == false {
-			return false, fmt.Errorf("Failed to upload the chunk to the server: %v", err)
-		}
-
-		s.Printf("%s >>> %d / %d\n", remoteFilepath, i+1, localChunkCount)
-		uploadCount++
-
-		return true, nil
-	})
-
-	if err != nil {
-		return uploadCount, fmt.Errorf("Failed to upload the local file chunk for %s: %v", filename, err)
 	}
 
-	return uploadCount, nil
+	return remoteVersionID, uploadCount, nil
 }
 
-func (s *State) syncUploadNew(filename string, remoteFilepath string, isDir bool, localPermissions uint32, localLastMod int64, localChunkCount int, localHash string) (uploadCount int, e error) {
+func (s *State) syncUploadNew(filename string, remoteFilepath string, localStats *filefreezer.FileStats) (remoteID int, remoteVersionID int, uploadCount int, e error) {
 	// encrypt the remote filepath so that the server doesn't see the plaintext version
 	cryptoRemoteName, err := s.EncryptString(remoteFilepath)
 	if err != nil {
-		return 0, fmt.Errorf("Could not encrypt the remote file name before uploading: %v", err)
+		return 0, 0, 0, fmt.Errorf("Could not encrypt the remote file name before uploading: %v", err)
 	}
 
 	// establish a new file on the remote freezer
-	var putReq models.FilePutRequest
-	putReq.FileName = cryptoRemoteName
-	putReq.IsDir = isDir
-	putReq.Permissions = localPermissions
-	putReq.LastMod = localLastMod
-	putReq.ChunkCount = localChunkCount
-	putReq.FileHash = localHash
-	target := fmt.Sprintf("%s/api/files", s.HostURI)
-	body, err := s.RunAuthRequest(target, "POST", s.AuthToken, putReq)
+	size, err := localFileSize(filename, localStats)
 	if err != nil {
-		return 0, err
+		return 0, 0, 0, err
 	}
-
-	var putResp models.FilePutResponse
-	err = json.Unmarshal(body, &putResp)
+	sess, err := s.StartUpload(0, cryptoRemoteName, localStats, size)
 	if err != nil {
-		return 0, err
+		return 0, 0, 0, err
 	}
+	remoteID = sess.FileID
+	remoteVersionID = sess.Version.VersionID
 
 	// if we're uploading a new directory, stop here because there are no
 	// chunks to sync.
-	if isDir == true {
+	if localStats.IsDir == true {
 		s.Printf("%s ==> directory created\n", remoteFilepath)
+		return remoteID, 0, 0, nil
+	}
+
+	// upload each chunk
+	uploadCount, err = s.syncUploadChunks(remoteID, &sess.Version, filename, remoteFilepath, localStats, sess.MissingChunks, ">>>")
+	if err != nil {
+		return remoteID, remoteVersionID, uploadCount, fmt.Errorf("Failed to upload the local file chunk for %s: %v", filename, err)
+	}
+	if !sess.Version.Committed {
+		err = s.CommitVersion(remoteID, remoteVersionID, localStats)
+		if err != nil {
+			return remoteID, remoteVersionID, uploadCount, err
+		}
+	}
+
+	s.Printf("%s ==> uploaded\n", remoteFilepath)
+	return remoteID, remoteVersionID, uploadCount, nil
+}
+
+// localFileSize returns the size of the local file, which is 0 for directories.
+func localFileSize(filename string, localStats *filefreezer.FileStats) (int64, error) {
+	if localStats.IsDir {
+		return 0, nil
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the size of the file %s: %v", filename, err)
+	}
+	return info.Size(), nil
+}
+
+// syncUploadChunks uploads the chunks of the local file to a remote file version. If chunkNumbers
+// is nil every chunk of the file is uploaded, otherwise only the chunk numbers listed are. The
+// chunk hashes are sent to the server first so that the chunks the user already has in storage
+// get reused and only the remaining chunks are uploaded. If localStats doesn't have the hash and
+// length of every chunk, the file is read to split it into chunks with the chunking mode of the
+// stats again. The number of chunks uploaded is returned.
+func (s *State) syncUploadChunks(remoteID int, version *filefreezer.FileVersionInfo, filename string, remoteFilepath string,
+	localStats *filefreezer.FileStats, chunkNumbers []int, marker string) (uploadCount int, e error) {
+	remoteVersionID := version.VersionID
+	chunkSize := int(s.ServerCapabilities.ChunkSize)
+	localChunkCount := localStats.ChunkCount
+	localChunkHashes := localStats.ChunkHashes
+	localChunkLengths := localStats.ChunkLengths
+	if len(localChunkHashes) != localChunkCount || len(localChunkLengths) != localChunkCount {
+		f, err := os.Open(filename)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to open the file %s: %v", filename, err)
+		}
+		_, localChunkHashes, localChunkLengths, err = filefreezer.CalcChunkedReaderHashInfo(localStats.Chunking, int64(chunkSize), f, s.hashKey())
+		f.Close()
+		if err != nil {
+			return 0, fmt.Errorf("Failed to hash the local file chunks for %s: %v", filename, err)
+		}
+		if len(localChunkHashes) != localChunkCount {
+			return 0, fmt.Errorf("The local file %s has %d chunks instead of %d; it changed while being synced", filename, len(localChunkHashes), localChunkCount)
+		}
+	}
+
+	// the chunks start where the chunk before them ends
+	offsets := make([]int64, localChunkCount)
+	for i := 1; i < localChunkCount; i++ {
+		offsets[i] = offsets[i-1] + int64(localChunkLengths[i-1])
+	}
+
+	wanted := make(map[int]bool)
+	for _, i := range chunkNumbers {
+		wanted[i] = true
+	}
+
+	// collect the hashes of each of the chunks to send
+	var reuseReq models.FileChunksReuseRequest
+	chunkHashes := make(map[int]string)
+	for i, chunkHash := range localChunkHashes {
+		if chunkNumbers != nil && !wanted[i] {
+			continue
+		}
+		chunkHashes[i] = chunkHash
+		reuseReq.Chunks = append(reuseReq.Chunks, filefreezer.FileChunk{ChunkNumber: i, ChunkHash: chunkHash, ChunkLength: localChunkLengths[i]})
+	}
+	if len(reuseReq.Chunks) == 0 {
 		return 0, nil
 	}
 
-	var getFileInfoResp models.FileGetResponse
-	target = fmt.Sprintf("%s/api/file/%d", s.HostURI, putResp.FileID)
-	body, err = s.RunAuthRequest(target, "GET", s.AuthToken, nil)
-	err = json.Unmarshal(body, &getFileInfoResp)
+	// have the server add any of the chunks it already has stored for the user
+	target := fmt.Sprintf("%s/api/chunk/%d/%d", s.HostURI, remoteID, remoteVersionID)
+	body, err := s.RunAuthRequest(target, "POST", s.authToken(), reuseReq)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("Failed to reuse the stored chunks for the file %d: %v", remoteID, err)
 	}
 
-	remoteID := putResp.FileID
-	remoteVersionID := getFileInfoResp.CurrentVersion.VersionID
+	var reuseResp models.FileChunksReuseResponse
+	err = json.Unmarshal(body, &reuseResp)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read the response for reusing the stored chunks for the file %d: %v", remoteID, err)
+	}
+	for _, i := range reuseResp.ReusedChunks {
+		delete(chunkHashes, i)
+		s.Printf("%s === %d / %d\n", remoteFilepath, i+1, localChunkCount)
+	}
 
-	// upload each chunk
-	err = forEachChunk(int(s.ServerCapabilities.ChunkSize), filename, localChunkCount, func(i int, b []byte) (bool, error) {
-		// hash the chunk
-		hasher := sha1.New()
-		hasher.Write(b)
-		hash := hasher.Sum(nil)
-		chunkHash := base64.URLEncoding.EncodeToString(hash)
-
-		cryptoBytes, err := s.encryptBytes(b)
+	// upload each chunk that wasn't reused using a pool of workers
+	var uploadChunks []int
+	for i := 0; i < localChunkCount; i++ {
+		if _, needed := chunkHashes[i]; needed {
+			uploadChunks = append(uploadChunks, i)
+		}
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to open the file %s: %v", filename, err)
+	}
+	defer f.Close()
+
+	buffers := make([][]byte, s.jobCount())
+	var countLock sync.Mutex
+	err = runChunkJobs(s.jobCount(), uploadChunks, func(worker int, i int) error {
+		if buffers[worker] == nil {
+			buffers[worker] = make([]byte, chunkSize)
+		}
+		b, err := readChunkAt(f, i, offsets[i], localChunkLengths[i], buffers[worker])
 		if err != nil {
-			return false, fmt.Errorf("Failed to encrypt chunk before sending to the server: %v", err)
+			return err
 		}
 
-		target = fmt.Sprintf("%s/api/chunk/%d/%d/%d/%s", s.HostURI, remoteID, remoteVersionID, i, chunkHash)
-		body, err = s.RunAuthRequest(target, "PUT", s.AuthToken, cryptoBytes)
+		cryptoBytes, err := s.encryptChunk(b, chunkOrigin{remoteID, version.VersionNumber, i})
 		if err != nil {
-			return false, err
+			return fmt.Errorf("Failed to encrypt chunk before sending to the server: %v", err)
+		}
+
+		target := fmt.Sprintf("%s/api/chunk/%d/%d/%d/%s?length=%d", s.HostURI, remoteID, remoteVersionID, i, chunkHashes[i], len(b))
+		body, err := s.RunAuthRequest(target, "PUT", s.authToken(), cryptoBytes)
+		if err != nil {
+			return err
 		}
 
 		var resp models.FileChunkPutResponse
 		err = json.Unmarshal(body, &resp)
 		if err != nil || resp.Status == false {
-			return false, fmt.Errorf("Failed to upload the chunk to the server: %v", err)
+			return fmt.Errorf("Failed to upload the chunk to the server: %v", err)
 		}
 
-		s.Printf("%s >>> %d / %d\n", remoteFilepath, i+1, localChunkCount)
+		s.Printf("%s %s %d / %d\n", remoteFilepath, marker, i+1, localChunkCount)
+		countLock.Lock()
 		uploadCount++
+		countLock.Unlock()
 
-		return true, nil
+		return nil
 	})
 	if err != nil {
-		return uploadCount, fmt.Errorf("Failed to upload the local file chunk for %s: %v", filename, err)
+		return uploadCount, err
 	}
 
-	s.Printf("%s ==> uploaded\n", remoteFilepath)
 	return uploadCount, nil
 }
 
-func (s *State) syncDownload(remoteID int, remoteVersionID int, filename string, remoteFilepath string, chunkCount int) (downloadCount int, e error) {
-	localFile, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+func (s *State) syncDownload(remoteID int, version *filefreezer.FileVersionInfo, filename string, remoteFilepath string) (downloadCount int, e error) {
+	remoteVersionID := version.VersionID
+	chunkCount := version.ChunkCount
+
+	// a version that hasn't been committed may still be missing chunks, so it's
+	// left alone until the upload is finished
+	if !version.Committed {
+		s.Printf("%s ... waiting for the upload to be committed\n", remoteFilepath)
+		return 0, nil
+	}
+
+	// the chunk hashes are needed to verify the chunks after they're decrypted
+	remoteChunks, err := s.getRemoteChunks(remoteID, remoteVersionID)
 	if err != nil {
-		return 0, fmt.Errorf("Failed to open local file (%s) for writing: %v", filename, err)
+		return 0, fmt.Errorf("Failed to get the file chunk list for file id %d: %v", remoteID, err)
+	}
+	chunkHashes := make(map[int]string)
+	for _, c := range remoteChunks {
+		chunkHashes[c.ChunkNumber] = c.ChunkHash
+	}
+
+	// fixed size chunks are all full but the last one; otherwise the chunks start
+	// where the chunk before them ends
+	chunkSize := s.ServerCapabilities.ChunkSize
+	fixedChunks := version.Chunking == "" || version.Chunking == filefreezer.ChunkingFixed
+	chunkLengths := make([]int, chunkCount)
+	offsets := make([]int64, chunkCount)
+	if !fixedChunks {
+		for _, c := range remoteChunks {
+			if c.ChunkNumber >= 0 && c.ChunkNumber < chunkCount {
+				chunkLengths[c.ChunkNumber] = c.ChunkLength
+			}
+		}
+		for i := range chunkLengths {
+			if chunkLengths[i] <= 0 || int64(chunkLengths[i]) > chunkSize {
+				return 0, fmt.Errorf("The #%d chunk for file id %d does not have a valid chunk length", i, remoteID)
+			}
+			if i > 0 {
+				offsets[i] = offsets[i-1] + int64(chunkLengths[i-1])
+			}
+		}
+	}
+
+	// the chunks are written to a temporary file that replaces the local file once
+	// the whole file is downloaded and verified so that a failed download doesn't
+	// leave a truncated file behind to be uploaded as a newer version
+	downloadFilename := filename + downloadSuffix
+	localFile, err := os.OpenFile(downloadFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to open local file (%s) for writing: %v", downloadFilename, err)
+	}
+	defer func() {
+		localFile.Close()
+		if e != nil {
+			os.Remove(downloadFilename)
+		}
+	}()
+	if existing, err := os.Stat(filename); err == nil {
+		localFile.Chmod(existing.Mode().Perm())
+	}
+
+	// download each chunk using a pool of workers and write it out to
+	// the file at the offset for the chunk number
+	chunkNumbers := make([]int, chunkCount)
+	for i := range chunkNumbers {
+		chunkNumbers[i] = i
 	}
-	defer localFile.Close()
 
-	// download each chunk and write it out to the file
 	chunksWritten := 0
-	for i := 0; i < chunkCount; i++ {
+	var countLock sync.Mutex
+	err = runChunkJobs(s.jobCount(), chunkNumbers, func(worker int, i int) error {
 		target := fmt.Sprintf("%s/api/chunk/%d/%d/%d", s.HostURI, remoteID, remoteVersionID, i)
-		body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+		body, err := s.RunAuthRequest(target, "GET", s.authToken(), nil)
 		if err != nil {
-			return chunksWritten, fmt.Errorf("Failed to get the file chunk #%d for file id%d: %v", i, remoteID, err)
+			return fmt.Errorf("Failed to get the file chunk #%d for file id%d: %v", i, remoteID, err)
 		}
 
 		// write out the chunk that was downloaded
-		chunk := body
-		uncryptoBytes, err := s.decryptBytes(chunk)
+		expected := chunkOrigin{remoteID, version.VersionNumber, i}
+		uncryptoBytes, err := s.verifyChunk(body, expected, version.HashAlgo, chunkHashes[i])
 		if err != nil {
-			return chunksWritten, fmt.Errorf("Failed to decrypt the the chunk bytes: %v", err)
+			return err
 		}
 
-		_, err = localFile.Write(uncryptoBytes)
+		// the chunks have to be the expected length for the offsets to line up, which
+		// for fixed size chunks is every chunk but the last one being full
+		offset := offsets[i]
+		if fixedChunks {
+			offset = int64(i) * chunkSize
+			if i+1 != chunkCount && int64(len(uncryptoBytes)) != chunkSize {
+				return fmt.Errorf("The #%d chunk for file id %d has %d bytes instead of the chunk size of %d", i, remoteID, len(uncryptoBytes), chunkSize)
+			}
+		} else if len(uncryptoBytes) != chunkLengths[i] {
+			return fmt.Errorf("The #%d chunk for file id %d has %d bytes instead of its chunk length of %d", i, remoteID, len(uncryptoBytes), chunkLengths[i])
+		}
+
+		_, err = localFile.WriteAt(uncryptoBytes, offset)
 		if err != nil {
-			return chunksWritten, fmt.Errorf("Failed to write to the #%d chunk to the local file %s: %v", i, filename, err)
+			return fmt.Errorf("Failed to write to the #%d chunk to the local file %s: %v", i, filename, err)
 		}
 
 		s.Printf("%s <<< %d / %d\n", remoteFilepath, i+1, chunkCount)
+		countLock.Lock()
 		chunksWritten++
+		countLock.Unlock()
+		return nil
+	})
+	if err != nil {
+		return chunksWritten, err
+	}
+
+	// the chunks were verified against the chunk list, so check that the server didn't
+	// give out the wrong chunk list by hashing the whole file
+	localFile.Close()
+	downloadedStats, err := filefreezer.CalcFileHashInfo(chunkSize, downloadFilename, s.hashKeyFor(version.HashAlgo))
+	if err != nil {
+		return chunksWritten, fmt.Errorf("Failed to hash the downloaded file %s: %v", filename, err)
+	}
+	if downloadedStats.HashString != version.FileHash {
+		return chunksWritten, fmt.Errorf("The downloaded file %s does not match the file hash of version %d of file id %d; "+
+			"the chunks were reordered or substituted by the server", filename, version.VersionNumber, remoteID)
+	}
+	err = os.Rename(downloadFilename, filename)
+	if err != nil {
+		return chunksWritten, fmt.Errorf("Failed to replace the local file %s with the download: %v", filename, err)
 	}
 
 	s.Printf("%s <== downloaded\n", remoteFilepath)
-	return chunksWritten, nil
+
+	// the downloaded file has the contents of the remote version, so it
+	// doesn't need to be hashed on the next sync
+	return chunksWritten, s.recordDownload(filename, remoteID, version)
+}
+
+// getRemoteChunks returns the chunk list of the remote file version.
+func (s *State) getRemoteChunks(remoteID int, remoteVersionID int) ([]filefreezer.FileChunk, error) {
+	target := fmt.Sprintf("%s/api/chunk/%d/%d", s.HostURI, remoteID, remoteVersionID)
+	body, err := s.RunAuthRequest(target, "GET", s.authToken(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var remoteChunks models.FileChunksGetResponse
+	err = json.Unmarshal(body, &remoteChunks)
+	if err != nil {
+		return nil, err
+	}
+	return remoteChunks.Chunks, nil
+}
+
+// verifyChunk decrypts the downloaded chunk bytes and makes sure that they are the expected
+// chunk. A chunk encrypted for another file version or chunk number is only accepted if it's
+// a chunk shared with the expected one, which is the case when its hash matches the expected
+// chunk hash. An error naming the chunk that was substituted is returned otherwise.
+func (s *State) verifyChunk(cryptoBytes []byte, expected chunkOrigin, hashAlgo string, expectedHash string) ([]byte, error) {
+	chunk, origin, err := s.decryptChunk(cryptoBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt the %s: %v", expected, err)
+	}
+
+	chunkHash := filefreezer.CalcChunkHash(s.hashKeyFor(hashAlgo), chunk)
+	if chunkHash != expectedHash {
+		// versions stored with plain SHA1 file hashes may still have keyed chunk hashes
+		if hashAlgo == filefreezer.HashAlgoSHA1 && s.hashChunk(chunk) == expectedHash {
+			return chunk, nil
+		}
+		if origin != nil && *origin != expected {
+			return nil, fmt.Errorf("The %s was substituted with the %s", expected, origin)
+		}
+		return nil, fmt.Errorf("The %s does not match its chunk hash", expected)
+	}
+
+	return chunk, nil
+}
+
+// calcLocalFileStats returns the FileStats for the local file. When a SyncIndex is set, the
+// file hash recorded in the index is used instead of reading the file again if the stat data
+// for the file hasn't changed, unless Rehash is set. Stats taken from the index have no ChunkHashes
+// or ChunkLengths.
+// The index entry for the file is also returned, or nil if no index is used or the file is a directory.
+func (s *State) calcLocalFileStats(localFilename string) (stats filefreezer.FileStats, entry *SyncIndexEntry, e error) {
+	chunkSize := s.ServerCapabilities.ChunkSize
+	chunking := s.chunking()
+	if s.Index == nil {
+		stats, e = filefreezer.CalcChunkedFileHashInfo(chunking, chunkSize, localFilename, s.hashKey())
+		return stats, nil, e
+	}
+
+	// the file is stat'd before hashing so that a change made while the
+	// file is being hashed will get it hashed again on the next sync
+	fileInfo, err := os.Stat(localFilename)
+	if err != nil {
+		return stats, nil, fmt.Errorf("Failed to stat the local file %s: %v", localFilename, err)
+	}
+	if fileInfo.IsDir() {
+		stats, e = filefreezer.CalcChunkedFileHashInfo(chunking, chunkSize, localFilename, s.hashKey())
+		return stats, nil, e
+	}
+
+	absPath, err := filepath.Abs(localFilename)
+	if err != nil {
+		return stats, nil, fmt.Errorf("Failed to get the absolute path for %s: %v", localFilename, err)
+	}
+	entry, err = s.Index.GetEntry(absPath)
+	if err != nil {
+		return stats, nil, err
+	}
+
+	if entry != nil && !s.Rehash && entry.matches(fileInfo, chunkSize, chunking) {
+		stats.LastMod = fileInfo.ModTime().UTC().Unix()
+		stats.Permissions = uint32(fileInfo.Mode())
+		stats.Chunking = entry.Chunking
+		stats.ChunkCount = entry.ChunkCount
+		stats.HashString = entry.FileHash
+		stats.HashAlgo = entry.HashAlgo
+		return stats, entry, nil
+	}
+
+	stats, err = filefreezer.CalcChunkedFileHashInfo(chunking, chunkSize, localFilename, s.hashKey())
+	if err != nil {
+		return stats, nil, err
+	}
+
+	previous := entry
+	entry = newSyncIndexEntry(absPath, fileInfo, chunkSize, stats.Chunking, stats.ChunkCount, stats.HashString, stats.HashAlgo)
+	entry.keepSync(previous)
+	err = s.Index.PutEntry(entry)
+	return stats, entry, err
+}
+
+// recordSync records the remote file version that the local file in the index entry was
+// synced with. Nothing is recorded if the entry is nil.
+func (s *State) recordSync(entry *SyncIndexEntry, remoteFileID int, remoteVersionID int) error {
+	if s.Index == nil || entry == nil {
+		return nil
+	}
+
+	entry.RemoteFileID = remoteFileID
+	entry.RemoteVersionID = remoteVersionID
+	entry.SyncedHash = entry.FileHash
+	return s.Index.PutEntry(entry)
+}
+
+// recordDownload adds an index entry for the local file that was just written with the
+// contents of the remote file version.
+func (s *State) recordDownload(localFilename string, remoteFileID int, version *filefreezer.FileVersionInfo) error {
+	// versions with legacy hashes aren't recorded so the file gets hashed on the next sync
+	if s.Index == nil || version.HashAlgo != filefreezer.HashAlgoHMACSHA256 {
+		return nil
+	}
+
+	fileInfo, err := os.Stat(localFilename)
+	if err != nil {
+		return fmt.Errorf("Failed to stat the local file %s: %v", localFilename, err)
+	}
+	absPath, err := filepath.Abs(localFilename)
+	if err != nil {
+		return fmt.Errorf("Failed to get the absolute path for %s: %v", localFilename, err)
+	}
+
+	chunking := version.Chunking
+	if chunking == "" {
+		chunking = filefreezer.ChunkingFixed
+	}
+	entry := newSyncIndexEntry(absPath, fileInfo, s.ServerCapabilities.ChunkSize, chunking, version.ChunkCount, version.FileHash, version.HashAlgo)
+	return s.recordSync(entry, remoteFileID, version.VersionID)
 }
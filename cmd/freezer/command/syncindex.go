@@ -0,0 +1,370 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/tbogdala/filefreezer"
+
+	// import the sqlite3 driver for use with database/sql
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	createLocalFilesTable = `CREATE TABLE IF NOT EXISTS LocalFiles (
+        Path            TEXT PRIMARY KEY    NOT NULL,
+        Size            INTEGER             NOT NULL,
+        ModTime         INTEGER             NOT NULL,
+        Inode           INTEGER             NOT NULL,
+        ChunkSize       INTEGER             NOT NULL,
+        ChunkCount      INTEGER             NOT NULL,
+        FileHash        TEXT                NOT NULL,
+        HashAlgo        TEXT                NOT NULL,
+        RemoteFileID    INTEGER             NOT NULL,
+        RemoteVersionID INTEGER             NOT NULL,
+        Chunking        TEXT                NOT NULL DEFAULT 'fixed',
+        SyncedHash      TEXT                NOT NULL DEFAULT ''
+    );`
+
+	// indexes created before the chunking mode was recorded only have fixed size chunks
+	checkLocalFilesChunking = `SELECT Chunking FROM LocalFiles LIMIT 1;`
+	addLocalFilesChunking   = `ALTER TABLE LocalFiles ADD COLUMN Chunking TEXT NOT NULL DEFAULT 'fixed';`
+
+	// indexes created before the synced hash was recorded only kept the remote version
+	// of files that hadn't changed since they were synced
+	checkLocalFilesSyncedHash = `SELECT SyncedHash FROM LocalFiles LIMIT 1;`
+	addLocalFilesSyncedHash   = `ALTER TABLE LocalFiles ADD COLUMN SyncedHash TEXT NOT NULL DEFAULT '';`
+	setLocalFilesSyncedHash   = `UPDATE LocalFiles SET SyncedHash = FileHash WHERE RemoteVersionID <> 0;`
+
+	createRemoteNamesTable = `CREATE TABLE IF NOT EXISTS RemoteNames (
+        FileID          INTEGER PRIMARY KEY NOT NULL,
+        EncryptedName   TEXT                NOT NULL,
+        FileName        TEXT                NOT NULL
+    );`
+
+	createRemoteFilesTable = `CREATE TABLE IF NOT EXISTS RemoteFiles (
+        FileID          INTEGER PRIMARY KEY NOT NULL,
+        Info            TEXT                NOT NULL
+    );`
+
+	createRemoteRevisionTable = `CREATE TABLE IF NOT EXISTS RemoteRevision (
+        Revision        INTEGER             NOT NULL
+    );`
+
+	getLocalFile = `SELECT Size, ModTime, Inode, ChunkSize, ChunkCount, FileHash, HashAlgo, RemoteFileID, RemoteVersionID, Chunking, SyncedHash
+		FROM LocalFiles WHERE Path = ?;`
+	setLocalFile = `INSERT OR REPLACE INTO LocalFiles (Path, Size, ModTime, Inode, ChunkSize, ChunkCount, FileHash, HashAlgo, RemoteFileID, RemoteVersionID, Chunking, SyncedHash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+	getRemoteName = `SELECT FileName FROM RemoteNames WHERE FileID = ? AND EncryptedName = ?;`
+	setRemoteName = `INSERT OR REPLACE INTO RemoteNames (FileID, EncryptedName, FileName) VALUES (?, ?, ?);`
+
+	getRemoteFiles      = `SELECT Info FROM RemoteFiles ORDER BY FileID;`
+	setRemoteFile       = `INSERT OR REPLACE INTO RemoteFiles (FileID, Info) VALUES (?, ?);`
+	removeRemoteFile    = `DELETE FROM RemoteFiles WHERE FileID = ?;`
+	removeRemoteFiles   = `DELETE FROM RemoteFiles;`
+	getRemoteRevision   = `SELECT Revision FROM RemoteRevision;`
+	clearRemoteRevision = `DELETE FROM RemoteRevision;`
+	setRemoteRevision   = `INSERT INTO RemoteRevision (Revision) VALUES (?);`
+)
+
+// SyncIndex is a client side database for a sync root that remembers what the local
+// files looked like when they were last hashed and synced so that unchanged files
+// don't need to be read and hashed again. It also caches the decrypted remote file names
+// and the remote files as of a revision so that only the changes since then need to be
+// pulled from the server.
+type SyncIndex struct {
+	db *sql.DB
+}
+
+// SyncIndexEntry is the state of a local file recorded in the SyncIndex.
+type SyncIndexEntry struct {
+	// Path is the absolute path of the local file
+	Path string
+
+	// Size, ModTime (in nanoseconds) and Inode are the stat data for the local
+	// file at the time it was hashed
+	Size    int64
+	ModTime int64
+	Inode   uint64
+
+	// ChunkSize and Chunking are the chunk size and chunking mode used to calculate ChunkCount
+	ChunkSize  int64
+	Chunking   string
+	ChunkCount int
+	FileHash   string
+	HashAlgo   string
+
+	// RemoteFileID and RemoteVersionID identify the remote file version the local
+	// file was last synced with, or are 0 if it hasn't been synced yet; SyncedHash
+	// is the hash the local file had then, so the file has changed since it was
+	// synced if FileHash is different
+	RemoteFileID    int
+	RemoteVersionID int
+	SyncedHash      string
+}
+
+// DefaultIndexDir returns the default directory to keep the sync index databases in,
+// which is .filefreezer under the user's home directory.
+func DefaultIndexDir() (string, error) {
+	home := os.Getenv("HOME")
+	if runtime.GOOS == "windows" {
+		home = os.Getenv("USERPROFILE")
+	}
+	if home == "" {
+		return "", fmt.Errorf("could not determine the home directory for the sync index")
+	}
+	return filepath.Join(home, ".filefreezer"), nil
+}
+
+// SyncIndexPath returns the path of the sync index database in indexDir to use for
+// syncing the localRoot directory with the host for the username given.
+func SyncIndexPath(indexDir string, hostURI string, username string, localRoot string) (string, error) {
+	absRoot, err := filepath.Abs(localRoot)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the absolute path for %s: %v", localRoot, err)
+	}
+
+	hasher := sha1.New()
+	fmt.Fprintf(hasher, "%s\n%s\n%s", hostURI, username, absRoot)
+	return filepath.Join(indexDir, "index_"+hex.EncodeToString(hasher.Sum(nil))[:16]+".db"), nil
+}
+
+// OpenSyncIndex opens the sync index database at indexPath, creating it if necessary.
+func OpenSyncIndex(indexPath string) (*SyncIndex, error) {
+	err := os.MkdirAll(filepath.Dir(indexPath), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the directory for the sync index %s: %v", indexPath, err)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open the sync index %s: %v", indexPath, err)
+	}
+
+	for _, ddl := range []string{createLocalFilesTable, createRemoteNamesTable, createRemoteFilesTable, createRemoteRevisionTable} {
+		_, err = db.Exec(ddl)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		var rows *sql.Rows
+		rows, err = db.Query(checkLocalFilesChunking)
+		if err == nil {
+			rows.Close()
+		} else {
+			_, err = db.Exec(addLocalFilesChunking)
+		}
+	}
+	if err == nil {
+		var rows *sql.Rows
+		rows, err = db.Query(checkLocalFilesSyncedHash)
+		if err == nil {
+			rows.Close()
+		} else {
+			_, err = db.Exec(addLocalFilesSyncedHash)
+			if err == nil {
+				_, err = db.Exec(setLocalFilesSyncedHash)
+			}
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to create the tables for the sync index %s: %v", indexPath, err)
+	}
+
+	idx := new(SyncIndex)
+	idx.db = db
+	return idx, nil
+}
+
+// Close releases the connection to the sync index database.
+func (idx *SyncIndex) Close() error {
+	return idx.db.Close()
+}
+
+// GetEntry returns the entry for the local file path or nil if the file isn't in the index.
+func (idx *SyncIndex) GetEntry(path string) (*SyncIndexEntry, error) {
+	e := new(SyncIndexEntry)
+	e.Path = path
+	var inode int64
+	err := idx.db.QueryRow(getLocalFile, path).Scan(&e.Size, &e.ModTime, &inode, &e.ChunkSize,
+		&e.ChunkCount, &e.FileHash, &e.HashAlgo, &e.RemoteFileID, &e.RemoteVersionID, &e.Chunking, &e.SyncedHash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to get the sync index entry for %s: %v", path, err)
+	}
+	e.Inode = uint64(inode)
+
+	return e, nil
+}
+
+// PutEntry adds the entry to the index, replacing any entry with the same path.
+func (idx *SyncIndex) PutEntry(e *SyncIndexEntry) error {
+	_, err := idx.db.Exec(setLocalFile, e.Path, e.Size, e.ModTime, int64(e.Inode), e.ChunkSize,
+		e.ChunkCount, e.FileHash, e.HashAlgo, e.RemoteFileID, e.RemoteVersionID, e.Chunking, e.SyncedHash)
+	if err != nil {
+		return fmt.Errorf("Failed to set the sync index entry for %s: %v", e.Path, err)
+	}
+	return nil
+}
+
+// GetRemoteName returns the cached plaintext name for the remote file id if it was
+// cached for the same encrypted name. The returned bool is false if it wasn't.
+func (idx *SyncIndex) GetRemoteName(fileID int, encryptedName string) (string, bool, error) {
+	var name string
+	err := idx.db.QueryRow(getRemoteName, fileID, encryptedName).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("Failed to get the cached name for remote file id %d: %v", fileID, err)
+	}
+	return name, true, nil
+}
+
+// PutRemoteName caches the plaintext name for the remote file id and encrypted name.
+func (idx *SyncIndex) PutRemoteName(fileID int, encryptedName string, name string) error {
+	_, err := idx.db.Exec(setRemoteName, fileID, encryptedName, name)
+	if err != nil {
+		return fmt.Errorf("Failed to cache the name for remote file id %d: %v", fileID, err)
+	}
+	return nil
+}
+
+// GetRemoteFiles returns the remote files cached by PutRemoteFiles and the revision
+// they're current as of. The revision is -1 if nothing has been cached yet.
+func (idx *SyncIndex) GetRemoteFiles() (revision int, files []filefreezer.FileInfo, e error) {
+	err := idx.db.QueryRow(getRemoteRevision).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return -1, nil, nil
+	} else if err != nil {
+		return 0, nil, fmt.Errorf("Failed to get the cached remote revision: %v", err)
+	}
+
+	rows, err := idx.db.Query(getRemoteFiles)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Failed to get the cached remote files: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var info string
+		err = rows.Scan(&info)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Failed to get the cached remote files: %v", err)
+		}
+		var fi filefreezer.FileInfo
+		err = json.Unmarshal([]byte(info), &fi)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Failed to parse a cached remote file: %v", err)
+		}
+		files = append(files, fi)
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, nil, fmt.Errorf("Failed to get the cached remote files: %v", err)
+	}
+
+	return revision, files, nil
+}
+
+// PutRemoteFiles updates the cached remote files to be current as of revision by
+// replacing the changed files and removing the removed file ids. If reset is true,
+// all of the cached files are replaced by the changed files instead.
+func (idx *SyncIndex) PutRemoteFiles(revision int, changed []filefreezer.FileInfo, removed []int, reset bool) error {
+	tx, err := idx.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Failed to begin updating the cached remote files: %v", err)
+	}
+
+	err = func() error {
+		if reset {
+			_, err := tx.Exec(removeRemoteFiles)
+			if err != nil {
+				return err
+			}
+		}
+		for _, fileID := range removed {
+			_, err := tx.Exec(removeRemoteFile, fileID)
+			if err != nil {
+				return err
+			}
+		}
+		for _, fi := range changed {
+			info, err := json.Marshal(fi)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(setRemoteFile, fi.FileID, string(info))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(clearRemoteRevision)
+		if err == nil {
+			_, err = tx.Exec(setRemoteRevision, revision)
+		}
+		return err
+	}()
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Failed to update the cached remote files: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to update the cached remote files: %v", err)
+	}
+	return nil
+}
+
+// newSyncIndexEntry creates a new index entry for the local file that hasn't been synced yet.
+// Use keepSync to carry over the last sync from the file's previous entry.
+func newSyncIndexEntry(absPath string, fileInfo os.FileInfo, chunkSize int64, chunking string, chunkCount int, fileHash string, hashAlgo string) *SyncIndexEntry {
+	e := new(SyncIndexEntry)
+	e.Path = absPath
+	e.Size = fileInfo.Size()
+	e.ModTime = fileInfo.ModTime().UnixNano()
+	e.Inode = fileInode(fileInfo)
+	e.ChunkSize = chunkSize
+	e.Chunking = chunking
+	e.ChunkCount = chunkCount
+	e.FileHash = fileHash
+	e.HashAlgo = hashAlgo
+	return e
+}
+
+// keepSync copies the remote file version the local file was last synced with, and
+// the hash it had then, from the previous entry for the file so that a file that was
+// changed locally can still be compared with the version it was synced with. Nothing
+// is copied if previous is nil or its hash was calculated with another algorithm.
+func (e *SyncIndexEntry) keepSync(previous *SyncIndexEntry) {
+	if previous == nil || previous.HashAlgo != e.HashAlgo {
+		return
+	}
+	e.RemoteFileID = previous.RemoteFileID
+	e.RemoteVersionID = previous.RemoteVersionID
+	e.SyncedHash = previous.SyncedHash
+}
+
+// matches returns true if the entry was recorded for the file with the stat data,
+// chunk size and chunking mode given, meaning the file hasn't changed since it was
+// hashed, and the recorded hash uses the current hash algorithm.
+func (e *SyncIndexEntry) matches(fileInfo os.FileInfo, chunkSize int64, chunking string) bool {
+	return e.HashAlgo == filefreezer.HashAlgoHMACSHA256 &&
+		e.Size == fileInfo.Size() &&
+		e.ModTime == fileInfo.ModTime().UnixNano() &&
+		e.Inode == fileInode(fileInfo) &&
+		e.ChunkSize == chunkSize &&
+		e.Chunking == chunking
+}
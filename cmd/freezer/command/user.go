@@ -86,12 +86,38 @@ func (s *State) ModUser(store *filefreezer.Storage, username string, newQuota in
 	return nil
 }
 
+// SetUserAdmin grants or revokes the admin rights of a user in the database. Admins
+// can manage the other users remotely through the admin API of the server.
+func (s *State) SetUserAdmin(store *filefreezer.Storage, username string, isAdmin bool) error {
+	user, err := store.GetUser(username)
+	if err != nil {
+		return fmt.Errorf("Failed to get an existing user with the name %s: %v", username, err)
+	}
+
+	err = store.SetUserAdmin(user.ID, isAdmin)
+	if err != nil {
+		return fmt.Errorf("Failed to set the admin rights for the user %s: %v", username, err)
+	}
+
+	if isAdmin {
+		s.Println("User is now an admin")
+	} else {
+		s.Println("User is no longer an admin")
+	}
+	return nil
+}
+
 // GetUserStats returns a UserStats object for the authenticated user
 // in the command State. A non-nil error value is returned on failure.
 func (s *State) GetUserStats() (stats filefreezer.UserStats, e error) {
 	// get the file id for the filename provided
 	target := fmt.Sprintf("%s/api/user/stats", s.HostURI)
-	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	body, err := s.RunAuthRequest(target, "GET", s.authToken(), nil)
+	if err != nil {
+		e = fmt.Errorf("Failed to get the user stats: %v", err)
+		return
+	}
+
 	var r models.UserStatsGetResponse
 	err = json.Unmarshal(body, &r)
 	if err != nil {
@@ -112,7 +138,7 @@ func (s *State) GetUserStats() (stats filefreezer.UserStats, e error) {
 // returned on failure.
 func (s *State) GetAllFileHashes() ([]filefreezer.FileInfo, error) {
 	target := fmt.Sprintf("%s/api/files", s.HostURI)
-	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	body, err := s.RunAuthRequest(target, "GET", s.authToken(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -126,24 +152,161 @@ func (s *State) GetAllFileHashes() ([]filefreezer.FileInfo, error) {
 	return allFiles.Files, nil
 }
 
+// GetChanges returns the changes made to the files of the authenticated user in
+// the command State since the revision given. A non-nil error value is returned
+// on failure.
+func (s *State) GetChanges(since int) (*models.ChangesGetResponse, error) {
+	target := fmt.Sprintf("%s/api/changes?since=%d", s.HostURI, since)
+	body, err := s.RunAuthRequest(target, "GET", s.authToken(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes models.ChangesGetResponse
+	err = json.Unmarshal(body, &changes)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %v", target, err)
+	}
+
+	return &changes, nil
+}
+
 // SetCryptoHashForPassword sets the hash of the hash of the plaintext password on
 // the server for the authenticated user in the command State. This can then
 // be used to ensure the plaintext password entered by a user is the correct one
 // to decrypt the files without actually storing the crypto key (the hashed plaintext
-// password) on the server. A non-nil error value is returned on failure.
+// password) on the server. A new random master key is generated to encrypt the
+// files with and is stored on the server wrapped by the key derived from the
+// password. A non-nil error value is returned on failure.
 func (s *State) SetCryptoHashForPassword(cryptoPassword string) error {
+	masterKey, err := filefreezer.GenMasterKey()
+	if err != nil {
+		return fmt.Errorf("Failed to generate the master key: %v", err)
+	}
+
+	err = s.putCryptoPassword(cryptoPassword, masterKey)
+	if err != nil {
+		return err
+	}
+
+	s.Println("Hash of cryptography password updated successfully.")
+	return nil
+}
+
+// UnlockCryptoKey verifies the plaintext password against the crypto hash in the command
+// State and then sets CryptoKey to the master key unwrapped with the key derived from
+// the password. Accounts without a wrapped master key use the derived key directly.
+// A non-nil error value is returned if the password is invalid or on failure.
+func (s *State) UnlockCryptoKey(cryptoPassword string) error {
+	passKey, err := filefreezer.VerifyCryptoPassword(cryptoPassword, string(s.CryptoHash))
+	if err != nil {
+		return err
+	}
+	if passKey == nil {
+		return fmt.Errorf("the cryptography password supplied is invalid")
+	}
+
+	// accounts that set their password before the master keys were wrapped
+	// encrypted everything with the key derived from the password
+	if len(s.WrappedKey) == 0 {
+		s.CryptoKey = passKey
+		return nil
+	}
+
+	masterKey, err := filefreezer.UnwrapKey(passKey, s.WrappedKey)
+	if err != nil {
+		return fmt.Errorf("Failed to unwrap the master key with the cryptography password: %v", err)
+	}
+	s.CryptoKey = masterKey
+	return nil
+}
+
+// ChangeCryptoPassword changes the cryptography password for the authenticated user
+// in the command State from oldPassword to newPassword. Only the master key gets
+// wrapped again with the new password so all of the data already stored on the server
+// stays readable. For accounts without a wrapped master key, the key derived from the
+// old password becomes the master key. A non-nil error value is returned on failure.
+func (s *State) ChangeCryptoPassword(oldPassword string, newPassword string) error {
+	err := s.UnlockCryptoKey(oldPassword)
+	if err != nil {
+		return err
+	}
+
+	err = s.putCryptoPassword(newPassword, s.CryptoKey)
+	if err != nil {
+		return err
+	}
+
+	s.Println("Cryptography password changed successfully.")
+	return nil
+}
+
+// ExportRecoveryKey verifies the crypto password for the authenticated user in the command
+// State and returns the master key encoded as a recovery phrase. The phrase can later be
+// passed to RestoreCryptoPassword to set a new crypto password if this one is forgotten.
+// Anyone with the phrase can decrypt the user's data so it must be kept somewhere safe.
+func (s *State) ExportRecoveryKey(cryptoPassword string) (string, error) {
+	err := s.UnlockCryptoKey(cryptoPassword)
+	if err != nil {
+		return "", err
+	}
+	return filefreezer.EncodeRecoveryKey(s.CryptoKey), nil
+}
+
+// RestoreCryptoPassword sets newPassword as the crypto password for the authenticated user
+// in the command State using the master key from a recovery phrase created by ExportRecoveryKey
+// instead of the current crypto password. If the user has files stored on the server, the
+// recovered key must be able to decrypt their names. A non-nil error value is returned on failure.
+func (s *State) RestoreCryptoPassword(recoveryPhrase string, newPassword string) error {
+	masterKey, err := filefreezer.DecodeRecoveryKey(recoveryPhrase)
+	if err != nil {
+		return err
+	}
+
+	// make sure the recovery key is the one the stored data was encrypted with
+	// before replacing the crypto password
+	allFiles, err := s.GetAllFileHashes()
+	if err != nil {
+		return fmt.Errorf("Failed to get the files for the user: %v", err)
+	}
+	s.CryptoKey = masterKey
+	if len(allFiles) > 0 {
+		_, err = s.DecryptString(allFiles[0].FileName)
+		if err != nil {
+			s.CryptoKey = nil
+			return fmt.Errorf("the recovery key does not decrypt the files stored for the user")
+		}
+	}
+
+	err = s.putCryptoPassword(newPassword, masterKey)
+	if err != nil {
+		return err
+	}
+
+	s.Println("Cryptography password restored successfully.")
+	return nil
+}
+
+// putCryptoPassword stores the hash of the crypto password and the master key wrapped
+// by the key derived from the password on the server and updates the command State.
+func (s *State) putCryptoPassword(cryptoPassword string, masterKey []byte) error {
 	// first we derive the crypto password bytes that are derived from the password text
-	_, _, combinedHashString, err := filefreezer.GenCryptoPasswordHash(cryptoPassword, true, "")
+	passKey, _, combinedHashString, err := filefreezer.GenCryptoPasswordHash(cryptoPassword, true, "")
 	if err != nil {
 		return fmt.Errorf("Failed to generate the cryptography key from the password: %v", err)
 	}
 
+	wrappedKey, err := filefreezer.WrapKey(passKey, masterKey)
+	if err != nil {
+		return fmt.Errorf("Failed to wrap the master key: %v", err)
+	}
+
 	var putReq models.UserCryptoHashUpdateRequest
 	putReq.CryptoHash = []byte(combinedHashString)
+	putReq.WrappedKey = wrappedKey
 
-	// get the file id for the filename provided
 	target := fmt.Sprintf("%s/api/user/cryptohash", s.HostURI)
-	body, err := s.RunAuthRequest(target, "PUT", s.AuthToken, putReq)
+	body, err := s.RunAuthRequest(target, "PUT", s.authToken(), putReq)
 	if err != nil {
 		return fmt.Errorf("http request to set the user's cryptohash failed: %v", err)
 	}
@@ -159,6 +322,7 @@ func (s *State) SetCryptoHashForPassword(cryptoPassword string) error {
 	}
 
 	s.CryptoHash = putReq.CryptoHash
-	s.Println("Hash of cryptography password updated successfully.")
+	s.WrappedKey = putReq.WrappedKey
+	s.CryptoKey = masterKey
 	return nil
 }
@@ -0,0 +1,69 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"sync"
+)
+
+// chunkJobFunc is called by the workers in runChunkJobs for each chunk number.
+// worker is the index of the worker goroutine making the call so that
+// each worker can reuse its own buffers between calls.
+type chunkJobFunc func(worker int, chunkNumber int) error
+
+// runChunkJobs calls jobFunc for each of the chunk numbers using a pool of at most
+// jobs worker goroutines. Once jobFunc returns an error no more chunks are started,
+// and after the chunks already in progress finish, the first error is returned.
+func runChunkJobs(jobs int, chunkNumbers []int, jobFunc chunkJobFunc) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	if jobs > len(chunkNumbers) {
+		jobs = len(chunkNumbers)
+	}
+
+	var firstErr error
+	var errOnce sync.Once
+	cancel := make(chan struct{})
+	work := make(chan int)
+
+	// feed the chunk numbers to the workers until they run out or a worker fails
+	go func() {
+		defer close(work)
+		for _, i := range chunkNumbers {
+			select {
+			case work <- i:
+			case <-cancel:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(jobs)
+	for w := 0; w < jobs; w++ {
+		go func(worker int) {
+			defer wg.Done()
+			for i := range work {
+				// drain the remaining chunks without running them after a failure
+				select {
+				case <-cancel:
+					continue
+				default:
+				}
+
+				err := jobFunc(worker, i)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						close(cancel)
+					})
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,303 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	// defaultListenAddr is the net address the server listens to if it isn't set
+	defaultListenAddr = ":8080"
+
+	// defaultChunkSize is the number of bytes in a file chunk if it isn't set
+	defaultChunkSize = 4 * 1024 * 1024
+
+	// defaultUserQuota is the quota in bytes for new users if it isn't set
+	defaultUserQuota = 1000000000
+)
+
+// serverConfig holds the settings for the serve command. They're read from the
+// config file and then any flags or environment variables that were set override them.
+type serverConfig struct {
+	// Listen is the net address for the server to listen to
+	Listen string `toml:"listen"`
+
+	// DB is the database path to use for storing all of the data
+	DB string `toml:"db"`
+
+	// ChunkStore is the directory to store file chunks in; chunks are stored
+	// in the database if it's empty
+	ChunkStore string `toml:"chunkstore"`
+
+	// ChunkSize is the number of bytes contained in one chunk
+	ChunkSize int64 `toml:"chunksize"`
+
+	// DefaultQuota is the quota in bytes for users added through the admin API
+	// without one
+	DefaultQuota int `toml:"defaultquota"`
+
+	// UploadLifetime is how long an upload session is kept after the last chunk
+	// arrives before it's abandoned and its file version removed
+	UploadLifetime configDuration `toml:"uploadlifetime"`
+
+	// ShutdownDrain is how long the server keeps taking requests after it's told
+	// to shut down while /readyz reports that it isn't ready
+	ShutdownDrain configDuration `toml:"shutdowndrain"`
+
+	// TrustedProxies are the IP addresses or CIDR ranges of the reverse proxies in
+	// front of the server. The client's address is only taken from the X-Forwarded-For
+	// or X-Real-IP headers of requests that come from one of them.
+	TrustedProxies []string `toml:"trustedproxies"`
+
+	TLS       serverTLSConfig       `toml:"tls"`
+	Tokens    serverTokenConfig     `toml:"tokens"`
+	Metrics   serverMetricsConfig   `toml:"metrics"`
+	RateLimit serverRateLimitConfig `toml:"ratelimit"`
+	Logging   serverLoggingConfig   `toml:"logging"`
+}
+
+// serverTLSConfig has the key files used to serve HTTPS; plain HTTP is served
+// if either is empty.
+type serverTLSConfig struct {
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+
+	// ClientCA is the file with the PEM encoded CA certificates that client
+	// certificates are verified against; client certificates are ignored if
+	// it's empty
+	ClientCA string `toml:"clientca"`
+
+	// RequireClientCert makes the server refuse connections from clients that
+	// don't present a certificate signed by ClientCA
+	RequireClientCert bool `toml:"requireclientcert"`
+
+	// ClientUsers maps the subject common names of client certificates to the
+	// users they can log in as without a password. If it's empty, the common
+	// name is used as the username.
+	ClientUsers map[string]string `toml:"clientusers"`
+}
+
+// serverTokenConfig has the settings for the authentication tokens.
+type serverTokenConfig struct {
+	// JWTKey is the file with the key used to sign the authentication tokens
+	JWTKey string `toml:"jwtkey"`
+
+	// Lifetime is how long the authentication tokens stay valid
+	Lifetime configDuration `toml:"lifetime"`
+
+	// RefreshLifetime is how long the refresh tokens can be used
+	RefreshLifetime configDuration `toml:"refreshlifetime"`
+}
+
+// serverMetricsConfig has the settings for the Prometheus metrics endpoint.
+type serverMetricsConfig struct {
+	// Listen is the net address to serve the metrics on; they aren't served
+	// if it's empty. It should not be reachable publicly.
+	Listen string `toml:"listen"`
+}
+
+// serverRateLimitConfig has the settings that limit how fast clients can make
+// requests. A rate or threshold of 0 turns that limit off.
+type serverRateLimitConfig struct {
+	// LoginRate is the number of logins and token refreshes allowed per minute
+	// from each IP address and the number of logins allowed per minute for each
+	// username. LoginBurst is how many can be made at once.
+	LoginRate  int `toml:"loginrate"`
+	LoginBurst int `toml:"loginburst"`
+
+	// RequestRate is the number of authenticated API requests allowed per minute
+	// for each user. RequestBurst is how many can be made at once.
+	RequestRate  int `toml:"requestrate"`
+	RequestBurst int `toml:"requestburst"`
+
+	// LockoutThreshold is the number of failed logins in a row after which the
+	// username is locked out for LockoutBase. Each further failure doubles the
+	// lockout up to LockoutMax.
+	LockoutThreshold int            `toml:"lockoutthreshold"`
+	LockoutBase      configDuration `toml:"lockoutbase"`
+	LockoutMax       configDuration `toml:"lockoutmax"`
+}
+
+// defaultRateLimitConfig returns the rate limits used for settings that aren't
+// in the config file.
+func defaultRateLimitConfig() serverRateLimitConfig {
+	return serverRateLimitConfig{
+		LoginRate:        20,
+		LoginBurst:       10,
+		RequestRate:      1200,
+		RequestBurst:     200,
+		LockoutThreshold: 5,
+		LockoutBase:      configDuration(30 * time.Second),
+		LockoutMax:       configDuration(time.Hour),
+	}
+}
+
+// serverLoggingConfig has the settings for the server's console output and logs.
+type serverLoggingConfig struct {
+	Quiet bool `toml:"quiet"`
+
+	// Requests is the file the JSON request logs are appended to; they're
+	// written to stdout if it's "-" and not written at all if it's empty
+	Requests string `toml:"requests"`
+}
+
+// configDuration is a time.Duration that is written in the config file
+// as a string like "15m" or "720h".
+type configDuration time.Duration
+
+// UnmarshalText parses the duration string from the config file.
+func (d *configDuration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = configDuration(v)
+	return nil
+}
+
+// MarshalText writes the duration as a string for the config file.
+func (d configDuration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// serverFlagsSet records which of the flags that override the config file were
+// passed on the command line.
+var serverFlagsSet struct {
+	db, chunkStore, tlsKey, tlsCrt, quiet                   bool
+	chunkSize, defaultQuota, jwtKey, tokenLife, refreshLife bool
+	metrics, clientCA, requireClientCert, requestLog        bool
+}
+
+// setByUser returns a flag Action that records in set that the flag was passed on
+// the command line; kingpin only runs the actions of the flags that were passed.
+func setByUser(set *bool) kingpin.Action {
+	return func(*kingpin.ParseContext) error {
+		*set = true
+		return nil
+	}
+}
+
+// overridesConfig returns true if a flag was passed on the command line or
+// its environment variable was set so that it should override the config file.
+func overridesConfig(setByUser bool, envar string) bool {
+	return setByUser || os.Getenv(envar) != ""
+}
+
+// loadServerConfig returns the configuration for the server. The values start out
+// as the flag defaults, are replaced by the ones in the config file if one was
+// specified and then by any flags or environment variables that were set.
+func loadServerConfig() (*serverConfig, error) {
+	cfg := new(serverConfig)
+	cfg.Listen = *argServeListenAddr
+	cfg.DB = *flagDatabasePath
+	cfg.ChunkStore = *flagChunkStore
+	cfg.ChunkSize = *flagServeChunkSize
+	cfg.DefaultQuota = *flagServeDefaultQuota
+	cfg.TLS.Cert = *flagTLSCrt
+	cfg.TLS.Key = *flagTLSKey
+	cfg.TLS.ClientCA = *flagServeClientCA
+	cfg.TLS.RequireClientCert = *flagServeRequireCert
+	cfg.Tokens.JWTKey = *flagServeJWTKey
+	cfg.Tokens.Lifetime = configDuration(*flagServeTokenLife)
+	cfg.Tokens.RefreshLifetime = configDuration(*flagServeRefreshLife)
+	cfg.Metrics.Listen = *flagServeMetrics
+	cfg.RateLimit = defaultRateLimitConfig()
+	cfg.Logging.Quiet = *flagQuiet
+	cfg.Logging.Requests = *flagServeRequestLog
+
+	if *flagServeConfig == "" {
+		return normalizeServerConfig(cfg), nil
+	}
+
+	_, err := toml.DecodeFile(*flagServeConfig, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the config file %s: %v", *flagServeConfig, err)
+	}
+
+	if *argServeListenAddr != "" {
+		cfg.Listen = *argServeListenAddr
+	}
+	if overridesConfig(serverFlagsSet.db, "FREEZER_DB") {
+		cfg.DB = *flagDatabasePath
+	}
+	if overridesConfig(serverFlagsSet.chunkStore, "FREEZER_CHUNKSTORE") {
+		cfg.ChunkStore = *flagChunkStore
+	}
+	if overridesConfig(serverFlagsSet.chunkSize, "FREEZER_CHUNKSIZE") {
+		cfg.ChunkSize = *flagServeChunkSize
+	}
+	if overridesConfig(serverFlagsSet.defaultQuota, "FREEZER_DEFAULTQUOTA") {
+		cfg.DefaultQuota = *flagServeDefaultQuota
+	}
+	if overridesConfig(serverFlagsSet.tlsCrt, "FREEZER_TLSCERT") {
+		cfg.TLS.Cert = *flagTLSCrt
+	}
+	if overridesConfig(serverFlagsSet.tlsKey, "FREEZER_TLSKEY") {
+		cfg.TLS.Key = *flagTLSKey
+	}
+	if overridesConfig(serverFlagsSet.clientCA, "FREEZER_CLIENTCA") {
+		cfg.TLS.ClientCA = *flagServeClientCA
+	}
+	if overridesConfig(serverFlagsSet.requireClientCert, "FREEZER_REQUIRECLIENTCERT") {
+		cfg.TLS.RequireClientCert = *flagServeRequireCert
+	}
+	if overridesConfig(serverFlagsSet.jwtKey, "FREEZER_JWTKEY") {
+		cfg.Tokens.JWTKey = *flagServeJWTKey
+	}
+	if overridesConfig(serverFlagsSet.tokenLife, "FREEZER_TOKENLIFE") {
+		cfg.Tokens.Lifetime = configDuration(*flagServeTokenLife)
+	}
+	if overridesConfig(serverFlagsSet.refreshLife, "FREEZER_REFRESHLIFE") {
+		cfg.Tokens.RefreshLifetime = configDuration(*flagServeRefreshLife)
+	}
+	if overridesConfig(serverFlagsSet.metrics, "FREEZER_METRICS") {
+		cfg.Metrics.Listen = *flagServeMetrics
+	}
+	if overridesConfig(serverFlagsSet.quiet, "FREEZER_QUIET") {
+		cfg.Logging.Quiet = *flagQuiet
+	}
+	if overridesConfig(serverFlagsSet.requestLog, "FREEZER_REQUESTLOG") {
+		cfg.Logging.Requests = *flagServeRequestLog
+	}
+
+	return normalizeServerConfig(cfg), nil
+}
+
+// normalizeServerConfig replaces the settings that were left empty with their defaults.
+func normalizeServerConfig(cfg *serverConfig) *serverConfig {
+	if cfg.Listen == "" {
+		cfg.Listen = defaultListenAddr
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = defaultChunkSize
+	}
+	if cfg.DefaultQuota <= 0 {
+		cfg.DefaultQuota = defaultUserQuota
+	}
+	if cfg.Tokens.Lifetime <= 0 {
+		cfg.Tokens.Lifetime = configDuration(defaultAccessTokenLifetime)
+	}
+	if cfg.Tokens.RefreshLifetime <= 0 {
+		cfg.Tokens.RefreshLifetime = configDuration(defaultRefreshTokenLifetime)
+	}
+	if cfg.UploadLifetime <= 0 {
+		cfg.UploadLifetime = configDuration(defaultUploadLifetime)
+	}
+	if cfg.ShutdownDrain <= 0 {
+		cfg.ShutdownDrain = configDuration(defaultShutdownDrain)
+	}
+	return cfg
+}
+
+// write writes the configuration to w in the config file format.
+func (cfg *serverConfig) write(w io.Writer) error {
+	return toml.NewEncoder(w).Encode(cfg)
+}
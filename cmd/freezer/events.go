@@ -0,0 +1,196 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+)
+
+const (
+	// eventBufferSize is how many events can be waiting to be sent to a stream
+	// before the stream is closed for falling behind
+	eventBufferSize = 256
+
+	// eventKeepAlive is how often a comment is sent on an idle event stream so
+	// that proxies don't close it
+	eventKeepAlive = 30 * time.Second
+)
+
+// eventSubscription is an event stream open for a user.
+type eventSubscription struct {
+	userID int
+	events chan models.Event
+}
+
+// eventHub sends the events for a user to all of the event streams the user
+// has open. A stream that falls behind is closed; the client reconnects and
+// gets the changes it missed from /api/changes.
+type eventHub struct {
+	lock   sync.Mutex
+	subs   map[int]map[*eventSubscription]bool
+	closed bool
+}
+
+// newEventHub creates a new eventHub without any subscriptions.
+func newEventHub() *eventHub {
+	h := new(eventHub)
+	h.subs = make(map[int]map[*eventSubscription]bool)
+	return h
+}
+
+// subscribe opens a new event stream for the user. The events channel of the
+// subscription is closed when the hub closes or the stream falls behind.
+func (h *eventHub) subscribe(userID int) *eventSubscription {
+	sub := &eventSubscription{userID: userID, events: make(chan models.Event, eventBufferSize)}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		close(sub.events)
+		return sub
+	}
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[*eventSubscription]bool)
+	}
+	h.subs[userID][sub] = true
+	return sub
+}
+
+// unsubscribe removes the subscription from the hub if it's still there.
+func (h *eventHub) unsubscribe(sub *eventSubscription) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.remove(sub)
+}
+
+// remove closes the subscription and removes it from the hub; the lock must be held.
+func (h *eventHub) remove(sub *eventSubscription) {
+	userSubs := h.subs[sub.userID]
+	if !userSubs[sub] {
+		return
+	}
+	close(sub.events)
+	delete(userSubs, sub)
+	if len(userSubs) == 0 {
+		delete(h.subs, sub.userID)
+	}
+}
+
+// publish sends the event to all of the user's event streams without waiting.
+func (h *eventHub) publish(userID int, event models.Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for sub := range h.subs[userID] {
+		select {
+		case sub.events <- event:
+		default:
+			h.remove(sub)
+		}
+	}
+}
+
+// publishChange sends a change to the user's files as an event. It is meant
+// to be used as the ChangeObserver for the filefreezer Storage.
+func (h *eventHub) publishChange(userID int, change filefreezer.FileChange) {
+	h.publish(userID, models.Event{
+		Event:     change.Change,
+		Revision:  change.Revision,
+		FileID:    change.FileID,
+		VersionID: change.VersionID,
+	})
+}
+
+// close closes all of the event streams so that the server can shut down and
+// stops any more from being opened.
+func (h *eventHub) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	for _, userSubs := range h.subs {
+		for sub := range userSubs {
+			h.remove(sub)
+		}
+	}
+}
+
+// writeEvent writes the event to the stream in the Server-Sent Events format.
+func writeEvent(res *echo.Response, event models.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Event, data)
+	if err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
+
+// handleGetEvents streams the events for the authenticated user's files as
+// Server-Sent Events until the client disconnects. The first event is always
+// EventReady with the user's current revision. The stream is closed when the
+// authentication token expires so that the client reconnects with a new one.
+func handleGetEvents(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// subscribe before getting the revision so that no change is missed in between
+		sub := state.Events.subscribe(claims.UserID)
+		defer state.Events.unsubscribe(sub)
+
+		stats, err := state.Storage.GetUserStats(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to get the user stats information for the authenticated user.")
+		}
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set("Cache-Control", "no-cache")
+		res.WriteHeader(http.StatusOK)
+		err = writeEvent(res, models.Event{Event: models.EventReady, Revision: stats.Revision})
+		if err != nil {
+			return nil
+		}
+
+		var expired <-chan time.Time
+		if claims.ExpiresAt > 0 {
+			expiry := time.NewTimer(time.Until(time.Unix(claims.ExpiresAt, 0)))
+			defer expiry.Stop()
+			expired = expiry.C
+		}
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		done := c.Request().Context().Done()
+
+		for {
+			select {
+			case event, ok := <-sub.events:
+				if !ok {
+					return nil
+				}
+				err = writeEvent(res, event)
+			case <-keepAlive.C:
+				_, err = fmt.Fprint(res, ": keep-alive\n\n")
+				res.Flush()
+			case <-expired:
+				return nil
+			case <-done:
+				return nil
+			}
+			if err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -7,10 +7,14 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime/pprof"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/tbogdala/filefreezer"
@@ -24,27 +28,54 @@ import (
 // User kingpin to define a set of commands and flags for the application.
 var (
 	appFlags         = kingpin.New("freezer", "A command-line interface to filefreezer able to act as client or server.")
-	flagDatabasePath = appFlags.Flag("db", "The database path to use for storing all of the data.").Default("file:freezer.db").String()
-	flagTLSKey       = appFlags.Flag("tlskey", "The HTTPS TLS private key file to be used by the server.").String()
-	flagTLSCrt       = appFlags.Flag("tlscert", "The HTTPS TLS public crt file to be used by the server.").String()
+	flagDatabasePath = appFlags.Flag("db", "The database path to use for storing all of the data.").Default("file:freezer.db").Envar("FREEZER_DB").Action(setByUser(&serverFlagsSet.db)).String()
+	flagChunkStore   = appFlags.Flag("chunkstore", "The directory to store file chunks in; chunks are stored in the database if not set.").Envar("FREEZER_CHUNKSTORE").Action(setByUser(&serverFlagsSet.chunkStore)).String()
+	flagTLSKey       = appFlags.Flag("tlskey", "The HTTPS TLS private key file to be used by the server.").Envar("FREEZER_TLSKEY").Action(setByUser(&serverFlagsSet.tlsKey)).String()
+	flagTLSCrt       = appFlags.Flag("tlscert", "The HTTPS TLS public crt file to be used by the server.").Envar("FREEZER_TLSCERT").Action(setByUser(&serverFlagsSet.tlsCrt)).String()
 	flagExtraStrict  = appFlags.Flag("xs", "File checking should be extra strict on file sync comparisons.").Default("true").Bool()
 	flagUserName     = appFlags.Flag("user", "The username for user.").Short('u').String()
 	flagUserPass     = appFlags.Flag("pass", "The password for user.").Short('p').String()
 	flagCryptoPass   = appFlags.Flag("crypt", "The passwod used for cryptography.").Short('s').String()
 	flagHost         = appFlags.Flag("host", "The host URL for the server to contact.").Short('h').String()
 	flagCPUProfile   = appFlags.Flag("cpuprofile", "Turns on cpu profiling and stores the result in the file specified by this flag.").String()
-	flagQuiet        = appFlags.Flag("quiet", "Turns off non-fatal error console output for the command.").Bool()
+	flagQuiet        = appFlags.Flag("quiet", "Turns off non-fatal error console output for the command.").Envar("FREEZER_QUIET").Action(setByUser(&serverFlagsSet.quiet)).Bool()
+	flagJobs         = appFlags.Flag("jobs", "The number of file chunks to upload or download at the same time.").Default("4").Int()
+	flagIndexDir     = appFlags.Flag("indexdir", "The directory to keep the sync indexes of local files in; defaults to ~/.filefreezer.").String()
+	flagRehash       = appFlags.Flag("rehash", "Hash all of the local files when syncing even if the sync index has them unchanged.").Bool()
+	flagChunking     = appFlags.Flag("chunking", "How files are split into chunks when uploading them, if the server supports it: fixed or fastcdc.").Default(filefreezer.ChunkingFastCDC).Enum(filefreezer.ChunkingModes...)
+	flagCompression  = appFlags.Flag("compression", "How chunks are compressed before they're encrypted when uploading them: none or gzip.").Default(command.CompressionNone).Enum(command.CompressionModes...)
+	flagConflict     = appFlags.Flag("conflict", "How to resolve a file that changed both locally and on the server since it was last synced: newer, local, remote, keep-both or ask.").Default(command.ConflictNewer).Enum(command.ConflictPolicies...)
+	flagCACert       = appFlags.Flag("cacert", "The file with the CA certificates the client trusts for the server; defaults to the --tlscert file.").Envar("FREEZER_CACERT").String()
+	flagClientCert   = appFlags.Flag("clientcert", "The certificate file the client presents to the server to log in without a password.").Envar("FREEZER_CLIENTCERT").String()
+	flagClientKey    = appFlags.Flag("clientkey", "The private key file for the --clientcert certificate.").Envar("FREEZER_CLIENTKEY").String()
 
 	// Server commands
-	cmdServe           = appFlags.Command("serve", "Adds a new user to the storage.")
-	argServeListenAddr = cmdServe.Arg("http", "The net address to listen to").Default(":8080").String()
-	flagServeChunkSize = cmdServe.Flag("cs", "The number of bytes contained in one chunk.").Default("4194304").Int64() // 4 MB
+	cmdServe              = appFlags.Command("serve", "Runs the filefreezer server.")
+	argServeListenAddr    = cmdServe.Arg("http", "The net address to listen to; defaults to :8080.").Envar("FREEZER_LISTEN").String()
+	flagServeConfig       = cmdServe.Flag("config", "The TOML file to read the server configuration from; flags and environment variables override it.").Envar("FREEZER_CONFIG").String()
+	flagServePrintConfig  = cmdServe.Flag("print-config", "Prints the effective server configuration and exits.").Bool()
+	flagServeChunkSize    = cmdServe.Flag("cs", "The number of bytes contained in one chunk.").Default("4194304").Envar("FREEZER_CHUNKSIZE").Action(setByUser(&serverFlagsSet.chunkSize)).Int64() // 4 MB
+	flagServeDefaultQuota = cmdServe.Flag("quota", "The quota size in bytes for users added by admins without one.").Default("1000000000").Envar("FREEZER_DEFAULTQUOTA").Action(setByUser(&serverFlagsSet.defaultQuota)).Int()
+	flagServeJWTKey       = cmdServe.Flag("jwtkey", "The file with the key used to sign authentication tokens; it is created if it doesn't exist.").Default("freezer.jwtkey").Envar("FREEZER_JWTKEY").Action(setByUser(&serverFlagsSet.jwtKey)).String()
+	flagServeTokenLife    = cmdServe.Flag("tokenlife", "How long the authentication tokens stay valid before they need to be refreshed.").Default("15m").Envar("FREEZER_TOKENLIFE").Action(setByUser(&serverFlagsSet.tokenLife)).Duration()
+	flagServeMetrics      = cmdServe.Flag("metrics", "The net address to serve the Prometheus metrics on; they aren't served if not set.").Envar("FREEZER_METRICS").Action(setByUser(&serverFlagsSet.metrics)).String()
+	flagServeRefreshLife  = cmdServe.Flag("refreshlife", "How long the refresh tokens can be used to get new authentication tokens.").Default("720h").Envar("FREEZER_REFRESHLIFE").Action(setByUser(&serverFlagsSet.refreshLife)).Duration()
+	flagServeClientCA     = cmdServe.Flag("clientca", "The file with the CA certificates that client certificates are verified against.").Envar("FREEZER_CLIENTCA").Action(setByUser(&serverFlagsSet.clientCA)).String()
+	flagServeRequestLog   = cmdServe.Flag("requestlog", "The file to append the JSON request logs to; '-' writes them to stdout and an empty value turns them off.").Default("-").Envar("FREEZER_REQUESTLOG").Action(setByUser(&serverFlagsSet.requestLog)).String()
+	flagServeRequireCert  = cmdServe.Flag("requireclientcert", "Refuse connections from clients without a certificate signed by the client CA.").Envar("FREEZER_REQUIRECLIENTCERT").Action(setByUser(&serverFlagsSet.requireClientCert)).Bool()
+
+	// Database sub-commands
+	cmdDB = appFlags.Command("db", "Database management command.")
+
+	cmdDBMigrate        = cmdDB.Command("migrate", "Updates the storage database to the current version, backing it up first.")
+	flagDBMigrateDryRun = cmdDBMigrate.Flag("dryrun", "Only list the migration steps that would be applied.").Bool()
 
 	// User sub-commands
 	cmdUser = appFlags.Command("user", "User management command.")
 
 	cmdUserAdd       = cmdUser.Command("add", "Adds a new user to the storage.")
 	flagUserAddQuota = cmdUserAdd.Flag("quota", "The quota size in bytes.").Short('q').Default("1000000000").Int()
+	flagUserAddAdmin = cmdUserAdd.Flag("admin", "Allows the user to manage the other users with the admin commands.").Bool()
 
 	cmdUserRm = cmdUser.Command("rm", "Removes a user from the storage system and purges their data.")
 
@@ -52,11 +83,50 @@ var (
 	flagUserModQuota = cmdUserMod.Flag("quota", "New quota size in bytes.").Int()
 	flagUserModName  = cmdUserMod.Flag("name", "New username for the user being modified.").String()
 	flagUserModPass  = cmdUserMod.Flag("password", "New quota size in bytes.").String()
+	flagUserModAdmin = cmdUserMod.Flag("admin", "Grants (true) or revokes (false) the admin rights for the user.").Enum("true", "false")
 
 	cmdUserStats = cmdUser.Command("stats", "Displays the quota, allocation and revision counts for the user.")
 
-	cmdUserCryptoPass    = cmdUser.Command("cryptopass", "Sets the cryptography password for the client.")
-	flagUserCryptoPassPW = cmdUserCryptoPass.Arg("pasword", "New cryptography password.").String()
+	cmdUserCryptoPass       = cmdUser.Command("cryptopass", "Manages the cryptography password for the client.")
+	cmdUserCryptoPassSet    = cmdUserCryptoPass.Command("set", "Sets the cryptography password for the client with a new master key.").Default()
+	flagUserCryptoPassPW    = cmdUserCryptoPassSet.Arg("pasword", "New cryptography password.").String()
+	cmdUserCryptoPassChange = cmdUserCryptoPass.Command("change", "Changes the cryptography password (set with -s) while keeping the stored data readable.")
+	flagUserCryptoPassNewPW = cmdUserCryptoPassChange.Arg("newpassword", "New cryptography password.").String()
+
+	cmdUserRecoveryKey              = cmdUser.Command("recoverykey", "Manages the recovery key for the cryptography password.")
+	cmdUserRecoveryKeyExport        = cmdUserRecoveryKey.Command("export", "Prints the recovery key for the cryptography password (set with -s).")
+	flagUserRecoveryKeyExportOut    = cmdUserRecoveryKeyExport.Flag("out", "Writes the recovery key to this keyfile instead of printing it.").String()
+	cmdUserRecoveryKeyRestore       = cmdUserRecoveryKey.Command("restore", "Sets a new cryptography password using a recovery key.")
+	flagUserRecoveryKeyRestoreIn    = cmdUserRecoveryKeyRestore.Flag("keyfile", "Reads the recovery key from this keyfile instead of prompting for it.").String()
+	flagUserRecoveryKeyRestoreNewPW = cmdUserRecoveryKeyRestore.Arg("newpassword", "New cryptography password.").String()
+
+	// Admin sub-commands that manage the users remotely through the server
+	cmdAdmin     = appFlags.Command("admin", "Remote server administration command; the logged in user must be an admin.")
+	cmdAdminUser = cmdAdmin.Command("user", "Remote user management command.")
+
+	cmdAdminUserList = cmdAdminUser.Command("ls", "Lists the users on the server with their stats.")
+
+	cmdAdminUserAdd       = cmdAdminUser.Command("add", "Adds a new user to the server.")
+	argAdminUserAddName   = cmdAdminUserAdd.Arg("username", "The name of the new user.").Required().String()
+	argAdminUserAddPass   = cmdAdminUserAdd.Arg("password", "The login password for the new user.").String()
+	flagAdminUserAddQuota = cmdAdminUserAdd.Flag("quota", "The quota size in bytes; the server's default quota is used if not set.").Short('q').Int()
+	flagAdminUserAddAdmin = cmdAdminUserAdd.Flag("admin", "Allows the new user to manage the other users with the admin commands.").Bool()
+
+	cmdAdminUserRm     = cmdAdminUser.Command("rm", "Removes a user from the server and purges their data.")
+	argAdminUserRmName = cmdAdminUserRm.Arg("username", "The name of the user to remove.").Required().String()
+
+	cmdAdminUserPasswd     = cmdAdminUser.Command("passwd", "Resets the login password for a user on the server.")
+	argAdminUserPasswdName = cmdAdminUserPasswd.Arg("username", "The name of the user.").Required().String()
+	argAdminUserPasswdPass = cmdAdminUserPasswd.Arg("password", "The new login password for the user.").String()
+
+	cmdAdminUserQuota      = cmdAdminUser.Command("quota", "Sets the quota for a user on the server.")
+	argAdminUserQuotaName  = cmdAdminUserQuota.Arg("username", "The name of the user.").Required().String()
+	argAdminUserQuotaBytes = cmdAdminUserQuota.Arg("quota", "The new quota size in bytes.").Required().Int()
+
+	cmdAdminAudit       = cmdAdmin.Command("audit", "Lists the audit log of logins, file changes and user changes on the server.")
+	argAdminAuditUser   = cmdAdminAudit.Arg("username", "Only list the events for this user.").String()
+	flagAdminAuditSince = cmdAdminAudit.Flag("since", "Only list the events at or after this time: a date (2017-10-31), an RFC3339 time or a duration before now (24h).").String()
+	flagAdminAuditUntil = cmdAdminAudit.Flag("until", "Only list the events at or before this time, in the same formats as --since.").String()
 
 	// File sub-commands
 	cmdFile = appFlags.Command("file", "Basic file management command.")
@@ -90,6 +160,10 @@ var (
 	cmdSyncDir       = appFlags.Command("syncdir", "Synchronizes a directory with the server.")
 	argSyncDirPath   = cmdSyncDir.Arg("dirpath", "The directory to sync with the server.").Required().String()
 	argSyncDirTarget = cmdSyncDir.Arg("target", "The directory path to sync to on the server; defaults to the same as the filename arg.").Default("").String()
+
+	cmdWatch       = appFlags.Command("watch", "Synchronizes a directory with the server and keeps pulling the files that change on the server until interrupted.")
+	argWatchPath   = cmdWatch.Arg("dirpath", "The directory to sync with the server.").Required().String()
+	argWatchTarget = cmdWatch.Arg("target", "The directory path to sync to on the server; defaults to the same as the dirpath arg.").Default("").String()
 )
 
 func fmtPrintln(v ...interface{}) {
@@ -110,17 +184,46 @@ func fmtPrintf(format string, v ...interface{}) {
 
 // openStorage is the common function used to open the filefreezer Storage
 func openStorage() (*filefreezer.Storage, error) {
-	fmtPrintf("Opening database: %s\n", *flagDatabasePath)
+	return openStorageAt(*flagDatabasePath, *flagChunkStore)
+}
+
+// openStorageAt opens the filefreezer Storage with the database path and chunk
+// store directory given and makes sure the tables exist.
+func openStorageAt(dbPath string, chunkStore string) (*filefreezer.Storage, error) {
+	fmtPrintf("Opening database: %s\n", dbPath)
 
 	// open up the storage database
-	store, err := filefreezer.NewStorage(*flagDatabasePath)
+	store, err := filefreezer.NewStorage(dbPath, chunkStore)
 	if err != nil {
 		return nil, err
 	}
-	store.CreateTables()
+	err = store.CreateTables()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
 	return store, nil
 }
 
+// openSyncIndex opens the sync index for the local root directory being synced
+// with the host as the user given.
+func openSyncIndex(host string, username string, localRoot string) (*command.SyncIndex, error) {
+	indexDir := *flagIndexDir
+	if indexDir == "" {
+		var err error
+		indexDir, err = command.DefaultIndexDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	indexPath, err := command.SyncIndexPath(indexDir, host, username, localRoot)
+	if err != nil {
+		return nil, err
+	}
+	return command.OpenSyncIndex(indexPath)
+}
+
 func interactiveGetLoginUser() string {
 	if *flagUserName != "" {
 		return *flagUserName
@@ -145,6 +248,11 @@ func interactiveGetLoginPassword() string {
 		return *flagUserPass
 	}
 
+	// the server logs in users with a client certificate without a password
+	if *flagClientCert != "" && *flagClientKey != "" {
+		return ""
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 
 	for {
@@ -161,6 +269,20 @@ func interactiveGetLoginPassword() string {
 	}
 }
 
+func interactiveGetNewLoginPassword(username string) string {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("New password for %s: ", username)
+		password, _ := reader.ReadString('\n')
+		password = strings.TrimSpace(password)
+
+		// basic validation
+		if password != "" {
+			return password
+		}
+	}
+}
+
 func interactiveGetCryptoPassword() string {
 	if *flagCryptoPass != "" {
 		return *flagCryptoPass
@@ -181,6 +303,40 @@ func interactiveGetCryptoPassword() string {
 	}
 }
 
+func interactiveGetConflictPolicy(localFilename string, remoteFilepath string) string {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("%s changed locally and on the server as %s.\n", localFilename, remoteFilepath)
+		fmt.Print("Keep the newer, local, remote or both files? [newer/local/remote/keep-both]: ")
+		policy, err := reader.ReadString('\n')
+		if err != nil {
+			// nobody is there to answer, so nothing gets overwritten
+			return command.ConflictKeepBoth
+		}
+		policy = strings.TrimSpace(policy)
+
+		// basic validation
+		switch policy {
+		case command.ConflictNewer, command.ConflictLocal, command.ConflictRemote, command.ConflictKeepBoth:
+			return policy
+		}
+	}
+}
+
+func interactiveGetRecoveryKey() string {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("Recovery key: ")
+		recoveryKey, _ := reader.ReadString('\n')
+		recoveryKey = strings.TrimSpace(recoveryKey)
+
+		// basic validation
+		if recoveryKey != "" {
+			return recoveryKey
+		}
+	}
+}
+
 // initCrypto makes sure that the crypto hash has been setup
 // for the user. if the user authenticated and a crypto hash was not returned
 // in the reply, this function prompts the user for the password and makes
@@ -206,17 +362,7 @@ func initCrypto(cmdState *command.State) error {
 
 	// check the crypto password against the stored hash of the key and keep
 	// the resulting crypto key if the verification was successful.
-	var err error
-	cmdState.CryptoKey, err = filefreezer.VerifyCryptoPassword(*flagCryptoPass, string(cmdState.CryptoHash))
-	if err != nil {
-		return err
-	}
-
-	if cmdState.CryptoKey == nil {
-		return fmt.Errorf("the cryptography password supplied is invalid")
-	}
-
-	return nil
+	return cmdState.UnlockCryptoKey(*flagCryptoPass)
 }
 
 func interactiveFirstTimeSetCryptoPassword() string {
@@ -224,13 +370,19 @@ func interactiveFirstTimeSetCryptoPassword() string {
 		return *flagCryptoPass
 	}
 
-	reader := bufio.NewReader(os.Stdin)
 	fmtPrintln("The cryptography password has not been set for this account.")
 	fmtPrintln("Filefreezer will encrypt all data before sending it to the server, but")
 	fmtPrintln("it needs a password to encrypt with. Please enter a secure passphrase")
 	fmtPrintln("below, but keep in mind that the software will have no way of recovering")
 	fmtPrintln("encrypted data from the server if this password is lost.")
 
+	return interactiveGetNewCryptoPassword()
+}
+
+// interactiveGetNewCryptoPassword prompts for a new cryptography password
+// until the same non-empty password is entered twice.
+func interactiveGetNewCryptoPassword() string {
+	reader := bufio.NewReader(os.Stdin)
 	var password1, password2 string
 	verified := false
 	for !verified {
@@ -264,6 +416,26 @@ func interactiveFirstTimeSetCryptoPassword() string {
 	return password1
 }
 
+// parseAuditTime parses the time for the audit log command in Unix seconds. The time
+// can be a date, an RFC3339 time or a duration that's subtracted from now. An empty
+// string returns 0.
+func parseAuditTime(s string, now time.Time) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d).Unix(), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t.Unix(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a date, RFC3339 time or duration", s)
+	}
+	return t.Unix(), nil
+}
+
 func interactiveGetHost() string {
 	var host string
 
@@ -290,10 +462,23 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	cmdState := command.NewState()
-	cmdState.TLSKey = *flagTLSKey
-	cmdState.TLSCrt = *flagTLSCrt
+	cmdState.CACert = *flagCACert
+	if cmdState.CACert == "" {
+		// the server's own certificate is trusted when it's self-signed
+		cmdState.CACert = *flagTLSCrt
+	}
+	cmdState.ClientCert = *flagClientCert
+	cmdState.ClientKey = *flagClientKey
 	cmdState.ExtraStrict = *flagExtraStrict
-	if *flagQuiet {
+	cmdState.Jobs = *flagJobs
+	cmdState.Rehash = *flagRehash
+	cmdState.Chunking = *flagChunking
+	cmdState.Compression = *flagCompression
+	cmdState.Conflict = *flagConflict
+	cmdState.ConflictPrompt = interactiveGetConflictPolicy
+
+	// the config is printed without the banner so that it can be saved to a file
+	if *flagQuiet || *flagServePrintConfig {
 		cmdState.SetQuiet(true)
 	}
 
@@ -319,14 +504,31 @@ func main() {
 
 	switch parsedFlags {
 	case cmdServe.FullCommand():
+		// read the configuration file and apply the flags over it
+		cfg, err := loadServerConfig()
+		if err != nil {
+			fmt.Printf("Unable to load the server configuration: %v\n", err)
+			return
+		}
+		if *flagServePrintConfig {
+			err = cfg.write(os.Stdout)
+			if err != nil {
+				fmt.Printf("Unable to print the server configuration: %v\n", err)
+			}
+			return
+		}
+		if cfg.Logging.Quiet {
+			*flagQuiet = true
+			cmdState.SetQuiet(true)
+		}
+
 		// setup a new server state or exit out on failure
-		state, err := newState()
+		state, err := newState(cfg)
 		if err != nil {
 			fmt.Printf("Unable to initialize the server: %v", err)
 			return
 		}
 		defer state.close()
-		state.Storage.ChunkSize = *flagServeChunkSize
 		quitCh := state.serve(nil)
 
 		// wait until server shutdown to Exit out
@@ -357,6 +559,28 @@ func main() {
 			return
 		}
 
+		if *flagUserAddAdmin {
+			err = cmdState.SetUserAdmin(store, username, true)
+			if err != nil {
+				fmt.Printf("Failed to make the user an admin: %v", err)
+				return
+			}
+		}
+
+	case cmdDBMigrate.FullCommand():
+		fmtPrintf("Opening database: %s\n", *flagDatabasePath)
+		store, err := filefreezer.OpenStorage(*flagDatabasePath, *flagChunkStore)
+		if err != nil {
+			fmt.Printf("Failed to open the storage database: %v", err)
+			return
+		}
+		defer store.Close()
+		_, err = cmdState.MigrateDB(store, *flagDBMigrateDryRun)
+		if err != nil {
+			fmt.Printf("Failed to migrate the storage database: %v", err)
+			return
+		}
+
 	case cmdUserRm.FullCommand():
 		store, err := openStorage()
 		if err != nil {
@@ -379,22 +603,270 @@ func main() {
 			return
 		}
 
-	case cmdUserCryptoPass.FullCommand():
+		if *flagUserModAdmin != "" {
+			if *flagUserModName != "" {
+				username = *flagUserModName
+			}
+			err = cmdState.SetUserAdmin(store, username, *flagUserModAdmin == "true")
+			if err != nil {
+				fmt.Printf("Failed to change the admin rights for the user: %v", err)
+				return
+			}
+		}
+
+	case cmdAdminUserList.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		_, err = cmdState.AdminGetUsers()
+		if err != nil {
+			fmt.Printf("Failed to list the users: %v", err)
+			return
+		}
+
+	case cmdAdminUserAdd.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		newPassword := *argAdminUserAddPass
+		if newPassword == "" {
+			newPassword = interactiveGetNewLoginPassword(*argAdminUserAddName)
+		}
+
+		_, err = cmdState.AdminAddUser(*argAdminUserAddName, newPassword, *flagAdminUserAddQuota, *flagAdminUserAddAdmin)
+		if err != nil {
+			fmt.Printf("Failed to add the user: %v", err)
+			return
+		}
+
+	case cmdAdminUserRm.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = cmdState.AdminRmUser(*argAdminUserRmName)
+		if err != nil {
+			fmt.Printf("Failed to remove the user: %v", err)
+			return
+		}
+
+	case cmdAdminUserPasswd.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		newPassword := *argAdminUserPasswdPass
+		if newPassword == "" {
+			newPassword = interactiveGetNewLoginPassword(*argAdminUserPasswdName)
+		}
+
+		err = cmdState.AdminSetUserPassword(*argAdminUserPasswdName, newPassword)
+		if err != nil {
+			fmt.Printf("Failed to reset the user's password: %v", err)
+			return
+		}
+
+	case cmdAdminUserQuota.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = cmdState.AdminSetUserQuota(*argAdminUserQuotaName, *argAdminUserQuotaBytes)
+		if err != nil {
+			fmt.Printf("Failed to set the user's quota: %v", err)
+			return
+		}
+
+	case cmdAdminAudit.FullCommand():
+		now := time.Now()
+		since, err := parseAuditTime(*flagAdminAuditSince, now)
+		if err != nil {
+			fmt.Printf("Failed to parse the since time: %v", err)
+			return
+		}
+		until, err := parseAuditTime(*flagAdminAuditUntil, now)
+		if err != nil {
+			fmt.Printf("Failed to parse the until time: %v", err)
+			return
+		}
+
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err = cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		_, err = cmdState.AdminGetAuditLog(*argAdminAuditUser, since, until)
+		if err != nil {
+			fmt.Printf("Failed to get the audit log: %v", err)
+			return
+		}
+
+	case cmdUserCryptoPassSet.FullCommand():
 		username := interactiveGetLoginUser()
 		password := interactiveGetLoginPassword()
 		host := interactiveGetHost()
 
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		// a new password would come with a new master key, leaving everything
+		// already stored unreadable
+		if len(cmdState.CryptoHash) != 0 {
+			fmt.Println("The cryptography password has already been set for this account; use the cryptopass change command instead.")
+			return
+		}
+
 		if *flagUserCryptoPassPW == "" {
 			*flagUserCryptoPassPW = interactiveGetCryptoPassword()
 		}
 
+		err = cmdState.SetCryptoHashForPassword(*flagUserCryptoPassPW)
+		if err != nil {
+			fmt.Printf("Failed to set the cryptography password: %v", err)
+			return
+		}
+
+	case cmdUserCryptoPassChange.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		if len(cmdState.CryptoHash) == 0 {
+			fmt.Println("The cryptography password has not been set for this account yet; use the cryptopass set command instead.")
+			return
+		}
+
+		if *flagCryptoPass == "" {
+			*flagCryptoPass = interactiveGetCryptoPassword()
+		}
+		if *flagUserCryptoPassNewPW == "" {
+			fmtPrintln("Enter the new cryptography password.")
+			*flagUserCryptoPassNewPW = interactiveGetNewCryptoPassword()
+		}
+
+		err = cmdState.ChangeCryptoPassword(*flagCryptoPass, *flagUserCryptoPassNewPW)
+		if err != nil {
+			fmt.Printf("Failed to change the cryptography password: %v", err)
+			return
+		}
+
+	case cmdUserRecoveryKeyExport.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		if len(cmdState.CryptoHash) == 0 {
+			fmt.Println("The cryptography password has not been set for this account yet; use the cryptopass set command first.")
+			return
+		}
+
+		if *flagCryptoPass == "" {
+			*flagCryptoPass = interactiveGetCryptoPassword()
+		}
+
+		recoveryKey, err := cmdState.ExportRecoveryKey(*flagCryptoPass)
+		if err != nil {
+			fmt.Printf("Failed to export the recovery key: %v", err)
+			return
+		}
+
+		if *flagUserRecoveryKeyExportOut != "" {
+			err = ioutil.WriteFile(*flagUserRecoveryKeyExportOut, []byte(recoveryKey+"\n"), 0600)
+			if err != nil {
+				fmt.Printf("Failed to write the recovery key to %s: %v", *flagUserRecoveryKeyExportOut, err)
+				return
+			}
+			fmt.Printf("Recovery key written to %s.\n", *flagUserRecoveryKeyExportOut)
+		} else {
+			fmt.Println("Recovery key:")
+			fmt.Println(recoveryKey)
+		}
+		fmt.Println("Anyone with the recovery key can decrypt your files; keep it somewhere safe.")
+
+	case cmdUserRecoveryKeyRestore.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
 		err := cmdState.Authenticate(host, username, password)
 		if err != nil {
 			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
 			return
 		}
 
-		cmdState.SetCryptoHashForPassword(*flagUserCryptoPassPW)
+		var recoveryKey string
+		if *flagUserRecoveryKeyRestoreIn != "" {
+			keyBytes, err := ioutil.ReadFile(*flagUserRecoveryKeyRestoreIn)
+			if err != nil {
+				fmt.Printf("Failed to read the recovery key from %s: %v", *flagUserRecoveryKeyRestoreIn, err)
+				return
+			}
+			recoveryKey = string(keyBytes)
+		} else {
+			recoveryKey = interactiveGetRecoveryKey()
+		}
+		if *flagUserRecoveryKeyRestoreNewPW == "" {
+			fmtPrintln("Enter the new cryptography password.")
+			*flagUserRecoveryKeyRestoreNewPW = interactiveGetNewCryptoPassword()
+		}
+
+		err = cmdState.RestoreCryptoPassword(recoveryKey, *flagUserRecoveryKeyRestoreNewPW)
+		if err != nil {
+			fmt.Printf("Failed to restore the cryptography password: %v", err)
+			return
+		}
 
 	case cmdFileList.FullCommand():
 		username := interactiveGetLoginUser()
@@ -572,6 +1044,13 @@ func main() {
 			return
 		}
 
+		cmdState.Index, err = openSyncIndex(host, username, filepath.Dir(*argSyncPath))
+		if err != nil {
+			fmt.Printf("Failed to open the sync index: %v", err)
+			return
+		}
+		defer cmdState.Index.Close()
+
 		filepath := *argSyncPath
 		remoteFilepath := *argSyncTarget
 		if len(remoteFilepath) < 1 {
@@ -607,6 +1086,13 @@ func main() {
 			return
 		}
 
+		cmdState.Index, err = openSyncIndex(host, username, *argSyncDirPath)
+		if err != nil {
+			fmt.Printf("Failed to open the sync index: %v", err)
+			return
+		}
+		defer cmdState.Index.Close()
+
 		filepath := *argSyncDirPath
 		remoteFilepath := *argSyncDirTarget
 		if len(remoteFilepath) < 1 {
@@ -618,6 +1104,49 @@ func main() {
 			return
 		}
 
+	case cmdWatch.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		cmdState.Index, err = openSyncIndex(host, username, *argWatchPath)
+		if err != nil {
+			fmt.Printf("Failed to open the sync index: %v", err)
+			return
+		}
+		defer cmdState.Index.Close()
+
+		remoteFilepath := *argWatchTarget
+		if len(remoteFilepath) < 1 {
+			remoteFilepath = *argWatchPath
+		}
+
+		// watch until interrupted
+		stop := make(chan struct{})
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupt
+			close(stop)
+		}()
+		err = cmdState.Watch(*argWatchPath, remoteFilepath, stop)
+		if err != nil {
+			fmt.Printf("Failed to watch the directory %s: %v", *argWatchPath, err)
+			return
+		}
+
 	case cmdUserStats.FullCommand():
 		username := interactiveGetLoginUser()
 		password := interactiveGetLoginPassword()
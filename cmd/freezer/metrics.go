@@ -0,0 +1,250 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/tbogdala/filefreezer"
+)
+
+// storageLatencyBuckets are the upper bounds in seconds of the histogram buckets
+// used for the storage operation latencies.
+var storageLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// labelEscaper escapes the label values in the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// requestKey identifies the requests counted together by the server metrics.
+type requestKey struct {
+	method string
+	route  string
+	code   int
+}
+
+// latencyHistogram counts observations into the storageLatencyBuckets.
+type latencyHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// serverMetrics collects the metrics for the server that are exposed in the
+// Prometheus text format. The gauges for the data kept in storage are read
+// from the database when the metrics are written out.
+type serverMetrics struct {
+	lock sync.Mutex
+
+	requests      map[requestKey]uint64
+	storageOps    map[string]*latencyHistogram
+	storageErrors map[string]uint64
+	chunkBytesIn  uint64
+	chunkBytesOut uint64
+	loginFailures uint64
+}
+
+// newServerMetrics creates a new serverMetrics object with all of the counters at zero.
+func newServerMetrics() *serverMetrics {
+	m := new(serverMetrics)
+	m.requests = make(map[requestKey]uint64)
+	m.storageOps = make(map[string]*latencyHistogram)
+	m.storageErrors = make(map[string]uint64)
+	return m
+}
+
+// observeRequest counts a request for the route pattern that finished with the status code.
+func (m *serverMetrics) observeRequest(method string, route string, code int) {
+	m.lock.Lock()
+	m.requests[requestKey{method, route, code}]++
+	m.lock.Unlock()
+}
+
+// observeStorage records how long a storage operation took and whether it failed.
+// It is meant to be used as the TransactionObserver for the filefreezer Storage.
+func (m *serverMetrics) observeStorage(op string, elapsed time.Duration, err error) {
+	seconds := elapsed.Seconds()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	h, ok := m.storageOps[op]
+	if !ok {
+		h = &latencyHistogram{buckets: make([]uint64, len(storageLatencyBuckets))}
+		m.storageOps[op] = h
+	}
+	for i, bound := range storageLatencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+	if err != nil {
+		m.storageErrors[op]++
+	}
+}
+
+// addChunkBytesIn counts the bytes of a chunk uploaded to the server.
+func (m *serverMetrics) addChunkBytesIn(n int) {
+	m.lock.Lock()
+	m.chunkBytesIn += uint64(n)
+	m.lock.Unlock()
+}
+
+// addChunkBytesOut counts the bytes of a chunk downloaded from the server.
+func (m *serverMetrics) addChunkBytesOut(n int) {
+	m.lock.Lock()
+	m.chunkBytesOut += uint64(n)
+	m.lock.Unlock()
+}
+
+// addLoginFailure counts a failed login attempt.
+func (m *serverMetrics) addLoginFailure() {
+	m.lock.Lock()
+	m.loginFailures++
+	m.lock.Unlock()
+}
+
+// middleware counts every request handled by echo by the method, the route
+// pattern it matched and the status code of the response.
+func (m *serverMetrics) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+
+		code := c.Response().Status
+		if err != nil {
+			code = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				code = he.Code
+			}
+		}
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		m.observeRequest(c.Request().Method, route, code)
+
+		return err
+	}
+}
+
+// handler returns the http.Handler that serves the metrics at /metrics.
+func (m *serverMetrics) handler(store *filefreezer.Storage) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		err := m.write(&buf, store)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+	return mux
+}
+
+// write writes out all of the metrics in the Prometheus text format.
+func (m *serverMetrics) write(w io.Writer, store *filefreezer.Storage) error {
+	// read the gauges from storage before taking the lock so that the storage
+	// operations being timed don't wait on the metrics
+	totals, err := store.GetTotals()
+	if err != nil {
+		return fmt.Errorf("Failed to get the storage totals: %v", err)
+	}
+	allStats, err := store.GetAllUserStats()
+	if err != nil {
+		return fmt.Errorf("Failed to get the user stats: %v", err)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	writeHeader(w, "freezer_http_requests_total", "counter", "The number of HTTP requests handled by route and status code.")
+	requestKeys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requestKeys = append(requestKeys, k)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	for _, k := range requestKeys {
+		fmt.Fprintf(w, "freezer_http_requests_total{method=\"%s\",route=\"%s\",code=\"%d\"} %d\n",
+			labelEscaper.Replace(k.method), labelEscaper.Replace(k.route), k.code, m.requests[k])
+	}
+
+	writeHeader(w, "freezer_chunk_bytes_received_total", "counter", "The number of chunk bytes uploaded to the server.")
+	fmt.Fprintf(w, "freezer_chunk_bytes_received_total %d\n", m.chunkBytesIn)
+	writeHeader(w, "freezer_chunk_bytes_sent_total", "counter", "The number of chunk bytes downloaded from the server.")
+	fmt.Fprintf(w, "freezer_chunk_bytes_sent_total %d\n", m.chunkBytesOut)
+	writeHeader(w, "freezer_login_failures_total", "counter", "The number of failed login attempts.")
+	fmt.Fprintf(w, "freezer_login_failures_total %d\n", m.loginFailures)
+
+	ops := make([]string, 0, len(m.storageOps))
+	for op := range m.storageOps {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	writeHeader(w, "freezer_storage_operation_seconds", "histogram", "How long the storage transactions took, including the wait for the transaction lock.")
+	for _, op := range ops {
+		h := m.storageOps[op]
+		label := labelEscaper.Replace(op)
+		for i, bound := range storageLatencyBuckets {
+			fmt.Fprintf(w, "freezer_storage_operation_seconds_bucket{op=\"%s\",le=\"%s\"} %d\n",
+				label, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(w, "freezer_storage_operation_seconds_bucket{op=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "freezer_storage_operation_seconds_sum{op=\"%s\"} %s\n", label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "freezer_storage_operation_seconds_count{op=\"%s\"} %d\n", label, h.count)
+	}
+	writeHeader(w, "freezer_storage_operation_errors_total", "counter", "The number of storage transactions that failed.")
+	for _, op := range ops {
+		fmt.Fprintf(w, "freezer_storage_operation_errors_total{op=\"%s\"} %d\n", labelEscaper.Replace(op), m.storageErrors[op])
+	}
+
+	writeHeader(w, "freezer_users", "gauge", "The number of users.")
+	fmt.Fprintf(w, "freezer_users %d\n", totals.Users)
+	writeHeader(w, "freezer_files", "gauge", "The number of files stored for all of the users.")
+	fmt.Fprintf(w, "freezer_files %d\n", totals.Files)
+	writeHeader(w, "freezer_file_versions", "gauge", "The number of file versions stored for all of the users.")
+	fmt.Fprintf(w, "freezer_file_versions %d\n", totals.Versions)
+	writeHeader(w, "freezer_allocated_bytes", "gauge", "The number of bytes allocated to all of the users.")
+	fmt.Fprintf(w, "freezer_allocated_bytes %d\n", totals.Allocated)
+
+	names := make([]string, 0, len(allStats))
+	for name := range allStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeHeader(w, "freezer_user_allocated_bytes", "gauge", "The number of bytes allocated to each user.")
+	for _, name := range names {
+		fmt.Fprintf(w, "freezer_user_allocated_bytes{user=\"%s\"} %d\n", labelEscaper.Replace(name), allStats[name].Allocated)
+	}
+	writeHeader(w, "freezer_user_quota_bytes", "gauge", "The quota in bytes for each user.")
+	for _, name := range names {
+		fmt.Fprintf(w, "freezer_user_quota_bytes{user=\"%s\"} %d\n", labelEscaper.Replace(name), allStats[name].Quota)
+	}
+
+	return nil
+}
+
+// writeHeader writes the HELP and TYPE lines for a metric.
+func writeHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
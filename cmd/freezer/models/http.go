@@ -9,20 +9,35 @@ import "github.com/tbogdala/filefreezer"
 // that the server has to the client.
 type ServerCapabilities struct {
 	ChunkSize int64
+
+	// ChunkingModes are the chunking modes the server stores file versions for,
+	// like filefreezer.ChunkingFastCDC; servers that don't send any only
+	// support filefreezer.ChunkingFixed.
+	ChunkingModes []string
 }
 
 // UserLoginResponse is the JSON serializable response given by the
 // /api/users/login POST handlder.
 type UserLoginResponse struct {
 	Token        string
+	RefreshToken string
 	CryptoHash   []byte
+	WrappedKey   []byte
 	Capabilities ServerCapabilities
 }
 
+// UserRefreshResponse is the JSON serializable response given by the
+// /api/users/refresh POST handler.
+type UserRefreshResponse struct {
+	Token        string
+	RefreshToken string
+}
+
 // UserCryptoHashUpdateRequest is the JSON serializable request sent to the
 // /api/user/cryptohash PUT handler.
 type UserCryptoHashUpdateRequest struct {
 	CryptoHash []byte
+	WrappedKey []byte
 }
 
 // UserCryptoHashUpdateResponse is the JSON serializable response given by the
@@ -43,6 +58,41 @@ type AllFilesGetResponse struct {
 	Files []filefreezer.FileInfo
 }
 
+// ChangesGetResponse is the JSON serializable response given by the
+// /api/changes GET handler. Files has the current information for the files
+// that changed and still exist and Removed has the ids of the files that were
+// removed. If Complete is false, the changes since the revision requested
+// aren't known and the client should get all of the files again.
+type ChangesGetResponse struct {
+	Revision int
+	Complete bool
+	Changes  []filefreezer.FileChange
+	Files    []filefreezer.FileInfo
+	Removed  []int
+}
+
+// The names of the events sent on the /api/events stream that aren't changes
+// to files; those are named after the change, like filefreezer.ChangeFileAdd.
+const (
+	// EventReady is sent first once the stream is established with the
+	// user's current revision
+	EventReady = "ready"
+
+	// EventQuota is sent when an admin changes the user's quota
+	EventQuota = "user.quota"
+)
+
+// Event is the JSON serializable data of an event sent on the /api/events
+// stream. Revision is the user's revision after the change; FileID and VersionID
+// are set for the changes to files and Quota is set for EventQuota.
+type Event struct {
+	Event     string
+	Revision  int
+	FileID    int
+	VersionID int
+	Quota     int
+}
+
 // FileGetResponse is the JSON serializable response given by the
 // /api/file/{id} GET handlder.
 type FileGetResponse struct {
@@ -57,6 +107,10 @@ type NewFileVersionRequest struct {
 	LastMod     int64
 	ChunkCount  int
 	FileHash    string
+
+	// HashAlgo is the algorithm used for FileHash and the chunk hashes. Clients that
+	// don't send it are assumed to have used filefreezer.HashAlgoSHA1.
+	HashAlgo string
 }
 
 // NewFileVersionResponse is the  JSON serializable response given by the
@@ -66,6 +120,21 @@ type NewFileVersionResponse struct {
 	Status bool
 }
 
+// FileCommitRequest is the JSON serializable request object sent to the
+// /api/file/{fileid}/commit POST handler. ChunkCount and FileHash have to
+// match the ones the version was tagged with.
+type FileCommitRequest struct {
+	VersionID  int
+	ChunkCount int
+	FileHash   string
+}
+
+// FileCommitResponse is the JSON serializable response given by the
+// /api/file/{fileid}/commit POST handler.
+type FileCommitResponse struct {
+	Status bool
+}
+
 // FileGetAllVersionsResponse is the  JSON serializable response given by the
 // /api/file/{fileid}/versions GET handler.
 type FileGetAllVersionsResponse struct {
@@ -103,6 +172,21 @@ type FileChunksGetResponse struct {
 	Chunks []filefreezer.FileChunk
 }
 
+// FileChunksReuseRequest is the JSON serializable request object sent to the
+// /api/chunk/{fileid}/{versionID} POST handler. Only the ChunkNumber, ChunkHash and,
+// unless the version uses filefreezer.ChunkingFixed, ChunkLength fields of the chunks
+// need to be set.
+type FileChunksReuseRequest struct {
+	Chunks []filefreezer.FileChunk
+}
+
+// FileChunksReuseResponse is the JSON serializable response given by the
+// /api/chunk/{fileid}/{versionID} POST handler. ReusedChunks contains the chunk
+// numbers that were added from chunks already in storage and don't need uploading.
+type FileChunksReuseResponse struct {
+	ReusedChunks []int
+}
+
 // FilePutResponse is the JSON serializable response given by the
 // /api/files PUT handlder.
 type FilePutResponse struct {
@@ -118,6 +202,44 @@ type FilePutRequest struct {
 	LastMod     int64
 	ChunkCount  int
 	FileHash    string
+
+	// HashAlgo is the algorithm used for FileHash and the chunk hashes. Clients that
+	// don't send it are assumed to have used filefreezer.HashAlgoSHA1.
+	HashAlgo string
+}
+
+// UploadStartRequest is the JSON serializable request object sent to the
+// /api/uploads POST handler. A FileID of 0 registers a new file with the
+// FileName and IsDir given; otherwise a new version of the file is uploaded.
+type UploadStartRequest struct {
+	FileID      int
+	FileName    string
+	IsDir       bool
+	Permissions uint32
+	LastMod     int64
+	ChunkCount  int
+	FileHash    string
+	HashAlgo    string
+
+	// Chunking is the chunking mode the file was split into chunks with. Clients
+	// that don't send it are assumed to have used filefreezer.ChunkingFixed.
+	Chunking string
+
+	// Size is the number of bytes the chunks are expected to take up on the
+	// server, which is reserved in the user's quota until the upload finishes.
+	Size int
+}
+
+// UploadSessionResponse is the JSON serializable response given by the
+// /api/uploads POST and /api/upload/{sessionid} GET handlers.
+type UploadSessionResponse struct {
+	filefreezer.UploadSession
+}
+
+// UploadCancelResponse is the JSON serializable response given by the
+// /api/upload/{sessionid} DELETE handler.
+type UploadCancelResponse struct {
+	Status bool
 }
 
 // FileDeleteRequest is the JSON serializable request object sent to the
@@ -131,3 +253,76 @@ type FileDeleteRequest struct {
 type FileDeleteResponse struct {
 	Success bool
 }
+
+// AdminUserInfo describes a user in the responses of the /api/admin/users handlers.
+type AdminUserInfo struct {
+	ID      int
+	Name    string
+	IsAdmin bool
+	Stats   filefreezer.UserStats
+}
+
+// AdminUsersGetResponse is the JSON serializable response given by the
+// /api/admin/users GET handler.
+type AdminUsersGetResponse struct {
+	Users []AdminUserInfo
+}
+
+// AdminUserAddRequest is the JSON serializable request sent to the
+// /api/admin/users POST handler. A Quota of 0 uses the server's default quota.
+type AdminUserAddRequest struct {
+	Name     string
+	Password string
+	Quota    int
+	IsAdmin  bool
+}
+
+// AdminUserAddResponse is the JSON serializable response given by the
+// /api/admin/users POST handler.
+type AdminUserAddResponse struct {
+	User AdminUserInfo
+}
+
+// AdminUserPasswordRequest is the JSON serializable request sent to the
+// /api/admin/users/{name}/password PUT handler.
+type AdminUserPasswordRequest struct {
+	Password string
+}
+
+// AdminUserQuotaRequest is the JSON serializable request sent to the
+// /api/admin/users/{name}/quota PUT handler.
+type AdminUserQuotaRequest struct {
+	Quota int
+}
+
+// AdminUserUpdateResponse is the JSON serializable response given by the
+// /api/admin/users/{name} DELETE handler and the PUT handlers under it.
+type AdminUserUpdateResponse struct {
+	Success bool
+}
+
+// AdminAuditGetResponse is the JSON serializable response given by the
+// /api/admin/audit GET handler.
+type AdminAuditGetResponse struct {
+	Records []filefreezer.AuditRecord
+}
+
+// HealthResponse is the JSON serializable response given by the /healthz GET handler.
+type HealthResponse struct {
+	Status string
+}
+
+// ComponentStatus is the readiness of one of the components the server depends on.
+// Error is empty if the component is ready.
+type ComponentStatus struct {
+	Name  string
+	Ready bool
+	Error string `json:",omitempty"`
+}
+
+// ReadinessResponse is the JSON serializable response given by the /readyz GET handler.
+type ReadinessResponse struct {
+	Ready      bool
+	DBVersion  int
+	Components []ComponentStatus
+}
@@ -0,0 +1,266 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+// rateLimiterPruneInterval is how often the rate limiters and login lockouts
+// forget the keys that haven't been seen in a while.
+const rateLimiterPruneInterval = 10 * time.Minute
+
+// tokenBucket is the state of the rate limit for one key.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter keyed by strings like an IP
+// address or a username. Each key can make burst requests at once, and then
+// gets tokens back at the rate given. A nil *rateLimiter allows everything.
+type rateLimiter struct {
+	lock      sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// newRateLimiter creates a new rateLimiter that allows perMinute requests per key
+// with bursts of up to burst requests. If perMinute is not positive, nil is returned
+// so that the limit is disabled.
+func newRateLimiter(perMinute int, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	rl := new(rateLimiter)
+	rl.rate = float64(perMinute) / 60.0
+	rl.burst = float64(burst)
+	rl.buckets = make(map[string]*tokenBucket)
+	rl.lastPrune = time.Now()
+	return rl
+}
+
+// allow takes a token for the key if there is one. If there isn't, false is
+// returned along with how long it will be until the next token is available.
+func (rl *rateLimiter) allow(key string) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+
+	now := time.Now()
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	// full buckets don't need to be remembered
+	if now.Sub(rl.lastPrune) > rateLimiterPruneInterval {
+		for k, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastPrune = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateLimit returns echo middleware that responds with 429 Too Many Requests once
+// the key returned by keyFn has used up its rate limit. Requests with an empty key
+// are not limited.
+func rateLimit(rl *rateLimiter, keyFn func(c echo.Context) string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := keyFn(c)
+			if key == "" {
+				return next(c)
+			}
+			allowed, wait := rl.allow(key)
+			if !allowed {
+				return tooManyRequests(c, wait)
+			}
+			return next(c)
+		}
+	}
+}
+
+// tooManyRequests responds with 429 Too Many Requests and a Retry-After header
+// for the number of seconds to wait.
+func tooManyRequests(c echo.Context, wait time.Duration) error {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return c.String(http.StatusTooManyRequests, "Too many requests; try again in "+strconv.Itoa(seconds)+" seconds.")
+}
+
+// rateLimitByIP is the key function for rateLimit that limits by client IP address.
+func rateLimitByIP(c echo.Context) string {
+	return "ip:" + clientIP(c)
+}
+
+// rateLimitByLoginName is the key function for rateLimit that limits by the
+// username a client is trying to log in as.
+func rateLimitByLoginName(c echo.Context) string {
+	username := c.FormValue("user")
+	if username == "" {
+		return ""
+	}
+	return "user:" + username
+}
+
+// rateLimitByUserID is the key function for rateLimit that limits by the user
+// in the JWT token of an authenticated request.
+func rateLimitByUserID(c echo.Context) string {
+	jwtToken, ok := c.Get(jwtContextName).(*jwt.Token)
+	if !ok {
+		return ""
+	}
+	claims, ok := jwtToken.Claims.(*jwtCustomClaims)
+	if !ok {
+		return ""
+	}
+	return "id:" + strconv.Itoa(claims.UserID)
+}
+
+// lockoutEntry is the failed login state for one username.
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// loginLockouts tracks the consecutive failed logins for each username. Once a
+// username has threshold failures in a row, it is locked out for the base duration,
+// which doubles with each further failure up to the max duration. A successful
+// login resets the count. A nil *loginLockouts never locks anyone out.
+type loginLockouts struct {
+	lock      sync.Mutex
+	threshold int
+	base      time.Duration
+	max       time.Duration
+	users     map[string]*lockoutEntry
+	lastPrune time.Time
+}
+
+// newLoginLockouts creates a new loginLockouts object. If threshold is not positive,
+// nil is returned so that lockouts are disabled.
+func newLoginLockouts(threshold int, base time.Duration, max time.Duration) *loginLockouts {
+	if threshold <= 0 {
+		return nil
+	}
+	if base <= 0 {
+		base = time.Second
+	}
+	if max < base {
+		max = base
+	}
+
+	l := new(loginLockouts)
+	l.threshold = threshold
+	l.base = base
+	l.max = max
+	l.users = make(map[string]*lockoutEntry)
+	l.lastPrune = time.Now()
+	return l
+}
+
+// lockedOut returns how much longer the username is locked out for, or 0 if it isn't.
+func (l *loginLockouts) lockedOut(username string) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	e, ok := l.users[username]
+	if !ok {
+		return 0
+	}
+	remaining := e.lockedUntil.Sub(time.Now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// failed records a failed login for the username. If the failure locks the
+// username out, the duration of the lockout is returned along with the number
+// of consecutive failures; otherwise the duration is 0.
+func (l *loginLockouts) failed(username string) (time.Duration, int) {
+	if l == nil {
+		return 0, 0
+	}
+
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// forget the usernames that haven't failed in long enough that they'd be
+	// allowed to log in anyway
+	if now.Sub(l.lastPrune) > rateLimiterPruneInterval {
+		for k, e := range l.users {
+			if now.After(e.lockedUntil) && now.Sub(e.lastFailure) > l.max {
+				delete(l.users, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	e, ok := l.users[username]
+	if !ok {
+		e = new(lockoutEntry)
+		l.users[username] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	if e.failures < l.threshold {
+		return 0, e.failures
+	}
+
+	lockout := l.max
+	if shift := uint(e.failures - l.threshold); shift < 32 {
+		if d := l.base << shift; d > 0 && d < l.max {
+			lockout = d
+		}
+	}
+	e.lockedUntil = now.Add(lockout)
+	return lockout, e.failures
+}
+
+// succeeded resets the failed login count for the username.
+func (l *loginLockouts) succeeded(username string) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	delete(l.users, username)
+	l.lock.Unlock()
+}
@@ -0,0 +1,162 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+const (
+	// requestIDHeader is the header the request ID is returned in
+	requestIDHeader = "X-Request-ID"
+
+	// requestIDContextName is the name the request ID is stored under in the echo context
+	requestIDContextName = "RequestID"
+
+	// maxLoggedErrorLength is the most bytes of an error response body that are logged
+	maxLoggedErrorLength = 512
+)
+
+// requestLogEntry is the JSON object written to the request log for each request.
+type requestLogEntry struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	Method     string  `json:"method"`
+	Route      string  `json:"route"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	LatencyMS  float64 `json:"latency_ms"`
+	UserID     int     `json:"user_id,omitempty"`
+	RemoteAddr string  `json:"remote_addr"`
+	BytesOut   int64   `json:"bytes_out"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// requestLogger writes a line of JSON for every request handled by the server.
+// A nil *requestLogger still assigns request IDs but doesn't write anything.
+type requestLogger struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// newRequestLogger creates a new requestLogger that writes to w.
+func newRequestLogger(w io.Writer) *requestLogger {
+	l := new(requestLogger)
+	l.enc = json.NewEncoder(w)
+	return l
+}
+
+// write writes the entry to the log as one line of JSON.
+func (l *requestLogger) write(entry *requestLogEntry) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.enc.Encode(entry)
+}
+
+// errorCaptureWriter keeps the start of the response body when the status code
+// is an error so that the message the handler responded with can be logged.
+type errorCaptureWriter struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+// WriteHeader records the status code before sending it.
+func (w *errorCaptureWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write keeps the start of the body for error responses before writing it.
+func (w *errorCaptureWriter) Write(b []byte) (int, error) {
+	if w.status >= http.StatusBadRequest && len(w.body) < maxLoggedErrorLength {
+		n := maxLoggedErrorLength - len(w.body)
+		if n > len(b) {
+			n = len(b)
+		}
+		w.body = append(w.body, b[:n]...)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client if the wrapped writer supports it.
+func (w *errorCaptureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// newRequestID returns a random ID to identify a request in the logs.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// middleware gives every request an ID, which is returned in the X-Request-ID
+// header, and logs the request with its user, route, latency, status and any
+// error once it has been handled.
+func (l *requestLogger) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		requestID := newRequestID()
+		c.Set(requestIDContextName, requestID)
+		res := c.Response()
+		res.Header().Set(requestIDHeader, requestID)
+		if l == nil {
+			return next(c)
+		}
+
+		capture := &errorCaptureWriter{ResponseWriter: res.Writer}
+		res.Writer = capture
+		err := next(c)
+
+		entry := requestLogEntry{
+			Time:       start.UTC().Format(time.RFC3339Nano),
+			RequestID:  requestID,
+			Method:     c.Request().Method,
+			Route:      c.Path(),
+			Path:       c.Request().URL.Path,
+			Status:     res.Status,
+			LatencyMS:  float64(time.Since(start)) / float64(time.Millisecond),
+			RemoteAddr: clientIP(c),
+			BytesOut:   res.Size,
+			Error:      strings.TrimSpace(string(capture.body)),
+		}
+		if entry.Route == "" {
+			entry.Route = "unmatched"
+		}
+		if err != nil {
+			// the error hasn't been written out yet; echo does that after the middleware
+			entry.Status = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				entry.Status = he.Code
+			}
+			entry.Error = err.Error()
+		}
+		if jwtToken, ok := c.Get(jwtContextName).(*jwt.Token); ok {
+			if claims, ok := jwtToken.Claims.(*jwtCustomClaims); ok {
+				entry.UserID = claims.UserID
+			}
+		}
+
+		if logErr := l.write(&entry); logErr != nil {
+			fmtPrintf("Failed to write the request log: %v\n", logErr)
+		}
+		return err
+	}
+}
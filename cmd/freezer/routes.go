@@ -4,11 +4,17 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"time"
 
 	"strconv"
+	"sync/atomic"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo"
@@ -32,8 +38,24 @@ type jwtCustomClaims struct {
 
 // InitRoutes creates the routing multiplexer for the server
 func InitRoutes(state *serverState, e *echo.Echo) {
-	// setup the user login handler
-	e.POST("/api/users/login", handleUsersLogin(state))
+	// find the client's address, give each request an ID and log it, then count it for the metrics
+	e.Use(state.clientIPMiddleware)
+	e.Use(state.requestLog.middleware)
+	e.Use(state.Metrics.middleware)
+
+	// only the health probes are answered until the database has been migrated
+	e.Use(state.readyMiddleware)
+
+	// setup the user login handler; logins are rate limited by IP address and username
+	e.POST("/api/users/login", handleUsersLogin(state),
+		rateLimit(state.loginLimiter, rateLimitByIP), rateLimit(state.loginLimiter, rateLimitByLoginName))
+
+	// exchanges a refresh token for a new authentication token and refresh token
+	e.POST("/api/users/refresh", handleUsersRefresh(state), rateLimit(state.loginLimiter, rateLimitByIP))
+
+	// unauthenticated probes for whether the server is alive and ready to take requests
+	e.GET("/healthz", handleHealth(state))
+	e.GET("/readyz", handleReadiness(state))
 
 	restricted := e.Group("/api")
 	jwtConfig := middleware.JWTConfig{
@@ -42,6 +64,7 @@ func InitRoutes(state *serverState, e *echo.Echo) {
 		SigningKey: state.JWTSecretBytes,
 	}
 	restricted.Use(middleware.JWTWithConfig(jwtConfig))
+	restricted.Use(rateLimit(state.requestLimiter, rateLimitByUserID))
 
 	// returns the authenticated users's current stats such as quota, allocation and revision counts
 	restricted.GET("/user/stats", handleGetUserStats(state))
@@ -52,12 +75,30 @@ func InitRoutes(state *serverState, e *echo.Echo) {
 	// returns all files and their whole-file hash
 	restricted.GET("/files", handleGetAllFiles(state))
 
+	// returns the files that changed since a revision
+	restricted.GET("/changes", handleGetChanges(state))
+
+	// streams the changes to the user's files as they happen
+	restricted.GET("/events", handleGetEvents(state))
+
 	// handles registering a file to a user
 	restricted.POST("/files", handlePutFile(state))
 
 	// handles registering a new file version for a given file id
 	restricted.POST("/file/:fileid/version", handleNewFileVersion(state))
 
+	// commits a file version once all of its chunks are uploaded so that it becomes current
+	restricted.POST("/file/:fileid/commit", handleCommitFileVersion(state))
+
+	// starts or resumes an upload session for a new file or a new file version
+	restricted.POST("/uploads", handlePostUpload(state))
+
+	// returns an upload session with its missing chunk list
+	restricted.GET("/upload/:sessionid", handleGetUpload(state))
+
+	// cancels an upload session and removes the file version it was uploading
+	restricted.DELETE("/upload/:sessionid", handleDeleteUpload(state))
+
 	// returns a file information response with missing chunk list
 	restricted.GET("/file/:fileid", handleGetFile(state))
 
@@ -78,6 +119,81 @@ func InitRoutes(state *serverState, e *echo.Echo) {
 
 	// get all known file chunks (except the chunks themselves)
 	restricted.GET("/chunk/:fileid/:versionID", handleGetFileChunks(state))
+
+	// add file chunks using the chunks already in storage with the same hashes
+	restricted.POST("/chunk/:fileid/:versionID", handlePostFileChunks(state))
+
+	// the user management routes are only available to admins
+	admin := restricted.Group("/admin", requireAdmin(state))
+
+	// returns all of the users and their stats
+	admin.GET("/users", handleAdminGetUsers(state))
+
+	// creates a new user
+	admin.POST("/users", handleAdminAddUser(state))
+
+	// removes a user and purges their data
+	admin.DELETE("/users/:username", handleAdminRmUser(state))
+
+	// resets the login password for a user
+	admin.PUT("/users/:username/password", handleAdminSetUserPassword(state))
+
+	// sets the quota for a user
+	admin.PUT("/users/:username/quota", handleAdminSetUserQuota(state))
+
+	// returns the audit log records, optionally for one user and a time range
+	admin.GET("/audit", handleAdminGetAudit(state))
+}
+
+// handleHealth responds to GET /healthz to show that the server is running.
+func handleHealth(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, &models.HealthResponse{Status: "ok"})
+	}
+}
+
+// handleReadiness responds to GET /readyz with the status of the database, its
+// schema version and the chunk store. The server isn't ready until serve has
+// migrated the database or once it has started shutting down, in which case the
+// status code is 503.
+func handleReadiness(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		resp := models.ReadinessResponse{Ready: true}
+		addComponent := func(name string, err error) {
+			status := models.ComponentStatus{Name: name, Ready: err == nil}
+			if err != nil {
+				status.Error = err.Error()
+				resp.Ready = false
+			}
+			resp.Components = append(resp.Components, status)
+		}
+
+		var err error
+		if atomic.LoadInt32(&state.shuttingDown) != 0 {
+			err = fmt.Errorf("the server is shutting down")
+		} else if atomic.LoadInt32(&state.ready) == 0 {
+			err = fmt.Errorf("the server is starting up")
+		}
+		addComponent("server", err)
+
+		addComponent("database", state.Storage.Ping())
+
+		resp.DBVersion, err = state.Storage.GetDBVersion()
+		if err == nil && state.Storage.IsMigrating() {
+			err = fmt.Errorf("the database is being migrated")
+		} else if err == nil && resp.DBVersion != filefreezer.CurrentDBVersion {
+			err = fmt.Errorf("the database is at version %d instead of %d", resp.DBVersion, filefreezer.CurrentDBVersion)
+		}
+		addComponent("schema", err)
+
+		addComponent("chunkstore", state.Storage.CheckChunkStore())
+
+		code := http.StatusOK
+		if !resp.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		return c.JSON(code, &resp)
+	}
 }
 
 // handleUsersLogin handles the incoming POST /api/users/login
@@ -85,54 +201,165 @@ func handleUsersLogin(state *serverState) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		username := c.FormValue("user")
 		password := c.FormValue("password")
-		if username == "" || password == "" {
+
+		// a verified client certificate that maps to a user logs in as that
+		// user without a password
+		certUser := ""
+		if password == "" {
+			certUser = state.clientCertUser(c.Request())
+			if username == "" {
+				username = certUser
+			}
+		}
+		if username == "" || (password == "" && certUser == "") {
 			return c.String(http.StatusBadRequest, "Both user and password were not supplied.")
 		}
 
+		// don't spend the time checking the password for a username that is locked out
+		if wait := state.lockouts.lockedOut(username); wait > 0 {
+			return tooManyRequests(c, wait)
+		}
+
 		// check the username and password
 		user, err := state.Storage.GetUser(username)
 		if err != nil {
+			loginFailed(state, c, username, 0, "unknown user")
 			return c.String(http.StatusUnauthorized, "Could not find user in the database.")
 		}
 
-		verified := filefreezer.VerifyLoginPassword(password, user.Salt, user.SaltedHash)
-		if !verified {
+		method := "a password"
+		if certUser != "" {
+			method = "a client certificate"
+			if certUser != user.Name {
+				loginFailed(state, c, username, user.ID, "client certificate for "+certUser)
+				return c.String(http.StatusUnauthorized, "The client certificate does not belong to the user.")
+			}
+		} else if !filefreezer.VerifyLoginPassword(password, user.Salt, user.SaltedHash) {
+			loginFailed(state, c, username, user.ID, "wrong password")
 			return c.String(http.StatusUnauthorized, "Could not verify the user against the stored salted hash.")
 		}
+		state.lockouts.succeeded(username)
+		audit(state, c, user.ID, user.Name, filefreezer.AuditLogin, "logged in with "+method)
 
 		if err != nil || user == nil {
 			return c.String(http.StatusUnauthorized, "Failed to log in with the data provided.")
 		}
 
-		// Set claims
-		claims := &jwtCustomClaims{
-			user.Name,
-			user.ID,
-			jwt.StandardClaims{
-				ExpiresAt: time.Now().Add(time.Minute * 15).Unix(),
+		t, refreshToken, err := issueTokens(state, user.Name, user.ID)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, &models.UserLoginResponse{
+			Token:        t,
+			RefreshToken: refreshToken,
+			CryptoHash:   user.CryptoHash,
+			WrappedKey:   user.WrappedKey,
+			Capabilities: models.ServerCapabilities{
+				ChunkSize:     state.ChunkSize,
+				ChunkingModes: filefreezer.ChunkingModes,
 			},
+		})
+	}
+}
+
+// loginFailed counts a failed login for the username and records it in the audit
+// log along with the lockout if it locks the username out. The userID is 0 if the
+// username doesn't exist.
+func loginFailed(state *serverState, c echo.Context, username string, userID int, reason string) {
+	state.Metrics.addLoginFailure()
+	audit(state, c, userID, username, filefreezer.AuditLoginFailure, reason)
+	lockout, failures := state.lockouts.failed(username)
+	if lockout <= 0 {
+		return
+	}
+	audit(state, c, userID, username, filefreezer.AuditLoginLockout,
+		fmt.Sprintf("locked out for %v after %d failed logins in a row", lockout, failures))
+}
+
+// audit records the event for the user in the audit log with the address of the
+// client. A failure to record it is printed but doesn't fail the request.
+func audit(state *serverState, c echo.Context, userID int, username string, event string, detail string) {
+	err := state.Storage.AddAuditRecord(&filefreezer.AuditRecord{
+		UserID:     userID,
+		Username:   username,
+		Event:      event,
+		RemoteAddr: clientIP(c),
+		Detail:     detail,
+	})
+	if err != nil {
+		fmtPrintf("Failed to record the %s event for %s in the audit log: %v\n", event, username, err)
+	}
+}
+
+// handleUsersRefresh handles the incoming POST /api/users/refresh. The refresh
+// token can only be used once and a new one is returned with the new JWT token.
+func handleUsersRefresh(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		refreshToken := c.FormValue("token")
+		if refreshToken == "" {
+			return c.String(http.StatusBadRequest, "The refresh token was not supplied.")
 		}
 
-		// generate the authentication token
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		userID, username, err := state.Storage.UseRefreshToken(hashRefreshToken(refreshToken))
+		if err != nil {
+			return c.String(http.StatusUnauthorized, fmt.Sprintf("Failed to refresh the token: %v", err))
+		}
 
-		// Generate encoded token and send it as response.
-		t, err := token.SignedString(state.JWTSecretBytes)
+		t, newRefreshToken, err := issueTokens(state, username, userID)
 		if err != nil {
 			return err
 		}
-		return c.JSON(http.StatusOK, &models.UserLoginResponse{
-			Token:      t,
-			CryptoHash: user.CryptoHash,
-			Capabilities: models.ServerCapabilities{
-				ChunkSize: *flagServeChunkSize,
-			},
+		return c.JSON(http.StatusOK, &models.UserRefreshResponse{
+			Token:        t,
+			RefreshToken: newRefreshToken,
 		})
 	}
 }
 
+// issueTokens generates a signed JWT token for the user that expires after the access
+// token lifetime along with a new refresh token that is stored hashed in Storage.
+func issueTokens(state *serverState, username string, userID int) (token string, refreshToken string, e error) {
+	// Set claims
+	claims := &jwtCustomClaims{
+		username,
+		userID,
+		jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(state.AccessTokenLifetime).Unix(),
+		},
+	}
+
+	// generate the authentication token
+	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token, err := jwtToken.SignedString(state.JWTSecretBytes)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to sign the authentication token: %v", err)
+	}
+
+	var refreshBytes [32]byte
+	_, err = rand.Read(refreshBytes[:])
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate the refresh token: %v", err)
+	}
+	refreshToken = base64.URLEncoding.EncodeToString(refreshBytes[:])
+
+	expiresAt := time.Now().Add(state.RefreshTokenLifetime).Unix()
+	err = state.Storage.AddRefreshToken(userID, hashRefreshToken(refreshToken), expiresAt)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, refreshToken, nil
+}
+
+// hashRefreshToken returns the hash of the refresh token that gets stored so
+// that the refresh tokens can't be used by someone reading the database.
+func hashRefreshToken(refreshToken string) string {
+	hash := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(hash[:])
+}
+
 // handlePutUserCryptoHash updates a user's crypto hash which can be used to verify a
-// client side entered password.
+// client side entered password along with the master key wrapped by that password.
 func handlePutUserCryptoHash(state *serverState) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		jwtToken := c.Get(jwtContextName).(*jwt.Token)
@@ -146,11 +373,12 @@ func handlePutUserCryptoHash(state *serverState) echo.HandlerFunc {
 			return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
 		}
 
-		// set the new crypto hash for the user
-		err = state.Storage.UpdateUserCryptoHash(userID, req.CryptoHash)
+		// set the new crypto hash and wrapped key for the user
+		err = state.Storage.UpdateUserCryptoHash(userID, req.CryptoHash, req.WrappedKey)
 		if err != nil {
 			return c.String(http.StatusInternalServerError, "Failed to update the user's crypto hash information for the authenticated user.")
 		}
+		audit(state, c, userID, claims.Username, filefreezer.AuditCryptoHash, "updated the crypto hash and wrapped key")
 
 		return c.JSON(http.StatusOK, &models.UserCryptoHashUpdateResponse{
 			Status: true,
@@ -199,6 +427,61 @@ func handleGetAllFiles(state *serverState) echo.HandlerFunc {
 	}
 }
 
+// handleGetChanges returns a JSON object with the changes made to the authenticated
+// user's files since the revision in the since query parameter along with the
+// current FileInfo objects for the files that changed.
+func handleGetChanges(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		since, err := strconv.ParseInt(c.QueryParam("since"), 10, 32)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the since revision.")
+		}
+
+		changes, revision, complete, err := state.Storage.GetFileChanges(claims.UserID, int(since))
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the changes for the user. "+err.Error())
+		}
+
+		resp := &models.ChangesGetResponse{
+			Revision: revision,
+			Complete: complete,
+			Changes:  changes,
+			Files:    []filefreezer.FileInfo{},
+			Removed:  []int{},
+		}
+		if resp.Changes == nil {
+			resp.Changes = []filefreezer.FileChange{}
+		}
+
+		// the last change to each file decides whether it's still there
+		lastChanges := make(map[int]string)
+		var fileIDs []int
+		for _, change := range changes {
+			if _, seen := lastChanges[change.FileID]; !seen {
+				fileIDs = append(fileIDs, change.FileID)
+			}
+			lastChanges[change.FileID] = change.Change
+		}
+		for _, fileID := range fileIDs {
+			if lastChanges[fileID] != filefreezer.ChangeFileRemove {
+				// a file that can't be found was removed after the changes were
+				// read, which will also show up in the next set of changes
+				fi, err := state.Storage.GetFileInfo(claims.UserID, fileID)
+				if err == nil {
+					resp.Files = append(resp.Files, *fi)
+					continue
+				}
+			}
+			resp.Removed = append(resp.Removed, fileID)
+		}
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
 func handleNewFileVersion(state *serverState) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		jwtToken := c.Get(jwtContextName).(*jwt.Token)
@@ -223,11 +506,18 @@ func handleNewFileVersion(state *serverState) echo.HandlerFunc {
 			return c.String(http.StatusNotFound, "Failed to get file for the user.")
 		}
 
+		hashAlgo, ok := requestHashAlgo(req.HashAlgo)
+		if !ok {
+			return c.String(http.StatusBadRequest, "hashAlgo is not a supported hash algorithm")
+		}
+
 		// create new file version
-		fi, err = state.Storage.TagNewFileVersion(claims.UserID, int(fileID), req.Permissions, req.LastMod, req.ChunkCount, req.FileHash)
+		fi, err = state.Storage.TagNewFileVersion(claims.UserID, int(fileID), req.Permissions, req.LastMod, req.ChunkCount, req.FileHash, hashAlgo)
 		if err != nil {
 			return c.String(http.StatusInternalServerError, "Failed to tag a new version of the file for the user: "+err.Error())
 		}
+		audit(state, c, claims.UserID, claims.Username, filefreezer.AuditFileVersion,
+			fmt.Sprintf("tagged version %d of file %d", fi.CurrentVersion.VersionNumber, fi.FileID))
 
 		return c.JSON(http.StatusOK, &models.NewFileVersionResponse{
 			FileInfo: *fi,
@@ -236,10 +526,44 @@ func handleNewFileVersion(state *serverState) echo.HandlerFunc {
 	}
 }
 
+// handleCommitFileVersion commits the file version in the request once the chunk
+// count and file hash are checked against the version and all of its chunks are
+// uploaded.
+func handleCommitFileVersion(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// deserialize the JSON object that should be in the request body
+		var req models.FileCommitRequest
+		err = c.Bind(&req)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+
+		err = state.Storage.CommitFileVersion(claims.UserID, int(fileID), req.VersionID, req.ChunkCount, req.FileHash)
+		if err != nil {
+			return c.String(http.StatusConflict, "Failed to commit the file version for the user. "+err.Error())
+		}
+		audit(state, c, claims.UserID, claims.Username, filefreezer.AuditFileCommit,
+			fmt.Sprintf("committed version id %d of file %d", req.VersionID, fileID))
+
+		return c.JSON(http.StatusOK, &models.FileCommitResponse{
+			Status: true,
+		})
+	}
+}
+
 func handleGetAllFileVersion(state *serverState) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		//jwtToken := c.Get(jwtContextName).(*jwt.Token)
-		//claims := jwtToken.Claims.(*jwtCustomClaims)
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
 
 		// pull the file id from the URI matched by the mux
 		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
@@ -247,6 +571,12 @@ func handleGetAllFileVersion(state *serverState) echo.HandlerFunc {
 			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
 		}
 
+		// make sure the file belongs to the user
+		_, err = state.Storage.GetFileInfo(claims.UserID, int(fileID))
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get file for the user.")
+		}
+
 		// get all the versions associated with the file in storage
 		versions, err := state.Storage.GetFileVersions(int(fileID))
 		if err != nil {
@@ -281,6 +611,8 @@ func handleDeleteFileVersions(state *serverState) echo.HandlerFunc {
 		if err != nil {
 			return c.String(http.StatusBadRequest, "Failed to remove file versions for the file: "+err.Error())
 		}
+		audit(state, c, claims.UserID, claims.Username, filefreezer.AuditFileVersionsDelete,
+			fmt.Sprintf("removed versions %d to %d of file %d", req.MinVersion, req.MaxVersion, fileID))
 
 		return c.JSON(http.StatusOK, &models.FileDeleteVersionsResponse{
 			Status: true,
@@ -346,6 +678,15 @@ func handlePutFileChunk(state *serverState) echo.HandlerFunc {
 			return c.String(http.StatusBadRequest, "A valid string was not used for the chunk hash.")
 		}
 
+		// the length of the chunk before it was encrypted is optional for fixed size chunks
+		var chunkLength int64
+		if lengthParam := c.QueryParam("length"); lengthParam != "" {
+			chunkLength, err = strconv.ParseInt(lengthParam, 10, 64)
+			if err != nil || chunkLength < 0 || chunkLength > state.Storage.ChunkSize {
+				return c.String(http.StatusBadRequest, "A valid chunk length was not used for the length parameter.")
+			}
+		}
+
 		// get a byte limited reader, set to the maximum chunk size supported by Storage
 		// plus a little extra space for cryptography information
 		r := c.Request()
@@ -359,10 +700,11 @@ func handlePutFileChunk(state *serverState) echo.HandlerFunc {
 
 		// AddFileChunk does verify that the user ID owns the fild ID so we don't need
 		// to replicate that work here, just add the chunk.
-		fc, err := state.Storage.AddFileChunk(claims.UserID, int(fileID), int(versionID), int(chunkNumber), chunkHash, chunk)
+		fc, err := state.Storage.AddFileChunk(claims.UserID, int(fileID), int(versionID), int(chunkNumber), chunkHash, int(chunkLength), chunk)
 		if err != nil || fc == nil {
 			return c.String(http.StatusInternalServerError, "Failed to add the chunk to storage: "+err.Error())
 		}
+		state.Metrics.addChunkBytesIn(len(chunk))
 
 		return c.JSON(http.StatusOK, &models.FileChunkPutResponse{
 			Status: true,
@@ -398,6 +740,49 @@ func handleGetFileChunks(state *serverState) echo.HandlerFunc {
 	}
 }
 
+// handlePostFileChunks reads a list of chunk numbers and hashes from the request body
+// and adds the chunks to the file version for each hash the user already has in storage.
+// The chunk numbers that were added are returned so the client can upload the rest.
+func handlePostFileChunks(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := strconv.ParseInt(c.Param("fileid"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+		versionID, err := strconv.ParseInt(c.Param("versionID"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid string was not used for the version id in the URI.")
+		}
+
+		// deserialize the JSON object that should be in the request body
+		var req models.FileChunksReuseRequest
+		err = c.Bind(&req)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		for _, fc := range req.Chunks {
+			if fc.ChunkLength < 0 || int64(fc.ChunkLength) > state.Storage.ChunkSize {
+				return c.String(http.StatusBadRequest, fmt.Sprintf("chunkLength of chunk #%d is not a valid chunk length", fc.ChunkNumber))
+			}
+		}
+
+		// ReuseFileChunks does verify that the user ID owns the fild ID so we don't need
+		// to replicate that work here.
+		reused, err := state.Storage.ReuseFileChunks(claims.UserID, int(fileID), int(versionID), req.Chunks)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to reuse the chunks in storage: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.FileChunksReuseResponse{
+			ReusedChunks: reused,
+		})
+	}
+}
+
 // handleGetFile returns a JSON object with all of the FileInfo data for the file in Storage
 // as well as a slice of missing chunks, if any.
 func handleGetFileChunk(state *serverState) echo.HandlerFunc {
@@ -433,6 +818,7 @@ func handleGetFileChunk(state *serverState) echo.HandlerFunc {
 			return c.String(http.StatusBadRequest, "Failed to get the chunk information for the file id and chunk number in the URI.")
 		}
 
+		state.Metrics.addChunkBytesOut(len(chunk.Chunk))
 		return c.Blob(http.StatusOK, "application/octet-stream", chunk.Chunk)
 	}
 }
@@ -463,12 +849,18 @@ func handlePutFile(state *serverState) echo.HandlerFunc {
 		if len(req.FileHash) < 1 && !req.IsDir {
 			return c.String(http.StatusBadRequest, "fileHash must be supplied in the request")
 		}
+		hashAlgo, ok := requestHashAlgo(req.HashAlgo)
+		if !ok {
+			return c.String(http.StatusBadRequest, "hashAlgo is not a supported hash algorithm")
+		}
 
 		// register a new file in storage with the information
-		fi, err := state.Storage.AddFileInfo(claims.UserID, req.FileName, req.IsDir, req.Permissions, req.LastMod, req.ChunkCount, req.FileHash)
+		fi, err := state.Storage.AddFileInfo(claims.UserID, req.FileName, req.IsDir, req.Permissions, req.LastMod, req.ChunkCount, req.FileHash, hashAlgo)
 		if err != nil {
 			return c.String(http.StatusConflict, "Failed to put a new file in storage for the user. "+err.Error())
 		}
+		audit(state, c, claims.UserID, claims.Username, filefreezer.AuditFileRegister,
+			fmt.Sprintf("registered file %d", fi.FileID))
 
 		return c.JSON(http.StatusOK, &models.FilePutResponse{
 			FileInfo: *fi,
@@ -476,6 +868,111 @@ func handlePutFile(state *serverState) echo.HandlerFunc {
 	}
 }
 
+// handlePostUpload starts an upload session for a new file or a new version of a file,
+// or resumes the user's session uploading the same contents, and returns it along with
+// the chunks that still need to be uploaded.
+func handlePostUpload(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.UploadStartRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+
+		// sanity check some input
+		if req.FileID == 0 && len(req.FileName) < 1 {
+			return c.String(http.StatusBadRequest, "fileName must be supplied in the request")
+		}
+		if req.LastMod < 1 {
+			return c.String(http.StatusBadRequest, "lastMod time must be supplied in the request")
+		}
+		if req.ChunkCount < 0 {
+			return c.String(http.StatusBadRequest, "chunkCount must be supplied in the request")
+		}
+		if req.Size < 0 {
+			return c.String(http.StatusBadRequest, "size must not be negative")
+		}
+		if len(req.FileHash) < 1 && !req.IsDir {
+			return c.String(http.StatusBadRequest, "fileHash must be supplied in the request")
+		}
+		hashAlgo, ok := requestHashAlgo(req.HashAlgo)
+		if !ok {
+			return c.String(http.StatusBadRequest, "hashAlgo is not a supported hash algorithm")
+		}
+		chunking, ok := requestChunking(req.Chunking)
+		if !ok {
+			return c.String(http.StatusBadRequest, "chunking is not a supported chunking mode")
+		}
+
+		version := filefreezer.FileVersionInfo{
+			Permissions: req.Permissions,
+			LastMod:     req.LastMod,
+			ChunkCount:  req.ChunkCount,
+			FileHash:    req.FileHash,
+			HashAlgo:    hashAlgo,
+			Chunking:    chunking,
+		}
+		sess, err := state.Storage.StartUploadSession(claims.UserID, req.FileID, req.FileName, req.IsDir, version,
+			req.Size, state.UploadLifetime)
+		if err != nil {
+			return c.String(http.StatusConflict, "Failed to start the upload for the user. "+err.Error())
+		}
+		if req.FileID == 0 {
+			audit(state, c, claims.UserID, claims.Username, filefreezer.AuditFileRegister,
+				fmt.Sprintf("registered file %d", sess.FileID))
+		} else if !sess.Resumed {
+			audit(state, c, claims.UserID, claims.Username, filefreezer.AuditFileVersion,
+				fmt.Sprintf("tagged version %d of file %d", sess.Version.VersionNumber, sess.FileID))
+		}
+
+		return c.JSON(http.StatusOK, &models.UploadSessionResponse{
+			UploadSession: *sess,
+		})
+	}
+}
+
+// handleGetUpload returns the upload session identified in the URI along with the
+// chunks that still need to be uploaded.
+func handleGetUpload(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		sess, err := state.Storage.GetUploadSession(claims.UserID, c.Param("sessionid"))
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get the upload session for the user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.UploadSessionResponse{
+			UploadSession: *sess,
+		})
+	}
+}
+
+// handleDeleteUpload cancels the upload session identified in the URI.
+func handleDeleteUpload(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		sessionID := c.Param("sessionid")
+		err := state.Storage.CancelUploadSession(claims.UserID, sessionID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to cancel the upload session for the user. "+err.Error())
+		}
+		audit(state, c, claims.UserID, claims.Username, filefreezer.AuditUploadCancel,
+			fmt.Sprintf("cancelled upload session %s", sessionID))
+
+		return c.JSON(http.StatusOK, &models.UploadCancelResponse{
+			Status: true,
+		})
+	}
+}
+
 func handleDeleteFile(state *serverState) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		jwtToken := c.Get(jwtContextName).(*jwt.Token)
@@ -492,7 +989,275 @@ func handleDeleteFile(state *serverState) echo.HandlerFunc {
 		if err != nil {
 			return c.String(http.StatusConflict, "Failed to remove a file in storage for the user. "+err.Error())
 		}
+		audit(state, c, claims.UserID, claims.Username, filefreezer.AuditFileDelete,
+			fmt.Sprintf("removed file %d", fileID))
 
 		return c.JSON(http.StatusOK, &models.FileDeleteResponse{Success: true})
 	}
 }
+
+// requireAdmin is middleware that only lets the request through if the authenticated
+// user is currently an admin. The flag is checked in Storage on each request so that
+// revoking the admin rights takes effect without waiting for the token to expire.
+func requireAdmin(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			jwtToken := c.Get(jwtContextName).(*jwt.Token)
+			claims := jwtToken.Claims.(*jwtCustomClaims)
+
+			user, err := state.Storage.GetUserByID(claims.UserID)
+			if err != nil || !user.IsAdmin {
+				return c.String(http.StatusForbidden, "The user is not an admin.")
+			}
+			return next(c)
+		}
+	}
+}
+
+// handleAdminGetUsers returns a JSON object with all of the users in Storage and their stats.
+func handleAdminGetUsers(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		users, err := state.Storage.GetAllUsers()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the users.")
+		}
+
+		infos := make([]models.AdminUserInfo, 0, len(users))
+		for _, user := range users {
+			stats, err := state.Storage.GetUserStats(user.ID)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to get the stats for the users.")
+			}
+			infos = append(infos, models.AdminUserInfo{
+				ID:      user.ID,
+				Name:    user.Name,
+				IsAdmin: user.IsAdmin,
+				Stats:   *stats,
+			})
+		}
+
+		return c.JSON(http.StatusOK, &models.AdminUsersGetResponse{Users: infos})
+	}
+}
+
+// handleAdminAddUser creates a new user with the name, password and quota in the request.
+func handleAdminAddUser(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		var req models.AdminUserAddRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if req.Name == "" || req.Password == "" || req.Quota < 0 {
+			return c.String(http.StatusBadRequest, "A name, password and non-negative quota must be supplied.")
+		}
+		if req.Quota == 0 {
+			req.Quota = state.DefaultQuota
+		}
+
+		free, err := state.Storage.IsUsernameFree(req.Name)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to check the username.")
+		}
+		if !free {
+			return c.String(http.StatusConflict, "The username is already taken.")
+		}
+
+		// generate the salt and salted login password hash
+		salt, saltedPass, err := filefreezer.GenLoginPasswordHash(req.Password)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to generate the password hash.")
+		}
+		user, err := state.Storage.AddUser(req.Name, salt, saltedPass, req.Quota)
+		if err != nil {
+			return c.String(http.StatusConflict, "Failed to add the user. "+err.Error())
+		}
+		if req.IsAdmin {
+			err = state.Storage.SetUserAdmin(user.ID, true)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to make the user an admin. "+err.Error())
+			}
+		}
+		detail := fmt.Sprintf("added by %s with a quota of %d bytes", claims.Username, req.Quota)
+		if req.IsAdmin {
+			detail += " as an admin"
+		}
+		audit(state, c, user.ID, user.Name, filefreezer.AuditUserAdd, detail)
+
+		return c.JSON(http.StatusOK, &models.AdminUserAddResponse{
+			User: models.AdminUserInfo{
+				ID:      user.ID,
+				Name:    user.Name,
+				IsAdmin: req.IsAdmin,
+				Stats:   filefreezer.UserStats{Quota: req.Quota},
+			},
+		})
+	}
+}
+
+// handleAdminRmUser removes the user named in the URI and purges their data.
+// Admins can't remove themselves so that there is always an admin left.
+func handleAdminRmUser(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		user, err := state.Storage.GetUser(c.Param("username"))
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to find the user.")
+		}
+		if user.ID == claims.UserID {
+			return c.String(http.StatusBadRequest, "Admins cannot remove themselves.")
+		}
+
+		err = state.Storage.RemoveUser(user.Name)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to remove the user. "+err.Error())
+		}
+		audit(state, c, user.ID, user.Name, filefreezer.AuditUserRemove, "removed by "+claims.Username)
+
+		return c.JSON(http.StatusOK, &models.AdminUserUpdateResponse{Success: true})
+	}
+}
+
+// handleAdminSetUserPassword resets the login password for the user named in the URI
+// and revokes their refresh tokens so that they have to log in with the new password.
+func handleAdminSetUserPassword(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		var req models.AdminUserPasswordRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if req.Password == "" {
+			return c.String(http.StatusBadRequest, "A new password must be supplied.")
+		}
+
+		user, err := state.Storage.GetUser(c.Param("username"))
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to find the user.")
+		}
+		stats, err := state.Storage.GetUserStats(user.ID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the stats for the user.")
+		}
+
+		salt, saltedPass, err := filefreezer.GenLoginPasswordHash(req.Password)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to generate the password hash.")
+		}
+		err = state.Storage.UpdateUser(user.ID, user.Name, salt, saltedPass, user.CryptoHash, stats.Quota)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to update the password for the user. "+err.Error())
+		}
+		err = state.Storage.RevokeUserRefreshTokens(user.ID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to revoke the refresh tokens for the user. "+err.Error())
+		}
+		audit(state, c, user.ID, user.Name, filefreezer.AuditUserPassword, "password reset by "+claims.Username)
+
+		return c.JSON(http.StatusOK, &models.AdminUserUpdateResponse{Success: true})
+	}
+}
+
+// handleAdminSetUserQuota sets the quota for the user named in the URI.
+func handleAdminSetUserQuota(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		var req models.AdminUserQuotaRequest
+		err := c.Bind(&req)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to read the request body: "+err.Error())
+		}
+		if req.Quota <= 0 {
+			return c.String(http.StatusBadRequest, "A positive quota must be supplied.")
+		}
+
+		user, err := state.Storage.GetUser(c.Param("username"))
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to find the user.")
+		}
+		stats, err := state.Storage.GetUserStats(user.ID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the stats for the user.")
+		}
+		err = state.Storage.SetUserQuota(user.ID, req.Quota)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to set the quota for the user. "+err.Error())
+		}
+		audit(state, c, user.ID, user.Name, filefreezer.AuditUserQuota,
+			fmt.Sprintf("quota changed from %d to %d bytes by %s", stats.Quota, req.Quota, claims.Username))
+		state.Events.publish(user.ID, models.Event{Event: models.EventQuota, Revision: stats.Revision, Quota: req.Quota})
+
+		return c.JSON(http.StatusOK, &models.AdminUserUpdateResponse{Success: true})
+	}
+}
+
+// handleAdminGetAudit returns the audit log records. The optional user query parameter
+// limits them to one username and the since and until parameters limit them to a time
+// range in Unix seconds.
+func handleAdminGetAudit(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var since, until int64
+		var err error
+		if s := c.QueryParam("since"); s != "" {
+			since, err = strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return c.String(http.StatusBadRequest, "A valid integer was not used for the since time.")
+			}
+		}
+		if s := c.QueryParam("until"); s != "" {
+			until, err = strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return c.String(http.StatusBadRequest, "A valid integer was not used for the until time.")
+			}
+		}
+
+		records, err := state.Storage.GetAuditRecords(c.QueryParam("user"), since, until)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the audit records. "+err.Error())
+		}
+		if records == nil {
+			records = []filefreezer.AuditRecord{}
+		}
+
+		return c.JSON(http.StatusOK, &models.AdminAuditGetResponse{Records: records})
+	}
+}
+
+// requestHashAlgo returns the hash algorithm to store for the hashAlgo sent in a request
+// and false if the algorithm isn't supported. Clients that predate the keyed hashes don't
+// send an algorithm and hashed their files with plain SHA1.
+func requestHashAlgo(hashAlgo string) (string, bool) {
+	switch hashAlgo {
+	case "":
+		return filefreezer.HashAlgoSHA1, true
+	case filefreezer.HashAlgoSHA1, filefreezer.HashAlgoHMACSHA256:
+		return hashAlgo, true
+	default:
+		return "", false
+	}
+}
+
+// requestChunking returns the chunking mode to store for the chunking mode sent in a
+// request, which is filefreezer.ChunkingFixed for clients that don't send one, and
+// false if the chunking mode isn't supported.
+func requestChunking(chunking string) (string, bool) {
+	if chunking == "" {
+		return filefreezer.ChunkingFixed, true
+	}
+	for _, mode := range filefreezer.ChunkingModes {
+		if chunking == mode {
+			return chunking, true
+		}
+	}
+	return "", false
+}
@@ -5,11 +5,17 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -25,8 +31,70 @@ type serverState struct {
 	// DefaultQuota is the default quota size for a user
 	DefaultQuota int
 
-	// Port is the port to listen to
-	Port int
+	// ListenAddr is the net address to listen to
+	ListenAddr string
+
+	// TLSCrt and TLSKey are the key files used to serve HTTPS; plain HTTP
+	// is served if either is empty
+	TLSCrt string
+	TLSKey string
+
+	// ClientCAs are the certificate authorities that client certificates are
+	// verified against; client certificates are ignored if it's nil
+	ClientCAs *x509.CertPool
+
+	// RequireClientCert makes the server refuse connections without a verified
+	// client certificate
+	RequireClientCert bool
+
+	// ClientUsers maps the common names of client certificates to usernames;
+	// if it's empty, the common name is the username
+	ClientUsers map[string]string
+
+	// ChunkSize is the number of bytes in a file chunk that clients should use
+	ChunkSize int64
+
+	// MetricsAddr is the net address to serve the metrics on; they aren't
+	// served if it's empty
+	MetricsAddr string
+
+	// Metrics collects the request, chunk and storage metrics for the server
+	Metrics *serverMetrics
+
+	// Events sends the changes to a user's files to the user's event streams
+	Events *eventHub
+
+	// ready is non-zero once the database has been migrated and the server can
+	// take requests
+	ready int32
+
+	// shuttingDown is non-zero once the server has started shutting down
+	shuttingDown int32
+
+	// ShutdownDrain is how long the server keeps taking requests after it starts
+	// shutting down so that load balancers see /readyz fail before it stops
+	ShutdownDrain time.Duration
+
+	// stop gets the signal to shut the server down
+	stop chan os.Signal
+
+	// loginLimiter limits the login attempts by IP address and by username
+	loginLimiter *rateLimiter
+
+	// requestLimiter limits the authenticated requests by user
+	requestLimiter *rateLimiter
+
+	// trustedProxies are the reverse proxies whose X-Forwarded-For and X-Real-IP
+	// headers are used for the client's address
+	trustedProxies []*net.IPNet
+
+	// lockouts locks usernames out after too many failed logins
+	lockouts *loginLockouts
+
+	// requestLog writes the JSON request logs; requestLogFile is the file it
+	// writes to if it isn't stdout
+	requestLog     *requestLogger
+	requestLogFile *os.File
 
 	// Storage is the filefreezer storage object used to keep data
 	Storage *filefreezer.Storage
@@ -34,58 +102,289 @@ type serverState struct {
 	// JWTSecretBytes is the slice used to authenticate JWT tokens for this
 	// server instance.
 	JWTSecretBytes []byte
+
+	// AccessTokenLifetime is how long the JWT tokens issued by the server are valid
+	AccessTokenLifetime time.Duration
+
+	// RefreshTokenLifetime is how long the refresh tokens issued by the server
+	// can be exchanged for a new JWT token
+	RefreshTokenLifetime time.Duration
+
+	// UploadLifetime is how long an upload session is kept without receiving a chunk
+	UploadLifetime time.Duration
 }
 
-// newState does the setup for the initial state of the server
-func newState() (*serverState, error) {
+const (
+	// jwtSecretSize is the number of random bytes generated for the JWT signing key
+	jwtSecretSize = 64
+
+	// defaultAccessTokenLifetime is used if the access token lifetime isn't set
+	defaultAccessTokenLifetime = 15 * time.Minute
+
+	// defaultRefreshTokenLifetime is used if the refresh token lifetime isn't set
+	defaultRefreshTokenLifetime = 30 * 24 * time.Hour
+
+	// defaultUploadLifetime is used if the upload session lifetime isn't set
+	defaultUploadLifetime = 24 * time.Hour
+
+	// defaultShutdownDrain is used if the shutdown drain time isn't set
+	defaultShutdownDrain = 5 * time.Second
+)
+
+// newState does the setup for the initial state of the server using the configuration given
+func newState(cfg *serverConfig) (*serverState, error) {
 	var err error
 	s := new(serverState)
-	s.DatabasePath = *flagDatabasePath
+	s.DatabasePath = cfg.DB
+	s.DefaultQuota = cfg.DefaultQuota
+	s.ListenAddr = cfg.Listen
+	s.TLSCrt = cfg.TLS.Cert
+	s.TLSKey = cfg.TLS.Key
+	s.RequireClientCert = cfg.TLS.RequireClientCert
+	s.ClientUsers = cfg.TLS.ClientUsers
+	s.ChunkSize = cfg.ChunkSize
+	s.MetricsAddr = cfg.Metrics.Listen
+	s.Metrics = newServerMetrics()
+	s.Events = newEventHub()
+	s.loginLimiter = newRateLimiter(cfg.RateLimit.LoginRate, cfg.RateLimit.LoginBurst)
+	s.requestLimiter = newRateLimiter(cfg.RateLimit.RequestRate, cfg.RateLimit.RequestBurst)
+	s.lockouts = newLoginLockouts(cfg.RateLimit.LockoutThreshold,
+		time.Duration(cfg.RateLimit.LockoutBase), time.Duration(cfg.RateLimit.LockoutMax))
+	s.AccessTokenLifetime = time.Duration(cfg.Tokens.Lifetime)
+	s.RefreshTokenLifetime = time.Duration(cfg.Tokens.RefreshLifetime)
+	s.UploadLifetime = time.Duration(cfg.UploadLifetime)
+	s.ShutdownDrain = time.Duration(cfg.ShutdownDrain)
 
-	// attempt to open the storage database
-	s.Storage, err = openStorage()
+	// parse the trusted proxies and load the client CA bundle before anything is
+	// opened so there's nothing to clean up
+	s.trustedProxies, err = parseTrustedProxies(cfg.TrustedProxies)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to open the database using the path specified (%s): %v", s.DatabasePath, err)
+		return nil, err
+	}
+	if cfg.TLS.ClientCA != "" {
+		s.ClientCAs, err = loadCertPool(cfg.TLS.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+	} else if s.RequireClientCert {
+		return nil, fmt.Errorf("A client CA file is needed to require client certificates")
 	}
 
-	// generate a random passphrase for signing JWT if something wasn't specified
-	// on the command line as a flag; this will make the tokens only
-	// valid between the same running instance of the server
-	randomPassphrase := []byte(*flagCryptoPass)
-	if len(randomPassphrase) < 1 {
-		var randoms [32]byte
-		_, err = rand.Read(randoms[:])
+	switch cfg.Logging.Requests {
+	case "":
+	case "-":
+		s.requestLog = newRequestLogger(os.Stdout)
+	default:
+		s.requestLogFile, err = os.OpenFile(cfg.Logging.Requests, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 		if err != nil {
-			return nil, fmt.Errorf("A crypto passrandomPassphraseword was not supplied and random generation failed: %v", err)
+			return nil, fmt.Errorf("Failed to open the request log %s: %v", cfg.Logging.Requests, err)
 		}
-		fmtPrintln("JWT random passphrase generated.")
+		s.requestLog = newRequestLogger(s.requestLogFile)
 	}
-	s.JWTSecretBytes = randomPassphrase
 
-	fmtPrintf("Database opened: %s\n", s.DatabasePath)
+	// attempt to open the storage database; it's migrated by serve once the server
+	// is listening so that /readyz can answer during the migration
+	fmtPrintf("Opening database: %s\n", cfg.DB)
+	s.Storage, err = filefreezer.OpenStorage(cfg.DB, cfg.ChunkStore)
+	if err != nil {
+		s.closeRequestLog()
+		return nil, fmt.Errorf("Failed to open the database using the path specified (%s): %v", s.DatabasePath, err)
+	}
+
+	// load the key for signing JWT from the key file so that the tokens stay
+	// valid when the server restarts
+	s.JWTSecretBytes, err = loadJWTSecret(cfg.Tokens.JWTKey)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	s.Storage.ChunkSize = s.ChunkSize
+	s.Storage.TransactionObserver = s.Metrics.observeStorage
+	s.Storage.ChangeObserver = s.Events.publishChange
+
 	return s, nil
 }
 
+// loadJWTSecret reads the key used to sign JWT from the key file, creating the
+// file with a new random key if it doesn't exist. If keyFilepath is empty, a random
+// key is generated that only makes the tokens valid for this running instance of the server.
+func loadJWTSecret(keyFilepath string) ([]byte, error) {
+	if keyFilepath != "" {
+		secret, err := ioutil.ReadFile(keyFilepath)
+		if err == nil {
+			if len(secret) < jwtSecretSize {
+				return nil, fmt.Errorf("The JWT key file %s is too short; delete it to generate a new key", keyFilepath)
+			}
+			fmtPrintf("JWT key loaded: %s\n", keyFilepath)
+			return secret, nil
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Failed to read the JWT key file %s: %v", keyFilepath, err)
+		}
+	}
+
+	secret := make([]byte, jwtSecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate a random JWT key: %v", err)
+	}
+	if keyFilepath == "" {
+		fmtPrintln("JWT random key generated.")
+		return secret, nil
+	}
+
+	// only the server should be able to read the key
+	f, err := os.OpenFile(keyFilepath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the JWT key file %s: %v", keyFilepath, err)
+	}
+	_, err = f.Write(secret)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(keyFilepath)
+		return nil, fmt.Errorf("Failed to write the JWT key file %s: %v", keyFilepath, err)
+	}
+
+	fmtPrintf("JWT key generated: %s\n", keyFilepath)
+	return secret, nil
+}
+
+// loadCertPool reads the PEM encoded certificates in the file into a new CertPool.
+func loadCertPool(certFilepath string) (*x509.CertPool, error) {
+	pemData, err := ioutil.ReadFile(certFilepath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the certificate file %s: %v", certFilepath, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("No PEM encoded certificates were found in %s", certFilepath)
+	}
+	return pool, nil
+}
+
+// tlsConfig returns the TLS configuration for serving HTTPS with the server's
+// key pair that also verifies client certificates if there are client CAs.
+func (state *serverState) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(state.TLSCrt, state.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load the TLS key pair: %v", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	}
+	if state.ClientCAs != nil {
+		config.ClientCAs = state.ClientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if state.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// clientCertUser returns the username that the verified client certificate of
+// the request maps to, or an empty string if there isn't one.
+func (state *serverState) clientCertUser(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(state.ClientUsers) == 0 {
+		return commonName
+	}
+	return state.ClientUsers[commonName]
+}
+
 // close will close any state connections used by the server
 func (state *serverState) close() {
 	state.Storage.Close()
+	state.closeRequestLog()
 }
 
+// closeRequestLog closes the request log file if one was opened.
+func (state *serverState) closeRequestLog() {
+	if state.requestLogFile != nil {
+		state.requestLogFile.Close()
+		state.requestLogFile = nil
+	}
+}
+
+// prepareStorage migrates the database to the current version and creates any
+// tables that are missing, after which the server is ready to take requests.
+func (state *serverState) prepareStorage() error {
+	applied, err := state.Storage.Migrate()
+	if err != nil {
+		return fmt.Errorf("Failed to migrate the database (%s): %v", state.DatabasePath, err)
+	}
+	for _, step := range applied {
+		fmtPrintf("Migrated the database to version %d: %s\n", step.Version, step.Description)
+	}
+	err = state.Storage.CreateTables()
+	if err != nil {
+		return fmt.Errorf("Failed to create the database tables (%s): %v", state.DatabasePath, err)
+	}
+
+	atomic.StoreInt32(&state.ready, 1)
+	return nil
+}
+
+// readyMiddleware turns away the requests other than the health probes until the
+// database has been prepared.
+func (state *serverState) readyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if atomic.LoadInt32(&state.ready) == 0 && c.Path() != "/healthz" && c.Path() != "/readyz" {
+			return c.String(http.StatusServiceUnavailable, "The server is not ready to take requests yet.")
+		}
+		return next(c)
+	}
+}
+
+// serve starts the server and then prepares the database in the background. Once
+// the database is ready, true is sent on readyCh, or false if it couldn't be prepared
+// and the server is shutting down again.
 func (state *serverState) serve(readyCh chan bool) (quitCh chan bool) {
 	e := echo.New()
 	InitRoutes(state, e)
 
+	// the metrics are served on their own address so that they can be kept private
+	var metricsServer *http.Server
+	if state.MetricsAddr != "" {
+		metricsServer = &http.Server{
+			Addr:    state.MetricsAddr,
+			Handler: state.Metrics.handler(state.Storage),
+		}
+		go func() {
+			fmtPrintf("Starting metrics server on %s ...\n", state.MetricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmtPrintf("Failed to serve the metrics: %v\n", err)
+			}
+		}()
+	}
+
 	// attempt to listen to the interrupt signal to signal the stop
 	// chan in a goroutine to call server shutdown.
 	// NOTE: doesn't appear to work on windows
-	stop := make(chan os.Signal)
+	state.stop = make(chan os.Signal, 1)
 	quitCh = make(chan bool)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(state.stop, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-stop
+		<-state.stop
+		atomic.StoreInt32(&state.shuttingDown, 1)
+		fmtPrintln("Shutting down server...")
+
+		// keep taking requests for a while so that the load balancers notice
+		// /readyz failing and stop sending new requests here
+		time.Sleep(state.ShutdownDrain)
+
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		fmtPrintln("Shutting down server...")
+		state.Events.close()
+		if metricsServer != nil {
+			metricsServer.Shutdown(ctx)
+		}
 		if err := e.Shutdown(ctx); err != nil {
 			state.close()
 			log.Fatalf("could not shutdown: %v", err)
@@ -97,23 +396,39 @@ func (state *serverState) serve(readyCh chan bool) (quitCh chan bool) {
 
 	// create the HTTP server
 	go func() {
-		if len(*flagTLSCrt) < 1 || len(*flagTLSKey) < 1 {
-			fmtPrintf("Starting http server on %s ...", *argServeListenAddr)
-			if err := e.Start(*argServeListenAddr); err != nil {
+		if len(state.TLSCrt) < 1 || len(state.TLSKey) < 1 {
+			fmtPrintf("Starting http server on %s ...", state.ListenAddr)
+			if err := e.Start(state.ListenAddr); err != nil {
 				fmtPrintln("Shutting down the server ...")
 			}
 		} else {
-			fmtPrintf("Starting https server on %s ...", *argServeListenAddr)
-			if err := e.StartTLS(*argServeListenAddr, *flagTLSCrt, *flagTLSKey); err != nil {
+			tlsConfig, err := state.tlsConfig()
+			if err != nil {
+				fmtPrintf("Unable to start the https server: %v\n", err)
+				return
+			}
+			fmtPrintf("Starting https server on %s ...", state.ListenAddr)
+			e.TLSServer.Addr = state.ListenAddr
+			e.TLSServer.TLSConfig = tlsConfig
+			if err := e.StartServer(e.TLSServer); err != nil {
 				fmtPrintln("Shutting down the server ...")
 			}
 		}
 	}()
 
-	// now that the listener is up, send out the ready signal
-	if readyCh != nil {
-		readyCh <- true
-	}
+	// with the listener starting up, prepare the database and send out the ready signal
+	go func() {
+		err := state.prepareStorage()
+		if err != nil {
+			fmtPrintf("Unable to prepare the database: %v\n", err)
+			state.stop <- syscall.SIGTERM
+		} else {
+			fmtPrintf("Database opened: %s\n", state.DatabasePath)
+		}
+		if readyCh != nil {
+			readyCh <- err == nil
+		}
+	}()
 
 	return quitCh
 }
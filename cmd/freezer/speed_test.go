@@ -40,7 +40,7 @@ func setupBenchmarkState(b *testing.B) *command.State {
 			b.Fatalf("Failed to set the crypto password for the test user: %v", err)
 		}
 	}
-	cmdState.CryptoKey, err = filefreezer.VerifyCryptoPassword(cryptoPass, string(cmdState.CryptoHash))
+	err = cmdState.UnlockCryptoKey(cryptoPass)
 	if err != nil {
 		b.Fatalf("Failed to set the crypto key for the test user: %v", err)
 	}
@@ -56,24 +56,42 @@ func BenchmarkBasicFileSyncUp4MB(b *testing.B) {
 	doBenchBasicFileSyncUp(1024*1024*4, b)
 }
 
-func doBenchBasicFileSyncUp(testFileSize int, b *testing.B) {
-	// create the server and command states
-	cmdState := setupBenchmarkState(b)
-
-	// write the test file to the filesystem
-	testFilename := "bench_data.dat"
-	randoBytes := genRandomBytes(testFileSize)
-	ioutil.WriteFile(testFilename, randoBytes, os.ModePerm)
+// benchJobCounts are the number of chunks to transfer at the same time that
+// the sync benchmarks are run with.
+var benchJobCounts = []int{1, 4}
 
-	b.ResetTimer()
+// benchChunkSize is the chunk size the sync benchmarks use on the client so
+// that the test files get split into enough chunks to transfer in parallel.
+const benchChunkSize = 1024 * 256
 
-	// loop: sync a file
-	for n := 0; n < b.N; n++ {
-		destFilename := fmt.Sprintf("bench_data_%08d.dat", n)
-		_, _, err := cmdState.SyncFile(testFilename, destFilename, command.SyncCurrentVersion)
-		if err != nil {
-			b.Fatalf("Failed to at the file %s: %v", testFilename, err)
-		}
+func doBenchBasicFileSyncUp(testFileSize int, b *testing.B) {
+	for _, jobs := range benchJobCounts {
+		b.Run(fmt.Sprintf("jobs%d", jobs), func(b *testing.B) {
+			// create the server and command states
+			cmdState := setupBenchmarkState(b)
+			cmdState.Jobs = jobs
+			cmdState.ServerCapabilities.ChunkSize = benchChunkSize
+
+			testFilename := "bench_data.dat"
+			defer os.Remove(testFilename)
+
+			b.ResetTimer()
+
+			// loop: sync a file
+			for n := 0; n < b.N; n++ {
+				// write new test data each time so the chunks can't be reused from storage
+				b.StopTimer()
+				randoBytes := genRandomBytes(testFileSize)
+				ioutil.WriteFile(testFilename, randoBytes, os.ModePerm)
+				b.StartTimer()
+
+				destFilename := fmt.Sprintf("bench_data_j%d_%08d.dat", jobs, n)
+				_, _, err := cmdState.SyncFile(testFilename, destFilename, command.SyncCurrentVersion)
+				if err != nil {
+					b.Fatalf("Failed to at the file %s: %v", testFilename, err)
+				}
+			}
+		})
 	}
 }
 
@@ -86,55 +104,61 @@ func BenchmarkBasicFileSyncDown4MB(b *testing.B) {
 }
 
 func doBenchBasicFileSyncDown(testFileSize int, b *testing.B) {
-	// create the server and command states
-	cmdState := setupBenchmarkState(b)
-
-	// write the test file to the filesystem
-	testFilename := "bench_data.dat"
-	randoBytes := genRandomBytes(testFileSize)
-	ioutil.WriteFile(testFilename, randoBytes, os.ModePerm)
-
-	// test adding a file
-	fileStats, err := filefreezer.CalcFileHashInfo(cmdState.ServerCapabilities.ChunkSize, testFilename)
-	if err != nil {
-		b.Fatalf("Failed to calculate the file hash for %s: %v", testFilename, err)
-	}
-
-	// sync the test file to the server
-	_, _, err = cmdState.SyncFile(testFilename, testFilename, command.SyncCurrentVersion)
-	//_, err = cmdState.addFile(testFilename, testFilename, false, permissions, lastMod, chunkCount, hashString)
-	if err != nil {
-		b.Fatalf("Failed to at the file %s: %v", testFilename, err)
-	}
-
-	// remove the original copy
-	err = os.Remove(testFilename)
-	if err != nil {
-		b.Fatalf("Couldn't remove file just synced from server: %v", err)
-	}
-
-	b.ResetTimer()
-
-	// loop: sync a file
-	for n := 0; n < b.N; n++ {
-		localFilename := fmt.Sprintf("bench_data_local_%08d.dat", n)
-		status, changeCount, err := cmdState.SyncFile(localFilename, testFilename, command.SyncCurrentVersion)
-		if err != nil {
-			b.Fatalf("Failed to sync the file %s from the server: %v", localFilename, err)
-		}
-		if status != command.SyncStatusRemoteNewer {
-			b.Fatal("Benchmark sync should find the remote file newer.")
-		}
-		if changeCount != fileStats.ChunkCount {
-			b.Fatalf("The sync of the test file should be identical to the source, but sync said %d chunks were uploaded.", fileStats.ChunkCount)
-		}
-
-		// remove the local copy of the file
-		b.StopTimer()
-		err = os.Remove(localFilename)
-		if err != nil {
-			b.Fatalf("Couldn't remove file just synced from server: %v", err)
-		}
-		b.StartTimer()
+	for _, jobs := range benchJobCounts {
+		b.Run(fmt.Sprintf("jobs%d", jobs), func(b *testing.B) {
+			// create the server and command states
+			cmdState := setupBenchmarkState(b)
+			cmdState.Jobs = jobs
+			cmdState.ServerCapabilities.ChunkSize = benchChunkSize
+
+			// write the test file to the filesystem
+			testFilename := "bench_data.dat"
+			randoBytes := genRandomBytes(testFileSize)
+			ioutil.WriteFile(testFilename, randoBytes, os.ModePerm)
+
+			// test adding a file
+			fileStats, err := filefreezer.CalcFileHashInfo(cmdState.ServerCapabilities.ChunkSize, testFilename, nil)
+			if err != nil {
+				b.Fatalf("Failed to calculate the file hash for %s: %v", testFilename, err)
+			}
+
+			// sync the test file to the server
+			_, _, err = cmdState.SyncFile(testFilename, testFilename, command.SyncCurrentVersion)
+			//_, err = cmdState.addFile(testFilename, testFilename, false, permissions, lastMod, chunkCount, hashString)
+			if err != nil {
+				b.Fatalf("Failed to at the file %s: %v", testFilename, err)
+			}
+
+			// remove the original copy
+			err = os.Remove(testFilename)
+			if err != nil {
+				b.Fatalf("Couldn't remove file just synced from server: %v", err)
+			}
+
+			b.ResetTimer()
+
+			// loop: sync a file
+			for n := 0; n < b.N; n++ {
+				localFilename := fmt.Sprintf("bench_data_local_%08d.dat", n)
+				status, changeCount, err := cmdState.SyncFile(localFilename, testFilename, command.SyncCurrentVersion)
+				if err != nil {
+					b.Fatalf("Failed to sync the file %s from the server: %v", localFilename, err)
+				}
+				if status != command.SyncStatusRemoteNewer {
+					b.Fatal("Benchmark sync should find the remote file newer.")
+				}
+				if changeCount != fileStats.ChunkCount {
+					b.Fatalf("The sync of the test file should be identical to the source, but sync said %d chunks were uploaded.", fileStats.ChunkCount)
+				}
+
+				// remove the local copy of the file
+				b.StopTimer()
+				err = os.Remove(localFilename)
+				if err != nil {
+					b.Fatalf("Couldn't remove file just synced from server: %v", err)
+				}
+				b.StartTimer()
+			}
+		})
 	}
 }
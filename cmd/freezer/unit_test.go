@@ -4,11 +4,22 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,10 +29,14 @@ import (
 
 	"strings"
 
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
 	"github.com/spf13/afero"
 	"github.com/tbogdala/filefreezer"
+	"github.com/tbogdala/filefreezer/cmd/freezer/certgen"
 	"github.com/tbogdala/filefreezer/cmd/freezer/command"
 	"github.com/tbogdala/filefreezer/cmd/freezer/models"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
 const (
@@ -35,6 +50,12 @@ const (
 	testFilename3  = "testdata/subdir/unit_test_3.dat"
 	testFilename4  = "testdata/unit_test_empty.dat"
 	testRegex      = "testdata/uni*"
+
+	// the bytes added to each chunk by encrypting it: the chunk header, the nonce and the GCM tag
+	chunkCryptoOverhead = 25 + 12 + 16
+
+	// the password for the users added by addTestUser
+	testUserPassword = "1234"
 )
 
 var (
@@ -55,6 +76,78 @@ func genRandomBytes(length int) []byte {
 	return b
 }
 
+// adds a user to Storage with the username and quota given and testUserPassword, replacing
+// any user with that name left behind by an earlier test run; the returned function
+// removes the user again
+func addTestUser(t *testing.T, username string, quota int) (*filefreezer.User, func()) {
+	cmdState := command.NewState()
+	user, _ := state.Storage.GetUser(username)
+	if user != nil {
+		cmdState.RmUser(state.Storage, username)
+	}
+	user, err := cmdState.AddUser(state.Storage, username, testUserPassword, quota)
+	if user == nil || err != nil {
+		t.Fatalf("Failed to add the test user (%s) to Storage: %v", username, err)
+	}
+	return user, func() { cmdState.RmUser(state.Storage, username) }
+}
+
+// returns a command State that is logged in to the test server as the test user with the
+// crypto key unlocked by the test crypto password, which gets set if the user has none yet
+func loginTestUser(t *testing.T, username string) *command.State {
+	cmdState := command.NewState()
+	err := cmdState.Authenticate(testHost, username, testUserPassword)
+	if err == nil && len(cmdState.CryptoHash) == 0 {
+		err = cmdState.SetCryptoHashForPassword(*flagCryptoPass)
+	}
+	if err == nil {
+		err = cmdState.UnlockCryptoKey(*flagCryptoPass)
+	}
+	if err != nil {
+		t.Fatalf("Failed to log in as the test user (%s) with the crypto key unlocked: %v", username, err)
+	}
+	return cmdState
+}
+
+// adds a test user with addTestUser and logs in as the user with loginTestUser; the
+// returned function removes the user again
+func newTestUserState(t *testing.T, username string) (*command.State, *filefreezer.User, func()) {
+	user, cleanup := addTestUser(t, username, int(1e9))
+	return loginTestUser(t, username), user, cleanup
+}
+
+// parses the args with the application's flags like main does and returns a function
+// that puts back the flag values the other tests were using
+func parseTestArgs(t *testing.T, args ...string) func() {
+	model := appFlags.Model()
+	var values []kingpin.Value
+	for _, flag := range model.Flags {
+		values = append(values, flag.Value)
+	}
+	for _, cmd := range model.FlattenedCommands() {
+		for _, flag := range cmd.Flags {
+			values = append(values, flag.Value)
+		}
+		for _, arg := range cmd.Args {
+			values = append(values, arg.Value)
+		}
+	}
+	saved := make([]string, len(values))
+	for i, value := range values {
+		saved[i] = value.String()
+	}
+
+	_, err := appFlags.Parse(args)
+	if err != nil {
+		t.Fatalf("Failed to parse the command line %v: %v", args, err)
+	}
+	return func() {
+		for i, value := range values {
+			value.Set(saved[i])
+		}
+	}
+}
+
 // set the flags up to use the certificates used for testing via https and TLS
 func setupHTTPSTestFlags() {
 	*flagTLSKey = "freezer.key"
@@ -98,8 +191,18 @@ func TestMain(m *testing.M) {
 	ioutil.WriteFile(testFilename3, rando3, os.ModePerm)
 
 	// run a new state in a server
-	var err error
-	state, err = newState()
+	cfg, err := loadServerConfig()
+	if err != nil {
+		log.Fatalf("Unable to load the server configuration: %v", err)
+	}
+
+	// the tests log in and make requests much faster than the default rate limits
+	// allow, so they're turned off here and tested with a separate server
+	cfg.RateLimit = serverRateLimitConfig{}
+
+	// the requests are logged by a separate server in the tests instead of to stdout
+	cfg.Logging.Requests = ""
+	state, err = newState(cfg)
 	if err != nil {
 		log.Fatalf("Unable to initialize the server: %v", err)
 	}
@@ -109,7 +212,19 @@ func TestMain(m *testing.M) {
 	readyCh := make(chan bool)
 	go state.serve(readyCh)
 
-	<-readyCh
+	if !<-readyCh {
+		log.Fatalf("Unable to prepare the database for the server.")
+	}
+
+	// the database can be ready before the server is listening
+	for tries := 0; tries < 50; tries++ {
+		conn, err := net.Dial("tcp", "127.0.0.1"+testServerAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
 	os.Exit(m.Run())
 }
 
@@ -138,7 +253,7 @@ func TestEverything(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to set the crypto password for the test user: %v", err)
 	}
-	cmdState.CryptoKey, err = filefreezer.VerifyCryptoPassword(*flagCryptoPass, string(cmdState.CryptoHash))
+	err = cmdState.UnlockCryptoKey(*flagCryptoPass)
 	if err != nil {
 		t.Fatalf("Failed to set the crypto key for the test user: %v", err)
 	}
@@ -176,7 +291,7 @@ func TestEverything(t *testing.T) {
 
 	// test adding a file
 	filename := testFilename1
-	fileStats, err := filefreezer.CalcFileHashInfo(cmdState.ServerCapabilities.ChunkSize, filename)
+	fileStats, err := filefreezer.CalcFileHashInfo(cmdState.ServerCapabilities.ChunkSize, filename, nil)
 	if err != nil {
 		t.Fatalf("Failed to calculate the file hash for %s: %v", filename, err)
 	}
@@ -407,11 +522,12 @@ func TestEverything(t *testing.T) {
 	if syncStatus != command.SyncStatusLocalNewer {
 		t.Fatalf("Sync after regeneration should be newer for file %s (%d)", filename, syncStatus)
 	}
-	if ulCount != 3 {
-		t.Fatalf("The sync of the changed test file should have downloaded 3 chunks but it uploaded %d.", ulCount)
+	if ulCount != 0 {
+		t.Fatalf("The sync of the aliased test file should have reused all of the stored chunks but it uploaded %d.", ulCount)
 	}
 
-	// at this point we should have different allocation and revision
+	// at this point we should have a different revision, but the allocation should be the
+	// same because the chunks for the aliased file are already stored
 	oldAllocation = userStats.Allocated
 	oldRevision = userStats.Revision
 	userStats, err = cmdState.GetUserStats()
@@ -421,10 +537,9 @@ func TestEverything(t *testing.T) {
 	if userStats.Revision <= oldRevision {
 		t.Fatalf("The revision count didn't update as expected for the authenticated user: %d", userStats.Revision)
 	}
-	if userStats.Allocated <= oldAllocation {
-		t.Fatalf("The allocation count didn't update as expected for the authenticated user: %d", userStats.Allocated)
+	if userStats.Allocated != oldAllocation {
+		t.Fatalf("The allocation count changed for a file with chunks already in storage: %d", userStats.Allocated)
 	}
-	aliasedAllocation := userStats.Allocated - oldAllocation
 
 	// confirm that there's a new file by getting the total list of files
 	allFiles, err = cmdState.GetAllFileHashes()
@@ -448,7 +563,8 @@ func TestEverything(t *testing.T) {
 		t.Fatalf("Aliased file (%s) didn't show up in the file hash list.", aliasedFilename)
 	}
 
-	// remove the aliased file and make sure the allocation count decreases by the same amount
+	// remove the aliased file and make sure the allocation count stays the same
+	// because the original file still references the same chunks
 	err = cmdState.RmFile(aliasedFilename, false)
 	if err != nil {
 		t.Fatalf("Failed to remove the aliased file from the server: %v", err)
@@ -462,7 +578,7 @@ func TestEverything(t *testing.T) {
 	if userStats.Revision <= oldRevision {
 		t.Fatalf("The revision count didn't update as expected for the authenticated user: %d", userStats.Revision)
 	}
-	if userStats.Allocated != oldAllocation-aliasedAllocation {
+	if userStats.Allocated != oldAllocation {
 		t.Fatalf("The allocation count didn't update as expected for the authenticated user: %d", userStats.Allocated)
 	}
 
@@ -675,7 +791,7 @@ func TestFileVersioning(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to set the crypto password for the test user: %v", err)
 	}
-	cmdState.CryptoKey, err = filefreezer.VerifyCryptoPassword(*flagCryptoPass, string(cmdState.CryptoHash))
+	err = cmdState.UnlockCryptoKey(*flagCryptoPass)
 	if err != nil {
 		t.Fatalf("Failed to set the crypto key for the test user: %v", err)
 	}
@@ -729,7 +845,7 @@ func TestFileVersioning(t *testing.T) {
 	}
 
 	// make sure the user quota updated correctly
-	bytesAllocated += len(rando1) + 28*3 // bonus crypto for each chunk
+	bytesAllocated += len(rando1) + chunkCryptoOverhead*3 // bonus crypto for each chunk
 	userStats, err := cmdState.GetUserStats()
 	if err != nil {
 		t.Fatalf("Failed to get the user stats for the test user: %v", err)
@@ -777,8 +893,9 @@ func TestFileVersioning(t *testing.T) {
 	callbackVersion := versions[1]
 	callbackBytes := rando1
 
-	// make sure the user quota updated correctly
-	bytesAllocated += len(rando1) + 28*3 // bonus crypto for each chunk
+	// make sure the user quota updated correctly; only the first chunk changed
+	// so the other two are reused from the first version
+	bytesAllocated += int(*flagServeChunkSize) + chunkCryptoOverhead // bonus crypto for each chunk
 	userStats, err = cmdState.GetUserStats()
 	if err != nil {
 		t.Fatalf("Failed to get the user stats for the test user: %v", err)
@@ -819,7 +936,7 @@ func TestFileVersioning(t *testing.T) {
 	}
 
 	// make sure the user quota updated correctly
-	bytesAllocated += len(rando1) + 28*3 // bonus crypto for each chunk
+	bytesAllocated += len(rando1) + chunkCryptoOverhead*3 // bonus crypto for each chunk
 	userStats, err = cmdState.GetUserStats()
 	if err != nil {
 		t.Fatalf("Failed to get the user stats for the test user: %v", err)
@@ -860,7 +977,7 @@ func TestFileVersioning(t *testing.T) {
 	}
 
 	// make sure the user quota updated correctly
-	bytesAllocated += len(rando1) + 28*6 // bonus crypto for each chunk
+	bytesAllocated += len(rando1) + chunkCryptoOverhead*6 // bonus crypto for each chunk
 	userStats, err = cmdState.GetUserStats()
 	if err != nil {
 		t.Fatalf("Failed to get the user stats for the test user: %v", err)
@@ -900,8 +1017,9 @@ func TestFileVersioning(t *testing.T) {
 		t.Fatalf("Expected to get five file versions for the test file but received %d.", len(versions))
 	}
 
-	// make sure the user quota updated correctly
-	bytesAllocated += len(rando1) + 28*2 // bonus crypto for each chunk
+	// make sure the user quota updated correctly; the first chunk is the
+	// same as the previous version so only the second chunk is new
+	bytesAllocated += len(rando1) - int(*flagServeChunkSize) + chunkCryptoOverhead // bonus crypto for each chunk
 	userStats, err = cmdState.GetUserStats()
 	if err != nil {
 		t.Fatalf("Failed to get the user stats for the test user: %v", err)
@@ -1019,6 +1137,2302 @@ func TestFileVersioning(t *testing.T) {
 	}
 }
 
+func TestParallelChunkTransfers(t *testing.T) {
+	// create a separate test user
+	cmdState, _, cleanup := newTestUserState(t, "parallel")
+	defer cleanup()
+	cmdState.Jobs = 8
+
+	// use a small chunk size on the client so that the file has more chunks than workers
+	const chunkSize = 1024 * 64
+	const chunkCount = 21
+	cmdState.ServerCapabilities.ChunkSize = chunkSize
+
+	filename := testDataDir + "/parallel_test.dat"
+	downFilename := testDataDir + "/parallel_test_down.dat"
+	badFilename := testDataDir + "/parallel_test_bad.dat"
+	defer os.Remove(filename)
+	defer os.Remove(downFilename)
+	defer os.Remove(badFilename)
+
+	rando := genRandomBytes(chunkSize*(chunkCount-1) + 42)
+	ioutil.WriteFile(filename, rando, os.ModePerm)
+
+	// upload all of the chunks at once
+	status, ulCount, err := cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to upload the file %s: %v", filename, err)
+	}
+	if status != command.SyncStatusLocalNewer || ulCount != chunkCount {
+		t.Fatalf("Expected all %d chunks to be uploaded but %d were (status %d).", chunkCount, ulCount, status)
+	}
+
+	// download the chunks to a new file, which should be written at the right offsets
+	status, dlCount, err := cmdState.SyncFile(downFilename, filename, command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to download the file %s: %v", filename, err)
+	}
+	if status != command.SyncStatusRemoteNewer || dlCount != chunkCount {
+		t.Fatalf("Expected all %d chunks to be downloaded but %d were (status %d).", chunkCount, dlCount, status)
+	}
+	downBytes, err := ioutil.ReadFile(downFilename)
+	if err != nil {
+		t.Fatalf("Failed to read the downloaded file %s: %v", downFilename, err)
+	}
+	if bytes.Compare(rando, downBytes) != 0 {
+		t.Fatalf("The downloaded file did not match the uploaded file.")
+	}
+
+	// a failing chunk should stop the download with an error instead of hanging
+	goodKey := cmdState.CryptoKey
+	cmdState.CryptoKey = genRandomBytes(len(goodKey))
+	_, _, err = cmdState.SyncFile(badFilename, filename, command.SyncCurrentVersion)
+	cmdState.CryptoKey = goodKey
+	if err == nil {
+		t.Fatalf("Downloading the file with the wrong crypto key should have failed.")
+	}
+}
+
+func TestSyncIndex(t *testing.T) {
+	// create a separate test user
+	cmdState, user, cleanup := newTestUserState(t, "indexer")
+	defer cleanup()
+	cmdState.ServerCapabilities.ChunkSize = 1024 * 64
+
+	// open a sync index in a temporary directory
+	indexDir, err := ioutil.TempDir("", "freezer_index")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for the sync index: %v", err)
+	}
+	defer os.RemoveAll(indexDir)
+	indexPath, err := command.SyncIndexPath(indexDir, testHost, user.Name, testDataDir)
+	if err != nil {
+		t.Fatalf("Failed to get the sync index path: %v", err)
+	}
+	cmdState.Index, err = command.OpenSyncIndex(indexPath)
+	if err != nil {
+		t.Fatalf("Failed to open the sync index: %v", err)
+	}
+	defer cmdState.Index.Close()
+
+	filename := testDataDir + "/index_test.dat"
+	defer os.Remove(filename)
+	rando := genRandomBytes(int(cmdState.ServerCapabilities.ChunkSize)*2 + 42)
+	ioutil.WriteFile(filename, rando, os.ModePerm)
+
+	// the first sync uploads the file and records the remote version in the index
+	status, _, err := cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer {
+		t.Fatalf("Failed to upload the file %s (status %d): %v", filename, status, err)
+	}
+	remote, err := cmdState.GetFileInfoByFilename(filename)
+	if err != nil {
+		t.Fatalf("Failed to get the remote file info for %s: %v", filename, err)
+	}
+	absFilename, _ := filepath.Abs(filename)
+	entry, err := cmdState.Index.GetEntry(absFilename)
+	if err != nil || entry == nil {
+		t.Fatalf("Expected the file to have an entry in the sync index: %v", err)
+	}
+	if entry.RemoteFileID != remote.FileID || entry.RemoteVersionID != remote.CurrentVersion.VersionID ||
+		entry.FileHash != remote.CurrentVersion.FileHash || entry.Size != int64(len(rando)) {
+		t.Fatalf("The sync index entry doesn't match the uploaded file: %+v", entry)
+	}
+	cachedName, cached, err := cmdState.Index.GetRemoteName(remote.FileID, remote.FileName)
+	if err != nil || !cached || cachedName != filename {
+		t.Fatalf("Expected the remote file name to be cached in the sync index: %v", err)
+	}
+
+	// overwrite the file with the same size and modification time; since the stat
+	// data is unchanged, the file isn't hashed again and looks unchanged.
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Failed to stat the file %s: %v", filename, err)
+	}
+	changed := genRandomBytes(len(rando))
+	ioutil.WriteFile(filename, changed, os.ModePerm)
+	err = os.Chtimes(filename, fileInfo.ModTime(), fileInfo.ModTime())
+	if err != nil {
+		t.Fatalf("Failed to reset the modification time of %s: %v", filename, err)
+	}
+	status, changeCount, err := cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusSame || changeCount != 0 {
+		t.Fatalf("Expected the indexed file to be unchanged (status %d, changes %d): %v", status, changeCount, err)
+	}
+
+	// forcing a rehash should find the new contents and upload them
+	cmdState.Rehash = true
+	status, changeCount, err = cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer || changeCount != 3 {
+		t.Fatalf("Expected the rehashed file to be uploaded (status %d, changes %d): %v", status, changeCount, err)
+	}
+	cmdState.Rehash = false
+
+	// downloading the file should index it so the next sync doesn't hash it
+	os.Remove(filename)
+	status, _, err = cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusRemoteNewer {
+		t.Fatalf("Failed to download the file %s (status %d): %v", filename, status, err)
+	}
+	downBytes, err := ioutil.ReadFile(filename)
+	if err != nil || bytes.Compare(downBytes, changed) != 0 {
+		t.Fatalf("The downloaded file did not match the rehashed file: %v", err)
+	}
+	downStats, err := filefreezer.CalcFileHashInfo(cmdState.ServerCapabilities.ChunkSize, filename, filefreezer.DeriveHashKey(cmdState.CryptoKey))
+	if err != nil {
+		t.Fatalf("Failed to hash the downloaded file %s: %v", filename, err)
+	}
+	entry, err = cmdState.Index.GetEntry(absFilename)
+	if err != nil || entry == nil || entry.FileHash != downStats.HashString {
+		t.Fatalf("Expected the downloaded file to be in the sync index with its hash: %v", err)
+	}
+	status, changeCount, err = cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusSame || changeCount != 0 {
+		t.Fatalf("Expected the downloaded file to be unchanged (status %d, changes %d): %v", status, changeCount, err)
+	}
+}
+
+func TestSyncConflicts(t *testing.T) {
+	// create a separate test user
+	username := "conflicted"
+	_, cleanup := addTestUser(t, username, int(1e9))
+	defer cleanup()
+
+	testDir, err := ioutil.TempDir("", "freezer_conflict")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	// two clients of the same user, each with its own copy of the file and sync index
+	remoteName := "/conflict/notes.txt"
+	newClient := func(name string) (*command.State, string) {
+		cmdState := loginTestUser(t, username)
+		cmdState.ServerCapabilities.ChunkSize = 1024
+
+		localDir := filepath.Join(testDir, name)
+		os.MkdirAll(localDir, 0700)
+		indexPath, err := command.SyncIndexPath(testDir, testHost, username, localDir)
+		if err == nil {
+			cmdState.Index, err = command.OpenSyncIndex(indexPath)
+		}
+		if err != nil {
+			t.Fatalf("Failed to open the sync index: %v", err)
+		}
+		return cmdState, filepath.Join(localDir, "notes.txt")
+	}
+	clientA, filenameA := newClient("a")
+	defer clientA.Index.Close()
+	clientB, filenameB := newClient("b")
+	defer clientB.Index.Close()
+
+	writeAt := func(filename string, data []byte, mod time.Time) {
+		err := ioutil.WriteFile(filename, data, 0600)
+		if err == nil {
+			err = os.Chtimes(filename, mod, mod)
+		}
+		if err != nil {
+			t.Fatalf("Failed to write the test file: %v", err)
+		}
+	}
+	checkFile := func(filename string, data []byte) {
+		local, err := ioutil.ReadFile(filename)
+		if err != nil || !bytes.Equal(local, data) {
+			t.Fatalf("The file %s did not have the expected contents: %v", filename, err)
+		}
+	}
+	syncStatus := func(cmdState *command.State, filename string, expected int) {
+		status, _, err := cmdState.SyncFile(filename, remoteName, command.SyncCurrentVersion)
+		if err != nil || status != expected {
+			t.Fatalf("Expected %s to sync with status %d (got %d): %v", filename, expected, status, err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+
+	// both clients start out with the same file
+	first := genRandomBytes(3000)
+	writeAt(filenameA, first, start)
+	syncStatus(clientA, filenameA, command.SyncStatusLocalNewer)
+	syncStatus(clientB, filenameB, command.SyncStatusRemoteNewer)
+	checkFile(filenameB, first)
+
+	// a file that only changed remotely is downloaded even if the local file was
+	// touched after the remote change
+	second := genRandomBytes(3100)
+	writeAt(filenameA, second, start.Add(time.Minute))
+	syncStatus(clientA, filenameA, command.SyncStatusLocalNewer)
+	os.Chtimes(filenameB, start.Add(time.Minute*2), start.Add(time.Minute*2))
+	syncStatus(clientB, filenameB, command.SyncStatusRemoteNewer)
+	checkFile(filenameB, second)
+
+	// and a file that only changed locally is uploaded even if it looks older
+	third := genRandomBytes(3200)
+	writeAt(filenameB, third, start.Add(-time.Minute))
+	syncStatus(clientB, filenameB, command.SyncStatusLocalNewer)
+	syncStatus(clientA, filenameA, command.SyncStatusRemoteNewer)
+	checkFile(filenameA, third)
+
+	// by default the file that was modified last wins
+	restoreFlags := parseTestArgs(t, "syncdir", "local", "remote")
+	if *flagConflict != command.ConflictNewer {
+		restoreFlags()
+		t.Fatalf("Expected conflicts to be resolved with %s by default; got %s", command.ConflictNewer, *flagConflict)
+	}
+	restoreFlags()
+	clientB.Conflict = ""
+	fromA := genRandomBytes(3250)
+	fromB := genRandomBytes(3260)
+	writeAt(filenameA, fromA, start.Add(time.Minute*2))
+	syncStatus(clientA, filenameA, command.SyncStatusLocalNewer)
+	writeAt(filenameB, fromB, start.Add(time.Minute*2+time.Second*30))
+	syncStatus(clientB, filenameB, command.SyncStatusLocalNewer)
+	syncStatus(clientA, filenameA, command.SyncStatusRemoteNewer)
+	checkFile(filenameA, fromB)
+
+	// with keep-both the local changes are kept in a conflict copy
+	clientB.Conflict = command.ConflictKeepBoth
+	fromA = genRandomBytes(3300)
+	fromB = genRandomBytes(3400)
+	writeAt(filenameA, fromA, start.Add(time.Minute*3))
+	syncStatus(clientA, filenameA, command.SyncStatusLocalNewer)
+	writeAt(filenameB, fromB, start.Add(time.Minute*4))
+	syncStatus(clientB, filenameB, command.SyncStatusRemoteNewer)
+	checkFile(filenameB, fromA)
+	copies, err := filepath.Glob(filenameB + ".conflict-*")
+	if err != nil || len(copies) != 1 {
+		t.Fatalf("Expected one conflict copy of the local file (%v): %v", copies, err)
+	}
+	checkFile(copies[0], fromB)
+	syncStatus(clientB, filenameB, command.SyncStatusSame)
+
+	// with local the local file becomes the new version
+	clientB.Conflict = command.ConflictLocal
+	fromA = genRandomBytes(3500)
+	fromB = genRandomBytes(3600)
+	writeAt(filenameA, fromA, start.Add(time.Minute*6))
+	syncStatus(clientA, filenameA, command.SyncStatusLocalNewer)
+	writeAt(filenameB, fromB, start.Add(time.Minute*5))
+	syncStatus(clientB, filenameB, command.SyncStatusLocalNewer)
+	syncStatus(clientA, filenameA, command.SyncStatusRemoteNewer)
+	checkFile(filenameA, fromB)
+
+	// with ask the prompt picks the policy
+	clientB.Conflict = command.ConflictAsk
+	asked := 0
+	clientB.ConflictPrompt = func(localFilename string, remoteFilepath string) string {
+		asked++
+		if localFilename != filenameB || remoteFilepath != remoteName {
+			t.Fatalf("The conflict prompt was asked about the wrong file: %s (%s)", localFilename, remoteFilepath)
+		}
+		return command.ConflictRemote
+	}
+	fromA = genRandomBytes(3700)
+	fromB = genRandomBytes(3800)
+	writeAt(filenameA, fromA, start.Add(time.Minute*7))
+	syncStatus(clientA, filenameA, command.SyncStatusLocalNewer)
+	writeAt(filenameB, fromB, start.Add(time.Minute*8))
+	syncStatus(clientB, filenameB, command.SyncStatusRemoteNewer)
+	if asked != 1 {
+		t.Fatalf("Expected the conflict prompt to be asked once (asked %d times)", asked)
+	}
+	checkFile(filenameB, fromA)
+}
+
+func TestChangeFeed(t *testing.T) {
+	// create a separate test user
+	cmdState, user, cleanup := newTestUserState(t, "changer")
+	defer cleanup()
+	cmdState.ServerCapabilities.ChunkSize = 1024
+
+	// a second client for the same user that doesn't keep a sync index
+	otherState := loginTestUser(t, user.Name)
+	otherState.ServerCapabilities.ChunkSize = 1024
+
+	testDir, err := ioutil.TempDir("", "freezer_changes")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	dirA := filepath.Join(testDir, "a")
+	dirB := filepath.Join(testDir, "b")
+	os.MkdirAll(dirA, 0700)
+	os.MkdirAll(dirB, 0700)
+
+	cmdState.Index, err = command.OpenSyncIndex(filepath.Join(testDir, "index.db"))
+	if err != nil {
+		t.Fatalf("Failed to open the sync index: %v", err)
+	}
+	defer cmdState.Index.Close()
+
+	// the first sync has nothing cached so it gets all of the files
+	first := genRandomBytes(3000)
+	ioutil.WriteFile(filepath.Join(dirA, "first.dat"), first, 0600)
+	_, err = cmdState.SyncDirectory(dirA, "/feed")
+	if err != nil {
+		t.Fatalf("Failed to sync the first directory: %v", err)
+	}
+	revision, cached, err := cmdState.Index.GetRemoteFiles()
+	if err != nil || revision != 0 || len(cached) != 0 {
+		t.Fatalf("Expected the empty remote file list to be cached at revision 0 (got %d): %v", revision, err)
+	}
+
+	// the other client gets the file and adds one of its own
+	second := genRandomBytes(1500)
+	ioutil.WriteFile(filepath.Join(dirB, "second.dat"), second, 0600)
+	_, err = otherState.SyncDirectory(dirB, "/feed")
+	if err != nil {
+		t.Fatalf("Failed to sync the second directory: %v", err)
+	}
+	downBytes, err := ioutil.ReadFile(filepath.Join(dirB, "first.dat"))
+	if err != nil || bytes.Compare(downBytes, first) != 0 {
+		t.Fatalf("The second client didn't download the first file: %v", err)
+	}
+
+	// the next sync only pulls the changes and picks up the new file
+	stats, err := cmdState.GetUserStats()
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	changes, err := cmdState.GetChanges(0)
+	if err != nil || !changes.Complete || changes.Revision != stats.Revision || len(changes.Changes) != stats.Revision ||
+		len(changes.Files) != 2 || len(changes.Removed) != 0 {
+		t.Fatalf("Expected every change since the start to be returned for both files: %v %+v", err, changes)
+	}
+	_, err = cmdState.SyncDirectory(dirA, "/feed")
+	if err != nil {
+		t.Fatalf("Failed to sync the first directory again: %v", err)
+	}
+	downBytes, err = ioutil.ReadFile(filepath.Join(dirA, "second.dat"))
+	if err != nil || bytes.Compare(downBytes, second) != 0 {
+		t.Fatalf("The incremental sync didn't download the second file: %v", err)
+	}
+	revision, cached, err = cmdState.Index.GetRemoteFiles()
+	if err != nil || revision != stats.Revision || len(cached) != 2 {
+		t.Fatalf("Expected both remote files to be cached at revision %d (got %d files at %d): %v", stats.Revision, len(cached), revision, err)
+	}
+
+	// removed files are listed by id
+	secondInfo, err := cmdState.GetFileInfoByFilename("/feed/second.dat")
+	if err != nil {
+		t.Fatalf("Failed to get the second file info: %v", err)
+	}
+	err = otherState.RmFile("/feed/second.dat", false)
+	if err != nil {
+		t.Fatalf("Failed to remove the second file: %v", err)
+	}
+	changes, err = cmdState.GetChanges(revision)
+	if err != nil || !changes.Complete || len(changes.Changes) != 1 || changes.Changes[0].Change != filefreezer.ChangeFileRemove ||
+		len(changes.Files) != 0 || len(changes.Removed) != 1 || changes.Removed[0] != secondInfo.FileID {
+		t.Fatalf("Expected the change feed to have the removed file: %v %+v", err, changes)
+	}
+
+	// an unknown revision means the client has to get all of the files
+	changes, err = cmdState.GetChanges(changes.Revision + 10)
+	if err != nil || changes.Complete {
+		t.Fatalf("Expected the changes since an unknown revision to be incomplete: %v", err)
+	}
+	_, err = cmdState.RunAuthRequest(testHost+"/api/changes?since=nope", "GET", cmdState.AuthToken, nil)
+	if err == nil {
+		t.Fatalf("Expected a bad since revision to fail.")
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	// create a separate test user that is an admin so that it can change its own quota
+	cmdState, user, cleanup := newTestUserState(t, "watcher")
+	defer cleanup()
+	err := cmdState.SetUserAdmin(state.Storage, user.Name, true)
+	if err != nil {
+		t.Fatalf("Failed to make the test user an admin: %v", err)
+	}
+	cmdState.ServerCapabilities.ChunkSize = 1024
+
+	// the second client makes the changes the first one watches for
+	otherState := loginTestUser(t, user.Name)
+	otherState.ServerCapabilities.ChunkSize = 1024
+
+	testDir, err := ioutil.TempDir("", "freezer_watch")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	dirA := filepath.Join(testDir, "a")
+	dirB := filepath.Join(testDir, "b")
+	os.MkdirAll(dirA, 0700)
+	os.MkdirAll(dirB, 0700)
+
+	// listen to the raw event stream of the second client as well
+	stop := make(chan struct{})
+	events := make(chan models.Event, 1000)
+	streamDone := make(chan error, 1)
+	go func() {
+		streamDone <- otherState.StreamEvents(stop, func(event models.Event) error {
+			events <- event
+			return nil
+		})
+	}()
+	waitForEvent := func(name string) models.Event {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case event := <-events:
+				if event.Event == name {
+					return event
+				}
+			case <-timeout:
+				t.Fatalf("Timed out waiting for the %s event.", name)
+			}
+		}
+	}
+	ready := waitForEvent(models.EventReady)
+
+	// the first client watches its directory
+	watchDone := make(chan error, 1)
+	go func() {
+		watchDone <- cmdState.Watch(dirA, "/watch", stop)
+	}()
+	waitForFile := func(filename string, expected []byte) {
+		for i := 0; i < 100; i++ {
+			data, err := ioutil.ReadFile(filename)
+			if err == nil && bytes.Compare(data, expected) == 0 {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("Timed out waiting for the watching client to pull %s.", filename)
+	}
+
+	// a new file from the second client gets pulled by the first
+	localB := filepath.Join(dirB, "pushed.dat")
+	original := genRandomBytes(2500)
+	ioutil.WriteFile(localB, original, 0600)
+	_, _, err = otherState.SyncFile(localB, "/watch/pushed.dat", command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to upload the file from the second client: %v", err)
+	}
+	added := waitForEvent(filefreezer.ChangeFileAdd)
+	if added.Revision != ready.Revision+1 || added.FileID == 0 || added.VersionID == 0 {
+		t.Fatalf("The file add event didn't have the expected revision and ids: %+v", added)
+	}
+	chunk := waitForEvent(filefreezer.ChangeChunkAdd)
+	if chunk.FileID != added.FileID || chunk.Revision <= added.Revision {
+		t.Fatalf("The chunk add event didn't have the expected revision and ids: %+v", chunk)
+	}
+	waitForFile(filepath.Join(dirA, "pushed.dat"), original)
+
+	// and so does a new version of it
+	updated := genRandomBytes(1800)
+	ioutil.WriteFile(localB, updated, 0600)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(localB, later, later)
+	_, _, err = otherState.SyncFile(localB, "/watch/pushed.dat", command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to upload the new version from the second client: %v", err)
+	}
+	tagged := waitForEvent(filefreezer.ChangeVersionAdd)
+	if tagged.FileID != added.FileID || tagged.VersionID == added.VersionID {
+		t.Fatalf("The version event didn't have the expected ids: %+v", tagged)
+	}
+	waitForFile(filepath.Join(dirA, "pushed.dat"), updated)
+
+	// quota changes and removals are sent too
+	err = otherState.AdminSetUserQuota(user.Name, 5000000)
+	if err != nil {
+		t.Fatalf("Failed to change the quota: %v", err)
+	}
+	quota := waitForEvent(models.EventQuota)
+	if quota.Quota != 5000000 {
+		t.Fatalf("The quota event didn't have the new quota: %+v", quota)
+	}
+	err = otherState.RmFile("/watch/pushed.dat", false)
+	if err != nil {
+		t.Fatalf("Failed to remove the file: %v", err)
+	}
+	removed := waitForEvent(filefreezer.ChangeFileRemove)
+	if removed.FileID != added.FileID {
+		t.Fatalf("The remove event didn't have the file id: %+v", removed)
+	}
+
+	// closing the stop channel ends both streams
+	close(stop)
+	for _, done := range []chan error{streamDone, watchDone} {
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Fatalf("Expected the event stream to stop without an error: %v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for the event streams to stop.")
+		}
+	}
+	for i := 0; ; i++ {
+		state.Events.lock.Lock()
+		subCount := len(state.Events.subs[user.ID])
+		state.Events.lock.Unlock()
+		if subCount == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Expected the server to close the event streams but %d are still open.", subCount)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	// create a separate test user
+	cmdState, _, cleanup := newTestUserState(t, "resumer")
+	defer cleanup()
+	cmdState.ServerCapabilities.ChunkSize = 1024
+
+	// a proxy to the server that drops the connection after a number of chunk uploads
+	target, _ := url.Parse(testHost)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var chunksAllowed int32
+	dropping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/api/chunk/") && atomic.AddInt32(&chunksAllowed, -1) < 0 {
+			http.Error(w, "connection dropped", http.StatusBadGateway)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer dropping.Close()
+
+	testDir, err := ioutil.TempDir("", "freezer_resume")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	filename := filepath.Join(testDir, "resume.dat")
+	remoteName := "/resume/resume.dat"
+	writeAt := func(data []byte, mod time.Time) {
+		err := ioutil.WriteFile(filename, data, 0600)
+		if err == nil {
+			err = os.Chtimes(filename, mod, mod)
+		}
+		if err != nil {
+			t.Fatalf("Failed to write the test file: %v", err)
+		}
+	}
+
+	first := genRandomBytes(5000)
+	writeAt(first, time.Now().Add(-time.Hour))
+	_, _, err = cmdState.SyncFile(filename, remoteName, command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to sync the first version of the file: %v", err)
+	}
+
+	// the upload of the second version is interrupted after two chunks
+	second := genRandomBytes(5000)
+	writeAt(second, time.Now().Add(-time.Minute))
+	cmdState.HostURI = dropping.URL
+	atomic.StoreInt32(&chunksAllowed, 2)
+	_, _, err = cmdState.SyncFile(filename, remoteName, command.SyncCurrentVersion)
+	if err == nil {
+		t.Fatalf("The interrupted upload should have failed.")
+	}
+	cmdState.HostURI = testHost
+
+	// the unfinished version isn't current
+	fi, err := cmdState.GetFileInfoByFilename(remoteName)
+	if err != nil || fi.CurrentVersion.VersionNumber != 1 {
+		t.Fatalf("The interrupted upload should have left the first version current (%+v): %v", fi.CurrentVersion, err)
+	}
+
+	// syncing again resumes the upload with only the missing chunks
+	status, ulCount, err := cmdState.SyncFile(filename, remoteName, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer || ulCount != 3 {
+		t.Fatalf("Expected the resumed upload to send the 3 missing chunks (status %d, sent %d): %v", status, ulCount, err)
+	}
+	fi, err = cmdState.GetFileInfoByFilename(remoteName)
+	if err != nil || fi.CurrentVersion.VersionNumber != 2 {
+		t.Fatalf("The resumed upload should have made the second version current (%+v): %v", fi.CurrentVersion, err)
+	}
+
+	// an interrupted upload of a file that changes again is replaced by the new version
+	writeAt(genRandomBytes(5000), time.Now().Add(-time.Second*30))
+	cmdState.HostURI = dropping.URL
+	atomic.StoreInt32(&chunksAllowed, 1)
+	_, _, err = cmdState.SyncFile(filename, remoteName, command.SyncCurrentVersion)
+	if err == nil {
+		t.Fatalf("The interrupted upload should have failed.")
+	}
+	cmdState.HostURI = testHost
+	third := genRandomBytes(5000)
+	writeAt(third, time.Now())
+	_, ulCount, err = cmdState.SyncFile(filename, remoteName, command.SyncCurrentVersion)
+	if err != nil || ulCount != 5 {
+		t.Fatalf("Expected the new version to be uploaded in full (sent %d): %v", ulCount, err)
+	}
+	versions, err := cmdState.GetFileVersions(remoteName)
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("Expected the interrupted version to be removed leaving 3 versions (%+v): %v", versions, err)
+	}
+	for _, v := range versions {
+		if v.VersionNumber == 3 {
+			t.Fatalf("The interrupted version was left behind.")
+		}
+	}
+
+	// and the file downloads with the latest contents
+	os.Remove(filename)
+	_, _, err = cmdState.SyncFile(filename, remoteName, command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to download the file: %v", err)
+	}
+	downloaded, err := ioutil.ReadFile(filename)
+	if err != nil || !bytes.Equal(downloaded, third) {
+		t.Fatalf("The downloaded file did not match the latest version: %v", err)
+	}
+
+	// a new file that hasn't been committed isn't downloaded by other clients
+	newFilename := filepath.Join(testDir, "new.dat")
+	newRemoteName := "/resume/new.dat"
+	newData := genRandomBytes(3000)
+	ioutil.WriteFile(newFilename, newData, 0600)
+	cmdState.HostURI = dropping.URL
+	atomic.StoreInt32(&chunksAllowed, 1)
+	_, _, err = cmdState.SyncFile(newFilename, newRemoteName, command.SyncCurrentVersion)
+	if err == nil {
+		t.Fatalf("The interrupted upload should have failed.")
+	}
+	cmdState.HostURI = testHost
+	fi, err = cmdState.GetFileInfoByFilename(newRemoteName)
+	if err != nil || fi.CurrentVersion.Committed {
+		t.Fatalf("The interrupted upload of a new file should have left it pending (%+v): %v", fi.CurrentVersion, err)
+	}
+	otherFilename := filepath.Join(testDir, "other.dat")
+	_, dlCount, err := cmdState.SyncFile(otherFilename, newRemoteName, command.SyncCurrentVersion)
+	if err != nil || dlCount != 0 {
+		t.Fatalf("The pending file should not have been downloaded (got %d chunks): %v", dlCount, err)
+	}
+	if _, err = os.Stat(otherFilename); !os.IsNotExist(err) {
+		t.Fatalf("The pending file should not have been written locally: %v", err)
+	}
+
+	// the commit is refused until the chunks are there and the hash matches
+	newStats, err := filefreezer.CalcFileHashInfo(cmdState.ServerCapabilities.ChunkSize, newFilename, nil)
+	if err != nil {
+		t.Fatalf("Failed to hash the new file: %v", err)
+	}
+	err = cmdState.CommitVersion(fi.FileID, fi.CurrentVersion.VersionID, &newStats)
+	if err == nil {
+		t.Fatalf("Committing a version with missing chunks and a different hash should have failed.")
+	}
+
+	// syncing the file again finishes the upload and commits it
+	_, ulCount, err = cmdState.SyncFile(newFilename, newRemoteName, command.SyncCurrentVersion)
+	if err != nil || ulCount != 2 {
+		t.Fatalf("Expected the resumed upload to send the 2 missing chunks (sent %d): %v", ulCount, err)
+	}
+	fi, err = cmdState.GetFileInfoByFilename(newRemoteName)
+	if err != nil || !fi.CurrentVersion.Committed {
+		t.Fatalf("The finished upload should have been committed (%+v): %v", fi.CurrentVersion, err)
+	}
+	_, _, err = cmdState.SyncFile(otherFilename, newRemoteName, command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to download the committed file: %v", err)
+	}
+	downloaded, err = ioutil.ReadFile(otherFilename)
+	if err != nil || !bytes.Equal(downloaded, newData) {
+		t.Fatalf("The downloaded file did not match the committed version: %v", err)
+	}
+
+	// the versions of the file can't be listed by another user
+	strangerState, _, strangerCleanup := newTestUserState(t, "resumestranger")
+	defer strangerCleanup()
+	versionsTarget := fmt.Sprintf("%s/api/file/%d/versions", testHost, fi.FileID)
+	_, err = strangerState.RunAuthRequest(versionsTarget, "GET", strangerState.AuthToken, nil)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Expected listing the versions of another user's file to be not found: %v", err)
+	}
+	_, err = cmdState.RunAuthRequest(versionsTarget, "GET", cmdState.AuthToken, nil)
+	if err != nil {
+		t.Fatalf("Failed to list the versions of the file: %v", err)
+	}
+}
+
+func TestContentDefinedChunking(t *testing.T) {
+	// create a separate test user
+	cmdState, _, cleanup := newTestUserState(t, "chunker")
+	defer cleanup()
+	cmdState.ServerCapabilities.ChunkSize = 64 * 1024
+	cmdState.Chunking = filefreezer.ChunkingFastCDC
+
+	testDir, err := ioutil.TempDir("", "freezer_cdc")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	filename := filepath.Join(testDir, "cdc.dat")
+	remoteName := "/cdc/cdc.dat"
+
+	original := genRandomBytes(1024 * 1024)
+	ioutil.WriteFile(filename, original, 0600)
+	os.Chtimes(filename, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	status, ulCount, err := cmdState.SyncFile(filename, remoteName, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer {
+		t.Fatalf("Failed to upload the file with content-defined chunks (status %d): %v", status, err)
+	}
+	fi, err := cmdState.GetFileInfoByFilename(remoteName)
+	if err != nil || fi.CurrentVersion.Chunking != filefreezer.ChunkingFastCDC || fi.CurrentVersion.ChunkCount != ulCount {
+		t.Fatalf("Expected the file version to be split with FastCDC (%+v): %v", fi.CurrentVersion, err)
+	}
+
+	// inserting bytes at the start of the file only changes the first chunk or two
+	edited := append([]byte("a few new bytes at the start"), original...)
+	ioutil.WriteFile(filename, edited, 0600)
+	os.Chtimes(filename, time.Now(), time.Now())
+	status, ulCount, err = cmdState.SyncFile(filename, remoteName, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer || ulCount > 3 {
+		t.Fatalf("Expected only the edited chunks to be uploaded (status %d, sent %d): %v", status, ulCount, err)
+	}
+
+	// the chunks of different lengths are put back together when downloading
+	otherFilename := filepath.Join(testDir, "other.dat")
+	_, _, err = cmdState.SyncFile(otherFilename, remoteName, command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to download the file with content-defined chunks: %v", err)
+	}
+	downloaded, err := ioutil.ReadFile(otherFilename)
+	if err != nil || !bytes.Equal(downloaded, edited) {
+		t.Fatalf("The downloaded file did not match the uploaded one: %v", err)
+	}
+
+	// a client that splits files into fixed size chunks still sees the same file
+	cmdState.Chunking = filefreezer.ChunkingFixed
+	cmdState.ExtraStrict = true
+	status, _, err = cmdState.SyncFile(otherFilename, remoteName, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusSame {
+		t.Fatalf("Expected the file to be the same when chunked another way (status %d): %v", status, err)
+	}
+}
+
+func TestChunkCompression(t *testing.T) {
+	// chunks are only compressed when asked to so older clients can read them
+	restoreFlags := parseTestArgs(t, "syncdir", "local", "remote")
+	if *flagCompression != command.CompressionNone {
+		restoreFlags()
+		t.Fatalf("Expected chunks to be uploaded without compression by default; got %s", *flagCompression)
+	}
+	restoreFlags()
+
+	// create a separate test user
+	cmdState, _, cleanup := newTestUserState(t, "compressor")
+	defer cleanup()
+	cmdState.ServerCapabilities.ChunkSize = 4096
+	cmdState.Compression = command.CompressionGzip
+
+	testDir, err := ioutil.TempDir("", "freezer_compress")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	// a text file takes up much less of the quota once compressed
+	text := bytes.Repeat([]byte("2017-06-01 12:00:00 INFO the same log line over and over again\n"), 1000)
+	textFilename := filepath.Join(testDir, "log.txt")
+	ioutil.WriteFile(textFilename, text, 0600)
+	_, _, err = cmdState.SyncFile(textFilename, "/compress/log.txt", command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to upload the text file: %v", err)
+	}
+	userStats, err := cmdState.GetUserStats()
+	if err != nil || userStats.Allocated >= len(text)/4 {
+		t.Fatalf("Expected the compressed chunks to use less of the quota (%d of %d bytes): %v", userStats.Allocated, len(text), err)
+	}
+
+	// random data doesn't shrink, so it's stored as is and only gains the codec byte
+	random := genRandomBytes(10000)
+	randomFilename := filepath.Join(testDir, "random.dat")
+	ioutil.WriteFile(randomFilename, random, 0600)
+	_, ulCount, err := cmdState.SyncFile(randomFilename, "/compress/random.dat", command.SyncCurrentVersion)
+	if err != nil || ulCount != 3 {
+		t.Fatalf("Failed to upload the random file (sent %d): %v", ulCount, err)
+	}
+	oldAllocated := userStats.Allocated
+	userStats, err = cmdState.GetUserStats()
+	if err != nil || userStats.Allocated != oldAllocated+len(random)+3*(chunkCryptoOverhead+1) {
+		t.Fatalf("Expected the random chunks to be stored uncompressed (%d bytes allocated): %v", userStats.Allocated-oldAllocated, err)
+	}
+
+	// the server sees the same format for compressed and uncompressed chunks
+	for _, name := range []string{"/compress/log.txt", "/compress/random.dat"} {
+		fi, err := cmdState.GetFileInfoByFilename(name)
+		if err != nil {
+			t.Fatalf("Failed to get the file info for %s: %v", name, err)
+		}
+		fc, err := state.Storage.GetFileChunk(fi.FileID, 0, fi.CurrentVersion.VersionID)
+		if err != nil || fc.Chunk[0] != 2 {
+			t.Fatalf("Expected the chunk of %s to have the compressed chunk format: %v", name, err)
+		}
+	}
+
+	// a client that doesn't compress chunks still downloads the compressed ones
+	cmdState.Compression = command.CompressionNone
+	for name, data := range map[string][]byte{"/compress/log.txt": text, "/compress/random.dat": random} {
+		downloadName := filepath.Join(testDir, "download.dat")
+		os.Remove(downloadName)
+		_, _, err = cmdState.SyncFile(downloadName, name, command.SyncCurrentVersion)
+		if err != nil {
+			t.Fatalf("Failed to download %s: %v", name, err)
+		}
+		downloaded, err := ioutil.ReadFile(downloadName)
+		if err != nil || !bytes.Equal(downloaded, data) {
+			t.Fatalf("The downloaded file did not match %s: %v", name, err)
+		}
+	}
+}
+
+func TestLegacyHashUpgrade(t *testing.T) {
+	// create a separate test user
+	cmdState, user, cleanup := newTestUserState(t, "legacy")
+	defer cleanup()
+	chunkSize := 1024 * 64
+	cmdState.ServerCapabilities.ChunkSize = int64(chunkSize)
+
+	filename := testDataDir + "/legacy_test.dat"
+	defer os.Remove(filename)
+	rando := genRandomBytes(chunkSize*2 + 42)
+	ioutil.WriteFile(filename, rando, os.ModePerm)
+
+	// store the file the way clients did before the hashes were keyed
+	legacyStats, err := filefreezer.CalcFileHashInfo(cmdState.ServerCapabilities.ChunkSize, filename, nil)
+	if err != nil || legacyStats.HashAlgo != filefreezer.HashAlgoSHA1 {
+		t.Fatalf("Failed to calculate the legacy file hash for %s: %v", filename, err)
+	}
+	cryptoName, err := cmdState.EncryptString(filename)
+	if err != nil {
+		t.Fatalf("Failed to encrypt the file name: %v", err)
+	}
+	legacyFI, err := state.Storage.AddFileInfo(user.ID, cryptoName, false, legacyStats.Permissions, legacyStats.LastMod,
+		legacyStats.ChunkCount, legacyStats.HashString, filefreezer.HashAlgoSHA1)
+	if err != nil {
+		t.Fatalf("Failed to add the legacy file to storage: %v", err)
+	}
+	for i, chunkHash := range legacyStats.ChunkHashes {
+		end := (i + 1) * chunkSize
+		if end > len(rando) {
+			end = len(rando)
+		}
+		_, err = state.Storage.AddFileChunk(user.ID, legacyFI.FileID, legacyFI.CurrentVersion.VersionID, i, chunkHash, 0, rando[i*chunkSize:end])
+		if err != nil {
+			t.Fatalf("Failed to add the legacy file chunk %d to storage: %v", i, err)
+		}
+	}
+
+	// syncing the unchanged file should replace the legacy version with a keyed one
+	status, ulCount, err := cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer || ulCount != legacyStats.ChunkCount {
+		t.Fatalf("Expected the legacy file to be uploaded with keyed hashes (status %d, uploads %d): %v", status, ulCount, err)
+	}
+	keyedStats, err := filefreezer.CalcFileHashInfo(cmdState.ServerCapabilities.ChunkSize, filename, filefreezer.DeriveHashKey(cmdState.CryptoKey))
+	if err != nil {
+		t.Fatalf("Failed to calculate the keyed file hash for %s: %v", filename, err)
+	}
+	if keyedStats.HashString == legacyStats.HashString {
+		t.Fatalf("The keyed file hash should not match the legacy file hash.")
+	}
+	remote, err := cmdState.GetFileInfoByFilename(filename)
+	if err != nil {
+		t.Fatalf("Failed to get the remote file info for %s: %v", filename, err)
+	}
+	if remote.CurrentVersion.VersionNumber != 2 || remote.CurrentVersion.HashAlgo != filefreezer.HashAlgoHMACSHA256 ||
+		remote.CurrentVersion.FileHash != keyedStats.HashString {
+		t.Fatalf("Expected a second version of the file with keyed hashes: %+v", remote.CurrentVersion)
+	}
+
+	// and once upgraded the file is the same as the remote version
+	status, ulCount, err = cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusSame || ulCount != 0 {
+		t.Fatalf("Expected the upgraded file to be unchanged (status %d, uploads %d): %v", status, ulCount, err)
+	}
+}
+
+func TestChunkSubstitution(t *testing.T) {
+	// create a separate test user
+	cmdState, user, cleanup := newTestUserState(t, "tamper")
+	defer cleanup()
+	cmdState.ServerCapabilities.ChunkSize = 1024 * 64
+
+	filename := testDataDir + "/tamper_test.dat"
+	defer os.Remove(filename)
+	rando := genRandomBytes(int(cmdState.ServerCapabilities.ChunkSize)*2 + 42)
+	ioutil.WriteFile(filename, rando, os.ModePerm)
+
+	_, _, err := cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to upload the file %s: %v", filename, err)
+	}
+	remote, err := cmdState.GetFileInfoByFilename(filename)
+	if err != nil {
+		t.Fatalf("Failed to get the remote file info for %s: %v", filename, err)
+	}
+	fileID := remote.FileID
+	versionID := remote.CurrentVersion.VersionID
+	chunk0, err := state.Storage.GetFileChunk(fileID, 0, versionID)
+	if err != nil {
+		t.Fatalf("Failed to get the first chunk of the file: %v", err)
+	}
+	chunk1, err := state.Storage.GetFileChunk(fileID, 1, versionID)
+	if err != nil {
+		t.Fatalf("Failed to get the second chunk of the file: %v", err)
+	}
+
+	// replaceChunks swaps out the first two chunks stored for the file the way a malicious server could
+	replaceChunks := func(hash0 string, bytes0 []byte, hash1 string, bytes1 []byte) {
+		for i := 0; i < 2; i++ {
+			_, err := state.Storage.RemoveFileChunk(user.ID, fileID, versionID, i)
+			if err != nil {
+				t.Fatalf("Failed to remove chunk %d of the file: %v", i, err)
+			}
+		}
+		_, err := state.Storage.AddFileChunk(user.ID, fileID, versionID, 0, hash0, 0, bytes0)
+		if err == nil {
+			_, err = state.Storage.AddFileChunk(user.ID, fileID, versionID, 1, hash1, 0, bytes1)
+		}
+		if err != nil {
+			t.Fatalf("Failed to replace the chunks of the file: %v", err)
+		}
+	}
+
+	// swapping the chunk bytes should be caught when the chunks are decrypted
+	replaceChunks(chunk0.ChunkHash, chunk1.Chunk, chunk1.ChunkHash, chunk0.Chunk)
+	os.Remove(filename)
+	_, _, err = cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err == nil || !strings.Contains(err.Error(), "substituted") {
+		t.Fatalf("Expected the swapped chunks to be rejected as substituted: %v", err)
+	}
+
+	// swapping the chunk hashes along with the bytes should be caught by the file hash
+	replaceChunks(chunk1.ChunkHash, chunk1.Chunk, chunk0.ChunkHash, chunk0.Chunk)
+	os.Remove(filename)
+	_, _, err = cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err == nil || !strings.Contains(err.Error(), "does not match the file hash") {
+		t.Fatalf("Expected the reordered file to be rejected by the file hash: %v", err)
+	}
+
+	// and putting the chunks back should download the file again
+	replaceChunks(chunk0.ChunkHash, chunk0.Chunk, chunk1.ChunkHash, chunk1.Chunk)
+	os.Remove(filename)
+	status, _, err := cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusRemoteNewer {
+		t.Fatalf("Failed to download the restored file %s (status %d): %v", filename, status, err)
+	}
+	downBytes, err := ioutil.ReadFile(filename)
+	if err != nil || bytes.Compare(downBytes, rando) != 0 {
+		t.Fatalf("The downloaded file did not match the original file: %v", err)
+	}
+}
+
+func TestCryptoPasswordChange(t *testing.T) {
+	t.Run("MasterKey", func(t *testing.T) {
+		doTestCryptoPasswordChange(false, t)
+	})
+	t.Run("LegacyKey", func(t *testing.T) {
+		doTestCryptoPasswordChange(true, t)
+	})
+}
+
+// doTestCryptoPasswordChange uploads a file, changes the crypto password and then makes
+// sure the file is still readable with the new password. With legacy set the account
+// uses the key derived from the password directly like accounts from before master keys.
+func doTestCryptoPasswordChange(legacy bool, t *testing.T) {
+	cmdState := command.NewState()
+
+	// create a separate test user
+	username := "cryptochange"
+	oldCryptoPass := "old crypto password"
+	newCryptoPass := "new crypto password"
+	userQuota := int(1e9)
+
+	user, cleanup := addTestUser(t, username, userQuota)
+	defer cleanup()
+
+	if legacy {
+		_, _, combo, err := filefreezer.GenCryptoPasswordHash(oldCryptoPass, true, "")
+		if err != nil {
+			t.Fatalf("Failed to generate the legacy crypto password hash: %v", err)
+		}
+		err = state.Storage.UpdateUserCryptoHash(user.ID, []byte(combo), nil)
+		if err != nil {
+			t.Fatalf("Failed to set the legacy crypto password hash: %v", err)
+		}
+	}
+
+	err := cmdState.Authenticate(testHost, username, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the test user: %v", err)
+	}
+	if !legacy {
+		err = cmdState.SetCryptoHashForPassword(oldCryptoPass)
+		if err != nil {
+			t.Fatalf("Failed to set the crypto password for the test user: %v", err)
+		}
+		if len(cmdState.WrappedKey) == 0 {
+			t.Fatalf("Expected a wrapped master key after setting the crypto password.")
+		}
+	}
+	err = cmdState.UnlockCryptoKey(oldCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to set the crypto key for the test user: %v", err)
+	}
+	originalKey := cmdState.CryptoKey
+	cmdState.ServerCapabilities.ChunkSize = 1024 * 64
+
+	filename := testDataDir + "/crypto_change_test.dat"
+	defer os.Remove(filename)
+	rando := genRandomBytes(int(cmdState.ServerCapabilities.ChunkSize)*2 + 42)
+	ioutil.WriteFile(filename, rando, os.ModePerm)
+
+	_, _, err = cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to upload the file %s: %v", filename, err)
+	}
+
+	err = cmdState.ChangeCryptoPassword(newCryptoPass, newCryptoPass)
+	if err == nil {
+		t.Fatalf("Changing the crypto password should fail when the old password is wrong.")
+	}
+	err = cmdState.ChangeCryptoPassword(oldCryptoPass, newCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to change the crypto password: %v", err)
+	}
+
+	// log in again so that everything comes from the server
+	cmdState = command.NewState()
+	err = cmdState.Authenticate(testHost, username, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the test user: %v", err)
+	}
+	cmdState.ServerCapabilities.ChunkSize = 1024 * 64
+	if len(cmdState.WrappedKey) == 0 {
+		t.Fatalf("Expected a wrapped master key after changing the crypto password.")
+	}
+	err = cmdState.UnlockCryptoKey(oldCryptoPass)
+	if err == nil {
+		t.Fatalf("The old crypto password should no longer be accepted.")
+	}
+	err = cmdState.UnlockCryptoKey(newCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to unlock the crypto key with the new password: %v", err)
+	}
+	if bytes.Compare(originalKey, cmdState.CryptoKey) != 0 {
+		t.Fatalf("The crypto key changed along with the crypto password.")
+	}
+
+	// the file uploaded before the change should download and match
+	os.Remove(filename)
+	_, dlCount, err := cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil || dlCount != 3 {
+		t.Fatalf("Failed to download the file after changing the crypto password (%d chunks): %v", dlCount, err)
+	}
+	downloaded, err := ioutil.ReadFile(filename)
+	if err != nil || bytes.Compare(downloaded, rando) != 0 {
+		t.Fatalf("The file downloaded after changing the crypto password did not match: %v", err)
+	}
+}
+
+func TestRecoveryKey(t *testing.T) {
+	cmdState := command.NewState()
+
+	// create a separate test user
+	username := "recovery"
+	forgottenCryptoPass := "forgotten crypto password"
+	newCryptoPass := "new crypto password"
+	userQuota := int(1e9)
+
+	_, cleanup := addTestUser(t, username, userQuota)
+	defer cleanup()
+
+	err := cmdState.Authenticate(testHost, username, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the test user: %v", err)
+	}
+	err = cmdState.SetCryptoHashForPassword(forgottenCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to set the crypto password for the test user: %v", err)
+	}
+	cmdState.ServerCapabilities.ChunkSize = 1024 * 64
+
+	_, err = cmdState.ExportRecoveryKey(newCryptoPass)
+	if err == nil {
+		t.Fatalf("Exporting the recovery key should fail with the wrong crypto password.")
+	}
+	recoveryKey, err := cmdState.ExportRecoveryKey(forgottenCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to export the recovery key: %v", err)
+	}
+
+	filename := testDataDir + "/recovery_test.dat"
+	defer os.Remove(filename)
+	rando := genRandomBytes(int(cmdState.ServerCapabilities.ChunkSize) + 42)
+	ioutil.WriteFile(filename, rando, os.ModePerm)
+	_, _, err = cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to upload the file %s: %v", filename, err)
+	}
+
+	// log in again without knowing the crypto password
+	cmdState = command.NewState()
+	err = cmdState.Authenticate(testHost, username, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the test user: %v", err)
+	}
+	cmdState.ServerCapabilities.ChunkSize = 1024 * 64
+
+	// a recovery key for some other master key shouldn't replace the crypto password
+	otherKey, err := filefreezer.GenMasterKey()
+	if err != nil {
+		t.Fatalf("Failed to generate another master key: %v", err)
+	}
+	err = cmdState.RestoreCryptoPassword(filefreezer.EncodeRecoveryKey(otherKey), newCryptoPass)
+	if err == nil {
+		t.Fatalf("Restoring the crypto password with the wrong recovery key should have failed.")
+	}
+
+	err = cmdState.RestoreCryptoPassword(recoveryKey, newCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to restore the crypto password with the recovery key: %v", err)
+	}
+
+	// the new password should now unlock the key the file was uploaded with
+	cmdState = command.NewState()
+	err = cmdState.Authenticate(testHost, username, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the test user: %v", err)
+	}
+	cmdState.ServerCapabilities.ChunkSize = 1024 * 64
+	err = cmdState.UnlockCryptoKey(forgottenCryptoPass)
+	if err == nil {
+		t.Fatalf("The forgotten crypto password should no longer be accepted.")
+	}
+	err = cmdState.UnlockCryptoKey(newCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to unlock the crypto key with the restored password: %v", err)
+	}
+
+	os.Remove(filename)
+	_, dlCount, err := cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil || dlCount != 2 {
+		t.Fatalf("Failed to download the file after restoring the crypto password (%d chunks): %v", dlCount, err)
+	}
+	downloaded, err := ioutil.ReadFile(filename)
+	if err != nil || bytes.Compare(downloaded, rando) != 0 {
+		t.Fatalf("The file downloaded after restoring the crypto password did not match: %v", err)
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	cmdState := command.NewState()
+
+	// create a separate test user
+	username := "refresher"
+	userQuota := int(1e9)
+
+	user, cleanup := addTestUser(t, username, userQuota)
+	defer cleanup()
+
+	err := cmdState.Authenticate(testHost, username, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the test user: %v", err)
+	}
+	if cmdState.RefreshToken == "" {
+		t.Fatalf("Expected a refresh token to be returned when logging in.")
+	}
+
+	// replace the authentication token with one that has already expired
+	claims := &jwtCustomClaims{
+		user.Name,
+		user.ID,
+		jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+		},
+	}
+	expiredToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(state.JWTSecretBytes)
+	if err != nil {
+		t.Fatalf("Failed to sign the expired token: %v", err)
+	}
+	cmdState.AuthToken = expiredToken
+	firstRefreshToken := cmdState.RefreshToken
+
+	// the request should transparently refresh the token and rotate the refresh token
+	_, err = cmdState.GetUserStats()
+	if err != nil {
+		t.Fatalf("Failed to get the user stats with an expired token: %v", err)
+	}
+	if cmdState.AuthToken == expiredToken || cmdState.RefreshToken == firstRefreshToken {
+		t.Fatalf("Expected the authentication and refresh tokens to be replaced.")
+	}
+
+	// the first refresh token was used up, so trying it again revokes the newer one too
+	cmdState.AuthToken = expiredToken
+	cmdState.RefreshToken = firstRefreshToken
+	_, err = cmdState.GetUserStats()
+	if err == nil {
+		t.Fatalf("Reusing a refresh token should have failed.")
+	}
+	_, _, err = state.Storage.UseRefreshToken(hashRefreshToken(firstRefreshToken))
+	if err == nil {
+		t.Fatalf("The refresh tokens should have been revoked after a refresh token was reused.")
+	}
+
+	// without a refresh token the expired token is just rejected
+	cmdState.AuthToken = expiredToken
+	cmdState.RefreshToken = ""
+	_, err = cmdState.GetUserStats()
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Expected the expired token to be rejected: %v", err)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	cmdState := command.NewState()
+
+	// create an admin and a regular user to test with
+	adminName := "boss"
+	workerName := "worker"
+	userQuota := int(1e9)
+	if user, _ := state.Storage.GetUser("newhire"); user != nil {
+		cmdState.RmUser(state.Storage, "newhire")
+	}
+	for _, username := range []string{adminName, workerName} {
+		_, cleanup := addTestUser(t, username, userQuota)
+		defer cleanup()
+	}
+	err := cmdState.SetUserAdmin(state.Storage, adminName, true)
+	if err != nil {
+		t.Fatalf("Failed to make the test user an admin: %v", err)
+	}
+
+	// users that aren't admins can't use the admin routes
+	err = cmdState.Authenticate(testHost, workerName, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the regular user: %v", err)
+	}
+	_, err = cmdState.AdminGetUsers()
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Expected a regular user to be forbidden from listing the users: %v", err)
+	}
+	_, err = cmdState.AdminAddUser("newhire", testUserPassword, userQuota, true)
+	if err == nil {
+		t.Fatalf("A regular user should not be able to add users.")
+	}
+
+	err = cmdState.Authenticate(testHost, adminName, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the admin: %v", err)
+	}
+
+	// add a user remotely and make sure it gets listed
+	newUser, err := cmdState.AdminAddUser("newhire", testUserPassword, 5000, false)
+	if err != nil || newUser.Name != "newhire" || newUser.IsAdmin {
+		t.Fatalf("Failed to add a user as the admin: %v", err)
+	}
+	defer cmdState.RmUser(state.Storage, "newhire")
+	_, err = cmdState.AdminAddUser("newhire", testUserPassword, 5000, false)
+	if err == nil {
+		t.Fatalf("Adding a duplicate user should have failed.")
+	}
+
+	// users added without a quota get the server's default quota
+	defaulted, err := cmdState.AdminAddUser("defaulted", testUserPassword, 0, false)
+	if err != nil || defaulted.Stats.Quota != state.DefaultQuota {
+		t.Fatalf("Expected a user added without a quota to get the default quota of %d: %+v %v", state.DefaultQuota, defaulted, err)
+	}
+	defer cmdState.RmUser(state.Storage, "defaulted")
+
+	findUser := func(username string) *models.AdminUserInfo {
+		users, err := cmdState.AdminGetUsers()
+		if err != nil {
+			t.Fatalf("Failed to list the users as the admin: %v", err)
+		}
+		for _, u := range users {
+			if u.Name == username {
+				return &u
+			}
+		}
+		return nil
+	}
+	listed := findUser("newhire")
+	if listed == nil || listed.ID != newUser.ID || listed.Stats.Quota != 5000 {
+		t.Fatalf("The new user was not listed as expected: %+v", listed)
+	}
+	if boss := findUser(adminName); boss == nil || !boss.IsAdmin {
+		t.Fatalf("The admin was not listed as an admin: %+v", boss)
+	}
+
+	// set the quota and reset the password
+	err = cmdState.AdminSetUserQuota("newhire", 9000)
+	if err != nil {
+		t.Fatalf("Failed to set the quota for the user: %v", err)
+	}
+	listed = findUser("newhire")
+	if listed == nil || listed.Stats.Quota != 9000 {
+		t.Fatalf("The quota for the user was not changed: %+v", listed)
+	}
+	err = cmdState.AdminSetUserQuota("nobody", 9000)
+	if err == nil {
+		t.Fatalf("Setting the quota for a user that doesn't exist should have failed.")
+	}
+
+	err = cmdState.AdminSetUserPassword("newhire", "5678")
+	if err != nil {
+		t.Fatalf("Failed to reset the password for the user: %v", err)
+	}
+	otherState := command.NewState()
+	err = otherState.Authenticate(testHost, "newhire", testUserPassword)
+	if err == nil {
+		t.Fatalf("The old password should no longer work after it was reset.")
+	}
+	err = otherState.Authenticate(testHost, "newhire", "5678")
+	if err != nil {
+		t.Fatalf("Failed to authenticate with the reset password: %v", err)
+	}
+
+	// admins can remove other users but not themselves
+	err = cmdState.AdminRmUser(adminName)
+	if err == nil {
+		t.Fatalf("Admins should not be able to remove themselves.")
+	}
+	err = cmdState.AdminRmUser("newhire")
+	if err != nil {
+		t.Fatalf("Failed to remove the user as the admin: %v", err)
+	}
+	if findUser("newhire") != nil {
+		t.Fatalf("The removed user is still listed.")
+	}
+
+	// revoking the admin rights takes effect right away
+	err = cmdState.SetUserAdmin(state.Storage, adminName, false)
+	if err != nil {
+		t.Fatalf("Failed to revoke the admin rights: %v", err)
+	}
+	_, err = cmdState.AdminGetUsers()
+	if err == nil {
+		t.Fatalf("The user should not be able to list the users after the admin rights were revoked.")
+	}
+}
+
+func TestJWTKeyFile(t *testing.T) {
+	keyFilepath := filepath.Join(testDataDir, "freezer.jwtkey")
+	os.Remove(keyFilepath)
+	defer os.Remove(keyFilepath)
+
+	// the key file gets created the first time
+	secret, err := loadJWTSecret(keyFilepath)
+	if err != nil || len(secret) != jwtSecretSize {
+		t.Fatalf("Failed to create the JWT key file: %v", err)
+	}
+	fi, err := os.Stat(keyFilepath)
+	if err != nil {
+		t.Fatalf("The JWT key file was not written: %v", err)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		t.Fatalf("The JWT key file should only be readable by the owner but has the permissions %v.", fi.Mode().Perm())
+	}
+
+	// and then the same key is loaded from it after a restart
+	loaded, err := loadJWTSecret(keyFilepath)
+	if err != nil || bytes.Compare(secret, loaded) != 0 {
+		t.Fatalf("The JWT key loaded from the key file did not match the one created: %v", err)
+	}
+
+	// without a key file a new random key is used each time
+	random1, err := loadJWTSecret("")
+	if err != nil {
+		t.Fatalf("Failed to generate a random JWT key: %v", err)
+	}
+	random2, err := loadJWTSecret("")
+	if err != nil || bytes.Compare(random1, random2) == 0 {
+		t.Fatalf("Expected different random JWT keys: %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cmdState := command.NewState()
+	username := "metered"
+	_, cleanup := addTestUser(t, username, 5000)
+	defer cleanup()
+
+	// getMetric returns the value of the metric line starting with the name and labels given
+	getMetric := func(prefix string) int {
+		var buf bytes.Buffer
+		err := state.Metrics.write(&buf, state.Storage)
+		if err != nil {
+			t.Fatalf("Failed to write the metrics: %v", err)
+		}
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.HasPrefix(line, prefix+" ") {
+				v, err := strconv.Atoi(strings.TrimPrefix(line, prefix+" "))
+				if err != nil {
+					t.Fatalf("Failed to parse the metric line %s: %v", line, err)
+				}
+				return v
+			}
+		}
+		return 0
+	}
+
+	failures := getMetric("freezer_login_failures_total")
+	rejected := getMetric(`freezer_http_requests_total{method="POST",route="/api/users/login",code="401"}`)
+	issued := getMetric(`freezer_storage_operation_seconds_count{op="AddRefreshToken"}`)
+
+	err := cmdState.Authenticate(testHost, username, "wrong password")
+	if err == nil {
+		t.Fatalf("Authenticating with the wrong password should have failed.")
+	}
+	err = cmdState.Authenticate(testHost, username, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the test user: %v", err)
+	}
+
+	if getMetric("freezer_login_failures_total") != failures+1 {
+		t.Fatalf("Expected the failed login to be counted.")
+	}
+	if getMetric(`freezer_http_requests_total{method="POST",route="/api/users/login",code="401"}`) != rejected+1 {
+		t.Fatalf("Expected the rejected login request to be counted by route and status code.")
+	}
+	if getMetric(`freezer_storage_operation_seconds_count{op="AddRefreshToken"}`) != issued+1 {
+		t.Fatalf("Expected the storage operation for the login to be timed.")
+	}
+	if getMetric(`freezer_user_quota_bytes{user="metered"}`) != 5000 || getMetric("freezer_users") < 1 {
+		t.Fatalf("Expected the user gauges to be read from storage.")
+	}
+
+	// the metrics are served in the Prometheus text format
+	rec := httptest.NewRecorder()
+	state.Metrics.handler(state.Storage).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "# TYPE freezer_storage_operation_seconds histogram") {
+		t.Fatalf("Failed to serve the metrics (%d): %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	resp, err := http.Get(testHost + "/healthz")
+	if err != nil {
+		t.Fatalf("Failed to get the health of the server: %v", err)
+	}
+	var health models.HealthResponse
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || health.Status != "ok" {
+		t.Fatalf("Expected the server to be healthy (%d): %v", resp.StatusCode, err)
+	}
+
+	// getReadiness returns the status code and response for the readiness probe
+	getReadiness := func() (int, models.ReadinessResponse) {
+		resp, err := http.Get(testHost + "/readyz")
+		if err != nil {
+			t.Fatalf("Failed to get the readiness of the server: %v", err)
+		}
+		defer resp.Body.Close()
+		var r models.ReadinessResponse
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		if err != nil {
+			t.Fatalf("Poorly formatted readiness response: %v", err)
+		}
+		return resp.StatusCode, r
+	}
+
+	code, ready := getReadiness()
+	if code != http.StatusOK || !ready.Ready || ready.DBVersion != filefreezer.CurrentDBVersion {
+		t.Fatalf("Expected the server to be ready (%d): %+v", code, ready)
+	}
+	for _, c := range []string{"server", "database", "schema", "chunkstore"} {
+		found := false
+		for _, status := range ready.Components {
+			if status.Name == c && status.Ready && status.Error == "" {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("Expected the %s component to be ready: %+v", c, ready.Components)
+		}
+	}
+
+	// the server isn't ready once it starts shutting down
+	atomic.StoreInt32(&state.shuttingDown, 1)
+	code, ready = getReadiness()
+	atomic.StoreInt32(&state.shuttingDown, 0)
+	if code != http.StatusServiceUnavailable || ready.Ready {
+		t.Fatalf("Expected the server to not be ready while shutting down (%d): %+v", code, ready)
+	}
+}
+
+// the version 1 schema from before any migrations were written, like the fixture
+// in the storage tests, for starting a server that has to migrate its database
+var v1Schema = []string{
+	`CREATE TABLE AppData (DBVersion INTEGER NOT NULL);`,
+	`CREATE TABLE Users (UserID INTEGER PRIMARY KEY NOT NULL, Name TEXT UNIQUE NOT NULL ON CONFLICT ABORT,
+		Salt TEXT NOT NULL, Password BLOB NOT NULL, CryptoHash BLOB);`,
+	`CREATE TABLE UserStats (UserID INTEGER PRIMARY KEY NOT NULL, Quota INTEGER NOT NULL,
+		Allocated INTEGER NOT NULL, Revision INTEGER NOT NULL);`,
+	`CREATE TABLE FileInfo (FileID INTEGER PRIMARY KEY NOT NULL, UserID INTEGER NOT NULL,
+		FileName TEXT NOT NULL, IsDir INTEGER NOT NULL, CurrentVersionID INTEGER NOT NULL);`,
+	`CREATE TABLE FileVersion (VersionID INTEGER PRIMARY KEY NOT NULL, FileID INTEGER NOT NULL,
+		VersionNum INTEGER NOT NULL, Perms INTEGER NOT NULL, LastMod INTEGER NOT NULL,
+		ChunkCount INTEGER NOT NULL, FileHash TEXT NOT NULL);`,
+	`CREATE TABLE FileChunks (ChunkID INTEGER PRIMARY KEY NOT NULL, FileID INTEGER NOT NULL,
+		VersionID INTEGER NOT NULL, ChunkNum INTEGER NOT NULL, ChunkHash TEXT NOT NULL, Chunk BLOB NOT NULL);`,
+	`INSERT INTO AppData (DBVersion) VALUES (1);`,
+}
+
+func TestServerReadiness(t *testing.T) {
+	// write a database that needs to be migrated when the server starts
+	testDir, err := ioutil.TempDir("", "freezer_readiness")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	dbPath := "file:" + filepath.Join(testDir, "old.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open the old database: %v", err)
+	}
+	for _, stmt := range v1Schema {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			db.Close()
+			t.Fatalf("Failed to create the old database: %v", err)
+		}
+	}
+	db.Close()
+
+	cfg := normalizeServerConfig(&serverConfig{Listen: "127.0.0.1:8093", DB: dbPath})
+	cfg.ShutdownDrain = configDuration(2 * time.Second)
+	oldState, err := newState(cfg)
+	if err != nil {
+		t.Fatalf("Failed to set up the server with the old database: %v", err)
+	}
+	defer oldState.Storage.Close()
+
+	// hold the migration up after its first step to look at the server while it's migrating
+	migrating := make(chan struct{})
+	resume := make(chan struct{})
+	var once sync.Once
+	oldState.Storage.TransactionObserver = func(op string, elapsed time.Duration, err error) {
+		if op == "Migrate" {
+			once.Do(func() {
+				close(migrating)
+				<-resume
+			})
+		}
+	}
+	readyCh := make(chan bool, 1)
+	quitCh := oldState.serve(readyCh)
+	select {
+	case <-migrating:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("The server didn't start migrating the database.")
+	}
+
+	// getReadiness returns the status code and response for the readiness probe, waiting
+	// for the server to start listening
+	serverURL := "http://127.0.0.1:8093"
+	getReadiness := func() (int, models.ReadinessResponse) {
+		var resp *http.Response
+		var err error
+		for tries := 0; tries < 50; tries++ {
+			resp, err = http.Get(serverURL + "/readyz")
+			if err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("Failed to get the readiness of the server: %v", err)
+		}
+		defer resp.Body.Close()
+		var r models.ReadinessResponse
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		if err != nil {
+			t.Fatalf("Poorly formatted readiness response: %v", err)
+		}
+		return resp.StatusCode, r
+	}
+	componentError := func(r models.ReadinessResponse, name string) string {
+		for _, status := range r.Components {
+			if status.Name == name {
+				return status.Error
+			}
+		}
+		return ""
+	}
+
+	// the server answers the probes but isn't ready while the database is migrated
+	code, ready := getReadiness()
+	if code != http.StatusServiceUnavailable || ready.Ready ||
+		!strings.Contains(componentError(ready, "schema"), "migrated") || componentError(ready, "server") == "" {
+		t.Fatalf("Expected the server to not be ready while migrating (%d): %+v", code, ready)
+	}
+	resp, err := http.PostForm(serverURL+"/api/users/login", url.Values{"user": {"admin"}, "password": {"1234"}})
+	if err != nil {
+		t.Fatalf("Failed to make the login request while migrating: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the login to be turned away while migrating (%d).", resp.StatusCode)
+	}
+
+	// once the migration finishes the server is ready
+	close(resume)
+	if !<-readyCh {
+		t.Fatalf("The server failed to prepare the old database.")
+	}
+	code, ready = getReadiness()
+	if code != http.StatusOK || !ready.Ready || ready.DBVersion != filefreezer.CurrentDBVersion {
+		t.Fatalf("Expected the server to be ready after the migration (%d): %+v", code, ready)
+	}
+
+	// the server keeps answering while it drains but isn't ready anymore
+	oldState.stop <- os.Interrupt
+	for tries := 0; tries < 10 && atomic.LoadInt32(&oldState.shuttingDown) == 0; tries++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	code, ready = getReadiness()
+	if code != http.StatusServiceUnavailable || ready.Ready || !strings.Contains(componentError(ready, "server"), "shutting down") {
+		t.Fatalf("Expected the server to not be ready while shutting down (%d): %+v", code, ready)
+	}
+	select {
+	case <-quitCh:
+	case <-time.After(15 * time.Second):
+		t.Fatalf("The server didn't shut down after draining.")
+	}
+}
+
+func TestLoginLockouts(t *testing.T) {
+	lockouts := newLoginLockouts(2, time.Second, 3*time.Second)
+
+	// the lockout starts at the threshold and doubles up to the max
+	for i, expected := range []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		lockout, failures := lockouts.failed("mallory")
+		if lockout != expected || failures != i+1 {
+			t.Fatalf("Expected failure %d to lock out for %v but got %v (failures %d).", i+1, expected, lockout, failures)
+		}
+	}
+	if lockouts.lockedOut("mallory") <= 0 || lockouts.lockedOut("alice") != 0 {
+		t.Fatalf("Only the username with the failed logins should be locked out.")
+	}
+	lockouts.succeeded("mallory")
+	if lockouts.lockedOut("mallory") != 0 {
+		t.Fatalf("A successful login should reset the lockout.")
+	}
+
+	// a disabled lockout never locks anyone out
+	var disabled *loginLockouts
+	for i := 0; i < 10; i++ {
+		disabled.failed("mallory")
+	}
+	if disabled.lockedOut("mallory") != 0 {
+		t.Fatalf("Disabled lockouts should not lock anyone out.")
+	}
+
+	limiter := newRateLimiter(60, 2)
+	allowed1, _ := limiter.allow("key")
+	allowed2, _ := limiter.allow("key")
+	allowed3, wait := limiter.allow("key")
+	if !allowed1 || !allowed2 || allowed3 || wait <= 0 || wait > time.Second {
+		t.Fatalf("Expected the rate limiter to allow a burst of 2 and then wait up to a second (%v).", wait)
+	}
+	if allowed, _ := limiter.allow("other"); !allowed {
+		t.Fatalf("The rate limit should be separate for each key.")
+	}
+	if newRateLimiter(0, 10) != nil {
+		t.Fatalf("A rate of 0 should disable the rate limiter.")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	cmdState := command.NewState()
+	username := "limited"
+	user, cleanup := addTestUser(t, username, int(1e9))
+	defer cleanup()
+
+	// run a separate server on the same storage with strict limits
+	limitedState := *state
+	limitedState.loginLimiter = newRateLimiter(1, 4)
+	limitedState.requestLimiter = newRateLimiter(1, 2)
+	limitedState.lockouts = newLoginLockouts(2, time.Minute, time.Hour)
+	e := echo.New()
+	InitRoutes(&limitedState, e)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	// authenticated requests are limited for each user
+	err := cmdState.Authenticate(server.URL, username, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate with the rate limited server: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = cmdState.GetUserStats()
+		if err != nil {
+			t.Fatalf("Failed to get the user stats within the rate limit: %v", err)
+		}
+	}
+	_, err = cmdState.GetUserStats()
+	if err == nil || !strings.Contains(err.Error(), "429") {
+		t.Fatalf("Expected the user stats request over the rate limit to be rejected: %v", err)
+	}
+
+	// failed logins lock the username out, even with the right password
+	for i := 0; i < 2; i++ {
+		err = cmdState.Authenticate(server.URL, username, "wrong password")
+		if err == nil || !strings.Contains(err.Error(), "401") {
+			t.Fatalf("Expected the login with the wrong password to be unauthorized: %v", err)
+		}
+	}
+	err = cmdState.Authenticate(server.URL, username, testUserPassword)
+	if err == nil || !strings.Contains(err.Error(), "429") {
+		t.Fatalf("Expected the login to be rejected while the username is locked out: %v", err)
+	}
+	records, err := state.Storage.GetAuditRecords(username, 0, 0)
+	if err != nil || len(records) != 4 {
+		t.Fatalf("Expected the login, the failures and the lockout to be recorded in the audit log (%d records): %v", len(records), err)
+	}
+	lockout := records[3]
+	if lockout.Event != filefreezer.AuditLoginLockout || lockout.UserID != user.ID || lockout.RemoteAddr == "" {
+		t.Fatalf("The lockout audit record was not as expected: %+v", lockout)
+	}
+
+	// and the login attempts from the same address are limited as well
+	err = cmdState.Authenticate(server.URL, "someone else", testUserPassword)
+	if err == nil || !strings.Contains(err.Error(), "429") {
+		t.Fatalf("Expected the login over the rate limit for the address to be rejected: %v", err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatalf("Failed to parse the trusted proxies: %v", err)
+	}
+	_, err = parseTrustedProxies([]string{"proxy.example.com"})
+	if err == nil {
+		t.Fatalf("Expected a trusted proxy that isn't an address to be rejected.")
+	}
+	proxiedState := serverState{trustedProxies: proxies}
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		expected   string
+	}{
+		// the headers from clients are ignored
+		{"203.0.113.5:1234", "198.51.100.7", "198.51.100.8", "203.0.113.5"},
+		// the client behind a trusted proxy is the last untrusted forwarded address
+		{"10.0.0.1:1234", "198.51.100.7, 203.0.113.9, 192.168.1.1", "", "203.0.113.9"},
+		{"10.0.0.1:1234", "", "198.51.100.8", "198.51.100.8"},
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"[2001:db8::1]:1234", "198.51.100.7", "", "2001:db8::1"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/healthz", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.realIP != "" {
+			req.Header.Set("X-Real-IP", test.realIP)
+		}
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		handler := proxiedState.clientIPMiddleware(func(c echo.Context) error { return nil })
+		handler(c)
+		if ip := clientIP(c); ip != test.expected {
+			t.Fatalf("Expected the client IP for %+v to be %s but got %s", test, test.expected, ip)
+		}
+	}
+
+	// changing the forwarding headers doesn't get around the login rate limit
+	limitedState := *state
+	limitedState.loginLimiter = newRateLimiter(1, 2)
+	e := echo.New()
+	InitRoutes(&limitedState, e)
+	server := httptest.NewServer(e)
+	defer server.Close()
+	var status int
+	for i := 0; i < 3; i++ {
+		form := url.Values{"user": {"spoofer" + strconv.Itoa(i)}, "password": {"1234"}}
+		req, _ := http.NewRequest("POST", server.URL+"/api/users/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(i))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make the login request: %v", err)
+		}
+		resp.Body.Close()
+		status = resp.StatusCode
+	}
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("Expected the logins with spoofed addresses to be rate limited (status %d)", status)
+	}
+}
+
+func TestAuditTrail(t *testing.T) {
+	cmdState := command.NewState()
+	username := "audited"
+	adminName := "auditor"
+	for _, name := range []string{username, adminName} {
+		_, cleanup := addTestUser(t, name, int(1e9))
+		defer cleanup()
+	}
+	err := cmdState.SetUserAdmin(state.Storage, adminName, true)
+	if err != nil {
+		t.Fatalf("Failed to make the test user an admin: %v", err)
+	}
+	start := time.Now().Unix()
+
+	// a failed login and then the changes the user makes get recorded
+	err = cmdState.Authenticate(testHost, username, "wrong password")
+	if err == nil {
+		t.Fatalf("Logging in with the wrong password should have failed.")
+	}
+	err = cmdState.Authenticate(testHost, username, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the test user: %v", err)
+	}
+	err = cmdState.SetCryptoHashForPassword(*flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to set the crypto password for the test user: %v", err)
+	}
+	err = cmdState.UnlockCryptoKey(*flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to set the crypto key for the test user: %v", err)
+	}
+
+	filename := testDataDir + "/audit_test.dat"
+	defer os.Remove(filename)
+	ioutil.WriteFile(filename, genRandomBytes(1024), os.ModePerm)
+	_, _, err = cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to upload the file %s: %v", filename, err)
+	}
+	ioutil.WriteFile(filename, genRandomBytes(2048), os.ModePerm)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filename, later, later)
+	_, _, err = cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to upload the new version of %s: %v", filename, err)
+	}
+	err = cmdState.RmFileVersions(filename, 1, 1, false)
+	if err != nil {
+		t.Fatalf("Failed to remove the first version of %s: %v", filename, err)
+	}
+	err = cmdState.RmFile(filename, false)
+	if err != nil {
+		t.Fatalf("Failed to remove the file %s: %v", filename, err)
+	}
+
+	// admins change the quota and query the log
+	err = cmdState.Authenticate(testHost, adminName, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the admin: %v", err)
+	}
+	err = cmdState.AdminSetUserQuota(username, 5000)
+	if err != nil {
+		t.Fatalf("Failed to set the quota as the admin: %v", err)
+	}
+
+	records, err := cmdState.AdminGetAuditLog(username, start, 0)
+	if err != nil {
+		t.Fatalf("Failed to get the audit log as the admin: %v", err)
+	}
+	expected := []string{
+		filefreezer.AuditLoginFailure,
+		filefreezer.AuditLogin,
+		filefreezer.AuditCryptoHash,
+		filefreezer.AuditFileRegister,
+		filefreezer.AuditFileCommit,
+		filefreezer.AuditFileVersion,
+		filefreezer.AuditFileCommit,
+		filefreezer.AuditFileVersionsDelete,
+		filefreezer.AuditFileDelete,
+		filefreezer.AuditUserQuota,
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d audit records for the user but got %d: %+v", len(expected), len(records), records)
+	}
+	for i, r := range records {
+		if r.Event != expected[i] || r.Username != username || r.RemoteAddr == "" || r.Detail == "" {
+			t.Fatalf("Audit record %d was not the expected %s event: %+v", i, expected[i], r)
+		}
+	}
+	if !strings.Contains(records[9].Detail, adminName) {
+		t.Fatalf("The quota change should name the admin that made it: %+v", records[9])
+	}
+
+	// the time range limits the records returned
+	records, err = cmdState.AdminGetAuditLog(username, time.Now().Add(time.Hour).Unix(), 0)
+	if err != nil || len(records) != 0 {
+		t.Fatalf("Expected no audit records in the future (%d): %v", len(records), err)
+	}
+	records, err = cmdState.AdminGetAuditLog("", start, 0)
+	if err != nil || len(records) < len(expected)+1 {
+		t.Fatalf("Expected the audit records for all users including the admin's login (%d): %v", len(records), err)
+	}
+
+	// users that aren't admins can't read the log
+	err = cmdState.Authenticate(testHost, username, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the test user: %v", err)
+	}
+	_, err = cmdState.AdminGetAuditLog(username, 0, 0)
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Expected a regular user to be forbidden from reading the audit log: %v", err)
+	}
+
+	// and the times for the audit command can be dates, RFC3339 times or durations
+	now := time.Date(2017, 10, 31, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		s        string
+		expected int64
+	}{
+		{"", 0},
+		{"24h", now.Add(-24 * time.Hour).Unix()},
+		{"2017-10-01T08:30:00Z", time.Date(2017, 10, 1, 8, 30, 0, 0, time.UTC).Unix()},
+		{"2017-10-01", time.Date(2017, 10, 1, 0, 0, 0, 0, time.Local).Unix()},
+	} {
+		parsed, err := parseAuditTime(tc.s, now)
+		if err != nil || parsed != tc.expected {
+			t.Fatalf("Expected %q to parse to %d but got %d: %v", tc.s, tc.expected, parsed, err)
+		}
+	}
+	_, err = parseAuditTime("yesterday", now)
+	if err == nil {
+		t.Fatalf("Parsing an invalid audit time should have failed.")
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	cmdState := command.NewState()
+	username := "logged"
+	user, cleanup := addTestUser(t, username, int(1e9))
+	defer cleanup()
+
+	// run a separate server on the same storage that logs the requests to a buffer
+	var logBuffer bytes.Buffer
+	loggedState := *state
+	loggedState.requestLog = newRequestLogger(&logBuffer)
+	e := echo.New()
+	InitRoutes(&loggedState, e)
+	server := httptest.NewServer(e)
+
+	err := cmdState.Authenticate(server.URL, username, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to authenticate with the logged server: %v", err)
+	}
+	_, err = cmdState.GetUserStats()
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	err = cmdState.RmFileByID(999999)
+	if err == nil {
+		t.Fatalf("Removing a file that doesn't exist should have failed.")
+	}
+	resp, err := http.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("Failed to get the health of the server: %v", err)
+	}
+	resp.Body.Close()
+	requestID := resp.Header.Get(requestIDHeader)
+	if requestID == "" {
+		t.Fatalf("Expected the response to have a request ID.")
+	}
+
+	// closing the server waits for the requests to finish being logged
+	server.Close()
+	var entries []requestLogEntry
+	dec := json.NewDecoder(&logBuffer)
+	for dec.More() {
+		var entry requestLogEntry
+		err = dec.Decode(&entry)
+		if err != nil {
+			t.Fatalf("Failed to decode the request log entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 requests to be logged but got %d.", len(entries))
+	}
+
+	login, stats, rm, health := entries[0], entries[1], entries[2], entries[3]
+	if login.Route != "/api/users/login" || login.Method != "POST" || login.Status != http.StatusOK || login.UserID != 0 {
+		t.Fatalf("The login request was not logged as expected: %+v", login)
+	}
+	if stats.Route != "/api/user/stats" || stats.Status != http.StatusOK || stats.UserID != user.ID || stats.Error != "" {
+		t.Fatalf("The user stats request was not logged as expected: %+v", stats)
+	}
+	if rm.Route != "/api/file/:fileid" || rm.Path != "/api/file/999999" || rm.Status != http.StatusConflict ||
+		rm.UserID != user.ID || !strings.Contains(rm.Error, "Failed to remove a file") {
+		t.Fatalf("The failed file removal was not logged with its error: %+v", rm)
+	}
+	if health.RequestID != requestID || health.LatencyMS < 0 || health.RemoteAddr == "" || health.Time == "" {
+		t.Fatalf("The health request was not logged as expected: %+v", health)
+	}
+	if login.RequestID == stats.RequestID {
+		t.Fatalf("Each request should get its own request ID.")
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	configFilepath := filepath.Join(testDataDir, "freezer.toml")
+	defer os.Remove(configFilepath)
+	err := ioutil.WriteFile(configFilepath, []byte(`
+listen = ":9090"
+chunksize = 2048
+defaultquota = 5000
+uploadlifetime = "2h"
+
+[tls]
+cert = "config.crt"
+key = "config.key"
+clientca = "clients.crt"
+
+[tls.clientusers]
+"laptop.example.com" = "admin"
+
+[tokens]
+lifetime = "1h"
+refreshlifetime = "48h"
+`), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the config file: %v", err)
+	}
+
+	// restore the flags used by the other tests when done
+	oldChunkSize, oldTokenLife, oldListen := *flagServeChunkSize, *flagServeTokenLife, *argServeListenAddr
+	oldFlagsSet := serverFlagsSet
+	defer func() {
+		*flagServeConfig = ""
+		*flagServeChunkSize, *flagServeTokenLife, *argServeListenAddr = oldChunkSize, oldTokenLife, oldListen
+		serverFlagsSet = oldFlagsSet
+		os.Unsetenv("FREEZER_TOKENLIFE")
+	}()
+	*flagServeConfig = configFilepath
+	*argServeListenAddr = ""
+
+	// the config file replaces the flag defaults
+	cfg, err := loadServerConfig()
+	if err != nil {
+		t.Fatalf("Failed to load the config file: %v", err)
+	}
+	if cfg.Listen != ":9090" || cfg.ChunkSize != 2048 || cfg.DefaultQuota != 5000 ||
+		cfg.TLS.Cert != "config.crt" || cfg.TLS.Key != "config.key" ||
+		cfg.TLS.ClientCA != "clients.crt" || cfg.TLS.ClientUsers["laptop.example.com"] != "admin" ||
+		time.Duration(cfg.Tokens.Lifetime) != time.Hour || time.Duration(cfg.Tokens.RefreshLifetime) != 48*time.Hour ||
+		time.Duration(cfg.UploadLifetime) != 2*time.Hour {
+		t.Fatalf("The config file settings were not loaded: %+v", cfg)
+	}
+	if cfg.DB != *flagDatabasePath {
+		t.Fatalf("The settings missing from the config file should keep the flag values: %+v", cfg)
+	}
+
+	// flags set on the command line and environment variables override the config file
+	os.Setenv("FREEZER_TOKENLIFE", "2h")
+	restoreFlags := parseTestArgs(t, "serve", ":7070", "--config", configFilepath, "--cs", "4096")
+	defer restoreFlags()
+	if !serverFlagsSet.chunkSize || serverFlagsSet.tokenLife || serverFlagsSet.defaultQuota {
+		t.Fatalf("Only the flags passed on the command line should be recorded as set: %+v", serverFlagsSet)
+	}
+	cfg, err = loadServerConfig()
+	if err != nil {
+		t.Fatalf("Failed to load the config file: %v", err)
+	}
+	if cfg.Listen != ":7070" || cfg.ChunkSize != 4096 || time.Duration(cfg.Tokens.Lifetime) != 2*time.Hour {
+		t.Fatalf("The flags and environment variables did not override the config file: %+v", cfg)
+	}
+	if cfg.DefaultQuota != 5000 {
+		t.Fatalf("The config file settings without flags set should not have been overridden: %+v", cfg)
+	}
+
+	// the printed config should load back the same
+	var printed bytes.Buffer
+	err = cfg.write(&printed)
+	if err != nil {
+		t.Fatalf("Failed to write the config: %v", err)
+	}
+	err = ioutil.WriteFile(configFilepath, printed.Bytes(), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the printed config file: %v", err)
+	}
+	*argServeListenAddr = ""
+	serverFlagsSet.chunkSize = false
+	os.Unsetenv("FREEZER_TOKENLIFE")
+	reloaded, err := loadServerConfig()
+	if err != nil || !reflect.DeepEqual(reloaded, cfg) {
+		t.Fatalf("The printed config did not load back the same (%v):\n%s", err, printed.String())
+	}
+
+	// a config file that can't be parsed is an error
+	err = ioutil.WriteFile(configFilepath, []byte("chunksize = \"big\""), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the bad config file: %v", err)
+	}
+	_, err = loadServerConfig()
+	if err == nil {
+		t.Fatalf("Loading a bad config file should have failed.")
+	}
+}
+
+// writeTestCert generates a certificate with certgen and writes it and its key
+// to the directory, returning the file paths.
+func writeTestCert(dir string, name string, opts certgen.Options, t *testing.T) (string, string) {
+	certPEM, keyPEM, err := certgen.Generate(opts)
+	if err != nil {
+		t.Fatalf("Failed to generate the %s certificate: %v", name, err)
+	}
+	certFilepath := filepath.Join(dir, name+".crt")
+	keyFilepath := filepath.Join(dir, name+".key")
+	err = ioutil.WriteFile(certFilepath, certPEM, 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the %s certificate: %v", name, err)
+	}
+	err = ioutil.WriteFile(keyFilepath, keyPEM, 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the %s key: %v", name, err)
+	}
+	return certFilepath, keyFilepath
+}
+
+func TestClientCertLogin(t *testing.T) {
+	certDir, err := ioutil.TempDir("", "freezer_certs")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for the certificates: %v", err)
+	}
+	defer os.RemoveAll(certDir)
+
+	// a CA signs the server certificate and the client certificates
+	caCertPEM, caKeyPEM, err := certgen.Generate(certgen.Options{CommonName: "Freezer Test CA", IsCA: true, ECDSACurve: "P256"})
+	if err != nil {
+		t.Fatalf("Failed to generate the CA certificate: %v", err)
+	}
+	caCertFilepath := filepath.Join(certDir, "ca.crt")
+	err = ioutil.WriteFile(caCertFilepath, caCertPEM, 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the CA certificate: %v", err)
+	}
+	caCert, caKey, err := certgen.ParseCA(caCertPEM, caKeyPEM)
+	if err != nil {
+		t.Fatalf("Failed to parse the CA certificate: %v", err)
+	}
+	serverCrt, serverKey := writeTestCert(certDir, "server", certgen.Options{Hosts: []string{"127.0.0.1"},
+		ECDSACurve: "P256", Parent: caCert, ParentKey: caKey}, t)
+	clientCrt, clientKey := writeTestCert(certDir, "client", certgen.Options{CommonName: "laptop.example.com",
+		IsClient: true, ECDSACurve: "P256", Parent: caCert, ParentKey: caKey}, t)
+	strangerCrt, strangerKey := writeTestCert(certDir, "stranger", certgen.Options{CommonName: "stranger.example.com",
+		IsClient: true, ECDSACurve: "P256", Parent: caCert, ParentKey: caKey}, t)
+
+	cmdState := command.NewState()
+	username := "certuser"
+	otherUsername := "certother"
+	for _, name := range []string{username, otherUsername} {
+		_, cleanup := addTestUser(t, name, int(1e9))
+		defer cleanup()
+	}
+
+	// run a separate HTTPS server on the same storage that verifies client certificates
+	certState := *state
+	certState.TLSCrt = serverCrt
+	certState.TLSKey = serverKey
+	certState.ClientCAs, err = loadCertPool(caCertFilepath)
+	if err != nil {
+		t.Fatalf("Failed to load the client CA: %v", err)
+	}
+	certState.ClientUsers = map[string]string{"laptop.example.com": username}
+	startServer := func() *httptest.Server {
+		e := echo.New()
+		InitRoutes(&certState, e)
+		server := httptest.NewUnstartedServer(e)
+		server.TLS, err = certState.tlsConfig()
+		if err != nil {
+			t.Fatalf("Failed to create the TLS configuration for the server: %v", err)
+		}
+		server.StartTLS()
+		return server
+	}
+	server := startServer()
+	defer server.Close()
+
+	// the mapped client certificate logs in without a password
+	cmdState.CACert = caCertFilepath
+	cmdState.ClientCert = clientCrt
+	cmdState.ClientKey = clientKey
+	err = cmdState.Authenticate(server.URL, username, "")
+	if err != nil {
+		t.Fatalf("Failed to log in with the client certificate: %v", err)
+	}
+	_, err = cmdState.GetUserStats()
+	if err != nil {
+		t.Fatalf("Failed to get the user stats after logging in with the client certificate: %v", err)
+	}
+
+	// the username can be left out for the certificate to pick it
+	err = cmdState.Authenticate(server.URL, "", "")
+	if err != nil {
+		t.Fatalf("Failed to log in with the client certificate and no username: %v", err)
+	}
+
+	// but the certificate can't be used to log in as somebody else
+	err = cmdState.Authenticate(server.URL, otherUsername, "")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Expected the login as another user with the client certificate to be unauthorized: %v", err)
+	}
+
+	// a password still works for any user with the certificate presented
+	err = cmdState.Authenticate(server.URL, otherUsername, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to log in with a password while presenting the client certificate: %v", err)
+	}
+
+	// a certificate signed by the CA that isn't mapped to a user needs a password
+	cmdState.ClientCert = strangerCrt
+	cmdState.ClientKey = strangerKey
+	err = cmdState.Authenticate(server.URL, username, "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("Expected the login with an unmapped client certificate and no password to fail: %v", err)
+	}
+
+	// as does not presenting a certificate at all
+	cmdState.ClientCert = ""
+	cmdState.ClientKey = ""
+	err = cmdState.Authenticate(server.URL, username, "")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("Expected the login without a client certificate or password to fail: %v", err)
+	}
+	err = cmdState.Authenticate(server.URL, username, testUserPassword)
+	if err != nil {
+		t.Fatalf("Failed to log in with a password without a client certificate: %v", err)
+	}
+
+	// a certificate from another CA is rejected when connecting
+	selfCrt, selfKey := writeTestCert(certDir, "self", certgen.Options{CommonName: "laptop.example.com",
+		IsClient: true, ECDSACurve: "P256"}, t)
+	cmdState.ClientCert = selfCrt
+	cmdState.ClientKey = selfKey
+	err = cmdState.Authenticate(server.URL, username, "")
+	if err == nil {
+		t.Fatalf("Expected the login with a client certificate from another CA to fail.")
+	}
+
+	// when client certificates are required, clients without one can't connect at all
+	server.Close()
+	certState.RequireClientCert = true
+	server = startServer()
+	cmdState.ClientCert = ""
+	cmdState.ClientKey = ""
+	err = cmdState.Authenticate(server.URL, username, testUserPassword)
+	if err == nil {
+		t.Fatalf("Expected the login without a client certificate to fail when one is required.")
+	}
+	cmdState.ClientCert = clientCrt
+	cmdState.ClientKey = clientKey
+	err = cmdState.Authenticate(server.URL, username, "")
+	if err != nil {
+		t.Fatalf("Failed to log in with the client certificate when one is required: %v", err)
+	}
+}
+
 func removeAllFilesFromStorage(cmdState *command.State) error {
 	// get all of the remote file names
 	allRemoteFiles, err := cmdState.GetAllFileHashes()
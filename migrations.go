@@ -0,0 +1,541 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// MigrationStep describes one step of the schema migrations that bring an
+// older database up to CurrentDBVersion.
+type MigrationStep struct {
+	// Version is the DBVersion the database will be at after the step is applied
+	Version int
+
+	// Description is a short human readable summary of the step
+	Description string
+}
+
+// migration is a registered schema migration step. The apply function is run
+// inside of a transaction and may return a function to run after the transaction
+// has been committed for work that can't be done in a transaction, like
+// removing chunks from the ChunkStore.
+//
+// The DDL used in the apply functions is frozen at the time the step was written
+// and must not reference the current table definitions, since those will keep
+// changing as the database version gets bumped.
+type migration struct {
+	MigrationStep
+	apply func(s *Storage, tx *sql.Tx) (afterCommit func() error, err error)
+}
+
+// migrations is the ordered registry of schema migration steps. Each entry
+// upgrades the database from Version-1 to Version and the last entry must
+// always be for CurrentDBVersion.
+var migrations = []migration{
+	{MigrationStep{2, "move the chunk bytes out of the FileChunks table and into the chunk store"}, migrateToVersion2},
+	{MigrationStep{3, "store the chunks once per user and share them by reference count"}, migrateToVersion3},
+	{MigrationStep{4, "record the hash algorithm of each file version"}, migrateToVersion4},
+	{MigrationStep{5, "store a wrapped master key for each user"}, migrateToVersion5},
+	{MigrationStep{6, "add the table of refresh tokens"}, migrateToVersion6},
+	{MigrationStep{7, "add the admin flag for users"}, migrateToVersion7},
+	{MigrationStep{8, "add the audit log table"}, migrateToVersion8},
+	{MigrationStep{9, "add the file change journal"}, migrateToVersion9},
+	{MigrationStep{10, "add the table of upload sessions"}, migrateToVersion10},
+	{MigrationStep{11, "add the committed flag for file versions"}, migrateToVersion11},
+	{MigrationStep{12, "record the chunking mode of file versions and the length of each chunk"}, migrateToVersion12},
+}
+
+// PendingMigrations returns the migration steps that have not yet been applied
+// to the database. A new database that doesn't have a DBVersion set yet has
+// no pending migrations since CreateTables will create the current tables.
+func (s *Storage) PendingMigrations() ([]MigrationStep, error) {
+	dbVersion, err := s.getMigratableDBVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []MigrationStep
+	if dbVersion == 0 {
+		return pending, nil
+	}
+	for _, m := range migrations {
+		if m.Version > dbVersion {
+			pending = append(pending, m.MigrationStep)
+		}
+	}
+
+	return pending, nil
+}
+
+// Migrate applies all of the pending migration steps to the database in order
+// and returns the steps that were applied. Before the first step is applied,
+// a copy of the database file is written next to it with the old DBVersion
+// in the name (e.g. freezer.db.v1.bak). Each step runs in its own transaction
+// so a failed step leaves the database at the version of the last step that
+// succeeded.
+func (s *Storage) Migrate() ([]MigrationStep, error) {
+	dbVersion, err := s.getMigratableDBVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []MigrationStep
+	for _, m := range migrations {
+		if dbVersion == 0 || m.Version <= dbVersion {
+			continue
+		}
+
+		if len(applied) == 0 {
+			atomic.StoreInt32(&s.migrating, 1)
+			defer atomic.StoreInt32(&s.migrating, 0)
+
+			err = s.backupDatabase(dbVersion)
+			if err != nil {
+				return applied, err
+			}
+		}
+
+		var afterCommit func() error
+		err = s.transact("Migrate", func(tx *sql.Tx) error {
+			var err error
+			afterCommit, err = m.apply(s, tx)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(updateAppDBVersion, m.Version)
+			if err != nil {
+				return fmt.Errorf("failed to update the DBVersion in the AppData table: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return applied, fmt.Errorf("failed to update the database to version %d: %v", m.Version, err)
+		}
+		applied = append(applied, m.MigrationStep)
+
+		if afterCommit != nil {
+			err = afterCommit()
+			if err != nil {
+				return applied, fmt.Errorf("failed to finish updating the database to version %d: %v", m.Version, err)
+			}
+		}
+	}
+
+	return applied, nil
+}
+
+// getMigratableDBVersion returns the DBVersion of the database or 0 if the
+// database is new and doesn't have a version set yet. An error is returned
+// if the database was written by a newer version of filefreezer.
+func (s *Storage) getMigratableDBVersion() (int, error) {
+	var tableCount int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'AppData';`).Scan(&tableCount)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check for the AppData table: %v", err)
+	}
+	if tableCount == 0 {
+		return 0, nil
+	}
+
+	var dbVersion int
+	err = s.db.QueryRow(getAppDBVersion).Scan(&dbVersion)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get the DBVersion from the AppData table: %v", err)
+	}
+
+	if dbVersion > CurrentDBVersion {
+		return 0, fmt.Errorf("the database version (%d) is newer than the version supported by this build (%d)", dbVersion, CurrentDBVersion)
+	}
+
+	return dbVersion, nil
+}
+
+// backupDatabase copies the database file to <path>.v<dbVersion>.bak before
+// the migrations get applied. In-memory databases are not backed up. The
+// chunk files of a FileSystemChunkStore are not part of the backup.
+func (s *Storage) backupDatabase(dbVersion int) error {
+	dbFilepath := databaseFilepath(s.dbPath)
+	if dbFilepath == "" {
+		return nil
+	}
+
+	// flush the write-ahead log into the database file so that the copy
+	// has all of the committed transactions.
+	_, err := s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE);")
+	if err != nil {
+		return fmt.Errorf("failed to checkpoint the database before the backup: %v", err)
+	}
+
+	backupPath := fmt.Sprintf("%s.v%d.bak", dbFilepath, dbVersion)
+	err = copyFile(dbFilepath, backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to back up the database to %s: %v", backupPath, err)
+	}
+
+	return nil
+}
+
+// databaseFilepath returns the file path of the sqlite database for the
+// connection string given or an empty string for in-memory databases.
+func databaseFilepath(dbPath string) string {
+	path := strings.TrimPrefix(dbPath, "file:")
+	query := ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	if path == "" || path == ":memory:" || strings.Contains(query, "mode=memory") {
+		return ""
+	}
+	return path
+}
+
+// copyFile copies the file at srcPath to dstPath, writing to a temporary file
+// first so that a partial copy is never left at dstPath.
+func copyFile(srcPath string, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := dstPath + ".tmp"
+	dst, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, dstPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// migrateToVersion2 moves the chunk bytes out of the FileChunks table and into
+// the ChunkStore, leaving a blob reference and the chunk size behind in FileChunks.
+func migrateToVersion2(s *Storage, tx *sql.Tx) (func() error, error) {
+	const createV2ChunkBlobsTable = `CREATE TABLE IF NOT EXISTS ChunkBlobs (
+        BlobRef     TEXT PRIMARY KEY    NOT NULL,
+        Chunk       BLOB                NOT NULL
+    );`
+	const createV2FileChunksTable = `CREATE TABLE FileChunksV2 (
+        ChunkID     INTEGER PRIMARY KEY	NOT NULL,
+        FileID 		INTEGER             NOT NULL,
+        VersionID   INTEGER             NOT NULL,
+        ChunkNum	INTEGER 			NOT NULL,
+        ChunkHash	TEXT				NOT NULL,
+        BlobRef     TEXT                NOT NULL,
+        BlobSize    INTEGER             NOT NULL
+	);`
+
+	// every existing chunk gets a new random blob reference
+	_, err := tx.Exec(`ALTER TABLE FileChunks ADD COLUMN BlobRef TEXT;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add the blob reference column to the FileChunks table: %v", err)
+	}
+	_, err = tx.Exec(`UPDATE FileChunks SET BlobRef = lower(hex(randomblob(16)));`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the blob references for the existing chunks: %v", err)
+	}
+
+	// copy the chunk bytes over to the chunk store
+	if _, inDB := s.chunks.(*databaseChunkStore); inDB {
+		_, err = tx.Exec(createV2ChunkBlobsTable)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the ChunkBlobs table: %v", err)
+		}
+		_, err = tx.Exec(`INSERT INTO ChunkBlobs (BlobRef, Chunk) SELECT BlobRef, Chunk FROM FileChunks;`)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy the existing chunks to the ChunkBlobs table: %v", err)
+		}
+	} else {
+		// chunks are pulled one at a time so that the whole table doesn't
+		// have to fit in memory.
+		lastChunkID := -1
+		for {
+			var blobRef string
+			var chunk []byte
+			err = tx.QueryRow(`SELECT ChunkID, BlobRef, Chunk FROM FileChunks WHERE ChunkID > ? ORDER BY ChunkID LIMIT 1;`,
+				lastChunkID).Scan(&lastChunkID, &blobRef, &chunk)
+			if err == sql.ErrNoRows {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to read the next existing chunk: %v", err)
+			}
+
+			err = s.chunks.PutChunk(blobRef, chunk)
+			if err != nil {
+				return nil, fmt.Errorf("failed to copy chunk %d to the chunk store: %v", lastChunkID, err)
+			}
+		}
+	}
+
+	// sqlite can't drop a column so the table is rebuilt without the chunk bytes
+	_, err = tx.Exec(createV2FileChunksTable)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the new FileChunks table: %v", err)
+	}
+	_, err = tx.Exec(`INSERT INTO FileChunksV2 (ChunkID, FileID, VersionID, ChunkNum, ChunkHash, BlobRef, BlobSize)
+		SELECT ChunkID, FileID, VersionID, ChunkNum, ChunkHash, BlobRef, LENGTH(Chunk) FROM FileChunks;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy the chunk metadata to the new FileChunks table: %v", err)
+	}
+	_, err = tx.Exec(`DROP TABLE FileChunks;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to drop the old FileChunks table: %v", err)
+	}
+	_, err = tx.Exec(`ALTER TABLE FileChunksV2 RENAME TO FileChunks;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rename the new FileChunks table: %v", err)
+	}
+
+	// the chunk bytes have all been moved out of the FileChunks table, so
+	// give the free pages back to the filesystem.
+	return func() error {
+		_, err := s.db.Exec(`VACUUM;`)
+		if err != nil {
+			return fmt.Errorf("failed to vacuum the database after moving the chunks: %v", err)
+		}
+		return nil
+	}, nil
+}
+
+// migrateToVersion3 moves the chunk blob references out of the FileChunks table and
+// into the UserChunks table so that chunks with the same hash are only stored once
+// for each user. The duplicate blobs are removed from the ChunkStore and the
+// allocation counts for the users are recalculated.
+func migrateToVersion3(s *Storage, tx *sql.Tx) (func() error, error) {
+	const createV3UserChunksTable = `CREATE TABLE IF NOT EXISTS UserChunks (
+        UserChunkID INTEGER PRIMARY KEY	NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        ChunkHash	TEXT				NOT NULL,
+        BlobRef     TEXT                NOT NULL,
+        BlobSize    INTEGER             NOT NULL,
+        RefCount    INTEGER             NOT NULL,
+        UNIQUE (UserID, ChunkHash)
+	);`
+	const createV3FileChunksTable = `CREATE TABLE FileChunksV3 (
+        ChunkID     INTEGER PRIMARY KEY	NOT NULL,
+        FileID 		INTEGER             NOT NULL,
+        VersionID   INTEGER             NOT NULL,
+        ChunkNum	INTEGER 			NOT NULL,
+        ChunkHash	TEXT				NOT NULL,
+        UserChunkID INTEGER             NOT NULL
+	);`
+
+	_, err := tx.Exec(createV3UserChunksTable)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the UserChunks table: %v", err)
+	}
+
+	// keep one blob for each distinct chunk hash a user has; the chunks with the
+	// same hash have the same plaintext so any one of the blobs will do.
+	_, err = tx.Exec(`INSERT INTO UserChunks (UserID, ChunkHash, BlobRef, BlobSize, RefCount)
+		SELECT FileInfo.UserID, FileChunks.ChunkHash, MIN(FileChunks.BlobRef), FileChunks.BlobSize, COUNT(*) FROM FileChunks
+		INNER JOIN FileInfo on FileChunks.FileID = FileInfo.FileID
+		GROUP BY FileInfo.UserID, FileChunks.ChunkHash;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build the UserChunks table from the existing chunks: %v", err)
+	}
+
+	duplicateBlobRefs, err := queryBlobRefs(tx, `SELECT BlobRef FROM FileChunks WHERE BlobRef NOT IN (SELECT BlobRef FROM UserChunks);`)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite can't drop a column so the table is rebuilt to reference the user chunks
+	_, err = tx.Exec(createV3FileChunksTable)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the new FileChunks table: %v", err)
+	}
+	_, err = tx.Exec(`INSERT INTO FileChunksV3 (ChunkID, FileID, VersionID, ChunkNum, ChunkHash, UserChunkID)
+		SELECT FileChunks.ChunkID, FileChunks.FileID, FileChunks.VersionID, FileChunks.ChunkNum, FileChunks.ChunkHash, UserChunks.UserChunkID FROM FileChunks
+		INNER JOIN FileInfo on FileChunks.FileID = FileInfo.FileID
+		INNER JOIN UserChunks on UserChunks.UserID = FileInfo.UserID AND UserChunks.ChunkHash = FileChunks.ChunkHash;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy the chunk metadata to the new FileChunks table: %v", err)
+	}
+	_, err = tx.Exec(`DROP TABLE FileChunks;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to drop the old FileChunks table: %v", err)
+	}
+	_, err = tx.Exec(`ALTER TABLE FileChunksV3 RENAME TO FileChunks;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rename the new FileChunks table: %v", err)
+	}
+
+	// users are now only charged once for each distinct chunk
+	_, err = tx.Exec(`UPDATE UserStats SET Allocated =
+		(SELECT IFNULL(SUM(BlobSize), 0) FROM UserChunks WHERE UserChunks.UserID = UserStats.UserID);`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recalculate the allocation counts for the users: %v", err)
+	}
+
+	return func() error {
+		s.removeChunkBlobs(duplicateBlobRefs)
+		return nil
+	}, nil
+}
+
+// migrateToVersion4 adds the HashAlgo column to FileVersion. The clients hashed the files
+// with plain SHA1 before the algorithm was recorded, so the existing versions get marked
+// with HashAlgoSHA1; the clients replace those versions with keyed hashes as they sync.
+func migrateToVersion4(s *Storage, tx *sql.Tx) (func() error, error) {
+	_, err := tx.Exec(`ALTER TABLE FileVersion ADD COLUMN HashAlgo TEXT NOT NULL DEFAULT 'sha1';`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add the HashAlgo column to the FileVersion table: %v", err)
+	}
+	return nil, nil
+}
+
+// migrateToVersion5 adds the WrappedKey column to Users. Users that set their crypto
+// password before the master keys were wrapped don't have one; their clients keep
+// using the key derived from the crypto password until the password is changed.
+func migrateToVersion5(s *Storage, tx *sql.Tx) (func() error, error) {
+	_, err := tx.Exec(`ALTER TABLE Users ADD COLUMN WrappedKey BLOB;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add the WrappedKey column to the Users table: %v", err)
+	}
+	return nil, nil
+}
+
+// migrateToVersion6 creates the RefreshTokens table.
+func migrateToVersion6(s *Storage, tx *sql.Tx) (func() error, error) {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS RefreshTokens (
+        TokenHash   TEXT PRIMARY KEY    NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        ExpiresAt   INTEGER             NOT NULL,
+        Revoked     INTEGER             NOT NULL
+	);`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the RefreshTokens table: %v", err)
+	}
+	return nil, nil
+}
+
+// migrateToVersion7 adds the IsAdmin column to Users. Nobody is an admin after
+// the migration; admins are granted with the user mod command.
+func migrateToVersion7(s *Storage, tx *sql.Tx) (func() error, error) {
+	_, err := tx.Exec(`ALTER TABLE Users ADD COLUMN IsAdmin INTEGER NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add the IsAdmin column to the Users table: %v", err)
+	}
+	return nil, nil
+}
+
+// migrateToVersion8 creates the AuditLog table and its index on the record time.
+func migrateToVersion8(s *Storage, tx *sql.Tx) (func() error, error) {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS AuditLog (
+        AuditID     INTEGER PRIMARY KEY NOT NULL,
+        Time        INTEGER             NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        Username    TEXT                NOT NULL,
+        Event       TEXT                NOT NULL,
+        RemoteAddr  TEXT                NOT NULL,
+        Detail      TEXT                NOT NULL
+    );`)
+	if err == nil {
+		_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS AuditLogTime ON AuditLog (Time);`)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the AuditLog table: %v", err)
+	}
+	return nil, nil
+}
+
+// migrateToVersion9 creates the FileChanges journal and its index on the user's
+// revision. The journal starts out empty, so clients that synced before the
+// migration do a full sync the next time.
+func migrateToVersion9(s *Storage, tx *sql.Tx) (func() error, error) {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS FileChanges (
+        ChangeID    INTEGER PRIMARY KEY NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        Revision    INTEGER             NOT NULL,
+        FileID      INTEGER             NOT NULL,
+        VersionID   INTEGER             NOT NULL,
+        Change      TEXT                NOT NULL,
+        Time        INTEGER             NOT NULL
+    );`)
+	if err == nil {
+		_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS FileChangesRevision ON FileChanges (UserID, Revision);`)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the FileChanges table: %v", err)
+	}
+	return nil, nil
+}
+
+// migrateToVersion10 creates the UploadSessions table. Files that were left with
+// missing chunks before the migration don't get a session; their clients upload
+// the missing chunks the same way they did before.
+func migrateToVersion10(s *Storage, tx *sql.Tx) (func() error, error) {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS UploadSessions (
+        SessionID   TEXT PRIMARY KEY    NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        FileID      INTEGER             NOT NULL,
+        VersionID   INTEGER             NOT NULL,
+        Reserved    INTEGER             NOT NULL,
+        Received    INTEGER             NOT NULL,
+        Lifetime    INTEGER             NOT NULL,
+        ExpiresAt   INTEGER             NOT NULL
+    );`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the UploadSessions table: %v", err)
+	}
+	return nil, nil
+}
+
+// migrateToVersion11 adds the Committed flag to the FileVersion table. Versions that
+// are still being uploaded in a session are left pending and every other version is
+// committed, since it could already have been the current version of its file.
+func migrateToVersion11(s *Storage, tx *sql.Tx) (func() error, error) {
+	_, err := tx.Exec(`ALTER TABLE FileVersion ADD COLUMN Committed INTEGER NOT NULL DEFAULT 1;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add the Committed column to the FileVersion table: %v", err)
+	}
+	_, err = tx.Exec(`UPDATE FileVersion SET Committed = 0 WHERE VersionID IN (SELECT VersionID FROM UploadSessions);`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mark the file versions being uploaded as pending: %v", err)
+	}
+	return nil, nil
+}
+
+// migrateToVersion12 adds the Chunking mode to the FileVersion table and the ChunkLength
+// to the FileChunks table. Every existing version was split into fixed size chunks, so
+// the lengths of their chunks aren't needed and are left at 0.
+func migrateToVersion12(s *Storage, tx *sql.Tx) (func() error, error) {
+	_, err := tx.Exec(`ALTER TABLE FileVersion ADD COLUMN Chunking TEXT NOT NULL DEFAULT 'fixed';`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add the Chunking column to the FileVersion table: %v", err)
+	}
+	_, err = tx.Exec(`ALTER TABLE FileChunks ADD COLUMN ChunkLength INTEGER NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add the ChunkLength column to the FileChunks table: %v", err)
+	}
+	return nil, nil
+}
@@ -4,16 +4,22 @@
 package filefreezer
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/subtle"
+	"hash"
 	"strconv"
 	"strings"
 
+	"encoding/base32"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 
 	"golang.org/x/crypto/bcrypt"
@@ -22,6 +28,33 @@ import (
 
 const (
 	defaultPasswordCost = 10 // analogus to bcrypt's DefaultCost
+
+	// hashKeyInfo is mixed with the crypto key to derive the key used for the file and chunk hashes
+	hashKeyInfo = "filefreezer chunk hash key"
+
+	// keyWrapInfo is the additional data authenticated with a wrapped master key
+	keyWrapInfo = "filefreezer master key"
+
+	// recoveryChecksumSize is the number of checksum bytes appended to a recovery key
+	recoveryChecksumSize = 4
+
+	// recoveryGroupSize is the number of characters between the dashes of a recovery phrase
+	recoveryGroupSize = 5
+)
+
+// recoveryEncoding is the encoding used for the recovery phrases; base32 avoids characters
+// that are easily confused when the phrase is written down.
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+const (
+	// HashAlgoSHA1 identifies the plain SHA1 file and chunk hashes that file versions were
+	// stored with before the hashes were keyed. These are only calculated to compare local
+	// files against those older versions.
+	HashAlgoSHA1 = "sha1"
+
+	// HashAlgoHMACSHA256 identifies the HMAC-SHA256 file and chunk hashes keyed with the
+	// key returned by DeriveHashKey.
+	HashAlgoHMACSHA256 = "hmac-sha256"
 )
 
 // FileStats is a structure used to return information about a given
@@ -32,11 +65,34 @@ type FileStats struct {
 	Permissions uint32
 	HashString  string
 	IsDir       bool
+
+	// HashAlgo identifies the algorithm used for HashString and ChunkHashes
+	HashAlgo string
+
+	// ChunkHashes are the hashes of each chunk of the file, in order
+	ChunkHashes []string
+
+	// Chunking is the chunking mode the file was split into chunks with
+	Chunking string
+
+	// ChunkLengths are the number of bytes in each chunk of the file, in order
+	ChunkLengths []int
 }
 
-// CalcFileHashInfo takes the file name and calculates the number of chunks, last modified time
-// and hash string for the file. An error is returned on failure.
-func CalcFileHashInfo(maxChunkSize int64, filename string) (stats FileStats, e error) {
+// CalcFileHashInfo takes the file name and calculates the number of chunks, last modified time,
+// hash string and the chunk hashes for the file. The file is streamed through the hashes one
+// chunk at a time so that it never has to be loaded into memory all at once. hashKey is the
+// key used for the hashes (see DeriveHashKey); if it is nil the legacy HashAlgoSHA1 hashes are
+// calculated instead. The file is split into chunks with ChunkingFixed. An error is returned
+// on failure.
+func CalcFileHashInfo(maxChunkSize int64, filename string, hashKey []byte) (stats FileStats, e error) {
+	return CalcChunkedFileHashInfo(ChunkingFixed, maxChunkSize, filename, hashKey)
+}
+
+// CalcChunkedFileHashInfo is like CalcFileHashInfo but splits the file into chunks with the
+// chunking mode given. The file hash is the same for every chunking mode; only the chunk
+// hashes and lengths differ.
+func CalcChunkedFileHashInfo(chunking string, maxChunkSize int64, filename string, hashKey []byte) (stats FileStats, e error) {
 	fileInfo, err := os.Stat(filename)
 	if err != nil {
 		e = fmt.Errorf("failed to stat the local file (%s) for the test: %v", filename, err)
@@ -45,6 +101,8 @@ func CalcFileHashInfo(maxChunkSize int64, filename string) (stats FileStats, e e
 
 	stats.LastMod = fileInfo.ModTime().UTC().Unix()
 	stats.Permissions = uint32(fileInfo.Mode())
+	stats.HashAlgo = hashAlgoForKey(hashKey)
+	stats.Chunking = chunking
 
 	// is this a directory? if so, we set the flag and return
 	if fileInfo.IsDir() {
@@ -52,27 +110,92 @@ func CalcFileHashInfo(maxChunkSize int64, filename string) (stats FileStats, e e
 		return stats, e
 	}
 
-	// calculate the chunk count required for the file size
-	fileSize := fileInfo.Size()
-	stats.ChunkCount = int(fileSize / maxChunkSize)
-	if fileSize%maxChunkSize != 0 {
-		stats.ChunkCount++
+	f, err := os.Open(filename)
+	if err != nil {
+		e = fmt.Errorf("failed to open the local file (%s) for hashing: %v", filename, err)
+		return
 	}
+	defer f.Close()
 
-	// generate a hash for the test file
-	hasher := sha1.New()
-	fileBytes, err := ioutil.ReadFile(filename)
+	stats.HashString, stats.ChunkHashes, stats.ChunkLengths, err = CalcChunkedReaderHashInfo(chunking, maxChunkSize, f, hashKey)
 	if err != nil {
-		e = fmt.Errorf("failed to create a file byte array for the hashing operation")
+		e = fmt.Errorf("failed to hash the local file (%s): %v", filename, err)
 		return
 	}
-	hasher.Write(fileBytes)
-	hash := hasher.Sum(nil)
-	stats.HashString = base64.URLEncoding.EncodeToString(hash)
+	stats.ChunkCount = len(stats.ChunkHashes)
 
 	return
 }
 
+// CalcReaderHashInfo reads r until EOF in chunks of maxChunkSize bytes and calculates the
+// hash string for all of the data as well as the hash of each chunk in one pass using the
+// same algorithm as CalcFileHashInfo. Only one chunk is held in memory at a time.
+func CalcReaderHashInfo(maxChunkSize int64, r io.Reader, hashKey []byte) (hashString string, chunkHashes []string, e error) {
+	hashString, chunkHashes, _, e = CalcChunkedReaderHashInfo(ChunkingFixed, maxChunkSize, r, hashKey)
+	return hashString, chunkHashes, e
+}
+
+// CalcChunkedReaderHashInfo is like CalcReaderHashInfo but splits the data into chunks
+// of at most maxChunkSize bytes with the chunking mode given and also returns the
+// length of each chunk.
+func CalcChunkedReaderHashInfo(chunking string, maxChunkSize int64, r io.Reader, hashKey []byte) (hashString string, chunkHashes []string, chunkLengths []int, e error) {
+	chunker, err := NewChunker(chunking, maxChunkSize, r, hashKey)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	hasher := newHasher(hashKey)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", nil, nil, err
+		}
+		hasher.Write(chunk)
+		chunkHashes = append(chunkHashes, CalcChunkHash(hashKey, chunk))
+		chunkLengths = append(chunkLengths, len(chunk))
+	}
+
+	hashString = base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+	return hashString, chunkHashes, chunkLengths, nil
+}
+
+// DeriveHashKey derives the key used for the file and chunk hashes from the user's crypto
+// key so that the crypto key itself is only ever used for encryption.
+func DeriveHashKey(cryptoKey []byte) []byte {
+	mac := hmac.New(sha256.New, cryptoKey)
+	mac.Write([]byte(hashKeyInfo))
+	return mac.Sum(nil)
+}
+
+// CalcChunkHash returns the keyed hash (HMAC-SHA256) of the chunk bytes as a URL safe
+// base64 string. Chunks are identified by this hash on the server, which can use it to
+// find chunks a user already has stored but can't use it to fingerprint the plaintext.
+// If hashKey is nil the legacy HashAlgoSHA1 hash is returned instead.
+func CalcChunkHash(hashKey []byte, chunk []byte) string {
+	hasher := newHasher(hashKey)
+	hasher.Write(chunk)
+	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// newHasher returns the hash for the file and chunk hashes keyed with hashKey,
+// or the legacy unkeyed SHA1 hash if hashKey is nil.
+func newHasher(hashKey []byte) hash.Hash {
+	if hashKey == nil {
+		return sha1.New()
+	}
+	return hmac.New(sha256.New, hashKey)
+}
+
+// hashAlgoForKey returns the HashAlgo identifier of the hashes newHasher returns for hashKey.
+func hashAlgoForKey(hashKey []byte) string {
+	if hashKey == nil {
+		return HashAlgoSHA1
+	}
+	return HashAlgoHMACSHA256
+}
+
 // GenLoginPasswordHash takes the user password, generates a new random salt,
 // then generates a hash from the salted password combination.
 func GenLoginPasswordHash(unsaltedPassword string) (salt string, saltedhash []byte, err error) {
@@ -173,6 +296,108 @@ func GenCryptoPasswordHash(password string, makeKeyHash bool, keyHashOpts string
 	return
 }
 
+// GenMasterKey generates a new random key to encrypt a user's data with. The master key
+// is stored on the server wrapped by the key derived from the crypto password (see WrapKey)
+// so that the crypto password can be changed without encrypting the data again.
+func GenMasterKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get random bytes for the master key: %v", err)
+	}
+	return key, nil
+}
+
+// WrapKey encrypts the key with the wrapping key, which is the key derived from the
+// crypto password, using AES-GCM. The nonce is prepended to the returned bytes.
+func WrapKey(wrappingKey []byte, key []byte) ([]byte, error) {
+	gcm, err := newKeyWrapGCM(wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get random bytes for the key wrapping nonce: %v", err)
+	}
+
+	return gcm.Seal(nonce, nonce, key, []byte(keyWrapInfo)), nil
+}
+
+// UnwrapKey decrypts a key that was encrypted by WrapKey with the same wrapping key.
+func UnwrapKey(wrappingKey []byte, wrappedKey []byte) ([]byte, error) {
+	gcm, err := newKeyWrapGCM(wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrappedKey) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("the wrapped key is too short")
+	}
+
+	nonceSize := gcm.NonceSize()
+	key, err := gcm.Open(nil, wrappedKey[:nonceSize], wrappedKey[nonceSize:], []byte(keyWrapInfo))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the key: %v", err)
+	}
+	return key, nil
+}
+
+func newKeyWrapGCM(wrappingKey []byte) (cipher.AEAD, error) {
+	aesCipher, err := aes.NewCipher(wrappingKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize the AES cipher for key wrapping: %v", err)
+	}
+	gcm, err := cipher.NewGCM(aesCipher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize the AES-GCM cipher for key wrapping: %v", err)
+	}
+	return gcm, nil
+}
+
+// EncodeRecoveryKey encodes the master key as a printable recovery phrase that can be
+// written down and later decoded with DecodeRecoveryKey. The phrase is the base32 encoding
+// of the key followed by a short checksum, split into groups of characters with dashes.
+func EncodeRecoveryKey(key []byte) string {
+	checksum := sha256.Sum256(key)
+	encoded := recoveryEncoding.EncodeToString(append(key[:len(key):len(key)], checksum[:recoveryChecksumSize]...))
+
+	groups := make([]string, 0, len(encoded)/recoveryGroupSize+1)
+	for len(encoded) > recoveryGroupSize {
+		groups = append(groups, encoded[:recoveryGroupSize])
+		encoded = encoded[recoveryGroupSize:]
+	}
+	groups = append(groups, encoded)
+	return strings.Join(groups, "-")
+}
+
+// DecodeRecoveryKey decodes a recovery phrase created by EncodeRecoveryKey back into the
+// master key. Case, spaces and dashes are ignored. An error is returned if the phrase
+// can't be decoded or if its checksum doesn't match, such as when it was mistyped.
+func DecodeRecoveryKey(phrase string) ([]byte, error) {
+	cleaned := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(phrase))
+
+	decoded, err := recoveryEncoding.DecodeString(cleaned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the recovery key: %v", err)
+	}
+	if len(decoded) <= recoveryChecksumSize {
+		return nil, fmt.Errorf("the recovery key is too short")
+	}
+
+	key := decoded[:len(decoded)-recoveryChecksumSize]
+	checksum := sha256.Sum256(key)
+	if subtle.ConstantTimeCompare(checksum[:recoveryChecksumSize], decoded[len(key):]) != 1 {
+		return nil, fmt.Errorf("the recovery key checksum does not match; check it for typos")
+	}
+	return key, nil
+}
+
 // VerifyCryptoPassword takes a plain text password and compares it against a hash
 // of the crypto key to verify that the password is correct and the crypto key is
 // the correct one. On success and successful match a non-nil []byte slice is returned.
@@ -7,6 +7,9 @@ import (
 	"database/sql"
 	"fmt"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	// import the sqlite3 driver for use with database/sql
 	_ "github.com/mattn/go-sqlite3"
@@ -15,7 +18,7 @@ import (
 const (
 	// CurrentDBVersion is set to the current database version and is used
 	// by filefreezer to detect when the database tables need to get updated.
-	CurrentDBVersion = 1
+	CurrentDBVersion = 12
 )
 
 const (
@@ -28,7 +31,9 @@ const (
         Name		TEXT	UNIQUE		NOT NULL ON CONFLICT ABORT,
 		Salt		TEXT				NOT NULL,
 		Password	BLOB				NOT NULL,
-		CryptoHash  BLOB                
+		CryptoHash  BLOB,
+		WrappedKey  BLOB,
+		IsAdmin     INTEGER             NOT NULL DEFAULT 0
     );`
 
 	createUserStatsTable = `CREATE TABLE IF NOT EXISTS UserStats (
@@ -53,7 +58,10 @@ const (
         Perms       INTEGER             NOT NULL,
         LastMod		INTEGER				NOT NULL,
         ChunkCount  INTEGER				NOT NULL,
-        FileHash	TEXT				NOT NULL
+        FileHash	TEXT				NOT NULL,
+        HashAlgo    TEXT                NOT NULL,
+        Committed   INTEGER             NOT NULL DEFAULT 1,
+        Chunking    TEXT                NOT NULL DEFAULT 'fixed'
     );`
 
 	createFileChunksTable = `CREATE TABLE IF NOT EXISTS FileChunks (
@@ -62,22 +70,46 @@ const (
         VersionID   INTEGER             NOT NULL,
         ChunkNum	INTEGER 			NOT NULL,
         ChunkHash	TEXT				NOT NULL,
-        Chunk		BLOB				NOT NULL
+        UserChunkID INTEGER             NOT NULL,
+        ChunkLength INTEGER             NOT NULL DEFAULT 0
 	);`
 
-	getAppDBVersion = `SELECT DBVersion FROM AppData;`
-	setAppDBVersion = `INSERT OR REPLACE INTO AppData (DBVersion) VALUES (?);`
+	createUserChunksTable = `CREATE TABLE IF NOT EXISTS UserChunks (
+        UserChunkID INTEGER PRIMARY KEY	NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        ChunkHash	TEXT				NOT NULL,
+        BlobRef     TEXT                NOT NULL,
+        BlobSize    INTEGER             NOT NULL,
+        RefCount    INTEGER             NOT NULL,
+        UNIQUE (UserID, ChunkHash)
+	);`
+
+	createRefreshTokensTable = `CREATE TABLE IF NOT EXISTS RefreshTokens (
+        TokenHash   TEXT PRIMARY KEY    NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        ExpiresAt   INTEGER             NOT NULL,
+        Revoked     INTEGER             NOT NULL
+	);`
+
+	getAppDBVersion    = `SELECT DBVersion FROM AppData;`
+	setAppDBVersion    = `INSERT OR REPLACE INTO AppData (DBVersion) VALUES (?);`
+	updateAppDBVersion = `UPDATE AppData SET DBVersion = ?;`
 
 	lookupUserByName  = `SELECT Name FROM Users WHERE Name = ?;`
 	addUser           = `INSERT INTO Users (Name, Salt, Password) VALUES (?, ?, ?);`
-	getUser           = `SELECT UserID, Salt, Password, CryptoHash FROM Users  WHERE Name = ?;`
-	setUserCryptoHash = `UPDATE Users SET CryptoHash = (?) WHERE UserID = ?;`
+	getUser           = `SELECT UserID, Salt, Password, CryptoHash, WrappedKey, IsAdmin FROM Users  WHERE Name = ?;`
+	getUserByID       = `SELECT Name, Salt, Password, CryptoHash, WrappedKey, IsAdmin FROM Users  WHERE UserID = ?;`
+	getAllUsers       = `SELECT UserID, Name, IsAdmin FROM Users ORDER BY Name;`
+	setUserAdmin      = `UPDATE Users SET IsAdmin = ? WHERE UserID = ?;`
+	setUserCryptoHash = `UPDATE Users SET CryptoHash = (?), WrappedKey = (?) WHERE UserID = ?;`
 	updateUser        = `UPDATE Users SET Name = ?, Salt = ?, Password = ?, CryptoHash = ? WHERE UserID = ?;`
 
 	setUserStats    = `INSERT OR REPLACE INTO UserStats (UserID, Quota, Allocated, Revision) VALUES (?, ?, ?, ?);`
 	getUserStats    = `SELECT Quota, Allocated, Revision FROM UserStats WHERE UserID = ?;`
 	updateUserStats = `UPDATE UserStats SET Allocated = Allocated + (?), Revision = Revision + 1 WHERE UserID = ?;`
 	setUserQuota    = `UPDATE UserStats SET Quota = (?) WHERE UserID = ?;`
+	getAllUserStats = `SELECT Users.Name, UserStats.Quota, UserStats.Allocated, UserStats.Revision FROM UserStats
+		INNER JOIN Users ON Users.UserID = UserStats.UserID;`
 
 	addFileInfo = `INSERT INTO FileInfo (UserID, FileName, IsDir, CurrentVersionID) SELECT ?, ?, ?, ?
                         WHERE NOT EXISTS (SELECT 1 FROM FileInfo WHERE UserID = ? AND FileName = ?);`
@@ -87,14 +119,18 @@ const (
 	getAllUserFiles       = `SELECT FileID, FileName, IsDir, CurrentVersionID FROM FileInfo WHERE UserID = ?;`
 	removeFileInfoByID    = `DELETE FROM FileInfo WHERE FileID = ?;`
 	setFileCurrentVersion = `UPDATE FileInfo SET CurrentVersionID = ? WHERE FileID = ?;`
+	getFileCurrentVersion = `SELECT FileInfo.CurrentVersionID, COALESCE(FileVersion.VersionNum, 0), COALESCE(FileVersion.Committed, 0)
+		FROM FileInfo LEFT JOIN FileVersion ON FileVersion.VersionID = FileInfo.CurrentVersionID WHERE FileInfo.FileID = ?;`
 
-	addFileVersion                = `INSERT INTO FileVersion (FileID, VersionNum, Perms, LastMod, ChunkCount, FileHash) VALUES (?, ?, ?, ?, ?, ?);`
-	getFileVersionByID            = `SELECT VersionNum, Perms, LastMod, ChunkCount, FileHash FROM FileVersion WHERE VersionID = ?;`
+	addFileVersion                = `INSERT INTO FileVersion (FileID, VersionNum, Perms, LastMod, ChunkCount, FileHash, HashAlgo, Committed, Chunking) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	getFileVersionByID            = `SELECT VersionNum, Perms, LastMod, ChunkCount, FileHash, HashAlgo, Committed, Chunking FROM FileVersion WHERE VersionID = ?;`
+	setFileVersionCommitted       = `UPDATE FileVersion SET Committed = 1 WHERE VersionID = ?;`
 	removeAllFileVersionsByFileID = `DELETE FROM FileVersion WHERE FileID = ?;`
 	removeFileVersionsByFileID    = `DELETE FROM FileVersion WHERE FileID = ? AND (VersionNum BETWEEN ? AND ?);`
-	getVersionsForFile            = `SELECT VersionID, VersionNum, Perms, LastMod, ChunkCount, FileHash FROM FileVersion WHERE FileID = ?;`
+	getVersionsForFile            = `SELECT VersionID, VersionNum, Perms, LastMod, ChunkCount, FileHash, HashAlgo, Committed, Chunking FROM FileVersion WHERE FileID = ?;`
 	getVersionsCountForFile       = `SELECT COUNT(*) AS COUNT FROM FileVersion WHERE FileID = ? AND (VersionNum BETWEEN ? AND ?);`
-	getFileVersionsTotalChunkSize = `SELECT SUM(LENGTH(Chunk)) FROM FileChunks 
+	getMaxVersionNumber           = `SELECT COALESCE(MAX(VersionNum), 0) FROM FileVersion WHERE FileID = ?;`
+	getFileVersionsUserChunkIDs   = `SELECT UserChunkID FROM FileChunks 
 					INNER JOIN FileVersion on FileChunks.VersionID = FileVersion.VersionID
 					WHERE FileChunks.FileID = ? AND (VersionNum BETWEEN ? AND ?);`
 	removeAllFileVersionChunks = `DELETE FROM FileChunks
@@ -104,18 +140,39 @@ const (
 						WHERE FileChunks.FileID = ? AND (VersionNum BETWEEN ? AND ?)
 					);`
 
-	getAllFileChunksByID  = `SELECT ChunkNum, ChunkHash FROM FileChunks WHERE FileID = ? AND VersionID = ?;`
-	addFileChunk          = `INSERT OR REPLACE INTO FileChunks (FileID, VersionID, ChunkNum, ChunkHash, Chunk) VALUES (?, ?, ?, ?, ?);`
-	removeAllFileChunks   = `DELETE FROM FileChunks WHERE FileID = ?;`
-	removeFileChunk       = `DELETE FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
-	getFileChunk          = `SELECT ChunkHash, Chunk FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
-	getFileTotalChunkSize = `SELECT SUM(LENGTH(Chunk)) FROM FileChunks WHERE FileID = ?;`
-	getNumberOfFileChunks = `SELECT COUNT(*) AS COUNT FROM FileChunks WHERE FileID = ?;`
+	getAllFileChunksByID = `SELECT ChunkNum, ChunkHash, ChunkLength FROM FileChunks WHERE FileID = ? AND VersionID = ? ORDER BY ChunkNum;`
+	addFileChunk         = `INSERT INTO FileChunks (FileID, VersionID, ChunkNum, ChunkHash, UserChunkID, ChunkLength) VALUES (?, ?, ?, ?, ?, ?);`
+	removeAllFileChunks  = `DELETE FROM FileChunks WHERE FileID = ?;`
+	removeFileChunk      = `DELETE FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
+	getFileChunk         = `SELECT FileChunks.ChunkHash, FileChunks.ChunkLength, UserChunks.BlobRef FROM FileChunks
+					INNER JOIN UserChunks on FileChunks.UserChunkID = UserChunks.UserChunkID
+					WHERE FileChunks.FileID = ? AND FileChunks.VersionID = ? AND FileChunks.ChunkNum = ?;`
+	getFileChunkUserChunkIDs = `SELECT UserChunkID FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
+	getFileUserChunkIDs      = `SELECT UserChunkID FROM FileChunks WHERE FileID = ?;`
+
+	getUserChunkByHash   = `SELECT UserChunkID FROM UserChunks WHERE UserID = ? AND ChunkHash = ?;`
+	addUserChunk         = `INSERT INTO UserChunks (UserID, ChunkHash, BlobRef, BlobSize, RefCount) VALUES (?, ?, ?, ?, 0);`
+	addUserChunkRef      = `UPDATE UserChunks SET RefCount = RefCount + 1 WHERE UserChunkID = ?;`
+	releaseUserChunkRef  = `UPDATE UserChunks SET RefCount = RefCount - 1 WHERE UserChunkID = ?;`
+	getUnusedUserChunk   = `SELECT BlobRef, BlobSize FROM UserChunks WHERE UserChunkID = ? AND RefCount <= 0;`
+	removeUserChunk      = `DELETE FROM UserChunks WHERE UserChunkID = ?;`
+	getUserChunkBlobRefs = `SELECT BlobRef FROM UserChunks WHERE UserID = ?;`
+
+	addRefreshToken = `INSERT INTO RefreshTokens (TokenHash, UserID, ExpiresAt, Revoked) VALUES (?, ?, ?, 0);`
+	getRefreshToken = `SELECT RefreshTokens.UserID, Users.Name, RefreshTokens.ExpiresAt, RefreshTokens.Revoked
+		FROM RefreshTokens INNER JOIN Users ON Users.UserID = RefreshTokens.UserID WHERE TokenHash = ?;`
+	revokeRefreshToken         = `UPDATE RefreshTokens SET Revoked = 1 WHERE TokenHash = ?;`
+	revokeUserRefreshTokens    = `UPDATE RefreshTokens SET Revoked = 1 WHERE UserID = ?;`
+	removeExpiredRefreshTokens = `DELETE FROM RefreshTokens WHERE ExpiresAt < ?;`
 
 	removeUser = `DELETE FROM FileChunks WHERE FileID IN (SELECT FileID FROM FileInfo WHERE UserID = ?);
+		DELETE FROM UserChunks WHERE UserID = ?;
 		DELETE FROM FileVersion WHERE FileID IN (SELECT FileID FROM FileInfo WHERE UserID = ?);
 		DELETE FROM FileInfo WHERE UserID = ?;
         DELETE FROM UserStats WHERE UserID = ?;
+        DELETE FROM RefreshTokens WHERE UserID = ?;
+        DELETE FROM FileChanges WHERE UserID = ?;
+        DELETE FROM UploadSessions WHERE UserID = ?;
         DELETE FROM Users WHERE UserID = ?;`
 )
 
@@ -136,6 +193,18 @@ type FileVersionInfo struct {
 	LastMod       int64
 	ChunkCount    int
 	FileHash      string
+
+	// HashAlgo identifies the algorithm the client used for FileHash and the chunk hashes
+	HashAlgo string
+
+	// Committed is set once every chunk of the version has been uploaded and the
+	// version has been committed; a version that is still pending should not be
+	// downloaded since it may be missing chunks
+	Committed bool
+
+	// Chunking is the chunking mode the client split the file into chunks with,
+	// like ChunkingFixed or ChunkingFastCDC
+	Chunking string
 }
 
 // FileChunk contains the information stored about a given file chunk.
@@ -145,6 +214,11 @@ type FileChunk struct {
 	ChunkNumber int
 	ChunkHash   string
 	Chunk       []byte
+
+	// ChunkLength is the number of bytes in the chunk before it was encrypted, which
+	// gives the offset of the following chunk in the file; it's 0 if the client
+	// didn't send it, which it doesn't need to for versions using ChunkingFixed
+	ChunkLength int
 }
 
 // User contains the basic information stored about a use, but does not
@@ -155,6 +229,8 @@ type User struct {
 	Salt       string
 	SaltedHash []byte
 	CryptoHash []byte // a bcrypt hash used to verify the bcrypt hash of the crypto password
+	WrappedKey []byte // the master key for the user's data wrapped by the key derived from the crypto password
+	IsAdmin    bool   // admins can manage the other users through the admin API
 }
 
 // UserStats contains the user specific state information to track data usage.
@@ -171,16 +247,85 @@ type Storage struct {
 
 	// db is the database connection
 	db *sql.DB
+
+	// dbPath is the connection string the database was opened with
+	dbPath string
+
+	// txLock serializes the transactions so that concurrent requests don't
+	// fail trying to upgrade their read locks to write locks.
+	txLock sync.Mutex
+
+	// chunks is the store that holds the bytes for the file chunks; each
+	// distinct chunk a user has is only stored once and is shared by
+	// reference count between every file version that contains it.
+	chunks ChunkStore
+
+	// migrating is non-zero while Migrate is applying migration steps
+	migrating int32
+
+	// TransactionObserver, if set, is called after every transaction with the
+	// name of the storage operation, how long it took including the wait for
+	// the transaction lock and the error it returned, if any.
+	TransactionObserver func(op string, elapsed time.Duration, err error)
+
+	// ChangeObserver, if set, is called with each change to a user's files once
+	// the transaction that made it has been committed. It's called while the
+	// transaction lock is held, so it must not use the Storage.
+	ChangeObserver func(userID int, change FileChange)
+
+	// ChangeRetention is how long the changes to users' files are kept in the
+	// change journal before they are pruned; 0 keeps them forever.
+	ChangeRetention time.Duration
+
+	// pendingChanges are the changes recorded by the transaction in progress
+	pendingChanges []userFileChange
+}
+
+// StorageTotals has the number of users, files and file versions kept in the
+// storage along with the total number of bytes allocated to all of the users.
+type StorageTotals struct {
+	Users     int
+	Files     int
+	Versions  int
+	Allocated int
 }
 
 // NewStorage creates a new Storage object using the sqlite3
-// driver at the path given.
-func NewStorage(dbPath string) (*Storage, error) {
+// driver at the path given. If chunkStorePath is empty, the chunk bytes
+// are kept in the database as well; otherwise they are written to a
+// sharded directory tree under chunkStorePath.
+//
+// Any pending schema migrations are applied to an existing database
+// before NewStorage returns.
+func NewStorage(dbPath string, chunkStorePath string) (*Storage, error) {
+	s, err := OpenStorage(dbPath, chunkStorePath)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.Migrate()
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to migrate the database (%s): %v", dbPath, err)
+	}
+
+	return s, nil
+}
+
+// OpenStorage creates a new Storage object like NewStorage does but
+// without applying any pending schema migrations.
+func OpenStorage(dbPath string, chunkStorePath string) (*Storage, error) {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("could not open the database (%s): %v", dbPath, err)
 	}
 
+	// connections to a shared in-memory database lock each other out at the
+	// table level instead of waiting on each other, so only one is used.
+	if databaseFilepath(dbPath) == "" {
+		db.SetMaxOpenConns(1)
+	}
+
 	// make sure we can hit the database by pinging it; this
 	// will detect potential connection problems early.
 	err = db.Ping()
@@ -204,7 +349,19 @@ func NewStorage(dbPath string) (*Storage, error) {
 
 	s := new(Storage)
 	s.db = db
+	s.dbPath = dbPath
 	s.ChunkSize = 1024 * 1024 * 4 // 4MB
+	s.ChangeRetention = DefaultChangeRetention
+
+	if chunkStorePath == "" {
+		s.chunks = &databaseChunkStore{db: db}
+	} else {
+		s.chunks, err = NewFileSystemChunkStore(chunkStorePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return s, nil
 }
 
@@ -214,7 +371,9 @@ func (s *Storage) Close() {
 }
 
 // CreateTables will create the tables needed in the database if they
-// don't already exist. If the tables already exist an error will be returned.
+// don't already exist and is safe to call on a database that already has them.
+// A new database is set to CurrentDBVersion; the tables of an older database
+// are left as they are and Migrate brings them up to date.
 func (s *Storage) CreateTables() error {
 	_, err := s.db.Exec(createAppDataTable)
 	if err != nil {
@@ -246,8 +405,43 @@ func (s *Storage) CreateTables() error {
 		return fmt.Errorf("failed to create the FILECHUNKS table: %v", err)
 	}
 
+	_, err = s.db.Exec(createUserChunksTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the USERCHUNKS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createChunkBlobsTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the CHUNKBLOBS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createRefreshTokensTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the REFRESHTOKENS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createAuditLogTable)
+	if err == nil {
+		_, err = s.db.Exec(createAuditLogTimeIndex)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create the AUDITLOG table: %v", err)
+	}
+
+	_, err = s.db.Exec(createFileChangesTable)
+	if err == nil {
+		_, err = s.db.Exec(createFileChangesRevisionIndex)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create the FILECHANGES table: %v", err)
+	}
+
+	_, err = s.db.Exec(createUploadSessionsTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the UPLOADSESSIONS table: %v", err)
+	}
+
 	// do some initialization if necessary
-	// TODO: Update database tables if there's a version bump.
 	var dbVersion int
 	err = s.db.QueryRow(getAppDBVersion).Scan(&dbVersion)
 	if err == sql.ErrNoRows {
@@ -349,7 +543,20 @@ func (s *Storage) AddUser(username string, salt string, saltedHash []byte, quota
 func (s *Storage) GetUser(username string) (*User, error) {
 	user := new(User)
 	user.Name = username
-	err := s.db.QueryRow(getUser, username).Scan(&user.ID, &user.Salt, &user.SaltedHash, &user.CryptoHash)
+	err := s.db.QueryRow(getUser, username).Scan(&user.ID, &user.Salt, &user.SaltedHash, &user.CryptoHash, &user.WrappedKey, &user.IsAdmin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the user information from the database: %v", err)
+	}
+
+	return user, nil
+}
+
+// GetUserByID queries the Users table for a given user id and returns the associated data.
+// If the query fails and error will be returned.
+func (s *Storage) GetUserByID(userID int) (*User, error) {
+	user := new(User)
+	user.ID = userID
+	err := s.db.QueryRow(getUserByID, userID).Scan(&user.Name, &user.Salt, &user.SaltedHash, &user.CryptoHash, &user.WrappedKey, &user.IsAdmin)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get the user information from the database: %v", err)
 	}
@@ -357,6 +564,51 @@ func (s *Storage) GetUser(username string) (*User, error) {
 	return user, nil
 }
 
+// GetAllUsers returns the id, name and admin flag of all the users sorted by name.
+// The password and crypto hashes are not returned.
+func (s *Storage) GetAllUsers() ([]User, error) {
+	rows, err := s.db.Query(getAllUsers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the users from the database: %v", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		err = rows.Scan(&user.ID, &user.Name, &user.IsAdmin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing the users: %v", err)
+		}
+		users = append(users, user)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the users from the database: %v", err)
+	}
+
+	return users, nil
+}
+
+// SetUserAdmin grants or revokes the admin rights for a given userID.
+// This will fail if the userID doesn't exist.
+func (s *Storage) SetUserAdmin(userID int, isAdmin bool) error {
+	res, err := s.db.Exec(setUserAdmin, isAdmin, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set the admin flag for the user id %d: %v", userID, err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get the number of rows affected when setting the admin flag: %v", err)
+	}
+	if affected != 1 {
+		return fmt.Errorf("failed to set the admin flag for the user id %d; user not found", userID)
+	}
+
+	return nil
+}
+
 // RemoveUser removes user and all files and file chunks associated with the user.
 func (s *Storage) RemoveUser(username string) error {
 	// make sure we have a user to begin with
@@ -365,18 +617,105 @@ func (s *Storage) RemoveUser(username string) error {
 		return fmt.Errorf("Failed to find the user in the database: %v", err)
 	}
 
-	_, err = s.db.Exec(removeUser, user.ID, user.ID, user.ID, user.ID, user.ID)
+	var blobRefs []string
+	err = s.transact("RemoveUser", func(tx *sql.Tx) error {
+		blobRefs, err = queryBlobRefs(tx, getUserChunkBlobRefs, user.ID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(removeUser, user.ID, user.ID, user.ID, user.ID, user.ID, user.ID, user.ID, user.ID, user.ID)
+		if err != nil {
+			return fmt.Errorf("failed to remove the user %s (id: %d): %v", user.Name, user.ID, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.removeChunkBlobs(blobRefs)
+	return nil
+}
+
+// AddRefreshToken stores the hash of a new refresh token for the user that
+// can be exchanged once with UseRefreshToken until expiresAt (in Unix seconds).
+// Any refresh tokens that have already expired are removed at the same time.
+func (s *Storage) AddRefreshToken(userID int, tokenHash string, expiresAt int64) error {
+	return s.transact("AddRefreshToken", func(tx *sql.Tx) error {
+		_, err := tx.Exec(removeExpiredRefreshTokens, time.Now().Unix())
+		if err != nil {
+			return fmt.Errorf("failed to remove the expired refresh tokens: %v", err)
+		}
+
+		_, err = tx.Exec(addRefreshToken, tokenHash, userID, expiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to add the refresh token for user id %d: %v", userID, err)
+		}
+		return nil
+	})
+}
+
+// UseRefreshToken revokes the refresh token with the hash given and returns the user
+// id and name it was issued to so that a new token can be issued in its place.
+// An error is returned if the token is unknown, expired or was already used. When
+// a token that was already used is presented again, it may have been stolen, so all
+// of the refresh tokens for the user are revoked.
+func (s *Storage) UseRefreshToken(tokenHash string) (userID int, username string, e error) {
+	var reused bool
+	err := s.transact("UseRefreshToken", func(tx *sql.Tx) error {
+		var expiresAt int64
+		var revoked bool
+		err := tx.QueryRow(getRefreshToken, tokenHash).Scan(&userID, &username, &expiresAt, &revoked)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("the refresh token is not valid")
+		} else if err != nil {
+			return fmt.Errorf("failed to get the refresh token: %v", err)
+		}
+
+		if revoked {
+			reused = true
+			_, err = tx.Exec(revokeUserRefreshTokens, userID)
+			if err != nil {
+				return fmt.Errorf("failed to revoke the refresh tokens for user id %d: %v", userID, err)
+			}
+			return nil
+		}
+		if expiresAt < time.Now().Unix() {
+			return fmt.Errorf("the refresh token has expired")
+		}
+
+		_, err = tx.Exec(revokeRefreshToken, tokenHash)
+		if err != nil {
+			return fmt.Errorf("failed to revoke the refresh token: %v", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to remove the user %s (id: %d): %v", user.Name, user.ID, err)
+		return 0, "", err
 	}
+	if reused {
+		return 0, "", fmt.Errorf("the refresh token was already used; all refresh tokens for the user have been revoked")
+	}
+
+	return userID, username, nil
+}
 
+// RevokeUserRefreshTokens revokes all of the refresh tokens issued to the user,
+// such as when their password is reset.
+func (s *Storage) RevokeUserRefreshTokens(userID int) error {
+	_, err := s.db.Exec(revokeUserRefreshTokens, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke the refresh tokens for user id %d: %v", userID, err)
+	}
 	return nil
 }
 
-// UpdateUserCryptoHash changes the cryptoHash for a given userID.
+// UpdateUserCryptoHash changes the cryptoHash and the wrappedKey for a given userID.
 // This will fail if the userID doesn't exist.
-func (s *Storage) UpdateUserCryptoHash(userID int, cryptoHash []byte) error {
-	res, err := s.db.Exec(setUserCryptoHash, cryptoHash, userID)
+func (s *Storage) UpdateUserCryptoHash(userID int, cryptoHash []byte, wrappedKey []byte) error {
+	res, err := s.db.Exec(setUserCryptoHash, cryptoHash, wrappedKey, userID)
 	if err != nil {
 		return fmt.Errorf("failed to update the user's cryptohash (%d): %v", userID, err)
 	}
@@ -456,7 +795,8 @@ func (s *Storage) SetUserStats(userID int, quota int, allocated int, revision in
 }
 
 // UpdateUserStats increments the user's revision by one and updates the allocated
-// byte counter with the new delta.
+// byte counter with the new delta. Nothing is written to the change journal, so
+// GetFileChanges treats the changes since an earlier revision as incomplete.
 func (s *Storage) UpdateUserStats(userID int, allocDelta int) error {
 	res, err := s.db.Exec(updateUserStats, allocDelta, userID)
 	if err != nil {
@@ -485,6 +825,81 @@ func (s *Storage) GetUserStats(userID int) (*UserStats, error) {
 	return stats, nil
 }
 
+// Ping makes sure that the connection to the database is still alive.
+func (s *Storage) Ping() error {
+	err := s.db.Ping()
+	if err != nil {
+		return fmt.Errorf("failed to ping the database: %v", err)
+	}
+	return nil
+}
+
+// CheckChunkStore returns a non-nil error if chunks can't currently be written
+// to the ChunkStore.
+func (s *Storage) CheckChunkStore() error {
+	return s.chunks.Check()
+}
+
+// IsMigrating returns true while Migrate is applying migration steps to the database.
+func (s *Storage) IsMigrating() bool {
+	return atomic.LoadInt32(&s.migrating) != 0
+}
+
+// GetAllUserStats returns the stats for every user keyed by the user name.
+func (s *Storage) GetAllUserStats() (map[string]UserStats, error) {
+	rows, err := s.db.Query(getAllUserStats)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the user stats from the database: %v", err)
+	}
+	defer rows.Close()
+
+	allStats := make(map[string]UserStats)
+	for rows.Next() {
+		var name string
+		var stats UserStats
+		err = rows.Scan(&name, &stats.Quota, &stats.Allocated, &stats.Revision)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing the user stats: %v", err)
+		}
+		allStats[name] = stats
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the user stats from the database: %v", err)
+	}
+
+	return allStats, nil
+}
+
+// GetTotals returns the number of users, files and file versions in the storage
+// and the total number of bytes allocated to all of the users.
+func (s *Storage) GetTotals() (*StorageTotals, error) {
+	var err error
+	totals := new(StorageTotals)
+	totals.Users, err = s.getRowCount("Users")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count the users: %v", err)
+	}
+	totals.Files, err = s.getRowCount("FileInfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count the files: %v", err)
+	}
+	totals.Versions, err = s.getRowCount("FileVersion")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count the file versions: %v", err)
+	}
+
+	allStats, err := s.GetAllUserStats()
+	if err != nil {
+		return nil, err
+	}
+	for _, stats := range allStats {
+		totals.Allocated += stats.Allocated
+	}
+
+	return totals, nil
+}
+
 // RemoveFileVersions will remove any file versions of the file specified by fileID
 // that are between the minVersion and maxVersion (inclusive). A non-nil error
 // value is returned on failure.
@@ -492,7 +907,8 @@ func (s *Storage) GetUserStats(userID int) (*UserStats, error) {
 // NOTE: supplying a minVersion and maxVersion that does not include any valid
 // file versions will end up returning an error.
 func (s *Storage) RemoveFileVersions(userID, fileID, minVersion, maxVersion int) error {
-	err := s.transact(func(tx *sql.Tx) error {
+	var blobRefs []string
+	err := s.transact("RemoveFileVersions", func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
 		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
@@ -503,66 +919,76 @@ func (s *Storage) RemoveFileVersions(userID, fileID, minVersion, maxVersion int)
 			return fmt.Errorf("user does not own the file id supplied")
 		}
 
-		// make sure there are versions to remove
-		var versionsToRemove int
-		err = tx.QueryRow(getVersionsCountForFile, fileID, minVersion, maxVersion).Scan(&versionsToRemove)
-		if err != nil {
-			return fmt.Errorf("failed to get the number of versions that are within range: %v", err)
-		}
+		blobRefs, err = s.removeFileVersions(tx, userID, fileID, minVersion, maxVersion)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-		// if we dont have any versions to remove, just return now without an error
-		if versionsToRemove < 1 {
-			return nil
-		}
+	s.removeChunkBlobs(blobRefs)
+	return nil
+}
 
-		// get the total chunk size used by the file versions
-		var totalChunkSize int
-		err = tx.QueryRow(getFileVersionsTotalChunkSize, fileID, minVersion, maxVersion).Scan(&totalChunkSize)
-		if err != nil {
-			return fmt.Errorf("failed to get the chunk sizes for a file in the database: %v", err)
-		}
+// removeFileVersions removes the versions of the file within the version number range
+// as part of the transaction. The blob references of the stored chunks that were freed
+// are returned so that they can be removed once the transaction succeeds.
+func (s *Storage) removeFileVersions(tx *sql.Tx, userID, fileID, minVersion, maxVersion int) ([]string, error) {
+	// make sure there are versions to remove
+	var versionsToRemove int
+	err := tx.QueryRow(getVersionsCountForFile, fileID, minVersion, maxVersion).Scan(&versionsToRemove)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the number of versions that are within range: %v", err)
+	}
 
-		// remove all of the file chunks used by the file versions
-		_, err = tx.Exec(removeAllFileVersionChunks, fileID, minVersion, maxVersion)
-		if err != nil {
-			return fmt.Errorf("failed to delete the file chunks associated with the file: %v", err)
-		}
+	// if we dont have any versions to remove, just return now without an error
+	if versionsToRemove < 1 {
+		return nil, nil
+	}
 
-		// update the allocation counts
-		if totalChunkSize > 0 {
-			res, err := tx.Exec(updateUserStats, -totalChunkSize, userID)
-			if err != nil {
-				return fmt.Errorf("failed to update the allocated bytes in the database after removing chunks: %v", err)
-			}
+	// get the stored chunks used by the file versions
+	userChunkIDs, err := queryUserChunkIDs(tx, getFileVersionsUserChunkIDs, fileID, minVersion, maxVersion)
+	if err != nil {
+		return nil, err
+	}
 
-			// make sure one row was affected with the UPDATE statement
-			affected, err := res.RowsAffected()
-			if affected != 1 {
-				return fmt.Errorf("failed to update the user info in the database after removing chunks; no rows were affected")
-			} else if err != nil {
-				return fmt.Errorf("failed to update the user info in the database after removing chunks: %v", err)
-			}
+	// remove all of the file chunks used by the file versions
+	_, err = tx.Exec(removeAllFileVersionChunks, fileID, minVersion, maxVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete the file chunks associated with the file: %v", err)
+	}
 
-			// if no rows were affected, that just means there were no chunks that
-			// needed to be deleted, so no need to check the result.
-		}
+	// release the stored chunks; only the chunks that no other file version
+	// references get freed and their bytes removed once the transaction succeeds
+	freedSize, blobRefs, err := releaseUserChunks(tx, userChunkIDs)
+	if err != nil {
+		return nil, err
+	}
 
-		// remove the file versions
-		_, err = tx.Exec(removeFileVersionsByFileID, fileID, minVersion, maxVersion)
-		if err != nil {
-			return fmt.Errorf("failed to remove the file versions in the database: %v", err)
-		}
+	// update the allocation counts and record the change
+	err = s.recordFileChange(tx, userID, fileID, 0, ChangeVersionRemove, -freedSize)
+	if err != nil {
+		return nil, err
+	}
 
-		return nil
-	})
+	// remove the file versions and any uploads to them
+	_, err = tx.Exec(removeFileVersionsByFileID, fileID, minVersion, maxVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove the file versions in the database: %v", err)
+	}
+	_, err = tx.Exec(removeOrphanedUploadSessions, fileID, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove the upload sessions for the file versions: %v", err)
+	}
 
-	return err
+	return blobRefs, nil
 }
 
 // RemoveFile removes a file listing and all of the associated chunks in storage.
 // Returns an error on failure
 func (s *Storage) RemoveFile(userID, fileID int) error {
-	err := s.transact(func(tx *sql.Tx) error {
+	var blobRefs []string
+	err := s.transact("RemoveFile", func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
 		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
@@ -573,64 +999,65 @@ func (s *Storage) RemoveFile(userID, fileID int) error {
 			return fmt.Errorf("user does not own the file id supplied")
 		}
 
-		// remove the file info
-		_, err = tx.Exec(removeFileInfoByID, fileID)
-		if err != nil {
-			return fmt.Errorf("failed to remove a file info in the database: %v", err)
-		}
+		blobRefs, err = s.removeFile(tx, userID, fileID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 
-		// remove the file versions
-		_, err = tx.Exec(removeAllFileVersionsByFileID, fileID)
-		if err != nil {
-			return fmt.Errorf("failed to remove the file versions in the database: %v", err)
-		}
+	s.removeChunkBlobs(blobRefs)
+	return nil
+}
 
-		// check to see if we have file chunks associated with this file -- which
-		// you will not have if the file is empty or the chunks have not been uploaded yet.
-		var totalChunkCount int
-		err = tx.QueryRow(getNumberOfFileChunks, fileID).Scan(&totalChunkCount)
-		if err != nil {
-			return fmt.Errorf("failed to get the chunk count for a file in the database: %v", err)
-		}
+// removeFile removes the file, its versions and its chunks as part of the transaction.
+// The blob references of the stored chunks that were freed are returned so that they
+// can be removed once the transaction succeeds.
+func (s *Storage) removeFile(tx *sql.Tx, userID, fileID int) (blobRefs []string, e error) {
+	// remove the file info
+	_, err := tx.Exec(removeFileInfoByID, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove a file info in the database: %v", err)
+	}
 
-		// get the total size for all chunks attached to the file id
-		var totalChunkSize int
-		if totalChunkCount > 0 {
-			err = tx.QueryRow(getFileTotalChunkSize, fileID).Scan(&totalChunkSize)
-			if err != nil {
-				return fmt.Errorf("failed to get the chunk sizes for a file in the database: %v", err)
-			}
+	// remove the file versions and any uploads to them
+	_, err = tx.Exec(removeAllFileVersionsByFileID, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove the file versions in the database: %v", err)
+	}
+	_, err = tx.Exec(removeOrphanedUploadSessions, fileID, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove the upload sessions for the file: %v", err)
+	}
 
-			// remove all of the file chunks
-			_, err = tx.Exec(removeAllFileChunks, fileID)
-			if err != nil {
-				return fmt.Errorf("failed to delete the file chunks associated with the file: %v", err)
-			}
+	// check to see if we have file chunks associated with this file -- which
+	// you will not have if the file is empty or the chunks have not been uploaded yet.
+	userChunkIDs, err := queryUserChunkIDs(tx, getFileUserChunkIDs, fileID)
+	if err != nil {
+		return nil, err
+	}
 
-			// update the allocation counts
-			if totalChunkSize > 0 {
-				res, err := tx.Exec(updateUserStats, -totalChunkSize, userID)
-				if err != nil {
-					return fmt.Errorf("failed to update the allocated bytes in the database after removing chunks: %v", err)
-				}
-
-				// make sure one row was affected with the UPDATE statement
-				affected, err := res.RowsAffected()
-				if affected != 1 {
-					return fmt.Errorf("failed to update the user info in the database after removing chunks; no rows were affected")
-				} else if err != nil {
-					return fmt.Errorf("failed to update the user info in the database after removing chunks: %v", err)
-				}
-
-				// if no rows were affected, that just means there were no chunks that
-				// needed to be deleted, so no need to check the result.
-			}
+	freedSize := 0
+	if len(userChunkIDs) > 0 {
+		// remove all of the file chunks
+		_, err = tx.Exec(removeAllFileChunks, fileID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete the file chunks associated with the file: %v", err)
 		}
 
-		return nil
-	})
+		// release the stored chunks; chunks shared with other files are kept
+		freedSize, blobRefs, err = releaseUserChunks(tx, userChunkIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return err
+	// update the allocation counts and record the change
+	err = s.recordFileChange(tx, userID, fileID, 0, ChangeFileRemove, -freedSize)
+	if err != nil {
+		return nil, err
+	}
+	return blobRefs, nil
 }
 
 // RemoveFileInfo removes a file listing in storage, returning an error on failure.
@@ -651,96 +1078,114 @@ func (s *Storage) RemoveFileInfo(fileID int) error {
 }
 
 // AddFileInfo registers a new file for a given user which is identified by the filename string.
-// lastmod (time in seconds since 1/1/1970) and the filehash string are provided as well. The
-// chunkCount parameter should be the number of chunks required for the size of the file. If the
-// file could not be added an error is returned, otherwise nil on success.
-func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissions uint32, lastMod int64, chunkCount int, fileHash string) (*FileInfo, error) {
+// lastmod (time in seconds since 1/1/1970), the filehash string and the hashAlgo used for it are
+// provided as well. The chunkCount parameter should be the number of chunks required for the size
+// of the file. The first version stays pending until it's committed with CommitFileVersion
+// unless it has no chunks. If the file could not be added an error is returned, otherwise nil
+// on success.
+func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissions uint32, lastMod int64, chunkCount int, fileHash string, hashAlgo string) (*FileInfo, error) {
 	fi := new(FileInfo)
+	err := s.transact("AddFileInfo", func(tx *sql.Tx) error {
+		return s.insertFileInfo(tx, fi, userID, filename, isDir, permissions, lastMod, chunkCount, fileHash, hashAlgo, ChunkingFixed)
+	})
 
-	const newVersionNumber = 1
+	// if the tx failed, then return here
+	if err != nil {
+		return nil, err
+	}
 
-	err := s.transact(func(tx *sql.Tx) error {
-		// attempt to first add to the FileInfo table
-		res, err := tx.Exec(addFileInfo, userID, filename, isDir, newVersionNumber, userID, filename)
-		if err != nil {
-			return fmt.Errorf("failed to add a new file info in the database: %v", err)
-		}
-
-		// make sure one row was affected -- if the file was a duplicate, it violates the SQL command
-		// and while an erro wasn't returned above, no rows will be affected.
-		affected, err := res.RowsAffected()
-		if affected != 1 {
-			return fmt.Errorf("failed to add a new file info in the database; no rows were affected (possible duplicate file)")
-		} else if err != nil {
-			return fmt.Errorf("failed to add a new file info in the database; error getting rows affected: %v", err)
-		}
+	return fi, nil
+}
 
-		newFileID, err := res.LastInsertId()
-		if err != nil {
-			return fmt.Errorf("failed to get the id for the last row inserted while adding a new file info into the database: %v", err)
-		}
+// insertFileInfo registers a new file with its first version as part of the transaction
+// and fills in fi with the file information. The first version is the current version
+// of the file even while it's pending since there's no other version to use.
+func (s *Storage) insertFileInfo(tx *sql.Tx, fi *FileInfo, userID int, filename string, isDir bool, permissions uint32, lastMod int64,
+	chunkCount int, fileHash string, hashAlgo string, chunking string) error {
+	const newVersionNumber = 1
+	committed := chunkCount == 0
 
-		// now create a new FileVersion entry
-		res, err = tx.Exec(addFileVersion, newFileID, newVersionNumber, permissions, lastMod, chunkCount, fileHash)
-		if err != nil {
-			return fmt.Errorf("failed to add a new file version in the database: %v", err)
-		}
+	// attempt to first add to the FileInfo table
+	res, err := tx.Exec(addFileInfo, userID, filename, isDir, newVersionNumber, userID, filename)
+	if err != nil {
+		return fmt.Errorf("failed to add a new file info in the database: %v", err)
+	}
 
-		// make sure only one row was affected
-		affected, err = res.RowsAffected()
-		if affected != 1 {
-			return fmt.Errorf("failed to add a new file version in the database; no rows were affected (possible duplicate file)")
-		} else if err != nil {
-			return fmt.Errorf("failed to add a new file version in the database: %v", err)
-		}
+	// make sure one row was affected -- if the file was a duplicate, it violates the SQL command
+	// and while an erro wasn't returned above, no rows will be affected.
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to add a new file info in the database; no rows were affected (possible duplicate file)")
+	} else if err != nil {
+		return fmt.Errorf("failed to add a new file info in the database; error getting rows affected: %v", err)
+	}
 
-		newVersionID, err := res.LastInsertId()
-		if err != nil {
-			return fmt.Errorf("failed to get the id for the last row inserted while adding a new file version into the database: %v", err)
-		}
+	newFileID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get the id for the last row inserted while adding a new file info into the database: %v", err)
+	}
 
-		// update the original new file info object with the versionID just created
-		res, err = tx.Exec(setFileCurrentVersion, newVersionID, newFileID)
-		if err != nil {
-			return fmt.Errorf("failed to update the new file version in the database: %v", err)
-		}
+	// now create a new FileVersion entry
+	res, err = tx.Exec(addFileVersion, newFileID, newVersionNumber, permissions, lastMod, chunkCount, fileHash, hashAlgo, committed, chunking)
+	if err != nil {
+		return fmt.Errorf("failed to add a new file version in the database: %v", err)
+	}
 
-		affected, err = res.RowsAffected()
-		if affected != 1 {
-			return fmt.Errorf("failed to update the new file version in the database; no rows were affected (possible duplicate file)")
-		} else if err != nil {
-			return fmt.Errorf("failed to update the new file version in the database: %v", err)
-		}
+	// make sure only one row was affected
+	affected, err = res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to add a new file version in the database; no rows were affected (possible duplicate file)")
+	} else if err != nil {
+		return fmt.Errorf("failed to add a new file version in the database: %v", err)
+	}
 
-		// generate a new UserFileInfo that contains the ID for the file just added to the database
-		fi.FileID = int(newFileID)
-		fi.UserID = userID
-		fi.FileName = filename
-		fi.IsDir = isDir
+	newVersionID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get the id for the last row inserted while adding a new file version into the database: %v", err)
+	}
 
-		fi.CurrentVersion.VersionID = int(newVersionID)
-		fi.CurrentVersion.VersionNumber = newVersionNumber
-		fi.CurrentVersion.Permissions = permissions
-		fi.CurrentVersion.LastMod = lastMod
-		fi.CurrentVersion.ChunkCount = chunkCount
-		fi.CurrentVersion.FileHash = fileHash
+	// update the original new file info object with the versionID just created
+	res, err = tx.Exec(setFileCurrentVersion, newVersionID, newFileID)
+	if err != nil {
+		return fmt.Errorf("failed to update the new file version in the database: %v", err)
+	}
 
-		return nil
-	})
+	affected, err = res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to update the new file version in the database; no rows were affected (possible duplicate file)")
+	} else if err != nil {
+		return fmt.Errorf("failed to update the new file version in the database: %v", err)
+	}
 
-	// if the tx failed, then return here
+	err = s.recordFileChange(tx, userID, int(newFileID), int(newVersionID), ChangeFileAdd, 0)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return fi, nil
+	// generate a new UserFileInfo that contains the ID for the file just added to the database
+	fi.FileID = int(newFileID)
+	fi.UserID = userID
+	fi.FileName = filename
+	fi.IsDir = isDir
+
+	fi.CurrentVersion.VersionID = int(newVersionID)
+	fi.CurrentVersion.VersionNumber = newVersionNumber
+	fi.CurrentVersion.Permissions = permissions
+	fi.CurrentVersion.LastMod = lastMod
+	fi.CurrentVersion.ChunkCount = chunkCount
+	fi.CurrentVersion.FileHash = fileHash
+	fi.CurrentVersion.HashAlgo = hashAlgo
+	fi.CurrentVersion.Committed = committed
+	fi.CurrentVersion.Chunking = chunking
+
+	return nil
 }
 
 // GetAllUserFileInfos returns a slice of UserFileInfo objects that describe all known
 // files in storage for a given user ID. If this query was unsuccessful and error is returned.
 func (s *Storage) GetAllUserFileInfos(userID int) ([]FileInfo, error) {
 	var result []FileInfo
-	err := s.transact(func(tx *sql.Tx) error {
+	err := s.transact("GetAllUserFileInfos", func(tx *sql.Tx) error {
 		rows, err := tx.Query(getAllUserFiles, userID)
 		if err != nil {
 			return fmt.Errorf("failed to get all of the file infos from the database: %v", err)
@@ -769,7 +1214,8 @@ func (s *Storage) GetAllUserFileInfos(userID int) ([]FileInfo, error) {
 		result = make([]FileInfo, 0, len(allFileInfos))
 		for _, fi := range allFileInfos {
 			err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-				&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+				&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash,
+				&fi.CurrentVersion.HashAlgo, &fi.CurrentVersion.Committed, &fi.CurrentVersion.Chunking)
 			if err != nil {
 				return fmt.Errorf("failed to get the current file version the database: %v", err)
 			}
@@ -793,7 +1239,7 @@ func (s *Storage) GetAllUserFileInfos(userID int) ([]FileInfo, error) {
 func (s *Storage) GetFileInfo(userID int, fileID int) (*FileInfo, error) {
 	fi := new(FileInfo)
 	fi.FileID = fileID
-	err := s.transact(func(tx *sql.Tx) error {
+	err := s.transact("GetFileInfo", func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
 		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
@@ -812,7 +1258,8 @@ func (s *Storage) GetFileInfo(userID int, fileID int) (*FileInfo, error) {
 
 		// pull the current version data
 		err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash,
+			&fi.CurrentVersion.HashAlgo, &fi.CurrentVersion.Committed, &fi.CurrentVersion.Chunking)
 		if err != nil {
 			return fmt.Errorf("failed to get the current file version the database: %v", err)
 		}
@@ -831,7 +1278,7 @@ func (s *Storage) GetFileInfo(userID int, fileID int) (*FileInfo, error) {
 func (s *Storage) GetFileInfoByName(userID int, filename string) (*FileInfo, error) {
 	fi := new(FileInfo)
 
-	err := s.transact(func(tx *sql.Tx) error {
+	err := s.transact("GetFileInfoByName", func(tx *sql.Tx) error {
 		// pull the basic file information
 		err := tx.QueryRow(getFileInfoByName, filename, userID).Scan(&fi.FileID, &fi.IsDir, &fi.CurrentVersion.VersionID)
 		if err != nil {
@@ -842,7 +1289,8 @@ func (s *Storage) GetFileInfoByName(userID int, filename string) (*FileInfo, err
 
 		// pull the current version data
 		err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash,
+			&fi.CurrentVersion.HashAlgo, &fi.CurrentVersion.Committed, &fi.CurrentVersion.Chunking)
 		if err != nil {
 			return fmt.Errorf("failed to get the current file version the database: %v", err)
 		}
@@ -869,7 +1317,7 @@ func (s *Storage) GetFileVersions(fileID int) ([]FileVersionInfo, error) {
 	result := make([]FileVersionInfo, 0)
 	var vi FileVersionInfo
 	for rows.Next() {
-		err := rows.Scan(&vi.VersionID, &vi.VersionNumber, &vi.Permissions, &vi.LastMod, &vi.ChunkCount, &vi.FileHash)
+		err := rows.Scan(&vi.VersionID, &vi.VersionNumber, &vi.Permissions, &vi.LastMod, &vi.ChunkCount, &vi.FileHash, &vi.HashAlgo, &vi.Committed, &vi.Chunking)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan the next row while processing files versions for fileID %d: %v", fileID, err)
 		}
@@ -880,10 +1328,12 @@ func (s *Storage) GetFileVersions(fileID int) ([]FileVersionInfo, error) {
 }
 
 // TagNewFileVersion creates a new version of a given file and returns the new version ID
-// as well as the incremented file-local version number.
-func (s *Storage) TagNewFileVersion(userID int, fileID int, permissions uint32, lastMod int64, chunkCount int, fileHash string) (*FileInfo, error) {
+// as well as the incremented file-local version number in the CurrentVersion of the
+// FileInfo. Unless it has no chunks, the new version is pending and doesn't become the
+// current version of the file until it's committed with CommitFileVersion.
+func (s *Storage) TagNewFileVersion(userID int, fileID int, permissions uint32, lastMod int64, chunkCount int, fileHash string, hashAlgo string) (*FileInfo, error) {
 	fi := new(FileInfo)
-	err := s.transact(func(tx *sql.Tx) error {
+	err := s.transact("TagNewFileVersion", func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
 		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
@@ -901,65 +1351,165 @@ func (s *Storage) TagNewFileVersion(userID int, fileID int, permissions uint32,
 			return err
 		}
 
-		// pull the current version data to get the correct chunk count for the current version
-		err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
-		if err != nil {
-			return fmt.Errorf("failed to get the current file version the database: %v", err)
-		}
-
-		// increment the file-local version number
-		fi.CurrentVersion.VersionNumber++
-
 		// force-update the current version object to match the parameters
 		fi.CurrentVersion.Permissions = permissions
 		fi.CurrentVersion.LastMod = lastMod
 		fi.CurrentVersion.ChunkCount = chunkCount
 		fi.CurrentVersion.FileHash = fileHash
+		fi.CurrentVersion.HashAlgo = hashAlgo
+		fi.CurrentVersion.Committed = chunkCount == 0
+		fi.CurrentVersion.Chunking = ChunkingFixed
 
-		// now create a new FileVersion entry
-		res, err := tx.Exec(addFileVersion, fi.FileID, fi.CurrentVersion.VersionNumber, fi.CurrentVersion.Permissions,
-			fi.CurrentVersion.LastMod, fi.CurrentVersion.ChunkCount, fi.CurrentVersion.FileHash)
+		return s.insertFileVersion(tx, userID, fileID, &fi.CurrentVersion)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fi, nil
+}
+
+// insertFileVersion adds the version to the file as part of the transaction, filling
+// in the VersionID and the VersionNumber, which is one higher than that of any other
+// version of the file. The version is made the current version if it's committed or
+// if the file doesn't have a committed version yet.
+func (s *Storage) insertFileVersion(tx *sql.Tx, userID int, fileID int, v *FileVersionInfo) error {
+	_, _, currentCommitted, err := getCurrentVersion(tx, fileID)
+	if err != nil {
+		return err
+	}
+	makeCurrent := v.Committed || !currentCommitted
+
+	// increment the file-local version number; versions that aren't current yet
+	// may have the highest version number
+	err = tx.QueryRow(getMaxVersionNumber, fileID).Scan(&v.VersionNumber)
+	if err != nil {
+		return fmt.Errorf("failed to get the latest file version number from the database: %v", err)
+	}
+	v.VersionNumber++
+
+	// now create a new FileVersion entry
+	res, err := tx.Exec(addFileVersion, fileID, v.VersionNumber, v.Permissions, v.LastMod, v.ChunkCount, v.FileHash, v.HashAlgo, v.Committed, v.Chunking)
+	if err != nil {
+		return fmt.Errorf("failed to add a new file version in the database: %v", err)
+	}
+
+	// make sure only one row was affected
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to add a new file version in the database; no rows were affected (possible duplicate file)")
+	} else if err != nil {
+		return fmt.Errorf("failed to add a new file version in the database: %v", err)
+	}
+
+	newVersionID64, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get the id for the last row inserted while adding a new file version into the database: %v", err)
+	}
+	v.VersionID = int(newVersionID64)
+
+	// update the original file info object with the versionID just created
+	if makeCurrent {
+		res, err = tx.Exec(setFileCurrentVersion, v.VersionID, fileID)
 		if err != nil {
-			return fmt.Errorf("failed to add a new file version in the database: %v", err)
+			return fmt.Errorf("failed to update the file version (%d) for the file id (%d) in the database: %v",
+				v.VersionID, fileID, err)
 		}
 
-		// make sure only one row was affected
-		affected, err := res.RowsAffected()
+		affected, err = res.RowsAffected()
 		if affected != 1 {
-			return fmt.Errorf("failed to add a new file version in the database; no rows were affected (possible duplicate file)")
+			return fmt.Errorf("failed to update the new file version in the database; no rows were affected (possible duplicate file)")
 		} else if err != nil {
-			return fmt.Errorf("failed to add a new file version in the database: %v", err)
+			return fmt.Errorf("failed to update the new file version in the database: %v", err)
 		}
+	}
+
+	return s.recordFileChange(tx, userID, fileID, v.VersionID, ChangeVersionAdd, 0)
+}
 
-		newVersionID64, err := res.LastInsertId()
+// CommitFileVersion commits a pending version of the file once all of its chunks have
+// been uploaded. The chunkCount and fileHash given have to match the ones the version
+// was tagged with so that a client can't commit a version it didn't upload. If the
+// version is newer than the current version of the file, or the file doesn't have a
+// committed version yet, it becomes the current version and any upload session for it
+// is finished. Committing a version that's already committed does nothing.
+func (s *Storage) CommitFileVersion(userID int, fileID int, versionID int, chunkCount int, fileHash string) error {
+	return s.transact("CommitFileVersion", func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
 		if err != nil {
-			return fmt.Errorf("failed to get the id for the last row inserted while adding a new file version into the database: %v", err)
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return fmt.Errorf("user does not own the file id supplied")
 		}
-		fi.CurrentVersion.VersionID = int(newVersionID64)
 
-		// update the original file info object with the versionID just created
-		res, err = tx.Exec(setFileCurrentVersion, fi.CurrentVersion.VersionID, fi.FileID)
+		err = checkFileVersion(tx, fileID, versionID)
 		if err != nil {
-			return fmt.Errorf("failed to update the file version (%d) for the file id (%d) in the database: %v",
-				fi.CurrentVersion.VersionID, fi.FileID, err)
+			return err
+		}
+		var v FileVersionInfo
+		err = tx.QueryRow(getFileVersionByID, versionID).Scan(&v.VersionNumber, &v.Permissions, &v.LastMod,
+			&v.ChunkCount, &v.FileHash, &v.HashAlgo, &v.Committed, &v.Chunking)
+		if err != nil {
+			return fmt.Errorf("failed to get the file version to commit: %v", err)
 		}
 
-		affected, err = res.RowsAffected()
-		if affected != 1 {
-			return fmt.Errorf("failed to update the new file version in the database; no rows were affected (possible duplicate file)")
-		} else if err != nil {
-			return fmt.Errorf("failed to update the new file version in the database: %v", err)
+		if chunkCount != v.ChunkCount {
+			return fmt.Errorf("the chunk count (%d) does not match the chunk count of the file version (%d)", chunkCount, v.ChunkCount)
+		}
+		if fileHash != v.FileHash {
+			return fmt.Errorf("the file hash does not match the file hash of the file version")
+		}
+		if v.Committed {
+			return nil
 		}
 
-		return nil
+		missing, err := getMissingVersionChunks(tx, fileID, versionID, v.ChunkCount)
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("the file version is still missing %d of its %d chunks", len(missing), v.ChunkCount)
+		}
+
+		_, err = tx.Exec(setFileVersionCommitted, versionID)
+		if err != nil {
+			return fmt.Errorf("failed to commit the file version: %v", err)
+		}
+		_, err = tx.Exec(removeVersionUploadSession, fileID, versionID)
+		if err != nil {
+			return fmt.Errorf("failed to remove the upload session of the committed file version: %v", err)
+		}
+
+		// a version that finished uploading after a newer one was committed stays in the
+		// version history without becoming current
+		currentVersionID, currentVersionNum, currentCommitted, err := getCurrentVersion(tx, fileID)
+		if err != nil {
+			return err
+		}
+		if currentCommitted && currentVersionID != versionID && currentVersionNum > v.VersionNumber {
+			return nil
+		}
+
+		_, err = tx.Exec(setFileCurrentVersion, versionID, fileID)
+		if err != nil {
+			return fmt.Errorf("failed to make the committed version current: %v", err)
+		}
+		return s.recordFileChange(tx, userID, fileID, versionID, ChangeVersionCurrent, 0)
 	})
+}
 
+// getCurrentVersion returns the version ID and version number of the current version
+// of the file along with whether it's been committed.
+func getCurrentVersion(tx *sql.Tx, fileID int) (versionID int, versionNum int, committed bool, e error) {
+	err := tx.QueryRow(getFileCurrentVersion, fileID).Scan(&versionID, &versionNum, &committed)
 	if err != nil {
-		return nil, err
+		return 0, 0, false, fmt.Errorf("failed to get the current version of the file: %v", err)
 	}
-
-	return fi, nil
+	return versionID, versionNum, committed, nil
 }
 
 // GetFileChunkInfos returns a slice of FileChunks containing all of the chunk
@@ -967,7 +1517,7 @@ func (s *Storage) TagNewFileVersion(userID int, fileID int, permissions uint32,
 func (s *Storage) GetFileChunkInfos(userID int, fileID int, versionID int) ([]FileChunk, error) {
 	var chunk FileChunk
 	knownChunks := []FileChunk{}
-	err := s.transact(func(tx *sql.Tx) error {
+	err := s.transact("GetFileChunkInfos", func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
 		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
@@ -988,7 +1538,7 @@ func (s *Storage) GetFileChunkInfos(userID int, fileID int, versionID int) ([]Fi
 		chunk.FileID = fileID
 		chunk.VersionID = versionID
 		for rows.Next() {
-			err := rows.Scan(&chunk.ChunkNumber, &chunk.ChunkHash)
+			err := rows.Scan(&chunk.ChunkNumber, &chunk.ChunkHash, &chunk.ChunkLength)
 			if err != nil {
 				return fmt.Errorf("failed to scan the next row while processing files chunks for fileID %d: %v", fileID, err)
 			}
@@ -1012,7 +1562,7 @@ func (s *Storage) GetFileChunkInfos(userID int, fileID int, versionID int) ([]Fi
 func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int, error) {
 	var fi FileInfo
 	knownChunks := []int{}
-	err := s.transact(func(tx *sql.Tx) error {
+	err := s.transact("GetMissingChunkNumbersForFile", func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
 		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
@@ -1032,7 +1582,8 @@ func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int,
 
 		// pull the current version data to get the correct chunk count for the current version
 		err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash,
+			&fi.CurrentVersion.HashAlgo, &fi.CurrentVersion.Committed, &fi.CurrentVersion.Chunking)
 		if err != nil {
 			return fmt.Errorf("failed to get the current file version the database: %v", err)
 		}
@@ -1045,9 +1596,9 @@ func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int,
 		defer rows.Close()
 
 		for rows.Next() {
-			var num int
+			var num, length int
 			var hash string
-			err := rows.Scan(&num, &hash)
+			err := rows.Scan(&num, &hash, &length)
 			if err != nil {
 				return fmt.Errorf("failed to scan the next row while processing files chunks for fileID %d: %v", fileID, err)
 			}
@@ -1071,7 +1622,7 @@ func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int,
 	// log the ones that are not found.
 	mia := []int{}
 	for i := 0; i < fi.CurrentVersion.ChunkCount; i++ {
-		if sort.SearchInts(knownChunks, i) >= maxKnown {
+		if j := sort.SearchInts(knownChunks, i); j >= maxKnown || knownChunks[j] != i {
 			mia = append(mia, i)
 		}
 
@@ -1083,14 +1634,38 @@ func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int,
 // AddFileChunk adds a binary chunk to storage for a given file at a position in the file
 // determined by the chunkNumber passed in and identified by the chunkHash. The userID is used
 // to update the allocation count in the same transaction as well as verify ownership.
-func (s *Storage) AddFileChunk(userID int, fileID int, versionID int, chunkNumber int, chunkHash string, chunk []byte) (*FileChunk, error) {
-	chunkLength := int64(len(chunk))
+// If the user already has a chunk stored with the same chunkHash, that chunk is referenced
+// instead of storing the bytes again and the allocation count doesn't change. chunkLength
+// is the number of bytes in the chunk before it was encrypted, or 0 if it's not known.
+func (s *Storage) AddFileChunk(userID int, fileID int, versionID int, chunkNumber int, chunkHash string, chunkLength int, chunk []byte) (*FileChunk, error) {
+	blobSize := int64(len(chunk))
 
 	// the length of the chunk is no longer sanity checked because it may
 	// become larger with extra data needed for cryptography.
 
+	// if the chunk isn't already stored for the user, the chunk bytes are
+	// written to the chunk store before the metadata gets added so that
+	// a UserChunks row never references a missing blob.
+	var blobRef string
+	var knownChunkID int
+	err := s.db.QueryRow(getUserChunkByHash, userID, chunkHash).Scan(&knownChunkID)
+	if err == sql.ErrNoRows {
+		blobRef, err = newBlobRef()
+		if err != nil {
+			return nil, err
+		}
+		err = s.chunks.PutChunk(blobRef, chunk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store the chunk bytes: %v", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to look up the chunk hash for the user: %v", err)
+	}
+
 	newChunk := new(FileChunk)
-	err := s.transact(func(tx *sql.Tx) error {
+	blobUsed := false
+	var freedBlobRefs []string
+	err = s.transact("AddFileChunk", func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
 		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
@@ -1100,67 +1675,169 @@ func (s *Storage) AddFileChunk(userID int, fileID int, versionID int, chunkNumbe
 		if owningUserID != userID {
 			return fmt.Errorf("user does not own the file id supplied")
 		}
-
-		// get the user's quota fand allocation count and test for a voliation
-		var quota, allocated, revision int64
-		err = tx.QueryRow(getUserStats, userID).Scan(&quota, &allocated, &revision)
+		err = checkFileVersion(tx, fileID, versionID)
 		if err != nil {
-			return fmt.Errorf("failed to get the user quota from the database before adding file chunk: %v", err)
+			return err
 		}
 
-		// fail the transaction if there's not enough allocation space
-		if (quota - allocated) < chunkLength {
-			return fmt.Errorf("not enough free allocation space (quota: %d ; current allocation %d ; chunk size %d)", quota, allocated, chunkLength)
+		// look up the chunk hash again now that we're in the transaction
+		// in case the stored chunk has been added or removed since
+		var userChunkID int64
+		var allocDelta int64
+		err = tx.QueryRow(getUserChunkByHash, userID, chunkHash).Scan(&userChunkID)
+		if err == sql.ErrNoRows {
+			if blobRef == "" {
+				return fmt.Errorf("the stored chunk with the same hash was removed while adding the file chunk")
+			}
+
+			// get the user's quota fand allocation count and test for a voliation
+			var quota, allocated, revision int64
+			err = tx.QueryRow(getUserStats, userID).Scan(&quota, &allocated, &revision)
+			if err != nil {
+				return fmt.Errorf("failed to get the user quota from the database before adding file chunk: %v", err)
+			}
+
+			// the space reserved by the user's other uploads isn't free
+			reserved, err := reservedUploadSpace(tx, userID, fileID, versionID)
+			if err != nil {
+				return err
+			}
+
+			// fail the transaction if there's not enough allocation space
+			if (quota - allocated - int64(reserved)) < blobSize {
+				return fmt.Errorf("not enough free allocation space (quota: %d ; current allocation %d ; reserved for uploads %d ; chunk size %d)",
+					quota, allocated, reserved, blobSize)
+			}
+
+			// now the that prechecks have succeeded, add the stored chunk for the user
+			res, err := tx.Exec(addUserChunk, userID, chunkHash, blobRef, blobSize)
+			if err != nil {
+				return fmt.Errorf("failed to add a new stored chunk in the database: %v", err)
+			}
+			userChunkID, err = res.LastInsertId()
+			if err != nil {
+				return fmt.Errorf("failed to get the id for the last row inserted while adding a new stored chunk into the database: %v", err)
+			}
+			blobUsed = true
+			allocDelta = blobSize
+		} else if err != nil {
+			return fmt.Errorf("failed to look up the chunk hash for the user: %v", err)
 		}
 
-		// now the that prechecks have succeeded, add the file
-		res, err := tx.Exec(addFileChunk, fileID, versionID, chunkNumber, chunkHash, chunk)
+		// add the file chunk referencing the stored chunk
+		freedSize, blobRefs, err := linkFileChunk(tx, fileID, versionID, chunkNumber, chunkHash, chunkLength, int(userChunkID))
 		if err != nil {
-			return fmt.Errorf("failed to add a new file chunk in the database: %v", err)
-		}
-		// make sure one row was affected
-		affected, err := res.RowsAffected()
-		if affected != 1 {
-			return fmt.Errorf("failed to add a new file chunk in the database; no rows were affected")
-		} else if err != nil {
-			return fmt.Errorf("failed to add a new file chunk in the database: %v", err)
+			return err
 		}
+		freedBlobRefs = blobRefs
+		allocDelta -= int64(freedSize)
 
-		// update the allocation count
-		res, err = tx.Exec(updateUserStats, chunkLength, userID)
+		// update the allocation count and record the change
+		err = s.recordFileChange(tx, userID, fileID, versionID, ChangeChunkAdd, int(allocDelta))
 		if err != nil {
-			return fmt.Errorf("failed to update the allocated bytes in the database after adding a chunk: %v", err)
+			return err
 		}
-		// make sure one row was affected with the UPDATE statement
-		affected, err = res.RowsAffected()
-		if affected != 1 {
-			return fmt.Errorf("failed to update the user info in the database after adding a chunk; no rows were affected")
-		} else if err != nil {
-			return fmt.Errorf("failed to update the user info in the database after adding a chunk: %v", err)
+		err = s.advanceUploadSession(tx, fileID, versionID, int(allocDelta))
+		if err != nil {
+			return err
 		}
 
 		newChunk.FileID = fileID
 		newChunk.VersionID = versionID
 		newChunk.ChunkNumber = chunkNumber
 		newChunk.ChunkHash = chunkHash
+		newChunk.ChunkLength = chunkLength
 		newChunk.Chunk = chunk
 		return nil
 	})
 
+	// clean up the chunk bytes written above if they ended up not being referenced
+	if blobRef != "" && (err != nil || !blobUsed) {
+		s.removeChunkBlobs([]string{blobRef})
+	}
+
 	// return the error, if any, from running the transaction
 	if err != nil {
 		return nil, err
 	}
+
+	s.removeChunkBlobs(freedBlobRefs)
 	return newChunk, nil
 }
 
+// ReuseFileChunks adds file chunks to a file version by referencing the chunks the user
+// already has in storage with the same chunk hash, so that the chunk bytes don't need to
+// be sent again. Only the ChunkNumber, ChunkHash and ChunkLength fields of the chunks passed
+// in are used.
+// The chunk numbers that were added are returned; chunks that are not already stored for the
+// user are skipped and still need to be added with AddFileChunk.
+func (s *Storage) ReuseFileChunks(userID int, fileID int, versionID int, chunks []FileChunk) ([]int, error) {
+	reused := []int{}
+	var freedBlobRefs []string
+	err := s.transact("ReuseFileChunks", func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return fmt.Errorf("user does not own the file id supplied")
+		}
+		err = checkFileVersion(tx, fileID, versionID)
+		if err != nil {
+			return err
+		}
+
+		totalFreedSize := 0
+		for _, fc := range chunks {
+			var userChunkID int
+			err = tx.QueryRow(getUserChunkByHash, userID, fc.ChunkHash).Scan(&userChunkID)
+			if err == sql.ErrNoRows {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("failed to look up the chunk hash for the user: %v", err)
+			}
+
+			freedSize, blobRefs, err := linkFileChunk(tx, fileID, versionID, fc.ChunkNumber, fc.ChunkHash, fc.ChunkLength, userChunkID)
+			if err != nil {
+				return err
+			}
+			totalFreedSize += freedSize
+			freedBlobRefs = append(freedBlobRefs, blobRefs...)
+			reused = append(reused, fc.ChunkNumber)
+		}
+
+		// update the allocation count and record the change if anything changed
+		if len(reused) > 0 {
+			err = s.recordFileChange(tx, userID, fileID, versionID, ChangeChunkAdd, -totalFreedSize)
+			if err != nil {
+				return err
+			}
+			err = s.advanceUploadSession(tx, fileID, versionID, 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.removeChunkBlobs(freedBlobRefs)
+	return reused, nil
+}
+
 // RemoveFileChunk removes a chunk from storage identifed by the fileID and chunkNumber.
 // If the chunkNumber specified is out of range of the file's max chunk count, this will
 // simply have no effect. An bool indicating if the chunk was successfully removed is returned
 // as well as an error on failure. userID is required so that the allocation count can updated
 // in the same transaction as well as to verify ownership of the chunk.
 func (s *Storage) RemoveFileChunk(userID int, fileID int, versionID int, chunkNumber int) (bool, error) {
-	err := s.transact(func(tx *sql.Tx) error {
+	var blobRefs []string
+	err := s.transact("RemoveFileChunk", func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
 		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
@@ -1171,15 +1848,14 @@ func (s *Storage) RemoveFileChunk(userID int, fileID int, versionID int, chunkNu
 			return fmt.Errorf("user does not own the file id supplied")
 		}
 
-		// get the existing chunk so that we can caluclate the chunk size in bytes to
-		// remove from the user's allocation count
-		var chunkHash string
-		var chunk []byte
-		err = tx.QueryRow(getFileChunk, fileID, versionID, chunkNumber).Scan(&chunkHash, &chunk)
+		// get the stored chunk referenced by the existing chunk
+		userChunkIDs, err := queryUserChunkIDs(tx, getFileChunkUserChunkIDs, fileID, versionID, chunkNumber)
 		if err != nil {
 			return fmt.Errorf("failed to get the existing chunk before removal: %v", err)
 		}
-		allocationCount := len(chunk)
+		if len(userChunkIDs) == 0 {
+			return fmt.Errorf("failed to get the existing chunk before removal: %v", sql.ErrNoRows)
+		}
 
 		// remove the chunk from the table
 		res, err := tx.Exec(removeFileChunk, fileID, versionID, chunkNumber)
@@ -1195,27 +1871,24 @@ func (s *Storage) RemoveFileChunk(userID int, fileID int, versionID int, chunkNu
 			return fmt.Errorf("failed to add a new file info in the database: %v", err)
 		}
 
-		// update the allocation counts
-		res, err = tx.Exec(updateUserStats, -allocationCount, userID)
+		// release the stored chunk so that we can caluclate the chunk size in bytes to
+		// remove from the user's allocation count, which is zero if it's still in use
+		var allocationCount int
+		allocationCount, blobRefs, err = releaseUserChunks(tx, userChunkIDs)
 		if err != nil {
-			return fmt.Errorf("failed to update the allocated bytes in the database after removing a chunk: %v", err)
-		}
-
-		// make sure one row was affected with the UPDATE statement
-		affected, err = res.RowsAffected()
-		if affected != 1 {
-			return fmt.Errorf("failed to update the user info in the database after removing a chunk; no rows were affected")
-		} else if err != nil {
-			return fmt.Errorf("failed to update the user info in the database after removing a chunk: %v", err)
+			return err
 		}
 
-		return nil
+		// update the allocation counts and record the change
+		return s.recordFileChange(tx, userID, fileID, versionID, ChangeChunkRemove, -allocationCount)
 	})
 
 	// return the error, if any, from running the transaction
 	if err != nil {
 		return false, err
 	}
+
+	s.removeChunkBlobs(blobRefs)
 	return true, nil
 }
 
@@ -1227,14 +1900,173 @@ func (s *Storage) GetFileChunk(fileID int, chunkNumber int, versionID int) (fc *
 	fc.VersionID = versionID
 	fc.ChunkNumber = chunkNumber
 
-	e = s.db.QueryRow(getFileChunk, fileID, versionID, chunkNumber).Scan(&fc.ChunkHash, &fc.Chunk)
+	var blobRef string
+	e = s.db.QueryRow(getFileChunk, fileID, versionID, chunkNumber).Scan(&fc.ChunkHash, &fc.ChunkLength, &blobRef)
+	if e != nil {
+		return
+	}
+
+	fc.Chunk, e = s.chunks.GetChunk(blobRef)
 	return
 }
 
+// linkFileChunk adds a file chunk at the chunk number of a file version that references
+// the stored chunk identified by userChunkID. Any file chunk already at that position is
+// replaced and its stored chunk released; the number of bytes freed by that and the blob
+// references to remove once the transaction succeeds are returned.
+func linkFileChunk(tx *sql.Tx, fileID int, versionID int, chunkNumber int, chunkHash string, chunkLength int, userChunkID int) (freedSize int, blobRefs []string, err error) {
+	// add the new reference first so that the stored chunk isn't freed below
+	// if the file chunk being replaced references the same one
+	_, err = tx.Exec(addUserChunkRef, userChunkID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to add a reference to the stored chunk: %v", err)
+	}
+
+	oldUserChunkIDs, err := queryUserChunkIDs(tx, getFileChunkUserChunkIDs, fileID, versionID, chunkNumber)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(oldUserChunkIDs) > 0 {
+		_, err = tx.Exec(removeFileChunk, fileID, versionID, chunkNumber)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to remove the file chunk being replaced in the database: %v", err)
+		}
+		freedSize, blobRefs, err = releaseUserChunks(tx, oldUserChunkIDs)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	res, err := tx.Exec(addFileChunk, fileID, versionID, chunkNumber, chunkHash, userChunkID, chunkLength)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to add a new file chunk in the database: %v", err)
+	}
+	// make sure one row was affected
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return 0, nil, fmt.Errorf("failed to add a new file chunk in the database; no rows were affected")
+	} else if err != nil {
+		return 0, nil, fmt.Errorf("failed to add a new file chunk in the database: %v", err)
+	}
+
+	return freedSize, blobRefs, nil
+}
+
+// releaseUserChunks drops a reference to each of the stored chunks identified; an id is
+// listed once for every file chunk that referenced it. Stored chunks that are no longer
+// referenced are removed and the number of bytes freed is returned along with the blob
+// references to remove from the chunk store once the transaction succeeds.
+func releaseUserChunks(tx *sql.Tx, userChunkIDs []int) (freedSize int, blobRefs []string, err error) {
+	for _, userChunkID := range userChunkIDs {
+		_, err = tx.Exec(releaseUserChunkRef, userChunkID)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to release a reference to the stored chunk: %v", err)
+		}
+	}
+
+	checked := make(map[int]bool)
+	for _, userChunkID := range userChunkIDs {
+		if checked[userChunkID] {
+			continue
+		}
+		checked[userChunkID] = true
+
+		var blobRef string
+		var blobSize int
+		err = tx.QueryRow(getUnusedUserChunk, userChunkID).Scan(&blobRef, &blobSize)
+		if err == sql.ErrNoRows {
+			// still referenced by another file chunk
+			continue
+		} else if err != nil {
+			return 0, nil, fmt.Errorf("failed to get the stored chunk after releasing it: %v", err)
+		}
+
+		_, err = tx.Exec(removeUserChunk, userChunkID)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to remove the unused stored chunk: %v", err)
+		}
+		freedSize += blobSize
+		blobRefs = append(blobRefs, blobRef)
+	}
+
+	return freedSize, blobRefs, nil
+}
+
+// removeChunkBlobs deletes the chunk bytes for the blob references from the
+// chunk store. This is called after the FileChunks rows have been removed, so
+// the blobs are unreachable either way; a failure here only leaves an orphaned
+// blob behind and is not reported.
+func (s *Storage) removeChunkBlobs(blobRefs []string) {
+	for _, blobRef := range blobRefs {
+		s.chunks.RemoveChunk(blobRef)
+	}
+}
+
+// queryBlobRefs runs the query in the transaction and returns the blob references
+// from the rows returned.
+func queryBlobRefs(tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the chunk blob references: %v", err)
+	}
+	defer rows.Close()
+
+	blobRefs := []string{}
+	for rows.Next() {
+		var blobRef string
+		err := rows.Scan(&blobRef)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing chunk blob references: %v", err)
+		}
+		blobRefs = append(blobRefs, blobRef)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan all of the chunk blob references: %v", err)
+	}
+
+	return blobRefs, nil
+}
+
+// queryUserChunkIDs runs the query in the transaction and returns the stored
+// chunk ids from the rows returned.
+func queryUserChunkIDs(tx *sql.Tx, query string, args ...interface{}) ([]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the stored chunk ids: %v", err)
+	}
+	defer rows.Close()
+
+	userChunkIDs := []int{}
+	for rows.Next() {
+		var userChunkID int
+		err := rows.Scan(&userChunkID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing stored chunk ids: %v", err)
+		}
+		userChunkIDs = append(userChunkIDs, userChunkID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan all of the stored chunk ids: %v", err)
+	}
+
+	return userChunkIDs, nil
+}
+
 // transact takes a function parameter that will get executed within the context
 // of a database/sql.DB transaction. This transaction will Comit or Rollback
 // based on whether or not an error or panic was generated from this function.
-func (s *Storage) transact(transFoo func(*sql.Tx) error) (err error) {
+// The op name identifies the storage operation to the TransactionObserver.
+func (s *Storage) transact(op string, transFoo func(*sql.Tx) error) (err error) {
+	if s.TransactionObserver != nil {
+		start := time.Now()
+		defer func() {
+			s.TransactionObserver(op, time.Since(start), err)
+		}()
+	}
+
+	s.txLock.Lock()
+	defer s.txLock.Unlock()
+
 	// start the transaction
 	tx, err := s.db.Begin()
 	if err != nil {
@@ -1255,11 +2087,13 @@ func (s *Storage) transact(transFoo func(*sql.Tx) error) (err error) {
 		// if there was an error, we rollback the transaction
 		if err != nil {
 			tx.Rollback()
+			s.notifyChanges(false)
 			return
 		}
 
 		// no error, so run the commit and return the result
 		err = tx.Commit()
+		s.notifyChanges(err == nil)
 	}()
 
 	// run the transaction function and do the commit/rollback in the deferred
@@ -0,0 +1,184 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+// countChunkFiles returns the number of chunk files in a FileSystemChunkStore directory.
+func countChunkFiles(rootPath string, t *testing.T) int {
+	count := 0
+	err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk the chunk store directory: %v", err)
+	}
+	return count
+}
+
+func TestFileSystemChunkStore(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "freezer_chunkstore")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	chunkDir := filepath.Join(testDir, "chunks")
+
+	// create a storage object that keeps the chunks on the filesystem
+	store, err := filefreezer.NewStorage("file:"+filepath.Join(testDir, "freezer.db"), chunkDir)
+	if err != nil {
+		t.Fatalf("Failed to create the storage for testing. %v", err)
+	}
+	defer store.Close()
+
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+
+	setupTestUser(store, "admin", "hamster", t)
+	user, err := store.GetUser("admin")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+
+	// upload a few versions of a random file
+	testChunkCount := 3
+	testFilename := "random_chunkstore.dat"
+	var fi *filefreezer.FileInfo
+	for i := 0; i < 2; i++ {
+		fi = addNewRandomFile(store, user, testFilename, testChunkCount, t)
+	}
+	defer os.Remove(testFilename)
+
+	// every chunk should have its own file in the chunk store
+	chunkFileCount := countChunkFiles(chunkDir, t)
+	if chunkFileCount != testChunkCount*2 {
+		t.Fatalf("Expected %d chunk files in the chunk store but found %d.", testChunkCount*2, chunkFileCount)
+	}
+
+	// the allocation count should still be tracked even though the bytes are not in the database
+	userStats, err := store.GetUserStats(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	if int64(userStats.Allocated) != store.ChunkSize*int64(testChunkCount)*2 {
+		t.Fatalf("Expected %d bytes allocated but the storage returned %d.", store.ChunkSize*int64(testChunkCount)*2, userStats.Allocated)
+	}
+
+	// the chunks read back should match the local file
+	localBytes, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatalf("Failed to read the test file: %v", err)
+	}
+	for i := 0; i < testChunkCount; i++ {
+		chunk, err := store.GetFileChunk(fi.FileID, i, fi.CurrentVersion.VersionID)
+		if err != nil {
+			t.Fatalf("Failed to get chunk %d for the test file: %v", i, err)
+		}
+		start := int64(i) * store.ChunkSize
+		if bytes.Compare(chunk.Chunk, localBytes[start:start+store.ChunkSize]) != 0 {
+			t.Fatalf("Chunk %d read back from the chunk store did not match the local file.", i)
+		}
+	}
+
+	// removing a version should remove the chunk files for that version
+	err = store.RemoveFileVersions(user.ID, fi.FileID, 1, 1)
+	if err != nil {
+		t.Fatalf("Failed to remove the first file version: %v", err)
+	}
+	chunkFileCount = countChunkFiles(chunkDir, t)
+	if chunkFileCount != testChunkCount {
+		t.Fatalf("Expected %d chunk files in the chunk store after removing a version but found %d.", testChunkCount, chunkFileCount)
+	}
+
+	// removing a single chunk should remove its chunk file
+	removed, err := store.RemoveFileChunk(user.ID, fi.FileID, fi.CurrentVersion.VersionID, 0)
+	if err != nil || !removed {
+		t.Fatalf("Failed to remove a file chunk: %v", err)
+	}
+	chunkFileCount = countChunkFiles(chunkDir, t)
+	if chunkFileCount != testChunkCount-1 {
+		t.Fatalf("Expected %d chunk files in the chunk store after removing a chunk but found %d.", testChunkCount-1, chunkFileCount)
+	}
+
+	// removing the file should remove the rest of them
+	err = store.RemoveFile(user.ID, fi.FileID)
+	if err != nil {
+		t.Fatalf("Failed to remove the test file: %v", err)
+	}
+	chunkFileCount = countChunkFiles(chunkDir, t)
+	if chunkFileCount != 0 {
+		t.Fatalf("Expected no chunk files in the chunk store after removing the file but found %d.", chunkFileCount)
+	}
+
+	userStats, err = store.GetUserStats(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	if userStats.Allocated != 0 {
+		t.Fatalf("Expected no bytes allocated after removing the file but the storage returned %d.", userStats.Allocated)
+	}
+}
+
+func TestChunkStoreCheck(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "freezer_chunkstore")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	chunkDir := filepath.Join(testDir, "chunks")
+
+	// both kinds of chunk store should be writable without leaving anything behind
+	for _, storeDir := range []string{"", chunkDir} {
+		store, err := filefreezer.NewStorage("file:"+filepath.Join(testDir, "freezer.db"), storeDir)
+		if err != nil {
+			t.Fatalf("Failed to create the storage for testing: %v", err)
+		}
+		err = store.CreateTables()
+		if err != nil {
+			t.Fatalf("Failed to create tables for testing: %v", err)
+		}
+		err = store.Ping()
+		if err != nil {
+			t.Fatalf("Failed to ping the database: %v", err)
+		}
+		err = store.CheckChunkStore()
+		if err != nil {
+			t.Fatalf("Failed to check the chunk store (%s): %v", storeDir, err)
+		}
+		if store.IsMigrating() {
+			t.Fatalf("The storage should not be migrating once it's opened.")
+		}
+		store.Close()
+	}
+	if countChunkFiles(chunkDir, t) != 0 {
+		t.Fatalf("Checking the chunk store should not leave any files behind.")
+	}
+
+	// a chunk store directory that has gone missing can't be written to
+	fs, err := filefreezer.NewFileSystemChunkStore(chunkDir)
+	if err != nil {
+		t.Fatalf("Failed to create the chunk store: %v", err)
+	}
+	os.RemoveAll(chunkDir)
+	err = fs.Check()
+	if err == nil {
+		t.Fatalf("Checking a missing chunk store directory should have failed.")
+	}
+}
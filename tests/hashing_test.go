@@ -0,0 +1,164 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package tests
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+func TestStreamingFileHash(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "freezer_hashing")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	const chunkSize = 1024
+	hashKey := filefreezer.DeriveHashKey([]byte("hashing test key"))
+
+	// the streamed hashes should match hashing the whole file at once for files that
+	// are empty, smaller than a chunk, an exact number of chunks and a partial chunk over
+	for _, fileSize := range []int{0, 100, chunkSize, chunkSize * 3, chunkSize*2 + 7} {
+		fileBytes := genRandomBytes(fileSize)
+		filename := filepath.Join(testDir, "hashed.dat")
+		err = ioutil.WriteFile(filename, fileBytes, os.ModePerm)
+		if err != nil {
+			t.Fatalf("Failed to write the test file: %v", err)
+		}
+
+		stats, err := filefreezer.CalcFileHashInfo(chunkSize, filename, hashKey)
+		if err != nil {
+			t.Fatalf("Failed to calculate the file hash for a %d byte file: %v", fileSize, err)
+		}
+		if stats.HashAlgo != filefreezer.HashAlgoHMACSHA256 {
+			t.Fatalf("Expected keyed hashes but got the %s hash algorithm.", stats.HashAlgo)
+		}
+
+		mac := hmac.New(sha256.New, hashKey)
+		mac.Write(fileBytes)
+		if stats.HashString != base64.URLEncoding.EncodeToString(mac.Sum(nil)) {
+			t.Fatalf("The streamed file hash for a %d byte file did not match the whole file hash.", fileSize)
+		}
+
+		// without a key the legacy unkeyed hashes are calculated
+		legacyStats, err := filefreezer.CalcFileHashInfo(chunkSize, filename, nil)
+		if err != nil {
+			t.Fatalf("Failed to calculate the legacy file hash for a %d byte file: %v", fileSize, err)
+		}
+		wholeHash := sha1.Sum(fileBytes)
+		if legacyStats.HashAlgo != filefreezer.HashAlgoSHA1 ||
+			legacyStats.HashString != base64.URLEncoding.EncodeToString(wholeHash[:]) {
+			t.Fatalf("The legacy file hash for a %d byte file did not match the SHA1 of the file.", fileSize)
+		}
+
+		expectedCount := (fileSize + chunkSize - 1) / chunkSize
+		if len(legacyStats.ChunkHashes) != expectedCount {
+			t.Fatalf("Expected %d legacy chunk hashes for a %d byte file but got %d.", expectedCount, fileSize, len(legacyStats.ChunkHashes))
+		}
+		if stats.ChunkCount != expectedCount || len(stats.ChunkHashes) != expectedCount {
+			t.Fatalf("Expected %d chunks for a %d byte file but got a count of %d and %d chunk hashes.",
+				expectedCount, fileSize, stats.ChunkCount, len(stats.ChunkHashes))
+		}
+		for i, chunkHash := range stats.ChunkHashes {
+			end := (i + 1) * chunkSize
+			if end > fileSize {
+				end = fileSize
+			}
+			if chunkHash != filefreezer.CalcChunkHash(hashKey, fileBytes[i*chunkSize:end]) {
+				t.Fatalf("Chunk hash %d for a %d byte file did not match the hash of the chunk bytes.", i, fileSize)
+			}
+		}
+	}
+
+	// directories are flagged and not hashed
+	stats, err := filefreezer.CalcFileHashInfo(chunkSize, testDir, hashKey)
+	if err != nil {
+		t.Fatalf("Failed to calculate the file hash info for a directory: %v", err)
+	}
+	if !stats.IsDir || stats.HashString != "" || stats.ChunkHashes != nil {
+		t.Fatalf("Expected a directory to be flagged without any hashes: %+v", stats)
+	}
+}
+
+func TestContentDefinedChunking(t *testing.T) {
+	const chunkSize = 4096
+	hashKey := filefreezer.DeriveHashKey([]byte("chunking test key"))
+	fileBytes := genRandomBytes(chunkSize * 64)
+
+	fixedHash, _, err := filefreezer.CalcReaderHashInfo(chunkSize, bytes.NewReader(fileBytes), hashKey)
+	if err != nil {
+		t.Fatalf("Failed to hash the file with fixed size chunks: %v", err)
+	}
+	fileHash, chunkHashes, chunkLengths, err := filefreezer.CalcChunkedReaderHashInfo(filefreezer.ChunkingFastCDC, chunkSize, bytes.NewReader(fileBytes), hashKey)
+	if err != nil {
+		t.Fatalf("Failed to hash the file with content-defined chunks: %v", err)
+	}
+
+	// the file hash doesn't depend on how the file was split into chunks
+	if fileHash != fixedHash {
+		t.Fatalf("The file hash changed with the chunking mode.")
+	}
+	if len(chunkHashes) != len(chunkLengths) || len(chunkHashes) <= 64 {
+		t.Fatalf("Expected more chunks than fixed size chunks would make but got %d hashes and %d lengths.", len(chunkHashes), len(chunkLengths))
+	}
+	offset := 0
+	for i, length := range chunkLengths {
+		if length < 1 || length > chunkSize {
+			t.Fatalf("Chunk %d has a length of %d which is not between 1 and the chunk size.", i, length)
+		}
+		if chunkHashes[i] != filefreezer.CalcChunkHash(hashKey, fileBytes[offset:offset+length]) {
+			t.Fatalf("Chunk hash %d did not match the hash of the chunk bytes.", i)
+		}
+		offset += length
+	}
+	if offset != len(fileBytes) {
+		t.Fatalf("The chunk lengths add up to %d bytes instead of the %d bytes of the file.", offset, len(fileBytes))
+	}
+
+	// inserting a byte at the start of the file only changes the chunks around it
+	known := make(map[string]bool)
+	for _, chunkHash := range chunkHashes {
+		known[chunkHash] = true
+	}
+	edited := append([]byte{42}, fileBytes...)
+	_, editedHashes, _, err := filefreezer.CalcChunkedReaderHashInfo(filefreezer.ChunkingFastCDC, chunkSize, bytes.NewReader(edited), hashKey)
+	if err != nil {
+		t.Fatalf("Failed to hash the edited file: %v", err)
+	}
+	changed := 0
+	for _, chunkHash := range editedHashes {
+		if !known[chunkHash] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Fatalf("Expected at most 2 chunks to change after inserting a byte but %d of %d did.", changed, len(editedHashes))
+	}
+
+	// the boundaries depend on the hash key
+	_, _, otherLengths, err := filefreezer.CalcChunkedReaderHashInfo(filefreezer.ChunkingFastCDC, chunkSize, bytes.NewReader(fileBytes),
+		filefreezer.DeriveHashKey([]byte("another key")))
+	if err != nil {
+		t.Fatalf("Failed to hash the file with another key: %v", err)
+	}
+	if reflect.DeepEqual(otherLengths, chunkLengths) {
+		t.Fatalf("Expected another hash key to pick other chunk boundaries.")
+	}
+
+	_, err = filefreezer.NewChunker("unknown", chunkSize, bytes.NewReader(fileBytes), hashKey)
+	if err == nil {
+		t.Fatalf("Expected an unsupported chunking mode to fail.")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package tests
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+func TestKeyWrapping(t *testing.T) {
+	masterKey, err := filefreezer.GenMasterKey()
+	if err != nil || len(masterKey) != 32 {
+		t.Fatalf("Failed to generate a 32 byte master key: %v", err)
+	}
+	wrappingKey, _, _, err := filefreezer.GenCryptoPasswordHash("wrapping password", false, "")
+	if err != nil {
+		t.Fatalf("Failed to derive the wrapping key: %v", err)
+	}
+
+	wrapped, err := filefreezer.WrapKey(wrappingKey, masterKey)
+	if err != nil {
+		t.Fatalf("Failed to wrap the master key: %v", err)
+	}
+	if bytes.Contains(wrapped, masterKey) {
+		t.Fatalf("The wrapped key contains the plaintext master key.")
+	}
+	unwrapped, err := filefreezer.UnwrapKey(wrappingKey, wrapped)
+	if err != nil || bytes.Compare(unwrapped, masterKey) != 0 {
+		t.Fatalf("The unwrapped key did not match the master key: %v", err)
+	}
+
+	// the wrong wrapping key or a modified wrapped key should fail to unwrap
+	otherKey, _, _, err := filefreezer.GenCryptoPasswordHash("other password", false, "")
+	if err != nil {
+		t.Fatalf("Failed to derive the other wrapping key: %v", err)
+	}
+	_, err = filefreezer.UnwrapKey(otherKey, wrapped)
+	if err == nil {
+		t.Fatalf("Unwrapping the master key with the wrong key should have failed.")
+	}
+	wrapped[len(wrapped)-1] ^= 0x01
+	_, err = filefreezer.UnwrapKey(wrappingKey, wrapped)
+	if err == nil {
+		t.Fatalf("Unwrapping a modified master key should have failed.")
+	}
+}
+
+func TestRecoveryKeyEncoding(t *testing.T) {
+	masterKey, err := filefreezer.GenMasterKey()
+	if err != nil {
+		t.Fatalf("Failed to generate the master key: %v", err)
+	}
+
+	phrase := filefreezer.EncodeRecoveryKey(masterKey)
+	decoded, err := filefreezer.DecodeRecoveryKey(phrase)
+	if err != nil || bytes.Compare(decoded, masterKey) != 0 {
+		t.Fatalf("The decoded recovery key did not match the master key: %v", err)
+	}
+
+	// case, spaces and the dashes shouldn't matter when the phrase is typed back in
+	retyped := strings.ToLower(strings.Replace(phrase, "-", " ", -1)) + "\n"
+	decoded, err = filefreezer.DecodeRecoveryKey(retyped)
+	if err != nil || bytes.Compare(decoded, masterKey) != 0 {
+		t.Fatalf("The retyped recovery key did not match the master key: %v", err)
+	}
+
+	// a mistyped character should be caught by the checksum
+	typo := []byte(phrase)
+	if typo[0] == 'A' {
+		typo[0] = 'B'
+	} else {
+		typo[0] = 'A'
+	}
+	_, err = filefreezer.DecodeRecoveryKey(string(typo))
+	if err == nil {
+		t.Fatalf("Decoding a mistyped recovery key should have failed.")
+	}
+
+	_, err = filefreezer.DecodeRecoveryKey("not a recovery key!")
+	if err == nil {
+		t.Fatalf("Decoding an invalid recovery key should have failed.")
+	}
+}
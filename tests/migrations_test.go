@@ -0,0 +1,315 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tbogdala/filefreezer"
+)
+
+// the version 1 schema as it was before any migrations were written
+var v1FixtureSchema = []string{
+	`CREATE TABLE AppData (
+		DBVersion	INTEGER				NOT NULL
+	);`,
+	`CREATE TABLE Users (
+        UserID 		INTEGER PRIMARY KEY	NOT NULL,
+        Name		TEXT	UNIQUE		NOT NULL ON CONFLICT ABORT,
+		Salt		TEXT				NOT NULL,
+		Password	BLOB				NOT NULL,
+		CryptoHash  BLOB
+    );`,
+	`CREATE TABLE UserStats (
+        UserID 		INTEGER PRIMARY KEY	NOT NULL,
+        Quota		INTEGER				NOT NULL,
+        Allocated	INTEGER				NOT NULL,
+        Revision	INTEGER				NOT NULL
+    );`,
+	`CREATE TABLE FileInfo (
+        FileID 	          INTEGER PRIMARY KEY  NOT NULL,
+        UserID 		      INTEGER              NOT NULL,
+        FileName	      TEXT                 NOT NULL,
+        IsDir             INTEGER              NOT NULL,
+        CurrentVersionID  INTEGER              NOT NULL
+      );`,
+	`CREATE TABLE FileVersion (
+        VersionID   INTEGER PRIMARY KEY	NOT NULL,
+        FileID 	    INTEGER 			NOT NULL,
+        VersionNum 	INTEGER 			NOT NULL,
+        Perms       INTEGER             NOT NULL,
+        LastMod		INTEGER				NOT NULL,
+        ChunkCount  INTEGER				NOT NULL,
+        FileHash	TEXT				NOT NULL
+    );`,
+	`CREATE TABLE FileChunks (
+        ChunkID     INTEGER PRIMARY KEY	NOT NULL,
+        FileID 		INTEGER             NOT NULL,
+        VersionID   INTEGER             NOT NULL,
+        ChunkNum	INTEGER 			NOT NULL,
+        ChunkHash	TEXT				NOT NULL,
+        Chunk		BLOB				NOT NULL
+	);`,
+}
+
+// v1FixtureChunk is a chunk written to the version 1 fixture database
+type v1FixtureChunk struct {
+	versionID int
+	chunkNum  int
+	hash      string
+	chunk     []byte
+}
+
+// createV1Fixture writes a version 1 database to dbFilepath with one user that
+// has a file with two versions. The first chunk is the same in both versions
+// and so is stored twice, which is how version 1 databases kept them.
+func createV1Fixture(dbFilepath string, t *testing.T) []v1FixtureChunk {
+	chunkA := genRandomBytes(64)
+	chunks := []v1FixtureChunk{
+		{1, 0, "hashA", chunkA},
+		{1, 1, "hashB", genRandomBytes(32)},
+		{2, 0, "hashA", chunkA},
+		{2, 1, "hashC", genRandomBytes(16)},
+	}
+	allocated := 0
+	for _, c := range chunks {
+		allocated += len(c.chunk)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+dbFilepath)
+	if err != nil {
+		t.Fatalf("Failed to open the fixture database: %v", err)
+	}
+	defer db.Close()
+
+	for _, ddl := range v1FixtureSchema {
+		_, err = db.Exec(ddl)
+		if err != nil {
+			t.Fatalf("Failed to create the fixture tables: %v", err)
+		}
+	}
+
+	type statement struct {
+		query string
+		args  []interface{}
+	}
+	statements := []statement{
+		{`INSERT INTO AppData (DBVersion) VALUES (1);`, nil},
+		{`INSERT INTO Users (UserID, Name, Salt, Password) VALUES (1, 'admin', 'salt', 'password');`, nil},
+		{`INSERT INTO UserStats (UserID, Quota, Allocated, Revision) VALUES (1, 1000000, ?, 6);`, []interface{}{allocated}},
+		{`INSERT INTO FileInfo (FileID, UserID, FileName, IsDir, CurrentVersionID) VALUES (1, 1, 'fixture.dat', 0, 2);`, nil},
+		{`INSERT INTO FileVersion (VersionID, FileID, VersionNum, Perms, LastMod, ChunkCount, FileHash) VALUES (1, 1, 1, 420, 1000, 2, 'filehash1');`, nil},
+		{`INSERT INTO FileVersion (VersionID, FileID, VersionNum, Perms, LastMod, ChunkCount, FileHash) VALUES (2, 1, 2, 420, 2000, 2, 'filehash2');`, nil},
+	}
+	for _, c := range chunks {
+		statements = append(statements, statement{`INSERT INTO FileChunks (FileID, VersionID, ChunkNum, ChunkHash, Chunk) VALUES (1, ?, ?, ?, ?);`,
+			[]interface{}{c.versionID, c.chunkNum, c.hash, c.chunk}})
+	}
+	for _, stmt := range statements {
+		_, err = db.Exec(stmt.query, stmt.args...)
+		if err != nil {
+			t.Fatalf("Failed to populate the fixture database: %v", err)
+		}
+	}
+
+	return chunks
+}
+
+func TestMigrateVersion1Database(t *testing.T) {
+	doTestMigrateVersion1Database(false, t)
+}
+
+func TestMigrateVersion1DatabaseWithChunkStore(t *testing.T) {
+	doTestMigrateVersion1Database(true, t)
+}
+
+func doTestMigrateVersion1Database(useChunkStore bool, t *testing.T) {
+	testDir, err := ioutil.TempDir("", "freezer_migrations")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	dbFilepath := filepath.Join(testDir, "freezer.db")
+	chunkDir := ""
+	if useChunkStore {
+		chunkDir = filepath.Join(testDir, "chunks")
+	}
+	chunks := createV1Fixture(dbFilepath, t)
+
+	// opening the storage without migrating should list every step
+	store, err := filefreezer.OpenStorage("file:"+dbFilepath, chunkDir)
+	if err != nil {
+		t.Fatalf("Failed to open the fixture database: %v", err)
+	}
+	pending, err := store.PendingMigrations()
+	if err != nil {
+		t.Fatalf("Failed to get the pending migrations: %v", err)
+	}
+	if len(pending) != filefreezer.CurrentDBVersion-1 {
+		t.Fatalf("Expected %d pending migrations but got %d.", filefreezer.CurrentDBVersion-1, len(pending))
+	}
+	for i, step := range pending {
+		if step.Version != i+2 || step.Description == "" {
+			t.Fatalf("Pending migration %d is out of order or undescribed: %+v", i, step)
+		}
+	}
+	dbVersion, err := store.GetDBVersion()
+	if err != nil || dbVersion != 1 {
+		t.Fatalf("Listing the pending migrations should not have changed the DB version (got %d): %v", dbVersion, err)
+	}
+	store.Close()
+
+	// NewStorage should migrate the database up to the current version
+	store, err = filefreezer.NewStorage("file:"+dbFilepath, chunkDir)
+	if err != nil {
+		t.Fatalf("Failed to open and migrate the fixture database: %v", err)
+	}
+	defer store.Close()
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for the migrated database: %v", err)
+	}
+
+	dbVersion, err = store.GetDBVersion()
+	if err != nil || dbVersion != filefreezer.CurrentDBVersion {
+		t.Fatalf("Expected the migrated DB to be at version %d (got %d): %v", filefreezer.CurrentDBVersion, dbVersion, err)
+	}
+	pending, err = store.PendingMigrations()
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("Expected no pending migrations after migrating (got %d): %v", len(pending), err)
+	}
+
+	// the backup should still be the version 1 database
+	backupPath := dbFilepath + ".v1.bak"
+	backup, err := filefreezer.OpenStorage("file:"+backupPath, "")
+	if err != nil {
+		t.Fatalf("Failed to open the database backup: %v", err)
+	}
+	dbVersion, err = backup.GetDBVersion()
+	backup.Close()
+	if err != nil || dbVersion != 1 {
+		t.Fatalf("Expected the database backup to be at version 1 (got %d): %v", dbVersion, err)
+	}
+
+	// the versions stored before the hash algorithm was recorded used plain SHA1 hashes,
+	// the versions from before they had to be committed are all committed and every
+	// version from before the chunking mode was recorded used fixed size chunks
+	versions, err := store.GetFileVersions(1)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Failed to get the versions of the migrated file: %v", err)
+	}
+	for _, v := range versions {
+		if v.HashAlgo != filefreezer.HashAlgoSHA1 {
+			t.Fatalf("Expected the migrated version %d to use the %s hash algorithm but got %s.", v.VersionNumber, filefreezer.HashAlgoSHA1, v.HashAlgo)
+		}
+		if !v.Committed {
+			t.Fatalf("Expected the migrated version %d to be committed.", v.VersionNumber)
+		}
+		if v.Chunking != filefreezer.ChunkingFixed {
+			t.Fatalf("Expected the migrated version %d to use the %s chunking but got %s.", v.VersionNumber, filefreezer.ChunkingFixed, v.Chunking)
+		}
+	}
+
+	// the users from before master keys were wrapped don't have one and nobody is an admin
+	user, err := store.GetUser("admin")
+	if err != nil || user.WrappedKey != nil || user.IsAdmin {
+		t.Fatalf("Expected the migrated user to not have a wrapped master key or be an admin: %v", err)
+	}
+
+	// the audit log starts out empty
+	records, err := store.GetAuditRecords("", 0, 0)
+	if err != nil || len(records) != 0 {
+		t.Fatalf("Expected the migrated database to have an empty audit log: %v", err)
+	}
+
+	// the changes from before the journal was added aren't known
+	_, revision, complete, err := store.GetFileChanges(1, 3)
+	if err != nil || revision != 6 || complete {
+		t.Fatalf("Expected the changes from before the migration to be incomplete (revision %d): %v", revision, err)
+	}
+
+	// every chunk should read back the same as it was written
+	for _, c := range chunks {
+		fc, err := store.GetFileChunk(1, c.chunkNum, c.versionID)
+		if err != nil {
+			t.Fatalf("Failed to get chunk %d of version %d: %v", c.chunkNum, c.versionID, err)
+		}
+		if fc.ChunkHash != c.hash || fc.ChunkLength != 0 || bytes.Compare(fc.Chunk, c.chunk) != 0 {
+			t.Fatalf("Chunk %d of version %d did not match after the migration.", c.chunkNum, c.versionID)
+		}
+	}
+	if useChunkStore {
+		chunkFileCount := countChunkFiles(chunkDir, t)
+		if chunkFileCount != 3 {
+			t.Fatalf("Expected the duplicate chunk to be removed leaving 3 chunk files but found %d.", chunkFileCount)
+		}
+	}
+
+	// the duplicate chunk should only be charged once
+	userStats, err := store.GetUserStats(1)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	expectedAlloc := len(chunks[0].chunk) + len(chunks[1].chunk) + len(chunks[3].chunk)
+	if userStats.Allocated != expectedAlloc {
+		t.Fatalf("Expected %d bytes allocated after the migration but the storage returned %d.", expectedAlloc, userStats.Allocated)
+	}
+
+	// and the migrated file should still be removable
+	err = store.RemoveFile(1, 1)
+	if err != nil {
+		t.Fatalf("Failed to remove the migrated file: %v", err)
+	}
+	userStats, err = store.GetUserStats(1)
+	if err != nil || userStats.Allocated != 0 {
+		t.Fatalf("Expected no bytes allocated after removing the migrated file: %v", err)
+	}
+	changes, _, complete, err := store.GetFileChanges(1, 6)
+	if err != nil || !complete || len(changes) != 1 || changes[0].Change != filefreezer.ChangeFileRemove {
+		t.Fatalf("Expected the removal of the migrated file to be journaled: %v %+v", err, changes)
+	}
+
+	// and uploads can be started in the migrated database
+	version := filefreezer.FileVersionInfo{Permissions: 0644, LastMod: 1, ChunkCount: 1, FileHash: "filehash3", HashAlgo: filefreezer.HashAlgoHMACSHA256}
+	sess, err := store.StartUploadSession(1, 0, "upload.dat", false, version, 10, time.Hour)
+	if err != nil || sess.SessionID == "" {
+		t.Fatalf("Failed to start an upload in the migrated database: %v", err)
+	}
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "freezer_migrations")
+	if err != nil {
+		t.Fatalf("Failed to create the temporary directory for testing: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+	dbFilepath := filepath.Join(testDir, "freezer.db")
+
+	store, err := filefreezer.NewStorage("file:"+dbFilepath, "")
+	if err != nil {
+		t.Fatalf("Failed to create the storage for testing. %v", err)
+	}
+	defer store.Close()
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+
+	// a new database is created at the current version and has nothing to migrate
+	applied, err := store.Migrate()
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("Expected no migrations to be applied to a new database (got %d): %v", len(applied), err)
+	}
+	_, err = os.Stat(dbFilepath + ".v1.bak")
+	if !os.IsNotExist(err) {
+		t.Fatalf("A new database should not have been backed up.")
+	}
+}
@@ -16,7 +16,7 @@ import (
 
 func setupBenchmarkStorage(dbPath string, b *testing.B) (*filefreezer.Storage, *filefreezer.User) {
 	// create an in memory storage
-	store, err := filefreezer.NewStorage(dbPath)
+	store, err := filefreezer.NewStorage(dbPath, "")
 	if err != nil {
 		b.Fatalf("Failed to create the in-memory storage for testing. %v", err)
 	}
@@ -79,12 +79,12 @@ func doBenchFileWrite(dbPath string, chunkSize int, b *testing.B) {
 
 	// loop: create a file with one chunk and upload the chunk
 	for n := 0; n < b.N; n++ {
-		fi, err := store.AddFileInfo(user.ID, fmt.Sprintf("TestFile_%08d.dat", n), false, 0777, modTime, 1, hashString)
+		fi, err := store.AddFileInfo(user.ID, fmt.Sprintf("TestFile_%08d.dat", n), false, 0777, modTime, 1, hashString, filefreezer.HashAlgoSHA1)
 		if err != nil {
 			b.Fatalf("Failed to add a test file for iteration %d: %v", n, err)
 		}
 
-		_, err = store.AddFileChunk(user.ID, fi.FileID, fi.CurrentVersion.VersionID, 0, hashString, randoBytes)
+		_, err = store.AddFileChunk(user.ID, fi.FileID, fi.CurrentVersion.VersionID, 0, hashString, 0, randoBytes)
 		if err != nil {
 			b.Fatalf("Failed to add a test fchunkile for iteration %d: %v", n, err)
 		}
@@ -121,12 +121,12 @@ func doBenchReadChunk(dbPath string, chunkSize int, b *testing.B) {
 	modTime := time.Now().Unix()
 
 	// create a file with one chunk and upload the chunk
-	fi, err := store.AddFileInfo(user.ID, "TestFile_00.dat", false, 0777, modTime, 1, hashString)
+	fi, err := store.AddFileInfo(user.ID, "TestFile_00.dat", false, 0777, modTime, 1, hashString, filefreezer.HashAlgoSHA1)
 	if err != nil {
 		b.Fatalf("Failed to add a test file: %v", err)
 	}
 
-	_, err = store.AddFileChunk(user.ID, fi.FileID, fi.CurrentVersion.VersionID, 0, hashString, randoBytes)
+	_, err = store.AddFileChunk(user.ID, fi.FileID, fi.CurrentVersion.VersionID, 0, hashString, 0, randoBytes)
 	if err != nil {
 		b.Fatalf("Failed to add a test chunk: %v", err)
 	}
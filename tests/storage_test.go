@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"reflect"
 	"sort"
 	"testing"
 	"time"
@@ -39,7 +40,7 @@ func genRandomBytes(length int) []byte {
 
 func TestQuotasAndPermissions(t *testing.T) {
 	// create an in memory storage
-	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared")
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
 	if err != nil {
 		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
 	}
@@ -95,7 +96,7 @@ func TestQuotasAndPermissions(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to get random bytes for test: %v", err)
 	}
-	store.UpdateUserCryptoHash(user.ID, cryptoBytes)
+	store.UpdateUserCryptoHash(user.ID, cryptoBytes, nil)
 
 	// read back the user information and make sure we updated it
 	user, err = store.GetUser("admin")
@@ -107,14 +108,14 @@ func TestQuotasAndPermissions(t *testing.T) {
 	}
 
 	filename := "../storage.go"
-	fileStats, err := filefreezer.CalcFileHashInfo(store.ChunkSize, filename)
+	fileStats, err := filefreezer.CalcFileHashInfo(store.ChunkSize, filename, nil)
 	if err != nil {
 		t.Fatalf("Failed to calculate the file hash data (%s): %v", filename, err)
 	}
 
 	// add the file information to the storage server
 	fi, err := store.AddFileInfo(user.ID, filename, fileStats.IsDir, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, fileStats.HashAlgo)
 	if err != nil {
 		t.Fatalf("Failed to add a new file (%s): %v", filename, err)
 	}
@@ -169,7 +170,7 @@ func TestQuotasAndPermissions(t *testing.T) {
 
 func TestBasicDBCreation(t *testing.T) {
 	// create an in memory storage
-	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared")
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
 	if err != nil {
 		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
 	}
@@ -244,14 +245,14 @@ func TestBasicDBCreation(t *testing.T) {
 
 	// pull up the local file information
 	filename := "../README.md"
-	fileStats, err := filefreezer.CalcFileHashInfo(store.ChunkSize, filename)
+	fileStats, err := filefreezer.CalcFileHashInfo(store.ChunkSize, filename, nil)
 	if err != nil {
 		t.Fatalf("Failed to calculate the file hash for %s: %v", filename, err)
 	}
 
 	// add the file information to the storage server
 	fi, err := store.AddFileInfo(user.ID, filename, fileStats.IsDir, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, fileStats.HashAlgo)
 	if err != nil {
 		t.Fatalf("Failed to add a new file (%s): %v", filename, err)
 	}
@@ -277,7 +278,7 @@ func TestBasicDBCreation(t *testing.T) {
 
 	// add the file information to the storage server again for the rest of the tests
 	_, err = store.AddFileInfo(user.ID, filename, fileStats.IsDir, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, fileStats.HashAlgo)
 	if err != nil {
 		t.Fatalf("Failed to add a new file (%s): %v", filename, err)
 	}
@@ -326,21 +327,21 @@ func TestBasicDBCreation(t *testing.T) {
 
 	// add a second file
 	filename = "../storage.go"
-	fileStats, err = filefreezer.CalcFileHashInfo(store.ChunkSize, filename)
+	fileStats, err = filefreezer.CalcFileHashInfo(store.ChunkSize, filename, nil)
 	if err != nil {
 		t.Fatalf("Failed to calculate the file hash for %s: %v", filename, err)
 	}
 
 	// add the file information to the storage server
 	_, err = store.AddFileInfo(user.ID, filename, fileStats.IsDir, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, fileStats.HashAlgo)
 	if err != nil {
 		t.Fatalf("Failed to add a new file (%s): %v", filename, err)
 	}
 
 	// attempt to add the same file information again, which should fail as a duplicate
 	_, err = store.AddFileInfo(user.ID, filename, fileStats.IsDir, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, fileStats.HashAlgo)
 	if err == nil {
 		t.Fatal("Added a duplicate filename under the same user successuflly when a failure was expected.")
 	}
@@ -417,7 +418,7 @@ func TestBasicDBCreation(t *testing.T) {
 
 	// add the first file back in so that the rests of the tests can continue
 	first, err = store.AddFileInfo(first.UserID, first.FileName, first.IsDir, first.CurrentVersion.Permissions,
-		first.CurrentVersion.LastMod, first.CurrentVersion.ChunkCount, first.CurrentVersion.FileHash)
+		first.CurrentVersion.LastMod, first.CurrentVersion.ChunkCount, first.CurrentVersion.FileHash, first.CurrentVersion.HashAlgo)
 	if err != nil {
 		t.Fatalf("Failed to add a the file again (%s): %v", first.FileName, err)
 	}
@@ -583,7 +584,7 @@ func TestFileVersioning(t *testing.T) {
 	bytesAllocated := 0
 
 	// create an in memory storage
-	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared")
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
 	if err != nil {
 		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
 	}
@@ -613,7 +614,7 @@ func TestFileVersioning(t *testing.T) {
 	defer os.Remove(testFilename1)
 
 	// get the local file information
-	fileStats, err := filefreezer.CalcFileHashInfo(store.ChunkSize, testFilename1)
+	fileStats, err := filefreezer.CalcFileHashInfo(store.ChunkSize, testFilename1, nil)
 	if err != nil {
 		t.Fatalf("Failed to calculate the file hash for %s: %v", testFilename1, err)
 	}
@@ -623,7 +624,7 @@ func TestFileVersioning(t *testing.T) {
 
 	// add the file information to the storage server
 	fi, err := store.AddFileInfo(user.ID, testFilename1, fileStats.IsDir, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, fileStats.HashAlgo)
 	if err != nil {
 		t.Fatalf("Failed to add a new file (%s): %v", testFilename1, err)
 	}
@@ -678,14 +679,14 @@ func TestFileVersioning(t *testing.T) {
 	rando1[2] = 0xBE
 	rando1[3] = 0xEF
 	ioutil.WriteFile(testFilename1, rando1, os.ModePerm)
-	fileStats, err = filefreezer.CalcFileHashInfo(store.ChunkSize, testFilename1)
+	fileStats, err = filefreezer.CalcFileHashInfo(store.ChunkSize, testFilename1, nil)
 	if err != nil {
 		t.Fatalf("Failed to calculate the file hash for %s: %v", testFilename1, err)
 	}
 
 	// register a new version of the file in storage with the updated local information
 	fiV2, err := store.TagNewFileVersion(user.ID, fi.FileID, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, fileStats.HashAlgo)
 	if err != nil {
 		t.Fatalf("Failed to tag a new file version for %s: %v", testFilename1, err)
 	}
@@ -723,8 +724,9 @@ func TestFileVersioning(t *testing.T) {
 		t.Fatalf("Expected to get two file versions for the test file but received %d.", len(versions))
 	}
 
-	// make sure the user quota updated correctly
-	bytesAllocated += len(rando1)
+	// make sure the user quota updated correctly; only the first chunk changed
+	// so the other two are reused from the first version
+	bytesAllocated += int(store.ChunkSize)
 	userStats, err = store.GetUserStats(user.ID)
 	if err != nil {
 		t.Fatalf("Failed to get the user stats for the test user: %v", err)
@@ -737,14 +739,14 @@ func TestFileVersioning(t *testing.T) {
 	// modify all existing chunks and upload a new version
 	rando1 = genRandomBytes(int(store.ChunkSize) * 3)
 	ioutil.WriteFile(testFilename1, rando1, os.ModePerm)
-	fileStats, err = filefreezer.CalcFileHashInfo(store.ChunkSize, testFilename1)
+	fileStats, err = filefreezer.CalcFileHashInfo(store.ChunkSize, testFilename1, nil)
 	if err != nil {
 		t.Fatalf("Failed to calculate the file hash for %s: %v", testFilename1, err)
 	}
 
 	// register a new version of the file in storage with the updated local information
 	fiV3, err := store.TagNewFileVersion(user.ID, fiV2.FileID, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, fileStats.HashAlgo)
 	if err != nil {
 		t.Fatalf("Failed to tag a new file version for %s: %v", testFilename1, err)
 	}
@@ -796,14 +798,14 @@ func TestFileVersioning(t *testing.T) {
 	// make a larger file and upload a new version
 	rando1 = genRandomBytes(int(store.ChunkSize) * 6)
 	ioutil.WriteFile(testFilename1, rando1, os.ModePerm)
-	fileStats, err = filefreezer.CalcFileHashInfo(store.ChunkSize, testFilename1)
+	fileStats, err = filefreezer.CalcFileHashInfo(store.ChunkSize, testFilename1, nil)
 	if err != nil {
 		t.Fatalf("Failed to calculate the file hash for %s: %v", testFilename1, err)
 	}
 
 	// register a new version of the file in storage with the updated local information
 	fiV4, err := store.TagNewFileVersion(user.ID, fiV3.FileID, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, fileStats.HashAlgo)
 	if err != nil {
 		t.Fatalf("Failed to tag a new file version for %s: %v", testFilename1, err)
 	}
@@ -855,14 +857,14 @@ func TestFileVersioning(t *testing.T) {
 	// make the file smaller and upload a new version
 	rando1 = rando1[:(int(store.ChunkSize)*2)-1]
 	ioutil.WriteFile(testFilename1, rando1, os.ModePerm)
-	fileStats, err = filefreezer.CalcFileHashInfo(store.ChunkSize, testFilename1)
+	fileStats, err = filefreezer.CalcFileHashInfo(store.ChunkSize, testFilename1, nil)
 	if err != nil {
 		t.Fatalf("Failed to calculate the file hash for %s: %v", testFilename1, err)
 	}
 
 	// register a new version of the file in storage with the updated local information
 	fiV5, err := store.TagNewFileVersion(user.ID, fiV4.FileID, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, fileStats.HashAlgo)
 	if err != nil {
 		t.Fatalf("Failed to tag a new file version for %s: %v", testFilename1, err)
 	}
@@ -900,8 +902,9 @@ func TestFileVersioning(t *testing.T) {
 		t.Fatalf("Expected to get five file versions for the test file but received %d.", len(versions))
 	}
 
-	// make sure the user quota updated correctly
-	bytesAllocated += len(rando1)
+	// make sure the user quota updated correctly; the first chunk is the
+	// same as the previous version so only the second chunk is new
+	bytesAllocated += len(rando1) - int(store.ChunkSize)
 	userStats, err = store.GetUserStats(user.ID)
 	if err != nil {
 		t.Fatalf("Failed to get the user stats for the test user: %v", err)
@@ -913,7 +916,7 @@ func TestFileVersioning(t *testing.T) {
 
 func TestVersionRemoval(t *testing.T) {
 	// create an in memory storage
-	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared")
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
 	if err != nil {
 		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
 	}
@@ -1011,8 +1014,896 @@ func TestVersionRemoval(t *testing.T) {
 	}
 }
 
+func TestChunkDeduplication(t *testing.T) {
+	// create an in memory storage
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
+	if err != nil {
+		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
+	}
+	defer store.Close()
+
+	// setup the tables in test database
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+	setupTestUser(store, "admin", "hamster", t)
+	user, err := store.GetUser("admin")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+
+	// upload a random file
+	testChunkCount := 3
+	testFilename := "random_dedup.dat"
+	first := addNewRandomFile(store, user, testFilename, testChunkCount, t)
+	defer os.Remove(testFilename)
+
+	userStats, err := store.GetUserStats(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	expectedAllocation := int(store.ChunkSize) * testChunkCount
+	if userStats.Allocated != expectedAllocation {
+		t.Fatalf("Expected %d bytes allocated but the storage returned %d.", expectedAllocation, userStats.Allocated)
+	}
+
+	// uploading a new version with the same chunks shouldn't use more space
+	fiV2, err := store.TagNewFileVersion(user.ID, first.FileID, first.CurrentVersion.Permissions,
+		first.CurrentVersion.LastMod, first.CurrentVersion.ChunkCount, first.CurrentVersion.FileHash, first.CurrentVersion.HashAlgo)
+	if err != nil {
+		t.Fatalf("Failed to tag a new file version: %v", err)
+	}
+	err = addMissingFileChunks(store, fiV2)
+	if err != nil {
+		t.Fatalf("Failed to add the file chunks for the new version: %v", err)
+	}
+	userStats, err = store.GetUserStats(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	if userStats.Allocated != expectedAllocation {
+		t.Fatalf("Expected %d bytes allocated after adding duplicate chunks but the storage returned %d.", expectedAllocation, userStats.Allocated)
+	}
+
+	// add a second file that reuses the chunks of the first without sending the bytes
+	second, err := store.AddFileInfo(user.ID, "random_dedup_copy.dat", false, first.CurrentVersion.Permissions,
+		first.CurrentVersion.LastMod, first.CurrentVersion.ChunkCount, first.CurrentVersion.FileHash, first.CurrentVersion.HashAlgo)
+	if err != nil {
+		t.Fatalf("Failed to add the second file: %v", err)
+	}
+	firstChunks, err := store.GetFileChunkInfos(user.ID, first.FileID, fiV2.CurrentVersion.VersionID)
+	if err != nil {
+		t.Fatalf("Failed to get the chunk infos for the first file: %v", err)
+	}
+	reused, err := store.ReuseFileChunks(user.ID, second.FileID, second.CurrentVersion.VersionID, firstChunks)
+	if err != nil {
+		t.Fatalf("Failed to reuse the chunks for the second file: %v", err)
+	}
+	if len(reused) != testChunkCount {
+		t.Fatalf("Expected %d chunks to be reused but %d were.", testChunkCount, len(reused))
+	}
+	miaList, err := store.GetMissingChunkNumbersForFile(user.ID, second.FileID)
+	if err != nil || len(miaList) != 0 {
+		t.Fatalf("Missing chunks were found for the second file after reusing the chunks: %v", err)
+	}
+
+	// unknown chunk hashes should not get reused
+	reused, err = store.ReuseFileChunks(user.ID, second.FileID, second.CurrentVersion.VersionID,
+		[]filefreezer.FileChunk{{ChunkNumber: 0, ChunkHash: "not-a-known-hash"}})
+	if err != nil || len(reused) != 0 {
+		t.Fatalf("Reusing an unknown chunk hash should not have added a chunk (%d): %v", len(reused), err)
+	}
+
+	// the user should still only be charged for the chunks once
+	userStats, err = store.GetUserStats(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	if userStats.Allocated != expectedAllocation {
+		t.Fatalf("Expected %d bytes allocated after reusing chunks but the storage returned %d.", expectedAllocation, userStats.Allocated)
+	}
+
+	// removing the first file should keep the chunks the second file uses
+	err = store.RemoveFile(user.ID, first.FileID)
+	if err != nil {
+		t.Fatalf("Failed to remove the first file: %v", err)
+	}
+	userStats, err = store.GetUserStats(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	if userStats.Allocated != expectedAllocation {
+		t.Fatalf("Expected %d bytes allocated after removing the first file but the storage returned %d.", expectedAllocation, userStats.Allocated)
+	}
+
+	localBytes, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatalf("Failed to read the test file: %v", err)
+	}
+	for i := 0; i < testChunkCount; i++ {
+		chunk, err := store.GetFileChunk(second.FileID, i, second.CurrentVersion.VersionID)
+		if err != nil {
+			t.Fatalf("Failed to get chunk %d for the second file: %v", i, err)
+		}
+		start := int64(i) * store.ChunkSize
+		if bytes.Compare(chunk.Chunk, localBytes[start:start+store.ChunkSize]) != 0 {
+			t.Fatalf("Chunk %d of the second file did not match the original bytes.", i)
+		}
+	}
+
+	// removing the last file referencing the chunks frees them
+	err = store.RemoveFile(user.ID, second.FileID)
+	if err != nil {
+		t.Fatalf("Failed to remove the second file: %v", err)
+	}
+	userStats, err = store.GetUserStats(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	if userStats.Allocated != 0 {
+		t.Fatalf("Expected no bytes allocated after removing both files but the storage returned %d.", userStats.Allocated)
+	}
+}
+
 // split the testing process of adding a user into a separate functions so that
 // it's easier to add multiple users.
+func TestUserAdmin(t *testing.T) {
+	// create an in memory storage
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
+	if err != nil {
+		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
+	}
+	defer store.Close()
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+	setupTestUser(store, "zed", "hamster", t)
+	setupTestUser(store, "amy", "hamster", t)
+
+	// new users are not admins
+	zed, err := store.GetUser("zed")
+	if err != nil || zed.IsAdmin {
+		t.Fatalf("Expected a new user to not be an admin: %v", err)
+	}
+
+	err = store.SetUserAdmin(zed.ID, true)
+	if err != nil {
+		t.Fatalf("Failed to make the user an admin: %v", err)
+	}
+	byID, err := store.GetUserByID(zed.ID)
+	if err != nil || byID.Name != "zed" || !byID.IsAdmin || byID.Salt != zed.Salt {
+		t.Fatalf("Failed to get the admin user by id: %v", err)
+	}
+	err = store.SetUserAdmin(zed.ID+100, true)
+	if err == nil {
+		t.Fatalf("Setting the admin flag for a user that doesn't exist should have failed.")
+	}
+
+	// the users are listed by name with their admin flag
+	users, err := store.GetAllUsers()
+	if err != nil || len(users) != 2 {
+		t.Fatalf("Expected to get 2 users (got %d): %v", len(users), err)
+	}
+	if users[0].Name != "amy" || users[0].IsAdmin || users[1].Name != "zed" || !users[1].IsAdmin {
+		t.Fatalf("The users were not listed as expected: %+v", users)
+	}
+	if users[1].SaltedHash != nil || users[1].CryptoHash != nil {
+		t.Fatalf("The password hashes should not be listed with the users.")
+	}
+
+	err = store.SetUserAdmin(zed.ID, false)
+	if err != nil {
+		t.Fatalf("Failed to revoke the admin rights of the user: %v", err)
+	}
+	zed, err = store.GetUser("zed")
+	if err != nil || zed.IsAdmin {
+		t.Fatalf("Expected the user to no longer be an admin: %v", err)
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	// create an in memory storage
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
+	if err != nil {
+		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
+	}
+	defer store.Close()
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+	setupTestUser(store, "refresher", "hamster", t)
+	user, err := store.GetUser("refresher")
+	if err != nil {
+		t.Fatalf("Failed to get the test user: %v", err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	err = store.AddRefreshToken(user.ID, "token1", expiresAt)
+	if err == nil {
+		err = store.AddRefreshToken(user.ID, "token2", expiresAt)
+	}
+	if err != nil {
+		t.Fatalf("Failed to add the refresh tokens: %v", err)
+	}
+
+	// a refresh token can be used once
+	userID, username, err := store.UseRefreshToken("token1")
+	if err != nil || userID != user.ID || username != user.Name {
+		t.Fatalf("Failed to use the refresh token (user id %d, name %s): %v", userID, username, err)
+	}
+	_, _, err = store.UseRefreshToken("unknown")
+	if err == nil {
+		t.Fatalf("Using an unknown refresh token should have failed.")
+	}
+
+	// and using it again revokes the rest of the refresh tokens for the user
+	_, _, err = store.UseRefreshToken("token1")
+	if err == nil {
+		t.Fatalf("Using a refresh token twice should have failed.")
+	}
+	_, _, err = store.UseRefreshToken("token2")
+	if err == nil {
+		t.Fatalf("The refresh tokens for the user should have been revoked after one was reused.")
+	}
+
+	// expired refresh tokens can't be used
+	err = store.AddRefreshToken(user.ID, "expired", time.Now().Add(-time.Second).Unix())
+	if err != nil {
+		t.Fatalf("Failed to add the expired refresh token: %v", err)
+	}
+	_, _, err = store.UseRefreshToken("expired")
+	if err == nil {
+		t.Fatalf("Using an expired refresh token should have failed.")
+	}
+
+	// removing the user removes their refresh tokens
+	err = store.AddRefreshToken(user.ID, "token3", expiresAt)
+	if err != nil {
+		t.Fatalf("Failed to add the refresh token: %v", err)
+	}
+	err = store.RemoveUser(user.Name)
+	if err != nil {
+		t.Fatalf("Failed to remove the test user: %v", err)
+	}
+	_, _, err = store.UseRefreshToken("token3")
+	if err == nil {
+		t.Fatalf("The refresh token should have been removed with the user.")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	// create an in memory storage
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
+	if err != nil {
+		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
+	}
+	defer store.Close()
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+
+	records := []filefreezer.AuditRecord{
+		{Time: 100, UserID: 1, Username: "amy", Event: filefreezer.AuditLoginLockout, RemoteAddr: "10.0.0.1", Detail: "first"},
+		{Time: 200, UserID: 0, Username: "nobody", Event: filefreezer.AuditLoginLockout, RemoteAddr: "10.0.0.2", Detail: "second"},
+		{Time: 300, UserID: 1, Username: "amy", Event: filefreezer.AuditLoginLockout, RemoteAddr: "10.0.0.1", Detail: "third"},
+	}
+	for i := range records {
+		err = store.AddAuditRecord(&records[i])
+		if err != nil || records[i].ID == 0 {
+			t.Fatalf("Failed to add the audit record: %v", err)
+		}
+	}
+	now := filefreezer.AuditRecord{Username: "amy", Event: filefreezer.AuditLoginLockout}
+	err = store.AddAuditRecord(&now)
+	if err != nil || now.Time < time.Now().Add(-time.Minute).Unix() {
+		t.Fatalf("Expected the audit record without a time to be recorded at the current time: %v", err)
+	}
+
+	// the records can be filtered by username and time range
+	all, err := store.GetAuditRecords("", 0, 0)
+	if err != nil || len(all) != 4 || all[0] != records[0] || all[3] != now {
+		t.Fatalf("Failed to get all of the audit records in order: %v", err)
+	}
+	amys, err := store.GetAuditRecords("amy", 0, 0)
+	if err != nil || len(amys) != 3 {
+		t.Fatalf("Expected 3 audit records for the user (got %d): %v", len(amys), err)
+	}
+	ranged, err := store.GetAuditRecords("", 150, 300)
+	if err != nil || len(ranged) != 2 || ranged[0].Detail != "second" || ranged[1].Detail != "third" {
+		t.Fatalf("Failed to get the audit records in the time range: %v %+v", err, ranged)
+	}
+	both, err := store.GetAuditRecords("amy", 150, 300)
+	if err != nil || len(both) != 1 || both[0] != records[2] {
+		t.Fatalf("Failed to get the audit records for the user in the time range: %v %+v", err, both)
+	}
+}
+
+func TestFileChanges(t *testing.T) {
+	// create an in memory storage
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
+	if err != nil {
+		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
+	}
+	defer store.Close()
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+
+	setupTestUser(store, "admin", "hamster", t)
+	user, err := store.GetUser("admin")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+
+	// the observer sees every committed change
+	var observed []filefreezer.FileChange
+	store.ChangeObserver = func(userID int, change filefreezer.FileChange) {
+		if userID != user.ID {
+			t.Fatalf("The change was observed for the wrong user id %d.", userID)
+		}
+		observed = append(observed, change)
+	}
+
+	// there are no changes since the current revision
+	userStats, err := store.GetUserStats(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	start := userStats.Revision
+	changes, revision, complete, err := store.GetFileChanges(user.ID, start)
+	if err != nil || revision != start || !complete || len(changes) != 0 {
+		t.Fatalf("Expected no changes since the current revision (revision %d, complete %v): %v", revision, complete, err)
+	}
+
+	// every mutation bumps the revision once and is journaled
+	fi, err := store.AddFileInfo(user.ID, "changes.dat", false, 0644, 1, 1, "hash1", filefreezer.HashAlgoHMACSHA256)
+	if err != nil {
+		t.Fatalf("Failed to add the file: %v", err)
+	}
+	_, err = store.AddFileChunk(user.ID, fi.FileID, fi.CurrentVersion.VersionID, 0, "chunk1", 0, []byte("chunk one"))
+	if err != nil {
+		t.Fatalf("Failed to add the file chunk: %v", err)
+	}
+	fi2, err := store.TagNewFileVersion(user.ID, fi.FileID, 0644, 2, 1, "hash2", filefreezer.HashAlgoHMACSHA256)
+	if err != nil {
+		t.Fatalf("Failed to tag a new file version: %v", err)
+	}
+	reused, err := store.ReuseFileChunks(user.ID, fi.FileID, fi2.CurrentVersion.VersionID, []filefreezer.FileChunk{{ChunkNumber: 0, ChunkHash: "chunk1"}})
+	if err != nil || len(reused) != 1 {
+		t.Fatalf("Failed to reuse the file chunk: %v", err)
+	}
+	removed, err := store.RemoveFileChunk(user.ID, fi.FileID, fi.CurrentVersion.VersionID, 0)
+	if err != nil || !removed {
+		t.Fatalf("Failed to remove the file chunk: %v", err)
+	}
+	err = store.RemoveFileVersions(user.ID, fi.FileID, 1, 1)
+	if err != nil {
+		t.Fatalf("Failed to remove the first file version: %v", err)
+	}
+	other, err := store.AddFileInfo(user.ID, "other.dat", false, 0644, 1, 0, "hash3", filefreezer.HashAlgoHMACSHA256)
+	if err != nil {
+		t.Fatalf("Failed to add the other file: %v", err)
+	}
+	err = store.RemoveFile(user.ID, fi.FileID)
+	if err != nil {
+		t.Fatalf("Failed to remove the file: %v", err)
+	}
+	_, err = store.AddFileInfo(user.ID, "other.dat", false, 0644, 1, 0, "hash3", filefreezer.HashAlgoHMACSHA256)
+	if err == nil {
+		t.Fatalf("Adding a duplicate file should have failed.")
+	}
+
+	expected := []struct {
+		fileID int
+		change string
+	}{
+		{fi.FileID, filefreezer.ChangeFileAdd},
+		{fi.FileID, filefreezer.ChangeChunkAdd},
+		{fi.FileID, filefreezer.ChangeVersionAdd},
+		{fi.FileID, filefreezer.ChangeChunkAdd},
+		{fi.FileID, filefreezer.ChangeChunkRemove},
+		{fi.FileID, filefreezer.ChangeVersionRemove},
+		{other.FileID, filefreezer.ChangeFileAdd},
+		{fi.FileID, filefreezer.ChangeFileRemove},
+	}
+	changes, revision, complete, err = store.GetFileChanges(user.ID, start)
+	if err != nil || !complete || revision != start+len(expected) || len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes (got %d at revision %d): %v", len(expected), len(changes), revision, err)
+	}
+	for i, c := range changes {
+		if c.Revision != start+i+1 || c.FileID != expected[i].fileID || c.Change != expected[i].change {
+			t.Fatalf("Change %d didn't match what was expected: %+v", i, c)
+		}
+	}
+	if !reflect.DeepEqual(observed, changes) {
+		t.Fatalf("The observed changes didn't match the journal:\n%+v\n%+v", observed, changes)
+	}
+	userStats, err = store.GetUserStats(user.ID)
+	if err != nil || userStats.Revision != revision || userStats.Allocated != 0 {
+		t.Fatalf("Expected the user stats to be at revision %d with nothing allocated: %v %+v", revision, err, userStats)
+	}
+
+	// only the changes after the revision given are returned
+	changes, _, complete, err = store.GetFileChanges(user.ID, revision-2)
+	if err != nil || !complete || len(changes) != 2 || changes[0].FileID != other.FileID {
+		t.Fatalf("Failed to get the last two changes: %v %+v", err, changes)
+	}
+	changes, _, complete, err = store.GetFileChanges(user.ID, revision)
+	if err != nil || !complete || len(changes) != 0 {
+		t.Fatalf("Expected no changes since the current revision: %v", err)
+	}
+
+	// a revision the journal doesn't know about means the client has to start over
+	_, _, complete, err = store.GetFileChanges(user.ID, revision+5)
+	if err != nil || complete {
+		t.Fatalf("Expected the changes since a future revision to be incomplete: %v", err)
+	}
+	_, _, complete, err = store.GetFileChanges(user.ID, start-1)
+	if err != nil || complete {
+		t.Fatalf("Expected the changes since a revision from before the journal to be incomplete: %v", err)
+	}
+	_, _, complete, err = store.GetFileChanges(user.ID, -1)
+	if err != nil || complete {
+		t.Fatalf("Expected the changes since a negative revision to be incomplete: %v", err)
+	}
+
+	// changes older than the retention are pruned as new changes are recorded
+	if store.ChangeRetention != filefreezer.DefaultChangeRetention {
+		t.Fatalf("Expected the storage to keep changes for the default retention (got %v).", store.ChangeRetention)
+	}
+	store.ChangeRetention = time.Second
+	time.Sleep(2100 * time.Millisecond)
+	_, err = store.AddFileInfo(user.ID, "pruned.dat", false, 0644, 1, 0, "hash4", filefreezer.HashAlgoHMACSHA256)
+	if err != nil {
+		t.Fatalf("Failed to add the file after the retention passed: %v", err)
+	}
+	changes, _, complete, err = store.GetFileChanges(user.ID, revision)
+	if err != nil || !complete || len(changes) != 1 || changes[0].Change != filefreezer.ChangeFileAdd {
+		t.Fatalf("Expected the new change to be kept in the journal: %v %+v", err, changes)
+	}
+	_, _, complete, err = store.GetFileChanges(user.ID, start)
+	if err != nil || complete {
+		t.Fatalf("Expected the changes since a pruned revision to be incomplete: %v", err)
+	}
+
+	// a revision bumped without a journaled change leaves a gap the client can't skip
+	userStats, err = store.GetUserStats(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	beforeGap := userStats.Revision
+	err = store.UpdateUserStats(user.ID, 0)
+	if err != nil {
+		t.Fatalf("Failed to bump the revision: %v", err)
+	}
+	_, err = store.AddFileInfo(user.ID, "gap.dat", false, 0644, 1, 0, "hash5", filefreezer.HashAlgoHMACSHA256)
+	if err != nil {
+		t.Fatalf("Failed to add the file after the gap: %v", err)
+	}
+	_, _, complete, err = store.GetFileChanges(user.ID, beforeGap-1)
+	if err != nil || complete {
+		t.Fatalf("Expected the changes across the gap to be incomplete: %v", err)
+	}
+	changes, _, complete, err = store.GetFileChanges(user.ID, beforeGap+1)
+	if err != nil || !complete || len(changes) != 1 {
+		t.Fatalf("Expected the change after the gap to be complete: %v %+v", err, changes)
+	}
+}
+
+func TestUploadSessions(t *testing.T) {
+	// create an in memory storage
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
+	if err != nil {
+		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
+	}
+	defer store.Close()
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+
+	setupTestUser(store, "admin", "hamster", t)
+	user, err := store.GetUser("admin")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+	err = store.SetUserQuota(user.ID, 1000)
+	if err != nil {
+		t.Fatalf("Failed to set the user quota: %v", err)
+	}
+	newVersion := func(hash string, chunkCount int) filefreezer.FileVersionInfo {
+		return filefreezer.FileVersionInfo{Permissions: 0644, LastMod: 1, ChunkCount: chunkCount,
+			FileHash: hash, HashAlgo: filefreezer.HashAlgoHMACSHA256}
+	}
+
+	// a new file is current right away since it has no other version to show
+	sess, err := store.StartUploadSession(user.ID, 0, "upload.dat", false, newVersion("hash1", 1), 100, time.Hour)
+	if err != nil || sess.SessionID == "" || !reflect.DeepEqual(sess.MissingChunks, []int{0}) {
+		t.Fatalf("Failed to start the upload of a new file (%+v): %v", sess, err)
+	}
+	fileID := sess.FileID
+	fi, err := store.GetFileInfo(user.ID, fileID)
+	if err != nil || fi.CurrentVersion.VersionID != sess.Version.VersionID || fi.CurrentVersion.Committed {
+		t.Fatalf("The new file should have the pending uploading version (%+v): %v", fi, err)
+	}
+	_, err = store.AddFileChunk(user.ID, fileID, sess.Version.VersionID, 0, "chunk1", 0, []byte("chunk one"))
+	if err != nil {
+		t.Fatalf("Failed to add the file chunk: %v", err)
+	}
+	_, err = store.GetUploadSession(user.ID, sess.SessionID)
+	if err != nil {
+		t.Fatalf("The upload session should last until the version is committed: %v", err)
+	}
+	err = store.CommitFileVersion(user.ID, fileID, sess.Version.VersionID, 1, "hash1")
+	if err != nil {
+		t.Fatalf("Failed to commit the uploaded version: %v", err)
+	}
+	_, err = store.GetUploadSession(user.ID, sess.SessionID)
+	if err == nil {
+		t.Fatalf("The upload session should have finished once the version was committed.")
+	}
+
+	// a new version doesn't become current until all of its chunks arrive
+	sess, err = store.StartUploadSession(user.ID, fileID, "", false, newVersion("hash2", 2), 100, time.Hour)
+	if err != nil || sess.Resumed || sess.Version.VersionNumber != 2 || !reflect.DeepEqual(sess.MissingChunks, []int{0, 1}) {
+		t.Fatalf("Failed to start the upload of a new version (%+v): %v", sess, err)
+	}
+	_, err = store.AddFileChunk(user.ID, fileID, sess.Version.VersionID, 0, "chunk2", 0, []byte("chunk two"))
+	if err != nil {
+		t.Fatalf("Failed to add the file chunk: %v", err)
+	}
+	fi, err = store.GetFileInfo(user.ID, fileID)
+	if err != nil || fi.CurrentVersion.VersionNumber != 1 {
+		t.Fatalf("The unfinished version should not be current (%+v): %v", fi, err)
+	}
+
+	// the space reserved by the upload isn't free for others
+	_, err = store.StartUploadSession(user.ID, 0, "big.dat", false, newVersion("hash3", 1), 900, time.Hour)
+	if err == nil {
+		t.Fatalf("Starting an upload larger than the free quota less the reserved space should have failed.")
+	}
+	_, err = store.GetFileInfoByName(user.ID, "big.dat")
+	if err == nil {
+		t.Fatalf("The file of the failed upload should not have been registered.")
+	}
+
+	// starting the upload of the same contents again resumes it with the missing chunks
+	resumed, err := store.StartUploadSession(user.ID, fileID, "", false, newVersion("hash2", 2), 100, time.Hour)
+	if err != nil || !resumed.Resumed || resumed.SessionID != sess.SessionID ||
+		resumed.Version.VersionID != sess.Version.VersionID || !reflect.DeepEqual(resumed.MissingChunks, []int{1}) {
+		t.Fatalf("Failed to resume the upload (%+v): %v", resumed, err)
+	}
+	current, err := store.GetUploadSession(user.ID, sess.SessionID)
+	if err != nil || current.Received != len("chunk two") || !reflect.DeepEqual(current.MissingChunks, []int{1}) {
+		t.Fatalf("The upload session should track the chunks received (%+v): %v", current, err)
+	}
+	_, err = store.GetUploadSession(user.ID+1, sess.SessionID)
+	if err == nil {
+		t.Fatalf("Getting another user's upload session should have failed.")
+	}
+	reused, err := store.ReuseFileChunks(user.ID, fileID, sess.Version.VersionID, []filefreezer.FileChunk{{ChunkNumber: 1, ChunkHash: "chunk1"}})
+	if err != nil || len(reused) != 1 {
+		t.Fatalf("Failed to reuse the file chunk: %v", err)
+	}
+	fi, err = store.GetFileInfo(user.ID, fileID)
+	if err != nil || fi.CurrentVersion.VersionNumber != 1 {
+		t.Fatalf("The version should not be current until it's committed (%+v): %v", fi, err)
+	}
+	err = store.CommitFileVersion(user.ID, fileID, sess.Version.VersionID, 2, "hash2")
+	if err != nil {
+		t.Fatalf("Failed to commit the uploaded version: %v", err)
+	}
+	fi, err = store.GetFileInfo(user.ID, fileID)
+	if err != nil || fi.CurrentVersion.VersionID != sess.Version.VersionID || !fi.CurrentVersion.Committed {
+		t.Fatalf("The version should be current once it's committed (%+v): %v", fi, err)
+	}
+
+	// chunks can't be added to a version of another file
+	_, err = store.AddFileChunk(user.ID, fileID, sess.Version.VersionID+100, 0, "chunk3", 0, []byte("chunk three"))
+	if err == nil {
+		t.Fatalf("Adding a chunk to a version that doesn't exist should have failed.")
+	}
+
+	// uploading different contents replaces the unfinished upload and removes its version
+	abandoned, err := store.StartUploadSession(user.ID, fileID, "", false, newVersion("hash4", 2), 100, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to start the upload of a new version: %v", err)
+	}
+	_, err = store.AddFileChunk(user.ID, fileID, abandoned.Version.VersionID, 0, "chunk4", 0, []byte("chunk four"))
+	if err != nil {
+		t.Fatalf("Failed to add the file chunk: %v", err)
+	}
+	replacement, err := store.StartUploadSession(user.ID, fileID, "", false, newVersion("hash5", 1), 100, time.Hour)
+	if err != nil || replacement.Resumed || replacement.Version.VersionNumber != 4 {
+		t.Fatalf("Failed to start the replacement upload (%+v): %v", replacement, err)
+	}
+	versions, err := store.GetFileVersions(fileID)
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("Expected the abandoned version to be removed (%+v): %v", versions, err)
+	}
+	for _, v := range versions {
+		if v.VersionID == abandoned.Version.VersionID {
+			t.Fatalf("The abandoned version was not removed.")
+		}
+	}
+	userStats, err := store.GetUserStats(user.ID)
+	if err != nil || userStats.Allocated != len("chunk one")+len("chunk two") {
+		t.Fatalf("The chunks of the abandoned version should have been freed (%+v): %v", userStats, err)
+	}
+
+	// cancelling an upload removes its version but keeps the current one
+	err = store.CancelUploadSession(user.ID, replacement.SessionID)
+	if err != nil {
+		t.Fatalf("Failed to cancel the upload: %v", err)
+	}
+	fi, err = store.GetFileInfo(user.ID, fileID)
+	if err != nil || fi.CurrentVersion.VersionID != sess.Version.VersionID {
+		t.Fatalf("Cancelling the upload should have kept the current version (%+v): %v", fi, err)
+	}
+
+	// a new file whose upload expires is removed when the next upload starts
+	expired, err := store.StartUploadSession(user.ID, 0, "expired.dat", false, newVersion("hash6", 1), 100, -time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to start the upload of a new file: %v", err)
+	}
+	_, err = store.StartUploadSession(user.ID, 0, "empty.dat", false, newVersion("hash7", 0), 0, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to start the upload of an empty file: %v", err)
+	}
+	_, err = store.GetFileInfoByName(user.ID, "expired.dat")
+	if err == nil {
+		t.Fatalf("The file of the expired upload should have been removed.")
+	}
+	_, err = store.GetUploadSession(user.ID, expired.SessionID)
+	if err == nil {
+		t.Fatalf("The expired upload session should have been removed.")
+	}
+}
+
+func TestChunkLengths(t *testing.T) {
+	// create an in memory storage
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
+	if err != nil {
+		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
+	}
+	defer store.Close()
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+
+	setupTestUser(store, "admin", "hamster", t)
+	user, err := store.GetUser("admin")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+	newVersion := func(hash string, chunking string) filefreezer.FileVersionInfo {
+		return filefreezer.FileVersionInfo{Permissions: 0644, LastMod: 1, ChunkCount: 2,
+			FileHash: hash, HashAlgo: filefreezer.HashAlgoHMACSHA256, Chunking: chunking}
+	}
+
+	// the chunking mode is stored with the version and defaults to fixed size chunks
+	sess, err := store.StartUploadSession(user.ID, 0, "cdc.dat", false, newVersion("hash1", filefreezer.ChunkingFastCDC), 100, time.Hour)
+	if err != nil || sess.Version.Chunking != filefreezer.ChunkingFastCDC {
+		t.Fatalf("Failed to start the upload of a file with content-defined chunks (%+v): %v", sess, err)
+	}
+	fileID := sess.FileID
+	fi, err := store.GetFileInfo(user.ID, fileID)
+	if err != nil || fi.CurrentVersion.Chunking != filefreezer.ChunkingFastCDC {
+		t.Fatalf("The chunking mode of the version was not stored (%+v): %v", fi, err)
+	}
+	fixed, err := store.StartUploadSession(user.ID, 0, "fixed.dat", false, newVersion("hash2", ""), 100, time.Hour)
+	if err != nil || fixed.Version.Chunking != filefreezer.ChunkingFixed {
+		t.Fatalf("Expected the upload to default to fixed size chunks (%+v): %v", fixed, err)
+	}
+
+	// the length of each chunk is kept with the chunk, including reused ones
+	_, err = store.AddFileChunk(user.ID, fileID, sess.Version.VersionID, 0, "chunk1", 9, []byte("encrypted chunk one"))
+	if err != nil {
+		t.Fatalf("Failed to add the file chunk: %v", err)
+	}
+	reused, err := store.ReuseFileChunks(user.ID, fileID, sess.Version.VersionID, []filefreezer.FileChunk{{ChunkNumber: 1, ChunkHash: "chunk1", ChunkLength: 9}})
+	if err != nil || len(reused) != 1 {
+		t.Fatalf("Failed to reuse the file chunk: %v", err)
+	}
+	chunks, err := store.GetFileChunkInfos(user.ID, fileID, sess.Version.VersionID)
+	if err != nil || len(chunks) != 2 || chunks[0].ChunkLength != 9 || chunks[1].ChunkLength != 9 {
+		t.Fatalf("Expected the chunk lengths to be stored with the chunks (%+v): %v", chunks, err)
+	}
+	fc, err := store.GetFileChunk(fileID, 0, sess.Version.VersionID)
+	if err != nil || fc.ChunkLength != 9 || string(fc.Chunk) != "encrypted chunk one" {
+		t.Fatalf("Expected the chunk to have its length (%+v): %v", fc, err)
+	}
+	err = store.CommitFileVersion(user.ID, fileID, sess.Version.VersionID, 2, "hash1")
+	if err != nil {
+		t.Fatalf("Failed to commit the uploaded version: %v", err)
+	}
+
+	// an upload of the same contents chunked another way doesn't resume the first one
+	sess, err = store.StartUploadSession(user.ID, fileID, "", false, newVersion("hash3", filefreezer.ChunkingFastCDC), 100, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to start the upload of a new version: %v", err)
+	}
+	other, err := store.StartUploadSession(user.ID, fileID, "", false, newVersion("hash3", filefreezer.ChunkingFixed), 100, time.Hour)
+	if err != nil || other.Resumed || other.Version.VersionID == sess.Version.VersionID || other.Version.Chunking != filefreezer.ChunkingFixed {
+		t.Fatalf("Expected the upload with other chunks to replace the first one (%+v): %v", other, err)
+	}
+	_, err = store.GetUploadSession(user.ID, sess.SessionID)
+	if err == nil {
+		t.Fatalf("The replaced upload session should have been abandoned.")
+	}
+}
+
+func TestCommitFileVersion(t *testing.T) {
+	// create an in memory storage
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
+	if err != nil {
+		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
+	}
+	defer store.Close()
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+
+	setupTestUser(store, "admin", "hamster", t)
+	user, err := store.GetUser("admin")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+
+	// the first version of a file is pending until it's committed
+	fi, err := store.AddFileInfo(user.ID, "commit.dat", false, 0644, 1, 2, "hash1", filefreezer.HashAlgoHMACSHA256)
+	if err != nil || fi.CurrentVersion.Committed {
+		t.Fatalf("Failed to add the file with a pending version (%+v): %v", fi, err)
+	}
+	v1 := fi.CurrentVersion.VersionID
+	_, err = store.AddFileChunk(user.ID, fi.FileID, v1, 0, "chunk1", 0, []byte("chunk one"))
+	if err != nil {
+		t.Fatalf("Failed to add the file chunk: %v", err)
+	}
+	err = store.CommitFileVersion(user.ID, fi.FileID, v1, 2, "hash1")
+	if err == nil {
+		t.Fatalf("Committing a version that is missing chunks should have failed.")
+	}
+	_, err = store.AddFileChunk(user.ID, fi.FileID, v1, 1, "chunk2", 0, []byte("chunk two"))
+	if err != nil {
+		t.Fatalf("Failed to add the file chunk: %v", err)
+	}
+	err = store.CommitFileVersion(user.ID, fi.FileID, v1, 2, "hash1")
+	if err != nil {
+		t.Fatalf("Failed to commit the first version: %v", err)
+	}
+
+	// a tagged version stays pending and the committed one stays current
+	fiV2, err := store.TagNewFileVersion(user.ID, fi.FileID, 0644, 2, 1, "hash2", filefreezer.HashAlgoHMACSHA256)
+	if err != nil || fiV2.CurrentVersion.Committed {
+		t.Fatalf("Failed to tag a pending version (%+v): %v", fiV2, err)
+	}
+	v2 := fiV2.CurrentVersion.VersionID
+	_, err = store.AddFileChunk(user.ID, fi.FileID, v2, 0, "chunk3", 0, []byte("chunk three"))
+	if err != nil {
+		t.Fatalf("Failed to add the file chunk: %v", err)
+	}
+	current, err := store.GetFileInfo(user.ID, fi.FileID)
+	if err != nil || current.CurrentVersion.VersionID != v1 || !current.CurrentVersion.Committed {
+		t.Fatalf("The last committed version should be current until the new one is committed (%+v): %v", current, err)
+	}
+
+	// the commit has to match the chunk count and hash the version was tagged with
+	err = store.CommitFileVersion(user.ID, fi.FileID, v2, 1, "hash1")
+	if err == nil {
+		t.Fatalf("Committing a version with the wrong file hash should have failed.")
+	}
+	err = store.CommitFileVersion(user.ID, fi.FileID, v2, 2, "hash2")
+	if err == nil {
+		t.Fatalf("Committing a version with the wrong chunk count should have failed.")
+	}
+	err = store.CommitFileVersion(user.ID+1, fi.FileID, v2, 1, "hash2")
+	if err == nil {
+		t.Fatalf("Committing a version of another user's file should have failed.")
+	}
+	err = store.CommitFileVersion(user.ID, fi.FileID+1, v2, 1, "hash2")
+	if err == nil {
+		t.Fatalf("Committing a version of another file should have failed.")
+	}
+
+	// a version that is committed after a newer one doesn't become current
+	fiV3, err := store.TagNewFileVersion(user.ID, fi.FileID, 0644, 3, 1, "hash3", filefreezer.HashAlgoHMACSHA256)
+	if err != nil {
+		t.Fatalf("Failed to tag a pending version: %v", err)
+	}
+	v3 := fiV3.CurrentVersion.VersionID
+	_, err = store.AddFileChunk(user.ID, fi.FileID, v3, 0, "chunk4", 0, []byte("chunk four"))
+	if err != nil {
+		t.Fatalf("Failed to add the file chunk: %v", err)
+	}
+	err = store.CommitFileVersion(user.ID, fi.FileID, v3, 1, "hash3")
+	if err != nil {
+		t.Fatalf("Failed to commit the third version: %v", err)
+	}
+	err = store.CommitFileVersion(user.ID, fi.FileID, v2, 1, "hash2")
+	if err != nil {
+		t.Fatalf("Failed to commit the second version: %v", err)
+	}
+	current, err = store.GetFileInfo(user.ID, fi.FileID)
+	if err != nil || current.CurrentVersion.VersionID != v3 {
+		t.Fatalf("The newest committed version should be current (%+v): %v", current, err)
+	}
+	versions, err := store.GetFileVersions(fi.FileID)
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("Failed to get the file versions (%+v): %v", versions, err)
+	}
+	for _, v := range versions {
+		if !v.Committed {
+			t.Fatalf("Every version should be committed: %+v", versions)
+		}
+	}
+
+	// committing a version again is harmless
+	err = store.CommitFileVersion(user.ID, fi.FileID, v2, 1, "hash2")
+	if err != nil {
+		t.Fatalf("Committing a version again should not fail: %v", err)
+	}
+}
+
+func TestStorageTotals(t *testing.T) {
+	// create an in memory storage
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared", "")
+	if err != nil {
+		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
+	}
+	defer store.Close()
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+	store.ChunkSize = 1024
+
+	// record the storage operations as they finish
+	observed := make(map[string]int)
+	store.TransactionObserver = func(op string, elapsed time.Duration, err error) {
+		if err == nil && elapsed > 0 {
+			observed[op]++
+		}
+	}
+
+	setupTestUser(store, "admin", "hamster", t)
+	setupTestUser(store, "other", "hamster", t)
+	user, err := store.GetUser("admin")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+	testFilename := "random_totals.dat"
+	addNewRandomFile(store, user, testFilename, 3, t)
+	addNewRandomFile(store, user, testFilename, 2, t)
+	defer os.Remove(testFilename)
+
+	if observed["AddFileInfo"] != 1 || observed["TagNewFileVersion"] != 1 || observed["AddFileChunk"] != 5 {
+		t.Fatalf("The storage operations were not observed as expected: %v", observed)
+	}
+
+	totals, err := store.GetTotals()
+	if err != nil {
+		t.Fatalf("Failed to get the storage totals: %v", err)
+	}
+	if totals.Users != 2 || totals.Files != 1 || totals.Versions != 2 || totals.Allocated != 5*1024 {
+		t.Fatalf("The storage totals were not as expected: %+v", totals)
+	}
+	allStats, err := store.GetAllUserStats()
+	if err != nil || len(allStats) != 2 {
+		t.Fatalf("Failed to get the stats for all of the users: %v", err)
+	}
+	if allStats["admin"].Allocated != 5*1024 || allStats["other"].Allocated != 0 || allStats["other"].Quota != 1e9 {
+		t.Fatalf("The user stats were not as expected: %+v", allStats)
+	}
+}
+
 func setupTestUser(store *filefreezer.Storage, username string, password string, t *testing.T) {
 	// attempt to add a user
 	salt, saltedPass, err := filefreezer.GenLoginPasswordHash(password)
@@ -1146,7 +2037,7 @@ func addMissingFileChunks(store *filefreezer.Storage, fi *filefreezer.FileInfo)
 			}
 
 			// send the data to the store
-			newChunk, err := store.AddFileChunk(fi.UserID, fi.FileID, fi.CurrentVersion.VersionID, i, chunkHash, clampedBuffer)
+			newChunk, err := store.AddFileChunk(fi.UserID, fi.FileID, fi.CurrentVersion.VersionID, i, chunkHash, 0, clampedBuffer)
 			if err != nil {
 				return fmt.Errorf("Failed to add the chunk to storage for file %s: %v", fi.FileName, err)
 			}
@@ -1165,8 +2056,10 @@ func addMissingFileChunks(store *filefreezer.Storage, fi *filefreezer.FileInfo)
 			}
 
 			// this should hold true because this database isn't getting hit by other
-			// requests which could update this between transactions.
-			if end.Allocated-start.Allocated != len(clampedBuffer) && end.Revision-start.Revision == 1 {
+			// requests which could update this between transactions. chunks that are
+			// already stored for the user don't get charged again.
+			allocDelta := end.Allocated - start.Allocated
+			if allocDelta != len(clampedBuffer) && allocDelta != 0 && end.Revision-start.Revision == 1 {
 				return fmt.Errorf("Failed to update the user allocation (%d -> %d) and rev count (%d -> %d) for byte count %d",
 					start.Allocated, end.Allocated, start.Revision, end.Revision, len(clampedBuffer))
 			}
@@ -1185,7 +2078,7 @@ func addNewRandomFile(store *filefreezer.Storage, user *filefreezer.User, filena
 
 	rando1 := genRandomBytes(int(store.ChunkSize) * chunkCount)
 	ioutil.WriteFile(filename, rando1, os.ModePerm)
-	fileStats, err := filefreezer.CalcFileHashInfo(store.ChunkSize, filename)
+	fileStats, err := filefreezer.CalcFileHashInfo(store.ChunkSize, filename, nil)
 	if err != nil {
 		t.Fatalf("Failed to calculate the file hash for %s: %v", filename, err)
 	}
@@ -1194,7 +2087,7 @@ func addNewRandomFile(store *filefreezer.Storage, user *filefreezer.User, filena
 	var fi *filefreezer.FileInfo
 	if existingFI != nil {
 		fi, err = store.TagNewFileVersion(user.ID, existingFI.FileID, fileStats.Permissions,
-			fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+			fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, fileStats.HashAlgo)
 		if err != nil {
 			t.Fatalf("Failed to tag a new file version for %s: %v", filename, err)
 		}
@@ -1204,7 +2097,7 @@ func addNewRandomFile(store *filefreezer.Storage, user *filefreezer.User, filena
 	} else {
 		// add the file information to the storage server
 		fi, err = store.AddFileInfo(user.ID, filename, fileStats.IsDir, fileStats.Permissions,
-			fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+			fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, fileStats.HashAlgo)
 		if err != nil {
 			t.Fatalf("Failed to add a new file (%s): %v", filename, err)
 		}
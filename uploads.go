@@ -0,0 +1,457 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	createUploadSessionsTable = `CREATE TABLE IF NOT EXISTS UploadSessions (
+        SessionID   TEXT PRIMARY KEY    NOT NULL,
+        UserID      INTEGER             NOT NULL,
+        FileID      INTEGER             NOT NULL,
+        VersionID   INTEGER             NOT NULL,
+        Reserved    INTEGER             NOT NULL,
+        Received    INTEGER             NOT NULL,
+        Lifetime    INTEGER             NOT NULL,
+        ExpiresAt   INTEGER             NOT NULL
+    );`
+
+	addUploadSession = `INSERT INTO UploadSessions (SessionID, UserID, FileID, VersionID, Reserved, Received, Lifetime, ExpiresAt)
+		VALUES (?, ?, ?, ?, ?, 0, ?, ?);`
+	getUploadSessions = `SELECT UploadSessions.SessionID, UploadSessions.UserID, UploadSessions.FileID, UploadSessions.Reserved,
+		UploadSessions.Received, UploadSessions.ExpiresAt, FileVersion.VersionID, FileVersion.VersionNum, FileVersion.Perms,
+		FileVersion.LastMod, FileVersion.ChunkCount, FileVersion.FileHash, FileVersion.HashAlgo, FileVersion.Committed,
+		FileVersion.Chunking FROM UploadSessions INNER JOIN FileVersion ON FileVersion.VersionID = UploadSessions.VersionID`
+	getUploadSessionByID         = getUploadSessions + ` WHERE UploadSessions.SessionID = ?;`
+	getUploadSessionsForFile     = getUploadSessions + ` WHERE UploadSessions.FileID = ?;`
+	getUploadSessionForVersion   = getUploadSessions + ` WHERE UploadSessions.FileID = ? AND UploadSessions.VersionID = ?;`
+	getExpiredUploadSessions     = getUploadSessions + ` WHERE UploadSessions.ExpiresAt < ?;`
+	extendUploadSession          = `UPDATE UploadSessions SET Received = Received + ?, ExpiresAt = ? + Lifetime WHERE SessionID = ?;`
+	resumeUploadSession          = `UPDATE UploadSessions SET Lifetime = ?, ExpiresAt = ? WHERE SessionID = ?;`
+	removeUploadSession          = `DELETE FROM UploadSessions WHERE SessionID = ?;`
+	removeVersionUploadSession   = `DELETE FROM UploadSessions WHERE FileID = ? AND VersionID = ?;`
+	removeOrphanedUploadSessions = `DELETE FROM UploadSessions WHERE FileID = ? AND VersionID NOT IN (SELECT VersionID FROM FileVersion WHERE FileID = ?);`
+	sumReservedUploadSpace       = `SELECT COALESCE(SUM(MAX(Reserved - Received, 0)), 0) FROM UploadSessions
+		WHERE UserID = ? AND ExpiresAt >= ? AND NOT (FileID = ? AND VersionID = ?);`
+
+	getFileVersionFileID   = `SELECT FileID FROM FileVersion WHERE VersionID = ?;`
+	getLatestOtherVersion  = `SELECT VersionID FROM FileVersion WHERE FileID = ? AND VersionID <> ? ORDER BY VersionNum DESC LIMIT 1;`
+	setFileVersionAttrs    = `UPDATE FileVersion SET Perms = ?, LastMod = ? WHERE VersionID = ?;`
+	getUploadedChunkNumber = `SELECT ChunkNum FROM FileChunks WHERE FileID = ? AND VersionID = ?;`
+)
+
+// UploadSession tracks the upload of the chunks of a file version. The version only
+// becomes the current version of the file once every chunk has arrived and it has been
+// committed with CommitFileVersion; until then the session reserves the space the
+// chunks are expected to take up in the user's quota. Sessions that don't receive a
+// chunk before they expire are abandoned and the version is removed.
+type UploadSession struct {
+	// SessionID identifies the session; it's empty if the version had no
+	// chunks to upload and was committed right away
+	SessionID string
+
+	UserID  int
+	FileID  int
+	Version FileVersionInfo
+
+	// Reserved is the number of bytes reserved in the user's quota for the chunks
+	// and Received is how many of them the chunks received so far took up
+	Reserved int
+	Received int
+
+	// ExpiresAt is when the session is abandoned in Unix seconds unless
+	// another chunk arrives before then
+	ExpiresAt int64
+
+	// MissingChunks are the chunk numbers that haven't been uploaded yet
+	MissingChunks []int
+
+	// Resumed is set if StartUploadSession resumed an upload already in progress
+	Resumed bool
+}
+
+// StartUploadSession starts an upload of a file version with the information in version;
+// its VersionID and VersionNumber are ignored and an empty Chunking means ChunkingFixed.
+// If fileID is 0 a new file is registered with the filename and isDir flag given,
+// otherwise a new version of the file is added. If the user already has an upload of
+// the same contents split into the same chunks to the file in progress, that
+// session is resumed instead and only the chunks still missing need to be uploaded. Any
+// other uploads to the file are abandoned since the new one replaces them.
+//
+// reserve is the number of bytes the chunks are expected to take up; it must fit in the
+// user's free quota, less the space reserved by their other uploads. The session expires
+// if no chunk arrives within the lifetime given. Expired sessions of every user are
+// removed at the same time.
+func (s *Storage) StartUploadSession(userID int, fileID int, filename string, isDir bool, version FileVersionInfo,
+	reserve int, lifetime time.Duration) (*UploadSession, error) {
+	if version.Chunking == "" {
+		version.Chunking = ChunkingFixed
+	}
+
+	sess := new(UploadSession)
+	var blobRefs []string
+	err := s.transact("StartUploadSession", func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+		var err error
+		blobRefs, err = s.removeExpiredUploadSessions(tx, now)
+		if err != nil {
+			return err
+		}
+
+		sess.UserID = userID
+		sess.Version = version
+		var others []UploadSession
+		if fileID == 0 {
+			if version.ChunkCount > 0 {
+				err = checkUploadReservation(tx, userID, reserve, now)
+				if err != nil {
+					return err
+				}
+			}
+			fi := new(FileInfo)
+			err = s.insertFileInfo(tx, fi, userID, filename, isDir, version.Permissions, version.LastMod,
+				version.ChunkCount, version.FileHash, version.HashAlgo, version.Chunking)
+			if err != nil {
+				return err
+			}
+			sess.FileID = fi.FileID
+			sess.Version = fi.CurrentVersion
+		} else {
+			// check to make sure the user owns the file id
+			var owningUserID int
+			err = tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+			if err != nil {
+				return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+			}
+			if owningUserID != userID {
+				return fmt.Errorf("user does not own the file id supplied")
+			}
+			sess.FileID = fileID
+
+			currentVersionID, _, currentCommitted, err := getCurrentVersion(tx, fileID)
+			if err != nil {
+				return err
+			}
+
+			// look for an upload of the same contents to resume
+			open, err := queryUploadSessions(tx, getUploadSessionsForFile, fileID)
+			if err != nil {
+				return err
+			}
+			for _, o := range open {
+				if sess.SessionID == "" && o.Version.FileHash == version.FileHash && o.Version.HashAlgo == version.HashAlgo &&
+					o.Version.ChunkCount == version.ChunkCount && o.Version.Chunking == version.Chunking {
+					*sess = o
+					continue
+				}
+				others = append(others, o)
+			}
+
+			if sess.SessionID != "" {
+				// the file may have been touched without changing the contents
+				_, err = tx.Exec(setFileVersionAttrs, version.Permissions, version.LastMod, sess.Version.VersionID)
+				if err != nil {
+					return fmt.Errorf("failed to update the file version of the upload session: %v", err)
+				}
+				sess.Resumed = true
+				sess.Version.Permissions = version.Permissions
+				sess.Version.LastMod = version.LastMod
+				sess.ExpiresAt = now + int64(lifetime/time.Second)
+				_, err = tx.Exec(resumeUploadSession, int64(lifetime/time.Second), sess.ExpiresAt, sess.SessionID)
+				if err != nil {
+					return fmt.Errorf("failed to extend the upload session: %v", err)
+				}
+
+				// like a new version, it replaces a pending version that's current
+				if !currentCommitted && currentVersionID != sess.Version.VersionID {
+					_, err = tx.Exec(setFileCurrentVersion, sess.Version.VersionID, fileID)
+					if err != nil {
+						return fmt.Errorf("failed to update the current version of the file: %v", err)
+					}
+				}
+			} else {
+				// the new version doesn't become current until it's committed unless there's
+				// nothing to upload or the file doesn't have a committed version yet
+				if version.ChunkCount > 0 {
+					err = checkUploadReservation(tx, userID, reserve, now)
+					if err != nil {
+						return err
+					}
+				}
+				sess.Version.Committed = version.ChunkCount == 0
+				err = s.insertFileVersion(tx, userID, fileID, &sess.Version)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// the uploads being replaced are removed once the new version is in place
+		for _, o := range others {
+			refs, err := s.abandonUploadSession(tx, &o)
+			if err != nil {
+				return err
+			}
+			blobRefs = append(blobRefs, refs...)
+		}
+
+		if sess.SessionID == "" && sess.Version.ChunkCount > 0 {
+			sess.SessionID, err = newBlobRef()
+			if err != nil {
+				return err
+			}
+			sess.Reserved = reserve
+			sess.ExpiresAt = now + int64(lifetime/time.Second)
+			_, err = tx.Exec(addUploadSession, sess.SessionID, userID, sess.FileID, sess.Version.VersionID, reserve,
+				int64(lifetime/time.Second), sess.ExpiresAt)
+			if err != nil {
+				return fmt.Errorf("failed to add the upload session: %v", err)
+			}
+		}
+
+		sess.MissingChunks, err = getMissingVersionChunks(tx, sess.FileID, sess.Version.VersionID, sess.Version.ChunkCount)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.removeChunkBlobs(blobRefs)
+	return sess, nil
+}
+
+// GetUploadSession returns the upload session with the session ID given, along with
+// the chunks that are still missing, if the user owns it.
+func (s *Storage) GetUploadSession(userID int, sessionID string) (*UploadSession, error) {
+	var sess *UploadSession
+	err := s.transact("GetUploadSession", func(tx *sql.Tx) error {
+		var err error
+		sess, err = getOwnedUploadSession(tx, userID, sessionID)
+		if err != nil {
+			return err
+		}
+		sess.MissingChunks, err = getMissingVersionChunks(tx, sess.FileID, sess.Version.VersionID, sess.Version.ChunkCount)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+// CancelUploadSession abandons the user's upload session with the session ID given and
+// removes the file version it was uploading. If that was the only version of a new file,
+// the file is removed as well.
+func (s *Storage) CancelUploadSession(userID int, sessionID string) error {
+	var blobRefs []string
+	err := s.transact("CancelUploadSession", func(tx *sql.Tx) error {
+		sess, err := getOwnedUploadSession(tx, userID, sessionID)
+		if err != nil {
+			return err
+		}
+		blobRefs, err = s.abandonUploadSession(tx, sess)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.removeChunkBlobs(blobRefs)
+	return nil
+}
+
+// getOwnedUploadSession returns the upload session with the session ID given if the
+// user owns it.
+func getOwnedUploadSession(tx *sql.Tx, userID int, sessionID string) (*UploadSession, error) {
+	sessions, err := queryUploadSessions(tx, getUploadSessionByID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 || sessions[0].UserID != userID {
+		return nil, fmt.Errorf("the upload session does not exist for the user")
+	}
+	return &sessions[0], nil
+}
+
+// removeExpiredUploadSessions abandons the upload sessions that expired before now as
+// part of the transaction and returns the blob references of the stored chunks freed.
+func (s *Storage) removeExpiredUploadSessions(tx *sql.Tx, now int64) ([]string, error) {
+	expired, err := queryUploadSessions(tx, getExpiredUploadSessions, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var blobRefs []string
+	for _, sess := range expired {
+		refs, err := s.abandonUploadSession(tx, &sess)
+		if err != nil {
+			return nil, err
+		}
+		blobRefs = append(blobRefs, refs...)
+	}
+	return blobRefs, nil
+}
+
+// abandonUploadSession removes the upload session and the file version it was uploading
+// as part of the transaction. If the version is the current one, the latest other version
+// becomes current; if there isn't one, the whole file is removed. The blob references of
+// the stored chunks that were freed are returned.
+func (s *Storage) abandonUploadSession(tx *sql.Tx, sess *UploadSession) ([]string, error) {
+	_, err := tx.Exec(removeUploadSession, sess.SessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove the upload session: %v", err)
+	}
+
+	currentVersionID, _, _, err := getCurrentVersion(tx, sess.FileID)
+	if err != nil {
+		return nil, err
+	}
+	if currentVersionID == sess.Version.VersionID {
+		var latestVersionID int
+		err = tx.QueryRow(getLatestOtherVersion, sess.FileID, currentVersionID).Scan(&latestVersionID)
+		if err == sql.ErrNoRows {
+			// the upload was the only version of a new file
+			return s.removeFile(tx, sess.UserID, sess.FileID)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get the latest version of the file for the upload session: %v", err)
+		}
+
+		_, err = tx.Exec(setFileCurrentVersion, latestVersionID, sess.FileID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update the current version of the file: %v", err)
+		}
+	}
+
+	return s.removeFileVersions(tx, sess.UserID, sess.FileID, sess.Version.VersionNumber, sess.Version.VersionNumber)
+}
+
+// advanceUploadSession is called as part of the transaction that added chunks to a file
+// version. If the version is being uploaded in a session, the session is extended and
+// allocated is added to the bytes it has received. The session is finished when the
+// version is committed.
+func (s *Storage) advanceUploadSession(tx *sql.Tx, fileID int, versionID int, allocated int) error {
+	sessions, err := queryUploadSessions(tx, getUploadSessionForVersion, fileID, versionID)
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	if allocated < 0 {
+		allocated = 0
+	}
+	_, err = tx.Exec(extendUploadSession, allocated, time.Now().Unix(), sessions[0].SessionID)
+	if err != nil {
+		return fmt.Errorf("failed to extend the upload session: %v", err)
+	}
+	return nil
+}
+
+// checkUploadReservation returns an error if reserve bytes don't fit in the user's
+// free quota less the space reserved by their other uploads.
+func checkUploadReservation(tx *sql.Tx, userID int, reserve int, now int64) error {
+	var quota, allocated, revision int
+	err := tx.QueryRow(getUserStats, userID).Scan(&quota, &allocated, &revision)
+	if err != nil {
+		return fmt.Errorf("failed to get the user quota from the database before starting the upload: %v", err)
+	}
+	var reserved int
+	err = tx.QueryRow(sumReservedUploadSpace, userID, now, 0, 0).Scan(&reserved)
+	if err != nil {
+		return fmt.Errorf("failed to get the space reserved for uploads: %v", err)
+	}
+
+	if quota-allocated-reserved < reserve {
+		return fmt.Errorf("not enough free allocation space for the upload (quota: %d ; current allocation %d ; reserved for uploads %d ; upload size %d)",
+			quota, allocated, reserved, reserve)
+	}
+	return nil
+}
+
+// reservedUploadSpace returns the number of bytes reserved by the user's upload sessions
+// that haven't expired and aren't uploading the file version given.
+func reservedUploadSpace(tx *sql.Tx, userID int, fileID int, versionID int) (int, error) {
+	var reserved int
+	err := tx.QueryRow(sumReservedUploadSpace, userID, time.Now().Unix(), fileID, versionID).Scan(&reserved)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the space reserved for uploads: %v", err)
+	}
+	return reserved, nil
+}
+
+// checkFileVersion returns an error if the version ID isn't a version of the file.
+func checkFileVersion(tx *sql.Tx, fileID int, versionID int) error {
+	var versionFileID int
+	err := tx.QueryRow(getFileVersionFileID, versionID).Scan(&versionFileID)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to get the file version: %v", err)
+	}
+	if err == sql.ErrNoRows || versionFileID != fileID {
+		return fmt.Errorf("the version id supplied is not a version of the file")
+	}
+	return nil
+}
+
+// getMissingVersionChunks returns the chunk numbers below chunkCount that the file
+// version doesn't have yet.
+func getMissingVersionChunks(tx *sql.Tx, fileID int, versionID int, chunkCount int) ([]int, error) {
+	rows, err := tx.Query(getUploadedChunkNumber, fileID, versionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the uploaded chunks for the file version: %v", err)
+	}
+	defer rows.Close()
+
+	uploaded := make(map[int]bool)
+	for rows.Next() {
+		var num int
+		err = rows.Scan(&num)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing the uploaded chunks: %v", err)
+		}
+		uploaded[num] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get the uploaded chunks for the file version: %v", err)
+	}
+
+	missing := []int{}
+	for i := 0; i < chunkCount; i++ {
+		if !uploaded[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing, nil
+}
+
+// queryUploadSessions returns the upload sessions selected by the query, which
+// must select the columns of getUploadSessions.
+func queryUploadSessions(tx *sql.Tx, query string, args ...interface{}) ([]UploadSession, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the upload sessions from the database: %v", err)
+	}
+	defer rows.Close()
+
+	var sessions []UploadSession
+	for rows.Next() {
+		var sess UploadSession
+		v := &sess.Version
+		err = rows.Scan(&sess.SessionID, &sess.UserID, &sess.FileID, &sess.Reserved, &sess.Received, &sess.ExpiresAt,
+			&v.VersionID, &v.VersionNumber, &v.Permissions, &v.LastMod, &v.ChunkCount, &v.FileHash, &v.HashAlgo, &v.Committed, &v.Chunking)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing the upload sessions: %v", err)
+		}
+		sessions = append(sessions, sess)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get the upload sessions from the database: %v", err)
+	}
+	return sessions, nil
+}